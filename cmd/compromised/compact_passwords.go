@@ -0,0 +1,74 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"resenje.org/compromised/pkg/passwords/compact"
+)
+
+func compactPasswordsCmd() error {
+	cli := flag.NewFlagSet("compact-passwords", flag.ExitOnError)
+
+	minHashCount := cli.Uint64("min-hash-count", 0, "Skip hashes with counts lower than specified with this flag.")
+	fingerprintBits := cli.Int("fingerprint-bits", 8, "Size of filter fingerprints in bits which determines the false positive rate. Possible values: 8 (0.39%, around 1.13 bytes per hash), 16 (0.0015%, around 2.25 bytes per hash).")
+	topCount := cli.Int("top-count", 0, "Store exact counts of this number of hashes with the highest counts.")
+
+	help := cli.Bool("h", false, "Show program usage.")
+
+	cli.Usage = func() {
+		fmt.Fprintf(os.Stderr, `USAGE
+
+  compact-passwords [database directory] [output filename]
+
+  Hashes are read from the existing database and stored only in binary fuse
+  filters, without their counts, in a single file that is loaded into memory
+  when it is configured as a passwords database. Passwords that are not
+  compromised are reported as compromised with the false positive rate of
+  filters, and compromised passwords are reported with the minimal count of
+  the database, except the ones with exact counts.
+
+  Filters take around 1.13 bytes per hash with 8 bit fingerprints and 2.25
+  bytes per hash with 16 bit fingerprints, which is around 650MB and 1.3GB
+  for 572 million hashes of pwned passwords version 6, and proportionally
+  more for newer releases. Smaller files require excluding less frequently
+  compromised passwords with the -min-hash-count flag, for example around
+  400MB with value 2 and 100MB with value 5 for version 6 with 8 bit
+  fingerprints.
+
+  The file is written with the .tmp suffix and renamed to the output
+  filename when it is complete.
+
+OPTIONS
+
+`)
+		cli.PrintDefaults()
+	}
+
+	if err := cli.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+
+	if *help {
+		cli.Usage()
+		return nil
+	}
+
+	if cli.NArg() != 2 {
+		return fmt.Errorf("compact-passwords command requires two arguments: database directory and output filename")
+	}
+
+	_, err := compact.Build(cli.Arg(0), cli.Arg(1), &compact.BuildOptions{
+		MinHashCount:    *minHashCount,
+		FingerprintBits: *fingerprintBits,
+		TopCount:        *topCount,
+	})
+
+	return err
+}
@@ -6,11 +6,16 @@
 package config
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 
 	"resenje.org/compromised"
+	"resenje.org/compromised/pkg/policy"
 	"resenje.org/marshal"
 )
 
@@ -22,7 +27,19 @@ type CompromisedOptions struct {
 	Headers               map[string]string `json:"headers" yaml:"headers" envconfig:"HEADERS"`
 	RealIPHeaderName      string            `json:"real-ip-header-name" yaml:"real-ip-header-name" envconfig:"REAL_IP_HEADER_NAME"`
 	// Passwords
-	PasswordsDB string `json:"passwords-db" yaml:"passwords-db" envconfig:"PASSWORDS_DB"`
+	PasswordsDB                PasswordsDBs `json:"passwords-db" yaml:"passwords-db" envconfig:"PASSWORDS_DB"`
+	PasswordsDBMode            string       `json:"passwords-db-mode" yaml:"passwords-db-mode" envconfig:"PASSWORDS_DB_MODE"`
+	PasswordsDBVerifyChecksums bool         `json:"passwords-db-verify-checksums" yaml:"passwords-db-verify-checksums" envconfig:"PASSWORDS_DB_VERIFY_CHECKSUMS"`
+	PasswordsDBDisableFilter   bool         `json:"passwords-db-disable-filter" yaml:"passwords-db-disable-filter" envconfig:"PASSWORDS_DB_DISABLE_FILTER"`
+	PasswordsBatchLimit        int          `json:"passwords-batch-limit" yaml:"passwords-batch-limit" envconfig:"PASSWORDS_BATCH_LIMIT"`
+	// Blocklist
+	Blocklist       string `json:"blocklist" yaml:"blocklist" envconfig:"BLOCKLIST"`
+	BlocklistFormat string `json:"blocklist-format" yaml:"blocklist-format" envconfig:"BLOCKLIST_FORMAT"`
+	BlocklistCount  uint64 `json:"blocklist-count" yaml:"blocklist-count" envconfig:"BLOCKLIST_COUNT"`
+	// Allowlist
+	Allowlist string `json:"allowlist" yaml:"allowlist" envconfig:"ALLOWLIST"`
+	// Policy
+	Policy PolicyOptions `json:"policy" yaml:"policy" envconfig:"POLICY"`
 	// Logging
 	LogDir string `json:"log-dir" yaml:"log-dir" envconfig:"LOG_DIR"`
 	// Daemon
@@ -40,12 +57,26 @@ func NewCompromisedOptions() *CompromisedOptions {
 			"Server":          Name + "/" + compromised.Version(),
 			"X-Frame-Options": "SAMEORIGIN",
 		},
-		RealIPHeaderName:  "X-Real-IP",
-		PasswordsDB:       "",
-		LogDir:            "",
-		DaemonLogFileName: "daemon.log",
-		DaemonLogFileMode: 0644,
-		PidFileName:       filepath.Join(os.TempDir(), Name+".pid"),
+		RealIPHeaderName:           "X-Real-IP",
+		PasswordsDB:                nil,
+		PasswordsDBMode:            "file",
+		PasswordsDBVerifyChecksums: false,
+		PasswordsDBDisableFilter:   false,
+		PasswordsBatchLimit:        10000,
+		Blocklist:                  "",
+		BlocklistFormat:            BlocklistFormatText,
+		BlocklistCount:             1,
+		Allowlist:                  "",
+		LogDir:                     "",
+		DaemonLogFileName:          "daemon.log",
+		DaemonLogFileMode:          0644,
+		PidFileName:                filepath.Join(os.TempDir(), Name+".pid"),
+		Policy: PolicyOptions{
+			Rules: append(PolicyRules{
+				{Outcome: policy.OutcomeReject, MinCount: 1, Source: BlocklistSourceName},
+			}, policy.DefaultRules...),
+			DefaultOutcome: policy.OutcomeAllow,
+		},
 	}
 }
 
@@ -62,6 +93,31 @@ func (o *CompromisedOptions) VerifyAndPrepare() (err error) {
 	}
 	ln.Close()
 
+	for name, dir := range o.PasswordsDB {
+		if name == "" {
+			return errors.New("passwords-db: empty database name")
+		}
+		if dir == "" {
+			return fmt.Errorf("passwords-db: empty directory for database %q", name)
+		}
+	}
+
+	switch o.BlocklistFormat {
+	case BlocklistFormatText, BlocklistFormatSHA1, BlocklistFormatDB:
+	default:
+		return fmt.Errorf("blocklist-format: unsupported format %q", o.BlocklistFormat)
+	}
+	if o.BlocklistCount == 0 {
+		return errors.New("blocklist-count: must be greater than 0")
+	}
+	if _, ok := o.PasswordsDB[BlocklistSourceName]; ok && o.Blocklist != "" {
+		return fmt.Errorf("passwords-db: database name %q is reserved for blocklist", BlocklistSourceName)
+	}
+
+	if _, err := o.Policy.New(); err != nil {
+		return fmt.Errorf("policy: %w", err)
+	}
+
 	for _, dir := range []string{
 		filepath.Dir(o.PidFileName),
 		o.LogDir,
@@ -74,3 +130,113 @@ func (o *CompromisedOptions) VerifyAndPrepare() (err error) {
 	}
 	return
 }
+
+// DefaultPasswordsDBName is the name of the database when passwords-db option
+// is set to a single directory.
+const DefaultPasswordsDBName = "default"
+
+// PasswordsDBs maps names of passwords databases to their directories. It can
+// be set to a single directory, a map of names to directories, or in
+// environment variable as comma separated name=directory pairs.
+type PasswordsDBs map[string]string
+
+// UnmarshalJSON implements json.Unmarshaler interface.
+func (d *PasswordsDBs) UnmarshalJSON(data []byte) error {
+	var dir string
+	if err := json.Unmarshal(data, &dir); err == nil {
+		return d.setDir(dir)
+	}
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	*d = m
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler interface.
+func (d *PasswordsDBs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var dir string
+	if err := unmarshal(&dir); err == nil {
+		return d.setDir(dir)
+	}
+	var m map[string]string
+	if err := unmarshal(&m); err != nil {
+		return err
+	}
+	*d = m
+	return nil
+}
+
+// Decode implements envconfig.Decoder interface.
+func (d *PasswordsDBs) Decode(value string) error {
+	if !strings.Contains(value, "=") {
+		return d.setDir(value)
+	}
+	m := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		name, dir, ok := strings.Cut(pair, "=")
+		if !ok {
+			return fmt.Errorf("invalid passwords database %q", pair)
+		}
+		m[strings.TrimSpace(name)] = strings.TrimSpace(dir)
+	}
+	*d = m
+	return nil
+}
+
+func (d *PasswordsDBs) setDir(dir string) error {
+	if dir == "" {
+		*d = nil
+		return nil
+	}
+	*d = PasswordsDBs{DefaultPasswordsDBName: dir}
+	return nil
+}
+
+// BlocklistSourceName is the name of the blocklist in API responses and in
+// sources of policy rules.
+const BlocklistSourceName = "blocklist"
+
+// Formats of the blocklist file.
+const (
+	// BlocklistFormatText is a file with one password in plain text per line.
+	BlocklistFormatText = "text"
+	// BlocklistFormatSHA1 is a file with one hex encoded SHA1 sum per line,
+	// optionally followed by a colon and the count.
+	BlocklistFormatSHA1 = "sha1"
+	// BlocklistFormatDB is a database generated by the index-passwords
+	// command.
+	BlocklistFormatDB = "db"
+)
+
+// PolicyOptions defines thresholds of the passwords verdict API endpoint.
+type PolicyOptions struct {
+	Version        string      `json:"version" yaml:"version" envconfig:"VERSION"`
+	Rules          PolicyRules `json:"rules" yaml:"rules" envconfig:"RULES"`
+	DefaultOutcome string      `json:"default-outcome" yaml:"default-outcome" envconfig:"DEFAULT_OUTCOME"`
+}
+
+// New creates a new policy from options.
+func (o PolicyOptions) New() (*policy.Policy, error) {
+	return policy.New(&policy.Options{
+		Version:        o.Version,
+		Rules:          o.Rules,
+		DefaultOutcome: o.DefaultOutcome,
+	})
+}
+
+// PolicyRules is a list of policy rules that can be set in environment
+// variable as comma separated outcome=min-count pairs, where the outcome can
+// be followed by @ and the source of the rule.
+type PolicyRules []policy.Rule
+
+// Decode implements envconfig.Decoder interface.
+func (r *PolicyRules) Decode(value string) error {
+	rules, err := policy.ParseRules(value)
+	if err != nil {
+		return err
+	}
+	*r = rules
+	return nil
+}
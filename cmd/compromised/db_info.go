@@ -0,0 +1,115 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	filepasswords "resenje.org/compromised/pkg/passwords/file"
+)
+
+func dbInfoCmd() error {
+	cli := flag.NewFlagSet("db-info", flag.ExitOnError)
+
+	jsonOutput := cli.Bool("json", false, "Print information in JSON format.")
+
+	help := cli.Bool("h", false, "Show program usage.")
+
+	cli.Usage = func() {
+		fmt.Fprintf(os.Stderr, `USAGE
+
+  db-info [database directory]
+
+OPTIONS
+
+`)
+		cli.PrintDefaults()
+	}
+
+	if err := cli.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+
+	if *help {
+		cli.Usage()
+		return nil
+	}
+
+	if cli.NArg() != 1 {
+		return fmt.Errorf("db-info command requires one argument: database directory")
+	}
+
+	s, err := filepasswords.New(cli.Arg(0), nil)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+
+	stats, err := s.Stats()
+	if err != nil {
+		return err
+	}
+
+	if *jsonOutput {
+		e := json.NewEncoder(os.Stdout)
+		e.SetIndent("", "    ")
+		return e.Encode(stats)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "version:\t%v\n", stats.Version)
+	fmt.Fprintf(w, "format:\t%s\n", stats.Format)
+	fmt.Fprintf(w, "hash:\t%s\n", stats.Hash)
+	fmt.Fprintf(w, "count decoder:\t%s\n", stats.CountDecoder)
+	if len(stats.CountClasses) > 0 {
+		fmt.Fprintf(w, "count classes:\t%v\n", stats.CountClasses)
+	}
+	fmt.Fprintf(w, "hashes:\t%v\n", stats.Count)
+	fmt.Fprintf(w, "min hash count:\t%v\n", stats.MinHashCount)
+	fmt.Fprintf(w, "max hash count:\t%v\n", stats.MaxHashCount)
+	fmt.Fprintf(w, "shards:\t%v\n", stats.ShardCount)
+	if stats.FilterFalsePositiveRate > 0 {
+		fmt.Fprintf(w, "filter false positive rate:\t%v\n", stats.FilterFalsePositiveRate)
+	}
+	fmt.Fprintf(w, "size:\t%v bytes\n", stats.Size)
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "FILE\tSIZE\tHASHES")
+	fmt.Fprintf(w, "index.db\t%v\t\n", stats.IndexSize)
+	for _, shard := range stats.Shards {
+		fmt.Fprintf(w, "%s\t%v\t%v\n", shard.Filename, shard.Size, shard.Count)
+	}
+	if stats.FilterSize > 0 {
+		fmt.Fprintf(w, "filter.db\t%v\t\n", stats.FilterSize)
+	}
+	fmt.Fprintln(w)
+
+	p := stats.Partitions
+	fmt.Fprintf(w, "partitions:\t%v\n", p.Count)
+	fmt.Fprintf(w, "empty partitions:\t%v\n", p.Empty)
+	fmt.Fprintf(w, "hashes per partition:\tmin %v, avg %.2f, max %v\n", p.Min, p.Avg, p.Max)
+	fmt.Fprintln(w)
+
+	fmt.Fprintln(w, "COUNT\tHASHES")
+	for _, b := range stats.Counts {
+		fmt.Fprintf(w, "%v-%v\t%v\n", b.Min, b.Max, b.Hashes)
+	}
+
+	if len(stats.Lineage) > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "TIME\tOPERATION\tINPUT\tHASHES\tADDED\tUPDATED\tREMOVED")
+		for _, l := range stats.Lineage {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%v\t%v\t%v\t%v\n", l.Time.Format(time.RFC3339), l.Operation, l.Input, l.Count, l.Added, l.Updated, l.Removed)
+		}
+	}
+
+	return w.Flush()
+}
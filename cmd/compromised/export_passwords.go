@@ -0,0 +1,79 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	filepasswords "resenje.org/compromised/pkg/passwords/file"
+)
+
+func exportPasswordsCmd() (err error) {
+	cli := flag.NewFlagSet("export-passwords", flag.ExitOnError)
+
+	minHashCount := cli.Uint64("min-hash-count", 1, "Skip hashes with counts lower than specified with this flag.")
+	startPrefix := cli.String("start-prefix", "", "Hexadecimal prefix of the first exported hash.")
+	endPrefix := cli.String("end-prefix", "", "Hexadecimal prefix of the last exported hash.")
+
+	help := cli.Bool("h", false, "Show program usage.")
+
+	cli.Usage = func() {
+		fmt.Fprintf(os.Stderr, `USAGE
+
+  export-passwords [database directory] [output filename]
+
+  Hashes are written to the standard output if the output filename is - or
+  it is not specified.
+
+OPTIONS
+
+`)
+		cli.PrintDefaults()
+	}
+
+	if err := cli.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+
+	if *help {
+		cli.Usage()
+		return nil
+	}
+
+	if cli.NArg() != 1 && cli.NArg() != 2 {
+		return fmt.Errorf("export-passwords command requires database directory and optional output filename arguments")
+	}
+
+	var w io.Writer = os.Stdout
+	if filename := cli.Arg(1); filename != "" && filename != "-" {
+		f, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if e := f.Close(); e != nil && err == nil {
+				err = e
+			}
+		}()
+		w = f
+	}
+
+	count, err := filepasswords.Export(cli.Arg(0), w, &filepasswords.ExportOptions{
+		MinHashCount: *minHashCount,
+		StartPrefix:  *startPrefix,
+		EndPrefix:    *endPrefix,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "exported %v hashes\n", count)
+
+	return nil
+}
@@ -35,8 +35,29 @@ COMMANDS
   debug-dump
     Send to a running process USR1 signal to log debug information in the log.
 
+  reload
+    Send to a running process HUP signal to reopen passwords databases.
+
   index-passwords
-    Generate passwords database from pwned passwords sha1 file.
+    Generate passwords database from pwned passwords sha1 or ntlm file.
+
+  update-passwords
+    Generate passwords database by merging new hashes into an existing one.
+
+  reindex
+    Generate passwords database from an existing one with different options.
+
+  compact-passwords
+    Generate compact passwords database with filters from an existing one.
+
+  export-passwords
+    Write hashes from passwords database in pwned passwords file format.
+
+  verify-passwords
+    Check the integrity of passwords database files.
+
+  db-info
+    Print information about passwords database content.
 
   version
     Print version to Stdout.
@@ -9,16 +9,28 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"runtime"
+	"strconv"
+	"strings"
 
 	filepasswords "resenje.org/compromised/pkg/passwords/file"
 )
 
+// hashCountingValues describes values of the hash-counting flag.
+const hashCountingValues = "exact stores counts as they are, approx stores counts in one byte with around 5% error, approx16 stores counts in two bytes with around 0.01% error, varint stores exact counts as variable length integers, classes stores only the lower bound of the count class from the count-classes flag, none does not store counts and every hash has count 1."
+
 func indexPasswordsCmd() error {
 	cli := flag.NewFlagSet("index-passwords", flag.ExitOnError)
 
 	minHashCount := cli.Uint64("min-hash-count", 1, "Skip hashes with counts lower than specified with this flag.")
 	shardCount := cli.Int("shard-count", 32, "Split hashes into a several files. Possible values: 1, 2, 4, 8, 16, 32, 64, 128, 256.")
-	hashCounting := cli.String("hash-counting", "exact", "Store approximate hash counts. Possible values: exact, approx, none.")
+	hash := cli.String("hash", "sha1", "Hash type of the input file. Possible values: sha1, ntlm.")
+	hashCounting := cli.String("hash-counting", "exact", "Precision of stored hash counts. Possible values: "+hashCountingValues)
+	countClasses := cli.String("count-classes", "", "Comma separated lower bounds of count classes for the classes hash counting, starting with 1, for example 1,10,100,1000. Empty value uses the default 1-2-5 sequence of classes up to 10000000.")
+	format := cli.String("format", "directory", "Store the database in a directory or in a single file. Possible values: directory, container.")
+	filterFalsePositiveRate := cli.Float64("filter-false-positive-rate", 0, "Store a Bloom filter of all hashes with this target false positive rate, for example 0.01. The filter is not stored if the rate is 0.")
+	concurrency := cli.Int("concurrency", runtime.NumCPU(), "Number of goroutines that parse input lines.")
+	resume := cli.Bool("resume", false, "Continue interrupted indexing of the same input file.")
 
 	help := cli.Bool("h", false, "Show program usage.")
 
@@ -27,6 +39,13 @@ func indexPasswordsCmd() error {
 
   index-passwords [input filename] [output directory]
 
+  Input file can be compressed with gzip, zstd or xz. Use - as the input
+  filename to read from the standard input.
+
+  The database is written in the output directory with the .tmp suffix and
+  renamed to the output directory when it is complete. With the container
+  format, the output is a single file instead of a directory.
+
 OPTIONS
 
 `)
@@ -46,11 +65,39 @@ OPTIONS
 		return fmt.Errorf("index-passwords command requires two arguments: input filename and output directory")
 	}
 
-	_, err := filepasswords.Index(cli.Arg(0), cli.Arg(1), &filepasswords.IndexOptions{
+	classes, err := parseCountClasses(*countClasses)
+	if err != nil {
+		return err
+	}
+
+	_, err = filepasswords.Index(cli.Arg(0), cli.Arg(1), &filepasswords.IndexOptions{
 		MinHashCount: *minHashCount,
 		ShardCount:   *shardCount,
 		HashCounting: filepasswords.HashCounting(*hashCounting),
+		CountClasses: classes,
+		Hash:         filepasswords.Hash(*hash),
+		Format:       filepasswords.Format(*format),
+		Concurrency:  *concurrency,
+		Resume:       *resume,
+
+		FilterFalsePositiveRate: *filterFalsePositiveRate,
 	})
 
 	return err
 }
+
+// parseCountClasses parses comma separated count classes of the count-classes
+// flag.
+func parseCountClasses(s string) (classes []uint64, err error) {
+	if s == "" {
+		return nil, nil
+	}
+	for _, v := range strings.Split(s, ",") {
+		c, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid count class %q", v)
+		}
+		classes = append(classes, c)
+	}
+	return classes, nil
+}
@@ -53,6 +53,24 @@ func execute() error {
 	case "index-passwords":
 		return indexPasswordsCmd()
 
+	case "update-passwords":
+		return updatePasswordsCmd()
+
+	case "reindex":
+		return reindexCmd()
+
+	case "compact-passwords":
+		return compactPasswordsCmd()
+
+	case "export-passwords":
+		return exportPasswordsCmd()
+
+	case "verify-passwords":
+		return verifyPasswordsCmd()
+
+	case "db-info":
+		return dbInfoCmd()
+
 	case "version":
 		versionCmd()
 		return nil
@@ -78,12 +96,33 @@ func execute() error {
 	case "debug-dump":
 		return debugDumpCmd()
 
+	case "reload":
+		return reloadCmd()
+
 	case "config":
 		return configCmd()
 
 	case "index-passwords":
 		return indexPasswordsCmd()
 
+	case "update-passwords":
+		return updatePasswordsCmd()
+
+	case "reindex":
+		return reindexCmd()
+
+	case "compact-passwords":
+		return compactPasswordsCmd()
+
+	case "export-passwords":
+		return exportPasswordsCmd()
+
+	case "verify-passwords":
+		return verifyPasswordsCmd()
+
+	case "db-info":
+		return dbInfoCmd()
+
 	default:
 		return helpUnknownCmd(cmd)
 	}
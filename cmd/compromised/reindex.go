@@ -0,0 +1,76 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	filepasswords "resenje.org/compromised/pkg/passwords/file"
+)
+
+func reindexCmd() error {
+	cli := flag.NewFlagSet("reindex", flag.ExitOnError)
+
+	minHashCount := cli.Uint64("min-hash-count", 0, "Skip hashes with counts lower than specified with this flag. It can not be lower than the value of the existing database. Databases with approx hash counting are filtered by approximated counts, the value must be one of the count classes for classes hash counting and it can not be higher than the value of the existing database for none hash counting. Value 0 keeps the value of the existing database.")
+	shardCount := cli.Int("shard-count", 0, "Split hashes into a several files. Possible values: 1, 2, 4, 8, 16, 32, 64, 128, 256. Value 0 keeps the value of the existing database.")
+	hashCounting := cli.String("hash-counting", "", "Store less precise hash counts than the existing database. Possible values: "+hashCountingValues+" Empty value keeps the value of the existing database.")
+	countClasses := cli.String("count-classes", "", "Comma separated lower bounds of count classes for the classes hash counting, starting with 1. If the existing database has count classes, only its classes can be used. Empty value keeps classes of the existing database or uses the default ones.")
+	format := cli.String("format", "", "Store the database in a directory or in a single file. Possible values: directory, container. Empty value keeps the format of the existing database.")
+	filterFalsePositiveRate := cli.Float64("filter-false-positive-rate", 0, "Store a Bloom filter of all hashes with this target false positive rate. Value 0 keeps the filter of the existing database, if it has it.")
+	resume := cli.Bool("resume", false, "Continue interrupted reindexing of the same database.")
+
+	help := cli.Bool("h", false, "Show program usage.")
+
+	cli.Usage = func() {
+		fmt.Fprintf(os.Stderr, `USAGE
+
+  reindex [database directory] [output directory]
+
+  Hashes are read from the existing database, without its original input
+  file, and written to a new database with different options.
+
+  The database is written in the output directory with the .tmp suffix and
+  renamed to the output directory when it is complete.
+
+OPTIONS
+
+`)
+		cli.PrintDefaults()
+	}
+
+	if err := cli.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+
+	if *help {
+		cli.Usage()
+		return nil
+	}
+
+	if cli.NArg() != 2 {
+		return fmt.Errorf("reindex command requires two arguments: database directory and output directory")
+	}
+
+	classes, err := parseCountClasses(*countClasses)
+	if err != nil {
+		return err
+	}
+
+	_, err = filepasswords.Reindex(cli.Arg(0), cli.Arg(1), &filepasswords.ReindexOptions{
+		MinHashCount: *minHashCount,
+		ShardCount:   *shardCount,
+		HashCounting: filepasswords.HashCounting(*hashCounting),
+		CountClasses: classes,
+		Format:       filepasswords.Format(*format),
+		Resume:       *resume,
+
+		FilterFalsePositiveRate: *filterFalsePositiveRate,
+	})
+
+	return err
+}
@@ -0,0 +1,23 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"syscall"
+
+	"resenje.org/daemon"
+)
+
+func reloadCmd() error {
+	// Send SIGHUP signal to a daemonized process.
+	// Service reopens all passwords databases on the signal.
+	return (&daemon.Daemon{
+		PidFileName: options.PidFileName,
+	}).Signal(syscall.SIGHUP)
+}
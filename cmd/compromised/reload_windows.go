@@ -0,0 +1,17 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+)
+
+func reloadCmd() error {
+	return errors.New("reload is not supported on Windows")
+}
@@ -10,10 +10,13 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/signal"
+	"sort"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/exp/slog"
 	"resenje.org/recovery"
 	"resenje.org/web/logging"
@@ -22,13 +25,18 @@ import (
 
 	"resenje.org/compromised"
 	"resenje.org/compromised/cmd/compromised/config"
+	"resenje.org/compromised/pkg/allowlist"
 	"resenje.org/compromised/pkg/api"
 	"resenje.org/compromised/pkg/metrics"
+	"resenje.org/compromised/pkg/passwords"
+	"resenje.org/compromised/pkg/passwords/blocklist"
+	"resenje.org/compromised/pkg/passwords/compact"
+	"resenje.org/compromised/pkg/passwords/composite"
 	filepasswords "resenje.org/compromised/pkg/passwords/file"
 )
 
 func startCmd(daemon bool) error {
-	if options.PasswordsDB == "" {
+	if len(options.PasswordsDB) == 0 {
 		fmt.Fprintln(os.Stderr, `Passwords database is not configured.
 
 Download Pwned passwords SHA1 ordered by hash from https://haveibeenpwned.com/Passwords and execute index-database command to generate a database.
@@ -101,26 +109,115 @@ Refer to https://resenje.org/compromised documentation.`)
 	}
 	srv.WithMetrics(loggingMetrics.Metrics()...)
 
-	passwordsService, err := filepasswords.New(options.PasswordsDB)
-	if err != nil {
-		return fmt.Errorf("passwords service: %w", err)
+	// Open all configured databases and serve each of them on the endpoint
+	// that matches its hash type. Databases are selected by name with the db
+	// query parameter, and the first one by name of every hash type is served
+	// by default.
+	var (
+		passwordsServices     = make(map[string]passwordsDatabase)
+		sha1PasswordsService  passwords.Service
+		ntlmPasswordsService  passwords.NTLMService
+		sha1PasswordsServices = make(map[string]passwords.Service)
+		ntlmPasswordsServices = make(map[string]passwords.NTLMService)
+	)
+	dbNames := make([]string, 0, len(options.PasswordsDB))
+	for name := range options.PasswordsDB {
+		dbNames = append(dbNames, name)
+	}
+	sort.Strings(dbNames)
+	for _, name := range dbNames {
+		passwordsService, err := openPasswordsDatabase(name, options.PasswordsDB[name])
+		if err != nil {
+			return fmt.Errorf("passwords service %s: %w", name, err)
+		}
+		srv.WithMetrics(passwordsService.Metrics()...)
+		shutdownFuncs = append(shutdownFuncs, passwordsService.Close)
+		passwordsServices[name] = passwordsService
+
+		switch passwordsService.Hash() {
+		case filepasswords.HashNTLM:
+			ntlmPasswordsServices[name] = passwordsService
+			if ntlmPasswordsService == nil {
+				ntlmPasswordsService = passwordsService
+			}
+		default:
+			sha1PasswordsServices[name] = passwordsService
+			if sha1PasswordsService == nil {
+				sha1PasswordsService = passwordsService
+			}
+		}
+		logger.Info("passwords database", "name", name, "hash", passwordsService.Hash())
+	}
+
+	// Check SHA1 passwords also in the organization blocklist, if it is
+	// configured, reporting which of them contains the password.
+	var blocklistService blocklistDatabase
+	if options.Blocklist != "" {
+		var blocklistMetrics []prometheus.Collector
+		blocklistService, blocklistMetrics, err = openBlocklist(logger)
+		if err != nil {
+			return fmt.Errorf("blocklist: %w", err)
+		}
+		srv.WithMetrics(blocklistMetrics...)
+		shutdownFuncs = append(shutdownFuncs, blocklistService.Close)
+
+		sha1PasswordsService = nil
+		for _, name := range dbNames {
+			passwordsService, ok := sha1PasswordsServices[name]
+			if !ok {
+				continue
+			}
+			s, err := composite.New(
+				composite.Source{Name: name, Service: passwordsService},
+				composite.Source{Name: config.BlocklistSourceName, Service: blocklistService, Private: true},
+			)
+			if err != nil {
+				return fmt.Errorf("blocklist: %w", err)
+			}
+			sha1PasswordsServices[name] = s
+			if sha1PasswordsService == nil {
+				sha1PasswordsService = s
+			}
+		}
+		logger.Info("blocklist", "path", options.Blocklist, "format", options.BlocklistFormat)
 	}
-	srv.WithMetrics(passwordsService.Metrics()...)
-	shutdownFuncs = append(shutdownFuncs, passwordsService.Close)
 
 	srvOptions := server.HTTPOptions{
 		Name:   config.Name,
 		Listen: options.Listen,
 	}
 
+	// Override compromised counts of passwords that are exempted by the
+	// allowlist.
+	var passwordsAllowlist *allowlist.List
+	if options.Allowlist != "" {
+		passwordsAllowlist, err = allowlist.New(options.Allowlist)
+		if err != nil {
+			return fmt.Errorf("allowlist: %w", err)
+		}
+		logger.Info("allowlist", "path", options.Allowlist, "entries", passwordsAllowlist.Len())
+	}
+
+	passwordsPolicy, err := options.Policy.New()
+	if err != nil {
+		return fmt.Errorf("policy: %w", err)
+	}
+	logger.Info("passwords policy", "version", passwordsPolicy.Version())
+
 	apiHandler, err := api.New(api.Options{
-		Version:          compromised.Version(),
-		Headers:          options.Headers,
-		RealIPHeaderName: options.RealIPHeaderName,
-		Logger:           logger,
-		AccessLogger:     accessLogger,
-		RecoveryService:  recoveryService,
-		PasswordsService: passwordsService,
+		Version:                    compromised.Version(),
+		Headers:                    options.Headers,
+		RealIPHeaderName:           options.RealIPHeaderName,
+		Logger:                     logger,
+		AccessLogger:               accessLogger,
+		RecoveryService:            recoveryService,
+		PasswordsService:           sha1PasswordsService,
+		NTLMPasswordsService:       ntlmPasswordsService,
+		NamedPasswordsServices:     sha1PasswordsServices,
+		NamedNTLMPasswordsServices: ntlmPasswordsServices,
+		PasswordsBatchLimit:        options.PasswordsBatchLimit,
+		Policy:                     passwordsPolicy,
+		Allowlist:                  passwordsAllowlist,
 	})
 	if err != nil {
 		return fmt.Errorf("api: %w", err)
@@ -136,8 +233,40 @@ Refer to https://resenje.org/compromised documentation.`)
 	// Start web server.
 	app.Functions = append(app.Functions, srv.Serve)
 
+	// Reopen passwords databases on HUP signal, allowing to replace them
+	// without stopping the service.
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	go func() {
+		for range reloadSignal {
+			for _, name := range dbNames {
+				if err := passwordsServices[name].Reload(); err != nil {
+					logger.Error("reload passwords database", err, "name", name)
+					continue
+				}
+				logger.Info("passwords database reloaded", "name", name)
+			}
+			if blocklistService != nil {
+				if err := blocklistService.Reload(); err != nil {
+					logger.Error("reload blocklist", err)
+				} else {
+					logger.Info("blocklist reloaded")
+				}
+			}
+			if passwordsAllowlist != nil {
+				if err := passwordsAllowlist.Reload(); err != nil {
+					logger.Error("reload allowlist", err)
+				} else {
+					logger.Info("allowlist reloaded", "entries", passwordsAllowlist.Len())
+				}
+			}
+		}
+	}()
+
 	// Define shutdown function.
 	app.ShutdownFunc = func() error {
+		signal.Stop(reloadSignal)
+
 		// Shutdown web server.
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		srv.Shutdown(ctx)
@@ -180,3 +309,78 @@ Refer to https://resenje.org/compromised documentation.`)
 
 	return nil
 }
+
+// passwordsDatabase is a passwords service of a configured database, which
+// can be a database directory, a container file or a compact database file.
+type passwordsDatabase interface {
+	passwords.Service
+	passwords.NTLMService
+	Hash() filepasswords.Hash
+	Metrics() []prometheus.Collector
+	Reload() error
+	Close() error
+}
+
+// openPasswordsDatabase opens the database on the path as a compact database
+// if it is a compact database file and as a file database otherwise.
+func openPasswordsDatabase(name, path string) (passwordsDatabase, error) {
+	isCompact, err := compact.IsCompactFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if isCompact {
+		return compact.New(path, &compact.Options{
+			Name: name,
+		})
+	}
+	return filepasswords.New(path, &filepasswords.Options{
+		Mode:            filepasswords.Mode(options.PasswordsDBMode),
+		Name:            name,
+		VerifyChecksums: options.PasswordsDBVerifyChecksums,
+		DisableFilter:   options.PasswordsDBDisableFilter,
+	})
+}
+
+// blocklistDatabase is a passwords service of the configured blocklist.
+type blocklistDatabase interface {
+	passwords.Service
+	Reload() error
+	Close() error
+}
+
+// openBlocklist opens the blocklist as a passwords database if it is
+// configured in the db format, and as a list of passwords or their hashes
+// otherwise, returning also metrics of the database. In both cases, the
+// blocklist is read again when its file changes.
+func openBlocklist(logger *slog.Logger) (blocklistDatabase, []prometheus.Collector, error) {
+	logFunc := func(format string, a ...interface{}) {
+		logger.Info(fmt.Sprintf(format, a...))
+	}
+	if options.BlocklistFormat == config.BlocklistFormatDB {
+		db, err := openPasswordsDatabase(config.BlocklistSourceName, options.Blocklist)
+		if err != nil {
+			return nil, nil, err
+		}
+		if db.Hash() == filepasswords.HashNTLM {
+			db.Close()
+			return nil, nil, errors.New("ntlm database is not supported")
+		}
+		s, err := blocklist.NewDatabase(db, options.Blocklist, &blocklist.Options{
+			LogFunc: logFunc,
+		})
+		if err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+		return s, db.Metrics(), nil
+	}
+	s, err := blocklist.New(options.Blocklist, &blocklist.Options{
+		Format:  blocklist.Format(options.BlocklistFormat),
+		Count:   options.BlocklistCount,
+		LogFunc: logFunc,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return s, nil, nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	filepasswords "resenje.org/compromised/pkg/passwords/file"
+)
+
+func updatePasswordsCmd() error {
+	cli := flag.NewFlagSet("update-passwords", flag.ExitOnError)
+
+	help := cli.Bool("h", false, "Show program usage.")
+
+	cli.Usage = func() {
+		fmt.Fprintf(os.Stderr, `USAGE
+
+  update-passwords [database directory] [input filename] [output directory]
+
+OPTIONS
+
+`)
+		cli.PrintDefaults()
+	}
+
+	if err := cli.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+
+	if *help {
+		cli.Usage()
+		return nil
+	}
+
+	if cli.NArg() != 3 {
+		return fmt.Errorf("update-passwords command requires three arguments: database directory, input filename and output directory")
+	}
+
+	_, err := filepasswords.Merge(cli.Arg(0), cli.Arg(1), cli.Arg(2), nil)
+
+	return err
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	filepasswords "resenje.org/compromised/pkg/passwords/file"
+)
+
+func verifyPasswordsCmd() error {
+	cli := flag.NewFlagSet("verify-passwords", flag.ExitOnError)
+
+	help := cli.Bool("h", false, "Show program usage.")
+
+	cli.Usage = func() {
+		fmt.Fprintf(os.Stderr, `USAGE
+
+  verify-passwords [database directory]
+
+OPTIONS
+
+`)
+		cli.PrintDefaults()
+	}
+
+	if err := cli.Parse(os.Args[2:]); err != nil {
+		return err
+	}
+
+	if *help {
+		cli.Usage()
+		return nil
+	}
+
+	if cli.NArg() != 1 {
+		return fmt.Errorf("verify-passwords command requires one argument: database directory")
+	}
+
+	err := filepasswords.Verify(cli.Arg(0), nil)
+	var verifyErr *filepasswords.VerifyError
+	if errors.As(err, &verifyErr) {
+		for _, p := range verifyErr.Problems {
+			fmt.Fprintln(os.Stderr, p)
+		}
+		return fmt.Errorf("found %v problems in the database", len(verifyErr.Problems))
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("database is valid")
+
+	return nil
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package allowlist provides overrides of compromised counts for specific
+// SHA1 sums, so that passwords can be exempted without changing passwords
+// databases. Every override has a reason for auditing.
+package allowlist
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Entry is an override of the compromised count of a single password.
+type Entry struct {
+	SHA1Sum [20]byte
+	// MaxCount is the highest count that is reported for the password. If it
+	// is 0, the password is reported as not compromised.
+	MaxCount uint64
+	Reason   string
+}
+
+// List holds allowlist entries from a file.
+//
+// The file has one entry per line with the hex encoded SHA1 sum, optionally
+// followed by a colon and the max count, and the reason separated by
+// whitespace:
+//
+//	# hash[:max-count] reason
+//	7C222FB2927D828AF22F592134E8932480637C0D generated service account secret
+//	D391477A0849048FC28E62850A25518D72AFD013:10 legacy system truncation
+//
+// Empty lines and lines starting with # are ignored.
+type List struct {
+	filename string
+
+	mu      sync.RWMutex
+	entries map[[20]byte]Entry
+}
+
+// New creates a new List by reading the allowlist file.
+func New(filename string) (*List, error) {
+	entries, err := readEntries(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &List{
+		filename: filename,
+		entries:  entries,
+	}, nil
+}
+
+// Len returns the number of entries in the list.
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return len(l.entries)
+}
+
+// Lookup returns the entry of the password SHA1 sum if it is in the list.
+func (l *List) Lookup(sum [20]byte) (e Entry, ok bool) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	e, ok = l.entries[sum]
+	return e, ok
+}
+
+// Override returns the count of the password limited by its entry. The entry
+// is returned only if the count is changed.
+func (l *List) Override(sum [20]byte, count uint64) (uint64, *Entry) {
+	e, ok := l.Lookup(sum)
+	if !ok || count <= e.MaxCount {
+		return count, nil
+	}
+	return e.MaxCount, &e
+}
+
+// Reload reads the allowlist file again and replaces all entries. If the file
+// can not be read, the current entries are kept.
+func (l *List) Reload() error {
+	entries, err := readEntries(l.filename)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = entries
+	return nil
+}
+
+// readEntries reads all entries from the allowlist file.
+func readEntries(filename string) (map[[20]byte]Entry, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := make(map[[20]byte]Entry)
+	scanner := bufio.NewScanner(f)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		e, err := parseEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %v: %w", n, err)
+		}
+		if _, ok := entries[e.SHA1Sum]; ok {
+			return nil, fmt.Errorf("line %v: duplicate hash %X", n, e.SHA1Sum)
+		}
+		entries[e.SHA1Sum] = e
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// parseEntry parses a single allowlist line.
+func parseEntry(line string) (e Entry, err error) {
+	key := line
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		key, e.Reason = line[:i], strings.TrimSpace(line[i:])
+	}
+	if e.Reason == "" {
+		return e, fmt.Errorf("missing reason for %q", key)
+	}
+	hash, maxCount, ok := strings.Cut(key, ":")
+	if ok {
+		e.MaxCount, err = strconv.ParseUint(maxCount, 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("invalid max count %q", maxCount)
+		}
+	}
+	if len(hash) != 2*sha1.Size {
+		return e, fmt.Errorf("invalid hash %q", hash)
+	}
+	if _, err := hex.Decode(e.SHA1Sum[:], []byte(hash)); err != nil {
+		return e, fmt.Errorf("invalid hash %q", hash)
+	}
+	return e, nil
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package allowlist_test
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"resenje.org/compromised/pkg/allowlist"
+)
+
+func TestList(t *testing.T) {
+	filename := writeFile(t, strings.Join([]string{
+		"# hash[:max-count] reason",
+		"7C222FB2927D828AF22F592134E8932480637C0D generated service account secret",
+		"",
+		"d391477a0849048fc28e62850a25518d72afd013:10\tlegacy system truncation, ticket 42 ",
+	}, "\n"))
+
+	l, err := allowlist.New(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := l.Len(); n != 2 {
+		t.Errorf("got %v entries, want 2", n)
+	}
+
+	sum := hexDecodeSHA1Sum(t, "d391477a0849048fc28e62850a25518d72afd013")
+	e, ok := l.Lookup(sum)
+	if !ok {
+		t.Fatal("entry not found")
+	}
+	want := allowlist.Entry{SHA1Sum: sum, MaxCount: 10, Reason: "legacy system truncation, ticket 42"}
+	if e != want {
+		t.Errorf("got entry %+v, want %+v", e, want)
+	}
+
+	for _, tc := range []struct {
+		hash       string
+		count      uint64
+		wantCount  uint64
+		wantReason string
+	}{
+		{
+			hash:       "7c222fb2927d828af22f592134e8932480637c0d",
+			count:      2996082,
+			wantCount:  0,
+			wantReason: "generated service account secret",
+		},
+		{
+			hash:      "7c222fb2927d828af22f592134e8932480637c0d",
+			count:     0,
+			wantCount: 0,
+		},
+		{
+			hash:       "d391477a0849048fc28e62850a25518d72afd013",
+			count:      100,
+			wantCount:  10,
+			wantReason: "legacy system truncation, ticket 42",
+		},
+		{
+			hash:      "d391477a0849048fc28e62850a25518d72afd013",
+			count:     10,
+			wantCount: 10,
+		},
+		{
+			hash:      "0000000000000000000000000000000000000000",
+			count:     100,
+			wantCount: 100,
+		},
+	} {
+		count, e := l.Override(hexDecodeSHA1Sum(t, tc.hash), tc.count)
+		if count != tc.wantCount {
+			t.Errorf("%s count %v: got count %v, want %v", tc.hash, tc.count, count, tc.wantCount)
+		}
+		var reason string
+		if e != nil {
+			reason = e.Reason
+		}
+		if reason != tc.wantReason {
+			t.Errorf("%s count %v: got reason %q, want %q", tc.hash, tc.count, reason, tc.wantReason)
+		}
+	}
+}
+
+func TestList_Reload(t *testing.T) {
+	filename := writeFile(t, "7c222fb2927d828af22f592134e8932480637c0d secret\n")
+
+	l, err := allowlist.New(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(filename, []byte("d391477a0849048fc28e62850a25518d72afd013 secret\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := l.Lookup(hexDecodeSHA1Sum(t, "7c222fb2927d828af22f592134e8932480637c0d")); ok {
+		t.Error("removed entry found")
+	}
+	if _, ok := l.Lookup(hexDecodeSHA1Sum(t, "d391477a0849048fc28e62850a25518d72afd013")); !ok {
+		t.Error("added entry not found")
+	}
+
+	// invalid file keeps the current entries
+	if err := os.WriteFile(filename, []byte("d391477a0849048fc28e62850a25518d72afd013\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Reload(); err == nil {
+		t.Error("expected error for invalid file")
+	}
+	if n := l.Len(); n != 1 {
+		t.Errorf("got %v entries, want 1", n)
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	for _, tc := range []struct {
+		data    string
+		wantErr string
+	}{
+		{
+			data:    "7c222fb2927d828af22f592134e8932480637c0d",
+			wantErr: `line 1: missing reason for "7c222fb2927d828af22f592134e8932480637c0d"`,
+		},
+		{
+			data:    "\n7c222fb2927d828af22f592134e8932480637c0 secret",
+			wantErr: `line 2: invalid hash "7c222fb2927d828af22f592134e8932480637c0"`,
+		},
+		{
+			data:    "7c222fb2927d828af22f592134e8932480637c0d:many secret",
+			wantErr: `line 1: invalid max count "many"`,
+		},
+		{
+			data:    "7c222fb2927d828af22f592134e8932480637c0d secret\n7C222FB2927D828AF22F592134E8932480637C0D:1 secret",
+			wantErr: "line 2: duplicate hash 7C222FB2927D828AF22F592134E8932480637C0D",
+		},
+	} {
+		_, err := allowlist.New(writeFile(t, tc.data))
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("got error %v, want %q", err, tc.wantErr)
+		}
+	}
+}
+
+func writeFile(t *testing.T, data string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "allowlist.txt")
+	if err := os.WriteFile(filename, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func hexDecodeSHA1Sum(t *testing.T, s string) (sum [20]byte) {
+	t.Helper()
+
+	if _, err := hex.Decode(sum[:], []byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
@@ -6,22 +6,121 @@
 package api
 
 import (
+	"bufio"
+	"context"
+	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
+	"resenje.org/compromised/pkg/passwords"
 	"resenje.org/jsonhttp"
 )
 
 type passwordResponse struct {
-	Compromised bool   `json:"compromised"`
-	Count       uint64 `json:"count,omitempty"`
+	Compromised bool     `json:"compromised"`
+	Count       uint64   `json:"count,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
 }
 
 func (s *server) passwordHandler(w http.ResponseWriter, r *http.Request) {
+	count, sources, ok := s.lookupPassword(w, r, "api password handler")
+	if !ok {
+		return
+	}
+
+	jsonhttp.OK(w, passwordResponse{
+		Compromised: count > 0,
+		Count:       count,
+		Sources:     sources,
+	})
+}
+
+func (s *server) passwordVerdictHandler(w http.ResponseWriter, r *http.Request) {
+	count, sources, ok := s.lookupPassword(w, r, "api password verdict handler")
+	if !ok {
+		return
+	}
+
+	jsonhttp.OK(w, s.Policy.Verdict(count, sources...))
+}
+
+// lookupPassword returns the compromised count and sources of the password
+// whose SHA1 hash is in the request path, with the allowlist override
+// applied. If the lookup fails, the response is written and false returned.
+func (s *server) lookupPassword(w http.ResponseWriter, r *http.Request, handlerName string) (count uint64, sources []string, ok bool) {
 	hash := mux.Vars(r)["hash"]
 
 	if len(hash) != 40 {
+		jsonhttp.NotFound(w, nil)
+		return 0, nil, false
+	}
+
+	slice, err := hex.DecodeString(hash)
+	if err != nil {
+		jsonhttp.NotFound(w, nil)
+		return 0, nil, false
+	}
+
+	passwordsService, ok := s.passwordsService(w, r)
+	if !ok {
+		return 0, nil, false
+	}
+
+	var sum [20]byte
+	copy(sum[:], slice)
+
+	count, sources, err = passwordSources(r.Context(), passwordsService, sum)
+	if err != nil {
+		s.Logger.Error(handlerName+": is password compromised", err, "hash", hash)
+		jsonhttp.InternalServerError(w, nil)
+		return 0, nil, false
+	}
+	count, sources = s.override(sum, count, sources)
+	return count, sources, true
+}
+
+// override limits the compromised count of the password by its allowlist
+// entry and logs the reason if the count is changed. Sources are removed if
+// the password is not compromised after the override.
+func (s *server) override(sum [20]byte, count uint64, sources []string) (uint64, []string) {
+	if s.Allowlist == nil {
+		return count, sources
+	}
+	newCount, e := s.Allowlist.Override(sum, count)
+	if e == nil {
+		return count, sources
+	}
+	s.metrics.OverrideCount.Inc()
+	s.Logger.Info("api allowlist override", "hash", hex.EncodeToString(sum[:]), "count", count, "max-count", e.MaxCount, "reason", e.Reason)
+	if newCount == 0 {
+		sources = nil
+	}
+	return newCount, sources
+}
+
+// passwordSources returns the compromised count and names of sources that
+// contain the password if passwords service combines multiple sources, or
+// only the count if it does not.
+func passwordSources(ctx context.Context, passwordsService passwords.Service, sum [20]byte) (uint64, []string, error) {
+	if sourceService, ok := passwordsService.(passwords.SourceService); ok {
+		return sourceService.PasswordSources(ctx, sum)
+	}
+	count, err := passwordsService.IsPasswordCompromised(ctx, sum)
+	return count, nil, err
+}
+
+func (s *server) ntlmPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	hash := mux.Vars(r)["hash"]
+
+	if len(hash) != 32 {
 		jsonhttp.NotFound(w, nil)
 		return
 	}
@@ -32,12 +131,17 @@ func (s *server) passwordHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	var sum [20]byte
+	ntlmPasswordsService, ok := s.ntlmPasswordsService(w, r)
+	if !ok {
+		return
+	}
+
+	var sum [16]byte
 	copy(sum[:], slice)
 
-	count, err := s.PasswordsService.IsPasswordCompromised(r.Context(), sum)
+	count, err := ntlmPasswordsService.IsNTLMPasswordCompromised(r.Context(), sum)
 	if err != nil {
-		s.Logger.Error("api password handler: is password compromised", err, "hash", hash)
+		s.Logger.Error("api ntlm password handler: is ntlm password compromised", err, "hash", hash)
 		jsonhttp.InternalServerError(w, nil)
 		return
 	}
@@ -47,3 +151,229 @@ func (s *server) passwordHandler(w http.ResponseWriter, r *http.Request) {
 		Count:       count,
 	})
 }
+
+type batchPasswordResponse struct {
+	Hash        string   `json:"hash"`
+	Compromised bool     `json:"compromised"`
+	Count       uint64   `json:"count,omitempty"`
+	Sources     []string `json:"sources,omitempty"`
+}
+
+func (s *server) passwordsBatchHandler(w http.ResponseWriter, r *http.Request) {
+	passwordsService, ok := s.passwordsService(w, r)
+	if !ok {
+		return
+	}
+
+	var hashes []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		if err := jsonhttp.UnmarshalRequestBody(w, r, &hashes); err != nil {
+			return
+		}
+	} else {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if hash := strings.TrimSpace(scanner.Text()); hash != "" {
+				hashes = append(hashes, hash)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				jsonhttp.RequestEntityTooLarge(w, nil)
+				return
+			}
+			s.Logger.Error("api passwords batch handler: read request body", err)
+			jsonhttp.BadRequest(w, nil)
+			return
+		}
+	}
+
+	if len(hashes) > s.PasswordsBatchLimit {
+		jsonhttp.RequestEntityTooLarge(w, fmt.Sprintf("too many hashes, limit is %v", s.PasswordsBatchLimit))
+		return
+	}
+
+	sums := make([][20]byte, len(hashes))
+	for i, hash := range hashes {
+		if len(hash) != 40 {
+			jsonhttp.BadRequest(w, fmt.Sprintf("invalid hash %q", hash))
+			return
+		}
+		if _, err := hex.Decode(sums[i][:], []byte(hash)); err != nil {
+			jsonhttp.BadRequest(w, fmt.Sprintf("invalid hash %q", hash))
+			return
+		}
+	}
+
+	counts, sources, err := arePasswordsCompromised(r.Context(), passwordsService, sums)
+	if err != nil {
+		s.Logger.Error("api passwords batch handler: are passwords compromised", err, "count", len(sums))
+		jsonhttp.InternalServerError(w, nil)
+		return
+	}
+
+	response := make([]batchPasswordResponse, len(sums))
+	for i, count := range counts {
+		var passwordSources []string
+		if sources != nil {
+			passwordSources = sources[i]
+		}
+		count, passwordSources = s.override(sums[i], count, passwordSources)
+		response[i] = batchPasswordResponse{
+			Hash:        strings.ToLower(hashes[i]),
+			Compromised: count > 0,
+			Count:       count,
+			Sources:     passwordSources,
+		}
+	}
+
+	jsonhttp.OK(w, response)
+}
+
+// arePasswordsCompromised checks all sums with a single call if passwords
+// service supports batch checks, or one by one if it does not. Names of
+// sources that contain passwords are returned only if passwords service
+// combines multiple sources.
+func arePasswordsCompromised(ctx context.Context, passwordsService passwords.Service, sums [][20]byte) ([]uint64, [][]string, error) {
+	if sourceService, ok := passwordsService.(passwords.SourceService); ok {
+		return sourceService.ArePasswordsInSources(ctx, sums)
+	}
+	counts, err := passwords.ArePasswordsCompromised(ctx, passwordsService, sums)
+	return counts, nil, err
+}
+
+// rangePaddingMin and rangePaddingMax define the bounds of the number of
+// entries in a padded range response, as the HIBP range API does.
+const (
+	rangePaddingMin = 800
+	rangePaddingMax = 1000
+)
+
+func (s *server) rangeHandler(w http.ResponseWriter, r *http.Request) {
+	prefix := mux.Vars(r)["prefix"]
+
+	if len(prefix) != 5 {
+		jsonhttp.NotFound(w, nil)
+		return
+	}
+
+	p, err := strconv.ParseUint(prefix, 16, 32)
+	if err != nil {
+		jsonhttp.NotFound(w, nil)
+		return
+	}
+
+	passwordsService, ok := s.passwordsService(w, r)
+	if !ok {
+		return
+	}
+
+	rangeService, ok := passwordsService.(passwords.RangeService)
+	if !ok {
+		jsonhttp.NotImplemented(w, nil)
+		return
+	}
+
+	list, err := rangeService.PasswordsByPrefix(r.Context(), uint32(p))
+	if err != nil {
+		s.Logger.Error("api range handler: passwords by prefix", err, "prefix", prefix)
+		jsonhttp.InternalServerError(w, nil)
+		return
+	}
+
+	lines := make([]string, 0, len(list))
+	for _, p := range list {
+		count, _ := s.override(p.SHA1Sum, p.Count, nil)
+		if count == 0 {
+			continue
+		}
+		lines = append(lines, strings.ToUpper(hex.EncodeToString(p.SHA1Sum[:])[5:])+":"+strconv.FormatUint(count, 10))
+	}
+
+	if strings.EqualFold(r.Header.Get("Add-Padding"), "true") {
+		lines, err = padRangeLines(lines)
+		if err != nil {
+			s.Logger.Error("api range handler: padding", err, "prefix", prefix)
+			jsonhttp.InternalServerError(w, nil)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, strings.Join(lines, "\r\n"))
+}
+
+// padRangeLines adds random hash suffixes with zero counts to the sorted range
+// response lines so that their number is random between rangePaddingMin and
+// rangePaddingMax.
+func padRangeLines(lines []string) ([]string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(rangePaddingMax-rangePaddingMin+1))
+	if err != nil {
+		return nil, err
+	}
+	size := rangePaddingMin + int(n.Int64())
+	if len(lines) >= size {
+		return lines, nil
+	}
+
+	existing := make(map[string]struct{}, len(lines))
+	for _, l := range lines {
+		existing[l[:35]] = struct{}{}
+	}
+
+	buf := make([]byte, 18)
+	for len(lines) < size {
+		if _, err := rand.Read(buf); err != nil {
+			return nil, err
+		}
+		suffix := strings.ToUpper(hex.EncodeToString(buf)[:35])
+		if _, ok := existing[suffix]; ok {
+			continue
+		}
+		existing[suffix] = struct{}{}
+		lines = append(lines, suffix+":0")
+	}
+
+	sort.Strings(lines)
+
+	return lines, nil
+}
+
+// passwordsService returns the SHA1 passwords service named by the db query
+// parameter, or the default one if the parameter is not set. If the service
+// can not be selected, an appropriate response is written and false is
+// returned.
+func (s *server) passwordsService(w http.ResponseWriter, r *http.Request) (passwords.Service, bool) {
+	if name := r.URL.Query().Get("db"); name != "" {
+		service := s.NamedPasswordsServices[name]
+		if service == nil {
+			jsonhttp.NotFound(w, fmt.Sprintf("unknown database %q", name))
+			return nil, false
+		}
+		return service, true
+	}
+	if s.PasswordsService == nil {
+		jsonhttp.NotImplemented(w, nil)
+		return nil, false
+	}
+	return s.PasswordsService, true
+}
+
+// ntlmPasswordsService returns the NTLM passwords service in the same way as
+// passwordsService does for SHA1.
+func (s *server) ntlmPasswordsService(w http.ResponseWriter, r *http.Request) (passwords.NTLMService, bool) {
+	if name := r.URL.Query().Get("db"); name != "" {
+		service := s.NamedNTLMPasswordsServices[name]
+		if service == nil {
+			jsonhttp.NotFound(w, fmt.Sprintf("unknown database %q", name))
+			return nil, false
+		}
+		return service, true
+	}
+	if s.NTLMPasswordsService == nil {
+		jsonhttp.NotImplemented(w, nil)
+		return nil, false
+	}
+	return s.NTLMPasswordsService, true
+}
@@ -8,12 +8,23 @@ package api_test
 import (
 	"context"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 
+	"resenje.org/compromised/pkg/allowlist"
 	"resenje.org/compromised/pkg/api"
+	"resenje.org/compromised/pkg/passwords"
+	"resenje.org/compromised/pkg/passwords/composite"
 	mockpasswords "resenje.org/compromised/pkg/passwords/mock"
+	"resenje.org/compromised/pkg/policy"
 	"resenje.org/jsonhttp"
 )
 
@@ -99,3 +110,729 @@ func TestPassword_error(t *testing.T) {
 		Message: http.StatusText(http.StatusInternalServerError),
 	})
 }
+
+func TestPassword_sources(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: newCompositeService(t),
+	})
+
+	for _, tc := range []struct {
+		hash string
+		want api.PasswordResponse
+	}{
+		{
+			hash: "0100000000000000000000000000000000000000",
+			want: api.PasswordResponse{Compromised: true, Count: 10, Sources: []string{"pwned"}},
+		},
+		{
+			hash: "0200000000000000000000000000000000000000",
+			want: api.PasswordResponse{Compromised: true, Count: 10, Sources: []string{"pwned", "blocklist"}},
+		},
+		{
+			hash: "0300000000000000000000000000000000000000",
+			want: api.PasswordResponse{Compromised: true, Count: 1, Sources: []string{"blocklist"}},
+		},
+		{
+			hash: "0400000000000000000000000000000000000000",
+			want: api.PasswordResponse{},
+		},
+	} {
+		var r api.PasswordResponse
+		testResponseUnmarshal(t, c, http.MethodGet, "/v1/passwords/"+tc.hash, nil, http.StatusOK, &r)
+
+		if !reflect.DeepEqual(r, tc.want) {
+			t.Errorf("%s: got response %+v, want %+v", tc.hash, r, tc.want)
+		}
+	}
+}
+
+// newNTLMService returns a passwords service that checks only NTLM hashes with
+// the function.
+func newNTLMService(f func(ctx context.Context, ntlmSum [16]byte) (uint64, error)) passwords.NTLMService {
+	return mockpasswords.New(nil, mockpasswords.WithIsNTLMPasswordCompromisedFunc(f)).(passwords.NTLMService)
+}
+
+// newCompositeService returns a passwords service with pwned source that has
+// passwords which sums start with 1 and 2, and private blocklist source that
+// has passwords which sums start with 2 and 3 and does not support batch
+// checks.
+func newCompositeService(t *testing.T) *composite.Service {
+	t.Helper()
+
+	pwnedCount := func(s [20]byte) uint64 {
+		if s[0] == 1 || s[0] == 2 {
+			return 10
+		}
+		return 0
+	}
+	s, err := composite.New(
+		composite.Source{
+			Name: "pwned",
+			Service: mockpasswords.New(func(_ context.Context, s [20]byte) (uint64, error) {
+				return pwnedCount(s), nil
+			}, mockpasswords.WithArePasswordsCompromisedFunc(func(_ context.Context, s [][20]byte) ([]uint64, error) {
+				counts := make([]uint64, len(s))
+				for i := range s {
+					counts[i] = pwnedCount(s[i])
+				}
+				return counts, nil
+			}), mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+				sum := [20]byte{byte(prefix >> 12)}
+				if count := pwnedCount(sum); count > 0 {
+					return []passwords.Password{{SHA1Sum: sum, Count: count}}, nil
+				}
+				return nil, nil
+			})),
+		},
+		composite.Source{
+			Name: "blocklist",
+			Service: mockpasswords.New(func(_ context.Context, s [20]byte) (uint64, error) {
+				if s[0] == 2 || s[0] == 3 {
+					return 1, nil
+				}
+				return 0, nil
+			}, mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+				if b := byte(prefix >> 12); b == 2 || b == 3 {
+					return []passwords.Password{{SHA1Sum: [20]byte{b}, Count: 1}}, nil
+				}
+				return nil, nil
+			})),
+			Private: true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestPasswordVerdict(t *testing.T) {
+	defaultPolicy, err := policy.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	customPolicy, err := policy.New(&policy.Options{
+		Version: "test",
+		Rules: []policy.Rule{
+			{Outcome: "block", MinCount: 5, Reason: "compromised"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		policy *policy.Policy
+		count  uint64
+		want   policy.Verdict
+	}{
+		{
+			name:  "default policy allow",
+			count: 0,
+			want:  policy.Verdict{Outcome: "allow", Reason: "password is not compromised", Version: defaultPolicy.Version()},
+		},
+		{
+			name:  "default policy warn",
+			count: 10,
+			want:  policy.Verdict{Outcome: "warn", Reason: "password is compromised 10 times, at least 10", Threshold: 10, Version: defaultPolicy.Version()},
+		},
+		{
+			name:  "default policy reject",
+			count: 2996082,
+			want:  policy.Verdict{Outcome: "reject", Reason: "password is compromised 2996082 times, at least 1000", Threshold: 1000, Version: defaultPolicy.Version()},
+		},
+		{
+			name:   "custom policy",
+			policy: customPolicy,
+			count:  10,
+			want:   policy.Verdict{Outcome: "block", Reason: "compromised", Threshold: 5, Version: "test"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sum := [20]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19}
+			var gotSum [20]byte
+			c := newTestServer(t, testServerOptions{
+				PasswordsService: mockpasswords.New(func(_ context.Context, s [20]byte) (uint64, error) {
+					gotSum = s
+					return tc.count, nil
+				}),
+				Policy: tc.policy,
+			})
+
+			var r policy.Verdict
+			testResponseUnmarshal(t, c, http.MethodGet, "/v1/passwords/"+hex.EncodeToString(sum[:])+"/verdict", nil, http.StatusOK, &r)
+
+			if gotSum != sum {
+				t.Errorf("got sum %v, want %v", gotSum, sum)
+			}
+			if r != tc.want {
+				t.Errorf("got verdict %+v, want %+v", r, tc.want)
+			}
+		})
+	}
+}
+
+func TestPasswordVerdict_sources(t *testing.T) {
+	p, err := policy.New(&policy.Options{
+		Version: "test",
+		Rules: append([]policy.Rule{
+			{Outcome: "reject", MinCount: 1, Source: "blocklist"},
+		}, policy.DefaultRules...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: newCompositeService(t),
+		Policy:           p,
+	})
+
+	var r policy.Verdict
+	testResponseUnmarshal(t, c, http.MethodGet, "/v1/passwords/0100000000000000000000000000000000000000/verdict", nil, http.StatusOK, &r)
+	want := policy.Verdict{Outcome: "warn", Reason: "password is compromised 10 times, at least 10", Threshold: 10, Version: "test"}
+	if r != want {
+		t.Errorf("got verdict %+v, want %+v", r, want)
+	}
+
+	testResponseUnmarshal(t, c, http.MethodGet, "/v1/passwords/0300000000000000000000000000000000000000/verdict", nil, http.StatusOK, &r)
+	want = policy.Verdict{Outcome: "reject", Reason: "password is found in blocklist", Threshold: 1, Source: "blocklist", Version: "test"}
+	if r != want {
+		t.Errorf("got verdict %+v, want %+v", r, want)
+	}
+}
+
+func TestPasswordVerdict_invalidSum(t *testing.T) {
+	c := newTestServer(t, testServerOptions{})
+
+	testResponseDirect(t, c, http.MethodGet, "/v1/passwords/g1234567890abcdef1234567890abcdef1234567/verdict", nil, http.StatusNotFound, jsonhttp.StatusResponse{
+		Code:    http.StatusNotFound,
+		Message: http.StatusText(http.StatusNotFound),
+	})
+}
+
+func TestPasswordVerdict_error(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(func(_ context.Context, s [20]byte) (uint64, error) {
+			return 0, errors.New("test error")
+		}),
+	})
+
+	testResponseDirect(t, c, http.MethodGet, "/v1/passwords/01234567890abcdef1234567890abcdef1234567/verdict", nil, http.StatusInternalServerError, jsonhttp.StatusResponse{
+		Code:    http.StatusInternalServerError,
+		Message: http.StatusText(http.StatusInternalServerError),
+	})
+}
+
+func TestNTLMPassword(t *testing.T) {
+	sum := [16]byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	var gotSum [16]byte
+	c := newTestServer(t, testServerOptions{
+		NTLMPasswordsService: newNTLMService(func(_ context.Context, s [16]byte) (uint64, error) {
+			gotSum = s
+			return 10, nil
+		}),
+	})
+
+	var r api.PasswordResponse
+	testResponseUnmarshal(t, c, http.MethodGet, "/v1/ntlm/"+hex.EncodeToString(sum[:]), nil, http.StatusOK, &r)
+
+	if gotSum != sum {
+		t.Errorf("got sum %v, want %v", gotSum, sum)
+	}
+
+	if !r.Compromised {
+		t.Error("want compromised")
+	}
+
+	if r.Count != 10 {
+		t.Errorf("got count %v, want 10", r.Count)
+	}
+}
+
+func TestNTLMPassword_invalidSum(t *testing.T) {
+	c := newTestServer(t, testServerOptions{})
+
+	for _, hash := range []string{"1234", "01234567890abcdef1234567890abcdef1234567", "g1234567890abcdef1234567890abcd"} {
+		testResponseDirect(t, c, http.MethodGet, "/v1/ntlm/"+hash, nil, http.StatusNotFound, jsonhttp.StatusResponse{
+			Code:    http.StatusNotFound,
+			Message: http.StatusText(http.StatusNotFound),
+		})
+	}
+}
+
+func TestNTLMPassword_notImplemented(t *testing.T) {
+	c := newTestServer(t, testServerOptions{})
+
+	testResponseDirect(t, c, http.MethodGet, "/v1/ntlm/0123456789abcdef0123456789abcdef", nil, http.StatusNotImplemented, jsonhttp.StatusResponse{
+		Code:    http.StatusNotImplemented,
+		Message: http.StatusText(http.StatusNotImplemented),
+	})
+}
+
+func TestNTLMPassword_error(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		NTLMPasswordsService: newNTLMService(func(_ context.Context, s [16]byte) (uint64, error) {
+			return 0, errors.New("test error")
+		}),
+	})
+
+	testResponseDirect(t, c, http.MethodGet, "/v1/ntlm/0123456789abcdef0123456789abcdef", nil, http.StatusInternalServerError, jsonhttp.StatusResponse{
+		Code:    http.StatusInternalServerError,
+		Message: http.StatusText(http.StatusInternalServerError),
+	})
+}
+
+func TestPassword_namedDatabase(t *testing.T) {
+	newService := func(count uint64) passwords.Service {
+		return mockpasswords.New(func(_ context.Context, s [20]byte) (uint64, error) {
+			return count, nil
+		})
+	}
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: newService(1),
+		NamedPasswordsServices: map[string]passwords.Service{
+			"full": newService(1),
+			"top":  newService(2),
+		},
+	})
+
+	for path, wantCount := range map[string]uint64{
+		"/v1/passwords/01234567890abcdef1234567890abcdef1234567":         1,
+		"/v1/passwords/01234567890abcdef1234567890abcdef1234567?db=full": 1,
+		"/v1/passwords/01234567890abcdef1234567890abcdef1234567?db=top":  2,
+	} {
+		var r api.PasswordResponse
+		testResponseUnmarshal(t, c, http.MethodGet, path, nil, http.StatusOK, &r)
+
+		if r.Count != wantCount {
+			t.Errorf("%s: got count %v, want %v", path, r.Count, wantCount)
+		}
+	}
+
+	testResponseDirect(t, c, http.MethodGet, "/v1/passwords/01234567890abcdef1234567890abcdef1234567?db=unknown", nil, http.StatusNotFound, jsonhttp.StatusResponse{
+		Code:    http.StatusNotFound,
+		Message: `unknown database "unknown"`,
+	})
+}
+
+func TestNTLMPassword_namedDatabase(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		NamedNTLMPasswordsServices: map[string]passwords.NTLMService{
+			"ntlm": newNTLMService(func(_ context.Context, s [16]byte) (uint64, error) {
+				return 3, nil
+			}),
+		},
+	})
+
+	var r api.PasswordResponse
+	testResponseUnmarshal(t, c, http.MethodGet, "/v1/ntlm/0123456789abcdef0123456789abcdef?db=ntlm", nil, http.StatusOK, &r)
+
+	if r.Count != 3 {
+		t.Errorf("got count %v, want 3", r.Count)
+	}
+
+	testResponseDirect(t, c, http.MethodGet, "/v1/ntlm/0123456789abcdef0123456789abcdef", nil, http.StatusNotImplemented, jsonhttp.StatusResponse{
+		Code:    http.StatusNotImplemented,
+		Message: http.StatusText(http.StatusNotImplemented),
+	})
+}
+
+func TestRange(t *testing.T) {
+	var gotPrefix uint32
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(nil, mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+			gotPrefix = prefix
+			return []passwords.Password{
+				{SHA1Sum: hexDecodeSHA1Sum(t, "7c222fb2927d828af22f592134e8932480637c0d"), Count: 2996082},
+				{SHA1Sum: hexDecodeSHA1Sum(t, "7c222fe1a9e3a6f6a3a2b1e0e6b0c4b4f1c1d2e3"), Count: 1},
+			}, nil
+		})),
+	})
+
+	resp, err := request(c, http.MethodGet, "/v1/range/7c222", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got response status %s, want %v", resp.Status, http.StatusOK)
+	}
+
+	if gotPrefix != 0x7c222 {
+		t.Errorf("got prefix %05x, want 7c222", gotPrefix)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := string(b)
+	want := "FB2927D828AF22F592134E8932480637C0D:2996082\r\nFE1A9E3A6F6A3A2B1E0E6B0C4B4F1C1D2E3:1"
+	if got != want {
+		t.Errorf("got response %q, want %q", got, want)
+	}
+}
+
+func TestRange_blocklist(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: newCompositeService(t),
+	})
+
+	for _, tc := range []struct {
+		prefix string
+		want   string
+	}{
+		{
+			prefix: "02000",
+			want:   "00000000000000000000000000000000000:10",
+		},
+		{
+			prefix: "03000",
+			want:   "",
+		},
+	} {
+		resp, err := request(c, http.MethodGet, "/v1/range/"+tc.prefix, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got response status %s, want %v", tc.prefix, resp.Status, http.StatusOK)
+		}
+		if got := string(b); got != tc.want {
+			t.Errorf("%s: got response %q, want %q", tc.prefix, got, tc.want)
+		}
+	}
+}
+
+func TestRange_padding(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(nil, mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+			return []passwords.Password{
+				{SHA1Sum: hexDecodeSHA1Sum(t, "7c222fb2927d828af22f592134e8932480637c0d"), Count: 2996082},
+			}, nil
+		})),
+	})
+
+	req, err := http.NewRequest(http.MethodGet, "/v1/range/7C222", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Add-Padding", "true")
+
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got response status %s, want %v", resp.Status, http.StatusOK)
+	}
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(b), "\r\n")
+	if l := len(lines); l < 800 || l > 1000 {
+		t.Errorf("got %v lines, want between 800 and 1000", l)
+	}
+	if !sort.StringsAreSorted(lines) {
+		t.Error("lines are not sorted")
+	}
+
+	var found bool
+	for _, line := range lines {
+		if line == "FB2927D828AF22F592134E8932480637C0D:2996082" {
+			found = true
+			continue
+		}
+		if len(line) != 37 || !strings.HasSuffix(line, ":0") {
+			t.Errorf("unexpected padding line %q", line)
+		}
+	}
+	if !found {
+		t.Error("compromised password hash suffix not found")
+	}
+}
+
+func TestRange_invalidPrefix(t *testing.T) {
+	c := newTestServer(t, testServerOptions{})
+
+	for _, prefix := range []string{"1234", "123456", "g1234"} {
+		testResponseDirect(t, c, http.MethodGet, "/v1/range/"+prefix, nil, http.StatusNotFound, jsonhttp.StatusResponse{
+			Code:    http.StatusNotFound,
+			Message: http.StatusText(http.StatusNotFound),
+		})
+	}
+}
+
+func TestRange_notImplemented(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(nil),
+	})
+
+	testResponseDirect(t, c, http.MethodGet, "/v1/range/12345", nil, http.StatusNotImplemented, jsonhttp.StatusResponse{
+		Code:    http.StatusNotImplemented,
+		Message: http.StatusText(http.StatusNotImplemented),
+	})
+}
+
+func TestRange_error(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(nil, mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+			return nil, errors.New("test error")
+		})),
+	})
+
+	testResponseDirect(t, c, http.MethodGet, "/v1/range/12345", nil, http.StatusInternalServerError, jsonhttp.StatusResponse{
+		Code:    http.StatusInternalServerError,
+		Message: http.StatusText(http.StatusInternalServerError),
+	})
+}
+
+func hexDecodeSHA1Sum(t *testing.T, s string) (sum [20]byte) {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(sum[:], b)
+	return sum
+}
+
+func TestPasswordsBatch(t *testing.T) {
+	sums := [][20]byte{
+		hexDecodeSHA1Sum(t, "7c222fb2927d828af22f592134e8932480637c0d"),
+		hexDecodeSHA1Sum(t, "d391477a0849048fc28e62850a25518d72afd013"),
+	}
+	want := []api.BatchPasswordResponse{
+		{Hash: "7c222fb2927d828af22f592134e8932480637c0d", Compromised: true, Count: 2996082},
+		{Hash: "d391477a0849048fc28e62850a25518d72afd013"},
+	}
+
+	for _, tc := range []struct {
+		name        string
+		contentType string
+		body        string
+	}{
+		{
+			name:        "json",
+			contentType: "application/json",
+			body:        `["7c222fb2927d828af22f592134e8932480637c0d", "D391477A0849048FC28E62850A25518D72AFD013"]`,
+		},
+		{
+			name:        "text",
+			contentType: "text/plain",
+			body:        "7c222fb2927d828af22f592134e8932480637c0d\r\nD391477A0849048FC28E62850A25518D72AFD013\n\n",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var gotSums [][20]byte
+			c := newTestServer(t, testServerOptions{
+				PasswordsService: mockpasswords.New(nil, mockpasswords.WithArePasswordsCompromisedFunc(func(_ context.Context, s [][20]byte) ([]uint64, error) {
+					gotSums = s
+					return []uint64{2996082, 0}, nil
+				})),
+			})
+
+			req, err := http.NewRequest(http.MethodPost, "/v1/passwords", strings.NewReader(tc.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tc.contentType)
+
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got response status %s, want %v", resp.Status, http.StatusOK)
+			}
+
+			var got []api.BatchPasswordResponse
+			if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(gotSums, sums) {
+				t.Errorf("got sums %x, want %x", gotSums, sums)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got response %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestPasswordsBatch_notBatchService(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(func(_ context.Context, s [20]byte) (uint64, error) {
+			return uint64(s[0]), nil
+		}),
+	})
+
+	var got []api.BatchPasswordResponse
+	testResponseUnmarshal(t, c, http.MethodPost, "/v1/passwords", strings.NewReader("0100000000000000000000000000000000000000\n0200000000000000000000000000000000000000\n"), http.StatusOK, &got)
+
+	want := []api.BatchPasswordResponse{
+		{Hash: "0100000000000000000000000000000000000000", Compromised: true, Count: 1},
+		{Hash: "0200000000000000000000000000000000000000", Compromised: true, Count: 2},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got response %+v, want %+v", got, want)
+	}
+}
+
+func TestPasswordsBatch_sources(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: newCompositeService(t),
+	})
+
+	var got []api.BatchPasswordResponse
+	testResponseUnmarshal(t, c, http.MethodPost, "/v1/passwords", strings.NewReader("0200000000000000000000000000000000000000\n0300000000000000000000000000000000000000\n0400000000000000000000000000000000000000\n"), http.StatusOK, &got)
+
+	want := []api.BatchPasswordResponse{
+		{Hash: "0200000000000000000000000000000000000000", Compromised: true, Count: 10, Sources: []string{"pwned", "blocklist"}},
+		{Hash: "0300000000000000000000000000000000000000", Compromised: true, Count: 1, Sources: []string{"blocklist"}},
+		{Hash: "0400000000000000000000000000000000000000"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got response %+v, want %+v", got, want)
+	}
+}
+
+func TestPasswordsBatch_limit(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService:    mockpasswords.New(nil),
+		PasswordsBatchLimit: 2,
+	})
+
+	testResponseDirect(t, c, http.MethodPost, "/v1/passwords", strings.NewReader(strings.Repeat("0100000000000000000000000000000000000000\n", 3)), http.StatusRequestEntityTooLarge, jsonhttp.StatusResponse{
+		Code:    http.StatusRequestEntityTooLarge,
+		Message: "too many hashes, limit is 2",
+	})
+}
+
+func TestPasswordsBatch_invalidHash(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(nil),
+	})
+
+	for _, hash := range []string{"1234", "g1234567890abcdef1234567890abcdef1234567"} {
+		testResponseDirect(t, c, http.MethodPost, "/v1/passwords", strings.NewReader(hash), http.StatusBadRequest, jsonhttp.StatusResponse{
+			Code:    http.StatusBadRequest,
+			Message: `invalid hash "` + hash + `"`,
+		})
+	}
+}
+
+func TestPasswordsBatch_error(t *testing.T) {
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(nil, mockpasswords.WithArePasswordsCompromisedFunc(func(_ context.Context, s [][20]byte) ([]uint64, error) {
+			return nil, errors.New("test error")
+		})),
+	})
+
+	testResponseDirect(t, c, http.MethodPost, "/v1/passwords", strings.NewReader("0100000000000000000000000000000000000000"), http.StatusInternalServerError, jsonhttp.StatusResponse{
+		Code:    http.StatusInternalServerError,
+		Message: http.StatusText(http.StatusInternalServerError),
+	})
+}
+
+func TestAllowlist(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "allowlist.txt")
+	if err := os.WriteFile(filename, []byte(strings.Join([]string{
+		"0100000000000000000000000000000000000000:5 legacy truncation",
+		"0200000000000000000000000000000000000000 service account secret",
+		"7c222fe1a9e3a6f6a3a2b1e0e6b0c4b4f1c1d2e3 service account secret",
+	}, "\n")), 0666); err != nil {
+		t.Fatal(err)
+	}
+	list, err := allowlist.New(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestServer(t, testServerOptions{
+		PasswordsService: newCompositeService(t),
+		Allowlist:        list,
+	})
+
+	for _, tc := range []struct {
+		hash string
+		want api.PasswordResponse
+	}{
+		{
+			hash: "0100000000000000000000000000000000000000",
+			want: api.PasswordResponse{Compromised: true, Count: 5, Sources: []string{"pwned"}},
+		},
+		{
+			hash: "0200000000000000000000000000000000000000",
+			want: api.PasswordResponse{},
+		},
+		{
+			hash: "0300000000000000000000000000000000000000",
+			want: api.PasswordResponse{Compromised: true, Count: 1, Sources: []string{"blocklist"}},
+		},
+	} {
+		var r api.PasswordResponse
+		testResponseUnmarshal(t, c, http.MethodGet, "/v1/passwords/"+tc.hash, nil, http.StatusOK, &r)
+
+		if !reflect.DeepEqual(r, tc.want) {
+			t.Errorf("%s: got response %+v, want %+v", tc.hash, r, tc.want)
+		}
+	}
+
+	var verdict policy.Verdict
+	testResponseUnmarshal(t, c, http.MethodGet, "/v1/passwords/0200000000000000000000000000000000000000/verdict", nil, http.StatusOK, &verdict)
+	if verdict.Outcome != policy.OutcomeAllow {
+		t.Errorf("got verdict outcome %s, want %s", verdict.Outcome, policy.OutcomeAllow)
+	}
+
+	var batch []api.BatchPasswordResponse
+	testResponseUnmarshal(t, c, http.MethodPost, "/v1/passwords", strings.NewReader("0100000000000000000000000000000000000000\n0200000000000000000000000000000000000000\n"), http.StatusOK, &batch)
+	wantBatch := []api.BatchPasswordResponse{
+		{Hash: "0100000000000000000000000000000000000000", Compromised: true, Count: 5, Sources: []string{"pwned"}},
+		{Hash: "0200000000000000000000000000000000000000"},
+	}
+	if !reflect.DeepEqual(batch, wantBatch) {
+		t.Errorf("got response %+v, want %+v", batch, wantBatch)
+	}
+
+	c = newTestServer(t, testServerOptions{
+		PasswordsService: mockpasswords.New(nil, mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+			return []passwords.Password{
+				{SHA1Sum: hexDecodeSHA1Sum(t, "7c222fb2927d828af22f592134e8932480637c0d"), Count: 2996082},
+				{SHA1Sum: hexDecodeSHA1Sum(t, "7c222fe1a9e3a6f6a3a2b1e0e6b0c4b4f1c1d2e3"), Count: 1},
+			}, nil
+		})),
+		Allowlist: list,
+	})
+
+	resp, err := request(c, http.MethodGet, "/v1/range/7c222", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(b), "FB2927D828AF22F592134E8932480637C0D:2996082"; got != want {
+		t.Errorf("got response %q, want %q", got, want)
+	}
+}
@@ -6,3 +6,5 @@
 package api
 
 type PasswordResponse = passwordResponse
+
+type BatchPasswordResponse = batchPasswordResponse
@@ -16,6 +16,7 @@ type metrics struct {
 	PageviewCount    prometheus.Counter
 	ResponseDuration prometheus.Histogram
 	ResponseCount    *prometheus.CounterVec
+	OverrideCount    prometheus.Counter
 }
 
 func newMetrics() metrics {
@@ -41,6 +42,12 @@ func newMetrics() metrics {
 			Name:      "response_code_count",
 			Help:      "Number of responses by status codes from frontend router.",
 		}, []string{"code"}),
+		OverrideCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: m.Namespace,
+			Subsystem: subsystem,
+			Name:      "allowlist_override_count",
+			Help:      "Number of compromised counts changed by the allowlist.",
+		}),
 	}
 }
 func (s *server) Metrics() (cs []prometheus.Collector) {
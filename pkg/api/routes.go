@@ -45,10 +45,26 @@ func newV1Router(s *server) http.Handler {
 	r.UseEncodedPath()
 	r.NotFoundHandler = http.HandlerFunc(jsonNotFoundHandler)
 
+	r.Handle("/v1/passwords", jsonMethodHandler{
+		"POST": http.HandlerFunc(s.passwordsBatchHandler),
+	})
+
 	r.Handle("/v1/passwords/{hash}", jsonMethodHandler{
 		"GET": http.HandlerFunc(s.passwordHandler),
 	})
 
+	r.Handle("/v1/passwords/{hash}/verdict", jsonMethodHandler{
+		"GET": http.HandlerFunc(s.passwordVerdictHandler),
+	})
+
+	r.Handle("/v1/ntlm/{hash}", jsonMethodHandler{
+		"GET": http.HandlerFunc(s.ntlmPasswordHandler),
+	})
+
+	r.Handle("/v1/range/{prefix}", jsonMethodHandler{
+		"GET": http.HandlerFunc(s.rangeHandler),
+	})
+
 	return web.ChainHandlers(
 		jsonMaxBodyBytesHandler,
 		web.NoCacheHeadersHandler,
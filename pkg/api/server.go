@@ -10,7 +10,9 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/exp/slog"
+	"resenje.org/compromised/pkg/allowlist"
 	"resenje.org/compromised/pkg/passwords"
+	"resenje.org/compromised/pkg/policy"
 	"resenje.org/recovery"
 )
 
@@ -38,14 +40,41 @@ type Options struct {
 
 	RecoveryService *recovery.Service
 
-	PasswordsService passwords.Service
+	// PasswordsService and NTLMPasswordsService are used for requests
+	// without the db query parameter.
+	PasswordsService     passwords.Service
+	NTLMPasswordsService passwords.NTLMService
+	// NamedPasswordsServices and NamedNTLMPasswordsServices are selected by
+	// their names with the db query parameter.
+	NamedPasswordsServices     map[string]passwords.Service
+	NamedNTLMPasswordsServices map[string]passwords.NTLMService
+	PasswordsBatchLimit        int
+	// Policy provides verdicts of the passwords verdict endpoint. The
+	// default policy is used if it is not set.
+	Policy *policy.Policy
+	// Allowlist overrides compromised counts of SHA1 sums from all passwords
+	// services. Every override is logged with its reason.
+	Allowlist *allowlist.List
 }
 
+// defaultPasswordsBatchLimit is the maximal number of hashes that can be
+// checked with a single request if Options.PasswordsBatchLimit is not set.
+const defaultPasswordsBatchLimit = 10000
+
 // New initializes a new Handler with provided options.
 func New(o Options) (h Handler, err error) {
 	if o.Version == "" {
 		o.Version = "0"
 	}
+	if o.PasswordsBatchLimit <= 0 {
+		o.PasswordsBatchLimit = defaultPasswordsBatchLimit
+	}
+	if o.Policy == nil {
+		o.Policy, err = policy.New(nil)
+		if err != nil {
+			return nil, err
+		}
+	}
 	s := &server{
 		Options: o,
 		metrics: newMetrics(),
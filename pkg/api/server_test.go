@@ -16,14 +16,22 @@ import (
 
 	"golang.org/x/exp/slog"
 	"resenje.org/compromised"
+	"resenje.org/compromised/pkg/allowlist"
 	"resenje.org/compromised/pkg/api"
 	"resenje.org/compromised/pkg/passwords"
+	"resenje.org/compromised/pkg/policy"
 	"resenje.org/recovery"
 	"resenje.org/web"
 )
 
 type testServerOptions struct {
-	PasswordsService passwords.Service
+	PasswordsService           passwords.Service
+	NTLMPasswordsService       passwords.NTLMService
+	NamedPasswordsServices     map[string]passwords.Service
+	NamedNTLMPasswordsServices map[string]passwords.NTLMService
+	PasswordsBatchLimit        int
+	Policy                     *policy.Policy
+	Allowlist                  *allowlist.List
 }
 
 func newTestServer(t *testing.T, o testServerOptions) *http.Client {
@@ -37,7 +45,13 @@ func newTestServer(t *testing.T, o testServerOptions) *http.Client {
 		RecoveryService: &recovery.Service{
 			Version: compromised.Version(),
 		},
-		PasswordsService: o.PasswordsService,
+		PasswordsService:           o.PasswordsService,
+		NTLMPasswordsService:       o.NTLMPasswordsService,
+		NamedPasswordsServices:     o.NamedPasswordsServices,
+		NamedNTLMPasswordsServices: o.NamedNTLMPasswordsServices,
+		PasswordsBatchLimit:        o.PasswordsBatchLimit,
+		Policy:                     o.Policy,
+		Allowlist:                  o.Allowlist,
 	})
 	if err != nil {
 		t.Fatal(err)
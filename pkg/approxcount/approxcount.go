@@ -44,3 +44,39 @@ func (e *Encoder) Encode(value uint64) uint8 {
 func (e *Encoder) Decode(encoded uint8) uint64 {
 	return uint64(math.Round(math.Exp(float64(encoded) / e.c)))
 }
+
+// Encoder16 encodes and decodes integer values to and from 16 bits in the same
+// way as Encoder, but with a much higher precision. Values up to a few
+// thousands are encoded exactly for the maximal value of around tens of
+// millions.
+//
+// Minimal value that can be encoded is 1.
+type Encoder16 struct {
+	max uint64
+	c   float64
+}
+
+// NewEncoder16 creates a new Encoder16 with up to max value able to encode.
+func NewEncoder16(max uint64) (*Encoder16, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("invalid max value %v", max)
+	}
+	return &Encoder16{
+		max: max,
+		c:   65535 / math.Log(float64(max)),
+	}, nil
+}
+
+// Encode returns an approximation of integer in 16 bits format.
+func (e *Encoder16) Encode(value uint64) uint16 {
+	if value > e.max || value < 1 {
+		panic("overflow")
+	}
+
+	return uint16(math.Round(math.Log(float64(value)) * e.c))
+}
+
+// Decode returns an approximated integer from 16 bits.
+func (e *Encoder16) Decode(encoded uint16) uint64 {
+	return uint64(math.Round(math.Exp(float64(encoded) / e.c)))
+}
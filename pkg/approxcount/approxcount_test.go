@@ -102,3 +102,86 @@ func TestEncoderPanic(t *testing.T) {
 	}
 	e.Encode(101)
 }
+
+func TestEncoder16(t *testing.T) {
+	for _, tc := range []struct {
+		max    uint64
+		values []uint64
+		want   []uint64
+	}{
+		{
+			max:    1,
+			values: []uint64{1},
+			want:   []uint64{1},
+		},
+		{
+			max:    256,
+			values: []uint64{1, 2, 3, 255, 256},
+			want:   []uint64{1, 2, 3, 255, 256},
+		},
+		{
+			max:    65536,
+			values: []uint64{1, 1000, 5000, 10000, 65535, 65536},
+			want:   []uint64{1, 1000, 5000, 10001, 65536, 65536},
+		},
+		{
+			max:    23597311,
+			values: []uint64{1, 1000, 3923, 10000, 100000, 1000000, 23597310, 23597311},
+			want:   []uint64{1, 1000, 3923, 10001, 99990, 999983, 23597311, 23597311},
+		},
+		{
+			max:    math.MaxUint32,
+			values: []uint64{1, 1000, 3003, 10000, 1000000, math.MaxUint32 - 1, math.MaxUint32},
+			want:   []uint64{1, 1000, 3003, 10001, 999922, math.MaxUint32, math.MaxUint32},
+		},
+	} {
+		t.Run(strconv.FormatUint(tc.max, 10), func(t *testing.T) {
+			e, err := approxcount.NewEncoder16(tc.max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, value := range tc.values {
+				t.Run(strconv.FormatUint(value, 10), func(t *testing.T) {
+					want := tc.want[i]
+					encoded := e.Encode(value)
+					got := e.Decode(encoded)
+					if got != want {
+						t.Errorf("got %v, want %v for %v (encoded %v)", got, want, value, encoded)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestEncoder16Precision(t *testing.T) {
+	e, err := approxcount.NewEncoder16(math.MaxUint32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for value := uint64(1); value < math.MaxUint32; value = value*11/10 + 1 {
+		got := e.Decode(e.Encode(value))
+		if d := math.Abs(float64(got)-float64(value)) / float64(value); d > 0.0002 {
+			t.Errorf("got %v for %v, relative error %v", got, value, d)
+		}
+	}
+}
+
+func TestEncoder16Panic(t *testing.T) {
+	defer func() {
+		err := recover()
+		if err == nil {
+			t.Fatal("got no panic")
+		}
+		want := "overflow"
+		if err != want {
+			t.Fatalf("got panic error message %q, want %q", err, want)
+		}
+	}()
+
+	e, err := approxcount.NewEncoder16(100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Encode(101)
+}
@@ -0,0 +1,191 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// bloomMagic identifies the binary encoding of the Bloom filter.
+const bloomMagic = "BLOOM\x00\x00\x01"
+
+// maxBloomHashFunctions limits the number of bit positions per key for very
+// low false positive rates.
+const maxBloomHashFunctions = 32
+
+// Bloom is a Bloom filter of byte keys. It answers that a key is definitely
+// not in the set or that it may be in the set with a false positive rate that
+// is chosen when the filter is created. It is safe to call Contains
+// concurrently, but not concurrently with Add.
+type Bloom struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint32 // number of bit positions per key
+}
+
+// NewBloom creates an empty Bloom filter sized for n keys with the target
+// false positive rate, which must be between 0 and 1.
+func NewBloom(n uint64, falsePositiveRate float64) (*Bloom, error) {
+	if !(falsePositiveRate > 0 && falsePositiveRate < 1) {
+		return nil, fmt.Errorf("invalid false positive rate %v", falsePositiveRate)
+	}
+	if n == 0 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	if m > math.MaxInt64 {
+		return nil, errors.New("bloom filter too large")
+	}
+	words := (uint64(m) + 63) / 64
+	k := uint32(math.Round(float64(words*64) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	if k > maxBloomHashFunctions {
+		k = maxBloomHashFunctions
+	}
+	return &Bloom{
+		bits: make([]uint64, words),
+		m:    words * 64,
+		k:    k,
+	}, nil
+}
+
+// Add adds the key to the filter.
+func (b *Bloom) Add(key []byte) {
+	h1, h2 := bloomHashes(key)
+	for i := uint32(0); i < b.k; i++ {
+		p, _ := bits.Mul64(h1, b.m)
+		b.bits[p/64] |= 1 << (p % 64)
+		h1 += h2
+	}
+}
+
+// Contains returns false if the key is definitely not in the filter and true
+// if it may be in the filter.
+func (b *Bloom) Contains(key []byte) bool {
+	h1, h2 := bloomHashes(key)
+	for i := uint32(0); i < b.k; i++ {
+		p, _ := bits.Mul64(h1, b.m)
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+		h1 += h2
+	}
+	return true
+}
+
+// Size returns the number of bytes of the filter bit array.
+func (b *Bloom) Size() int64 {
+	return int64(len(b.bits)) * 8
+}
+
+// HashFunctions returns the number of bit positions set for every key.
+func (b *Bloom) HashFunctions() int {
+	return int(b.k)
+}
+
+// WriteTo writes the binary encoding of the filter to the writer.
+func (b *Bloom) WriteTo(w io.Writer) (n int64, err error) {
+	bw := bufio.NewWriterSize(w, 64*1024)
+
+	header := make([]byte, len(bloomMagic)+4+8)
+	copy(header, bloomMagic)
+	binary.BigEndian.PutUint32(header[len(bloomMagic):], b.k)
+	binary.BigEndian.PutUint64(header[len(bloomMagic)+4:], uint64(len(b.bits)))
+	if _, err := bw.Write(header); err != nil {
+		return 0, err
+	}
+	n = int64(len(header))
+
+	var buf [8]byte
+	for _, word := range b.bits {
+		binary.BigEndian.PutUint64(buf[:], word)
+		if _, err := bw.Write(buf[:]); err != nil {
+			return n, err
+		}
+		n += 8
+	}
+	return n, bw.Flush()
+}
+
+// ReadBloom reads the Bloom filter encoded with the WriteTo method.
+func ReadBloom(r io.Reader) (*Bloom, error) {
+	br := bufio.NewReaderSize(r, 64*1024)
+
+	header := make([]byte, len(bloomMagic)+4+8)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("read bloom filter header: %w", err)
+	}
+	if string(header[:len(bloomMagic)]) != bloomMagic {
+		return nil, errors.New("invalid bloom filter header")
+	}
+	k := binary.BigEndian.Uint32(header[len(bloomMagic):])
+	if k < 1 || k > maxBloomHashFunctions {
+		return nil, fmt.Errorf("invalid bloom filter hash functions count %v", k)
+	}
+	words := binary.BigEndian.Uint64(header[len(bloomMagic)+4:])
+	if words < 1 || words > math.MaxInt64/64 {
+		return nil, fmt.Errorf("invalid bloom filter size %v", words)
+	}
+
+	// the bit array grows while it is read, so that a corrupted size does
+	// not allocate more memory than the encoded data requires
+	const chunkSize = 64 * 1024
+	bits := make([]uint64, 0, minUint64(words, chunkSize))
+	buf := make([]byte, 8*chunkSize)
+	for remaining := words; remaining > 0; {
+		n := minUint64(remaining, chunkSize)
+		if _, err := io.ReadFull(br, buf[:n*8]); err != nil {
+			return nil, fmt.Errorf("read bloom filter: %w", err)
+		}
+		for i := uint64(0); i < n; i++ {
+			bits = append(bits, binary.BigEndian.Uint64(buf[i*8:]))
+		}
+		remaining -= n
+	}
+
+	return &Bloom{
+		bits: bits,
+		m:    words * 64,
+		k:    k,
+	}, nil
+}
+
+// bloomHashes returns two hashes of the key for double hashing of bit
+// positions, with an odd second hash.
+func bloomHashes(key []byte) (h1, h2 uint64) {
+	// FNV-1a
+	h := uint64(14695981039346656037)
+	for _, c := range key {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	h1 = mix64(h)
+	h2 = mix64(h1) | 1
+	return h1, h2
+}
+
+// mix64 is the splitmix64 finalizer that distributes bits of the value.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func minUint64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
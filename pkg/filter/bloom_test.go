@@ -0,0 +1,134 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"resenje.org/compromised/pkg/filter"
+)
+
+func TestBloom(t *testing.T) {
+	const n = 100000
+
+	for _, falsePositiveRate := range []float64{0.1, 0.01, 0.001} {
+		t.Run(fmt.Sprint(falsePositiveRate), func(t *testing.T) {
+			b, err := filter.NewBloom(n, falsePositiveRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for i := 0; i < n; i++ {
+				b.Add(key(i))
+			}
+			for i := 0; i < n; i++ {
+				if !b.Contains(key(i)) {
+					t.Fatalf("key %v not found", i)
+				}
+			}
+
+			var falsePositives int
+			for i := n; i < 2*n; i++ {
+				if b.Contains(key(i)) {
+					falsePositives++
+				}
+			}
+			if got := float64(falsePositives) / n; got > falsePositiveRate*1.2 {
+				t.Errorf("got false positive rate %v, want %v", got, falsePositiveRate)
+			}
+
+			var buf bytes.Buffer
+			size, err := b.WriteTo(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != int64(buf.Len()) {
+				t.Errorf("got written size %v, want %v", size, buf.Len())
+			}
+			if want := b.Size() + 20; size != want {
+				t.Errorf("got encoded size %v, want %v", size, want)
+			}
+
+			r, err := filter.ReadBloom(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.HashFunctions() != b.HashFunctions() {
+				t.Errorf("got hash functions %v, want %v", r.HashFunctions(), b.HashFunctions())
+			}
+			for i := 0; i < 2*n; i++ {
+				if r.Contains(key(i)) != b.Contains(key(i)) {
+					t.Fatalf("key %v differs in the decoded filter", i)
+				}
+			}
+		})
+	}
+}
+
+func TestNewBloom_invalidFalsePositiveRate(t *testing.T) {
+	for _, rate := range []float64{0, 1, -0.1, 1.5} {
+		if _, err := filter.NewBloom(10, rate); err == nil {
+			t.Errorf("no error for false positive rate %v", rate)
+		}
+	}
+}
+
+func TestReadBloom_invalid(t *testing.T) {
+	b, err := filter.NewBloom(1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := b.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			wantErr: "read bloom filter header: EOF",
+		},
+		{
+			name:    "magic",
+			data:    append([]byte("NOTBLOOM"), data[8:]...),
+			wantErr: "invalid bloom filter header",
+		},
+		{
+			name:    "truncated",
+			data:    data[:len(data)-1],
+			wantErr: "read bloom filter: unexpected EOF",
+		},
+		{
+			name:    "size",
+			data:    append(append([]byte(nil), data[:12]...), 0, 0, 0, 1, 0, 0, 0, 0),
+			wantErr: "read bloom filter: EOF",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := filter.ReadBloom(bytes.NewReader(tc.data))
+			if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func key(i int) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	sum := sha1.Sum(b[:])
+	return sum[:]
+}
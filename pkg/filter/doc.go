@@ -0,0 +1,8 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package filter provides probabilistic set membership filters that answer
+// if a key is definitely not in the set without reading the complete set.
+package filter
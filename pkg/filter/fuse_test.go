@@ -0,0 +1,160 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package filter_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+
+	"resenje.org/compromised/pkg/filter"
+)
+
+func TestBinaryFuse(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 10, 1000, 100000} {
+		t.Run(fmt.Sprintf("8-bit %v keys", size), func(t *testing.T) {
+			testBinaryFuse[uint8](t, size, 1.0/256)
+		})
+		t.Run(fmt.Sprintf("16-bit %v keys", size), func(t *testing.T) {
+			testBinaryFuse[uint16](t, size, 1.0/65536)
+		})
+	}
+}
+
+func testBinaryFuse[T filter.Fingerprint](t *testing.T, size int, falsePositiveRate float64) {
+	keys := make([]uint64, size)
+	for i := range keys {
+		keys[i] = binary.BigEndian.Uint64(key(i))
+	}
+
+	f, err := filter.NewBinaryFuse[T](keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		if !f.Contains(k) {
+			t.Fatalf("key %v not found", i)
+		}
+	}
+
+	const lookups = 1000000
+	var falsePositives int
+	for i := size; i < size+lookups; i++ {
+		if f.Contains(binary.BigEndian.Uint64(key(i))) {
+			falsePositives++
+		}
+	}
+	if size == 0 && falsePositives > 0 {
+		t.Errorf("got %v false positives in empty filter", falsePositives)
+	}
+	// small filters have the same false positive rate, but with a higher
+	// variance for the low number of fingerprints
+	if got := float64(falsePositives) / lookups; size >= 1000 && got > falsePositiveRate*1.5 {
+		t.Errorf("got false positive rate %v, want %v", got, falsePositiveRate)
+	}
+	if size >= 100000 {
+		fingerprintSize := 1
+		if falsePositiveRate < 1.0/256 {
+			fingerprintSize = 2
+		}
+		if got, max := f.Size(), int64(float64(size)*1.2)*int64(fingerprintSize); got > max {
+			t.Errorf("got size %v for %v keys, want at most %v", got, size, max)
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := f.WriteTo(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != int64(buf.Len()) {
+		t.Errorf("got written size %v, want %v", n, buf.Len())
+	}
+	// another filter after the first one is not read
+	buf.WriteString("next")
+
+	r, err := filter.ReadBinaryFuse[T](&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "next" {
+		t.Errorf("got remaining data %q", buf.String())
+	}
+	for i := 0; i < size+1000; i++ {
+		k := binary.BigEndian.Uint64(key(i))
+		if r.Contains(k) != f.Contains(k) {
+			t.Fatalf("key %v differs in the decoded filter", i)
+		}
+	}
+}
+
+func TestBinaryFuse_duplicateKeys(t *testing.T) {
+	keys := make([]uint64, 0, 2000)
+	for i := 0; i < 1000; i++ {
+		k := binary.BigEndian.Uint64(key(i))
+		keys = append(keys, k, k)
+	}
+	f, err := filter.NewBinaryFuse[uint8](keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, k := range keys {
+		if !f.Contains(k) {
+			t.Fatalf("key %v not found", i)
+		}
+	}
+}
+
+func TestReadBinaryFuse_invalid(t *testing.T) {
+	f, err := filter.NewBinaryFuse[uint8]([]uint64{1, 2, 3, 4, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := f.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			wantErr: "read binary fuse filter header: EOF",
+		},
+		{
+			name:    "magic",
+			data:    append([]byte("NOTAFUSE"), data[8:]...),
+			wantErr: "invalid binary fuse filter header",
+		},
+		{
+			name:    "truncated",
+			data:    data[:len(data)-1],
+			wantErr: "read binary fuse filter: unexpected EOF",
+		},
+		{
+			name:    "size",
+			data:    append(append([]byte(nil), data[:25]...), 0, 0, 0, 0, 0, 0, 0, 1),
+			wantErr: "invalid binary fuse filter size 1",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := filter.ReadBinaryFuse[uint8](bytes.NewReader(tc.data))
+			if err == nil || !strings.HasPrefix(err.Error(), tc.wantErr) {
+				t.Errorf("got error %v, want %q", err, tc.wantErr)
+			}
+		})
+	}
+
+	if _, err := filter.ReadBinaryFuse[uint16](bytes.NewReader(data)); err == nil || err.Error() != "binary fuse filter has 8-bit fingerprints instead 16-bit" {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,345 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package blocklist provides a passwords service with a custom list of
+// passwords that are not in the pwned passwords data, such as names of the
+// organization and its products or leaked internal passwords. The list is
+// kept in memory and it is read again when its file changes. Large lists can
+// be indexed as passwords databases, which are reloaded in the same way.
+package blocklist
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"resenje.org/compromised/pkg/passwords"
+)
+
+var (
+	_ passwords.Service      = (*Service)(nil)
+	_ passwords.BatchService = (*Service)(nil)
+	_ passwords.RangeService = (*Service)(nil)
+)
+
+// ErrClosed is returned when a closed Service is used.
+var ErrClosed = errors.New("blocklist closed")
+
+// Format enumerates formats of blocklist files.
+type Format string
+
+var (
+	// FormatText is a file with one password in plain text per line. Lines
+	// are not trimmed, as spaces can be a part of a password, and empty lines
+	// are ignored.
+	FormatText Format = "text"
+	// FormatSHA1 is a file with one hex encoded SHA1 sum of a password per
+	// line, optionally followed by a colon and the count, as in pwned
+	// passwords files. Empty lines and lines starting with # are ignored.
+	FormatSHA1 Format = "sha1"
+)
+
+// Options holds optional parameters for the Service.
+type Options struct {
+	// Format is the format of the blocklist file. The default is FormatText.
+	Format Format
+	// Count is the compromised count of passwords without the count in the
+	// file. The default is 1.
+	Count uint64
+	// ReloadInterval is the interval of checking if the file is changed by
+	// its modification time and size. The default is 10 seconds and a
+	// negative value disables checking.
+	ReloadInterval time.Duration
+	// LogFunc can be specified as a custom receiver of log messages about
+	// reloads.
+	LogFunc func(string, ...interface{})
+}
+
+const defaultReloadInterval = 10 * time.Second
+
+// Service implements passwords service with the list of passwords from a
+// file.
+type Service struct {
+	filename string
+	format   Format
+	count    uint64
+	logFunc  func(string, ...interface{})
+
+	mu   sync.RWMutex // protects list
+	list *list
+
+	watcher   *watcher
+	closeOnce sync.Once
+}
+
+// list holds entries of the blocklist file, ordered by sums, and the file
+// information that is used to detect changes.
+type list struct {
+	entries []passwords.Password
+	info    fileInfo
+}
+
+// New creates a new instance of Service by reading the blocklist file.
+func New(filename string, o *Options) (*Service, error) {
+	if o == nil {
+		o = new(Options)
+	}
+	format := o.Format
+	if format == "" {
+		format = FormatText
+	}
+	if format != FormatText && format != FormatSHA1 {
+		return nil, fmt.Errorf("unsupported format %s", format)
+	}
+	count := o.Count
+	if count == 0 {
+		count = 1
+	}
+	interval := o.ReloadInterval
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+	logFunc := o.LogFunc
+	if logFunc == nil {
+		logFunc = func(format string, a ...interface{}) {
+			fmt.Printf(format+"\n", a...)
+		}
+	}
+
+	l, err := readList(filename, format, count)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Service{
+		filename: filename,
+		format:   format,
+		count:    count,
+		logFunc:  logFunc,
+		list:     l,
+	}
+	s.watcher = newWatcher(filename, l.info, interval, s.load, func() {
+		logFunc("blocklist %s reloaded with %v passwords", filename, s.Len())
+	}, logFunc)
+	return s, nil
+}
+
+// Len returns the number of passwords in the blocklist.
+func (s *Service) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.list == nil {
+		return 0
+	}
+	return len(s.list.entries)
+}
+
+// IsPasswordCompromised returns the count of the password if it is in the
+// blocklist.
+func (s *Service) IsPasswordCompromised(_ context.Context, sum [20]byte) (count uint64, err error) {
+	l, err := s.current()
+	if err != nil {
+		return 0, err
+	}
+	return l.find(sum), nil
+}
+
+// ArePasswordsCompromised returns counts of passwords that are in the
+// blocklist in the same order as provided sums.
+func (s *Service) ArePasswordsCompromised(_ context.Context, sums [][20]byte) (counts []uint64, err error) {
+	l, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	counts = make([]uint64, len(sums))
+	for i, sum := range sums {
+		counts[i] = l.find(sum)
+	}
+	return counts, nil
+}
+
+// PasswordsByPrefix returns all passwords from the blocklist which SHA1 sums
+// start with the 20 bit prefix.
+func (s *Service) PasswordsByPrefix(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+	if prefix >= 1<<20 {
+		return nil, fmt.Errorf("prefix %x out of range", prefix)
+	}
+	l, err := s.current()
+	if err != nil {
+		return nil, err
+	}
+	start := sort.Search(len(l.entries), func(i int) bool {
+		return sumPrefix(l.entries[i].SHA1Sum) >= prefix
+	})
+	var result []passwords.Password
+	for i := start; i < len(l.entries) && sumPrefix(l.entries[i].SHA1Sum) == prefix; i++ {
+		result = append(result, l.entries[i])
+	}
+	return result, nil
+}
+
+// sumPrefix returns the first 20 bits of the sum.
+func sumPrefix(sum [20]byte) uint32 {
+	return uint32(sum[0])<<12 | uint32(sum[1])<<4 | uint32(sum[2])>>4
+}
+
+func (s *Service) current() (*list, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.list == nil {
+		return nil, ErrClosed
+	}
+	return s.list, nil
+}
+
+// find returns the count of the sum or 0 if it is not in the list.
+func (l *list) find(sum [20]byte) uint64 {
+	i := sort.Search(len(l.entries), func(i int) bool {
+		return bytes.Compare(l.entries[i].SHA1Sum[:], sum[:]) >= 0
+	})
+	if i < len(l.entries) && l.entries[i].SHA1Sum == sum {
+		return l.entries[i].Count
+	}
+	return 0
+}
+
+// Reload reads the blocklist file again and replaces the current list with
+// it.
+func (s *Service) Reload() error {
+	_, err := s.watcher.reload(true)
+	return err
+}
+
+// load reads the blocklist file and replaces the current list with it.
+func (s *Service) load() (fileInfo, error) {
+	if _, err := s.current(); err != nil {
+		return fileInfo{}, err
+	}
+
+	l, err := readList(s.filename, s.format, s.count)
+	if err != nil {
+		return fileInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.list == nil {
+		return fileInfo{}, ErrClosed
+	}
+	s.list = l
+	return l.info, nil
+}
+
+// Close stops checking the blocklist file for changes and releases the list.
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() {
+		s.watcher.close()
+
+		s.mu.Lock()
+		s.list = nil
+		s.mu.Unlock()
+	})
+	return nil
+}
+
+// readList reads all entries from the blocklist file.
+func readList(filename string, format Format, count uint64) (*list, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []passwords.Password
+	scanner := bufio.NewScanner(f)
+	var n int
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		switch format {
+		case FormatText:
+			if line == "" {
+				continue
+			}
+			entries = append(entries, passwords.Password{
+				SHA1Sum: sha1.Sum([]byte(line)),
+				Count:   count,
+			})
+		case FormatSHA1:
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			p, err := parseSHA1Line(line, count)
+			if err != nil {
+				return nil, fmt.Errorf("line %v: %w", n, err)
+			}
+			entries = append(entries, p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].SHA1Sum[:], entries[j].SHA1Sum[:]) < 0
+	})
+	// keep the highest count of duplicates
+	unique := entries[:0]
+	for _, e := range entries {
+		if last := len(unique) - 1; last >= 0 && unique[last].SHA1Sum == e.SHA1Sum {
+			if e.Count > unique[last].Count {
+				unique[last].Count = e.Count
+			}
+			continue
+		}
+		unique = append(unique, e)
+	}
+
+	return &list{
+		entries: unique,
+		info: fileInfo{
+			modTime: stat.ModTime(),
+			size:    stat.Size(),
+		},
+	}, nil
+}
+
+// parseSHA1Line parses the hex encoded SHA1 sum and the optional count.
+func parseSHA1Line(line string, count uint64) (p passwords.Password, err error) {
+	hash, c, ok := strings.Cut(line, ":")
+	if ok {
+		count, err = strconv.ParseUint(c, 10, 64)
+		if err != nil || count == 0 {
+			return p, fmt.Errorf("invalid count %q", c)
+		}
+	}
+	if len(hash) != 2*sha1.Size {
+		return p, fmt.Errorf("invalid hash %q", hash)
+	}
+	if _, err := hex.Decode(p.SHA1Sum[:], []byte(hash)); err != nil {
+		return p, fmt.Errorf("invalid hash %q", hash)
+	}
+	p.Count = count
+	return p, nil
+}
@@ -0,0 +1,275 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blocklist_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"resenje.org/compromised/pkg/passwords"
+	"resenje.org/compromised/pkg/passwords/blocklist"
+)
+
+func TestService_text(t *testing.T) {
+	filename := writeFile(t, "acme\r\nAcme2023\n\nacme\n correct horse \n")
+
+	s, err := blocklist.New(filename, &blocklist.Options{
+		ReloadInterval: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if l := s.Len(); l != 3 {
+		t.Errorf("got %v passwords, want 3", l)
+	}
+
+	ctx := context.Background()
+	for password, want := range map[string]uint64{
+		"acme":            1,
+		"Acme2023":        1,
+		" correct horse ": 1,
+		"correct horse":   0,
+		"ACME":            0,
+		"":                0,
+	} {
+		count, err := s.IsPasswordCompromised(ctx, sha1.Sum([]byte(password)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Errorf("password %q: got count %v, want %v", password, count, want)
+		}
+	}
+
+	counts, err := s.ArePasswordsCompromised(ctx, [][20]byte{
+		sha1.Sum([]byte("ACME")),
+		sha1.Sum([]byte("Acme2023")),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0, 1}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got counts %v, want %v", counts, want)
+	}
+}
+
+func TestService_sha1(t *testing.T) {
+	filename := writeFile(t, strings.Join([]string{
+		"# leaked internal passwords",
+		"7C222FB2927D828AF22F592134E8932480637C0D:5",
+		"",
+		"7c222fb2927d828af22f592134e8932480637c0d:12",
+		"  d391477a0849048fc28e62850a25518d72afd013  ",
+		"7c222fb2927d828af22f592134e8932480637c0e",
+	}, "\n"))
+
+	s, err := blocklist.New(filename, &blocklist.Options{
+		Format:         blocklist.FormatSHA1,
+		Count:          1000,
+		ReloadInterval: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if l := s.Len(); l != 3 {
+		t.Errorf("got %v passwords, want 3", l)
+	}
+
+	ctx := context.Background()
+	for hash, want := range map[string]uint64{
+		"7c222fb2927d828af22f592134e8932480637c0d": 12,
+		"7c222fb2927d828af22f592134e8932480637c0e": 1000,
+		"d391477a0849048fc28e62850a25518d72afd013": 1000,
+		"0000000000000000000000000000000000000000": 0,
+	} {
+		count, err := s.IsPasswordCompromised(ctx, hexDecodeSHA1Sum(t, hash))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != want {
+			t.Errorf("hash %s: got count %v, want %v", hash, count, want)
+		}
+	}
+
+	got, err := s.PasswordsByPrefix(ctx, 0x7c222)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []passwords.Password{
+		{SHA1Sum: hexDecodeSHA1Sum(t, "7c222fb2927d828af22f592134e8932480637c0d"), Count: 12},
+		{SHA1Sum: hexDecodeSHA1Sum(t, "7c222fb2927d828af22f592134e8932480637c0e"), Count: 1000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got passwords %v, want %v", got, want)
+	}
+
+	got, err = s.PasswordsByPrefix(ctx, 0x7c223)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Errorf("got passwords %v, want none", got)
+	}
+}
+
+func TestService_invalid(t *testing.T) {
+	for _, tc := range []struct {
+		data    string
+		wantErr string
+	}{
+		{
+			data:    "7c222fb2927d828af22f592134e8932480637c0",
+			wantErr: `line 1: invalid hash "7c222fb2927d828af22f592134e8932480637c0"`,
+		},
+		{
+			data:    "\n7c222fb2927d828af22f592134e8932480637c0z",
+			wantErr: `line 2: invalid hash "7c222fb2927d828af22f592134e8932480637c0z"`,
+		},
+		{
+			data:    "7c222fb2927d828af22f592134e8932480637c0d:0",
+			wantErr: `line 1: invalid count "0"`,
+		},
+	} {
+		_, err := blocklist.New(writeFile(t, tc.data), &blocklist.Options{
+			Format: blocklist.FormatSHA1,
+		})
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("got error %v, want %q", err, tc.wantErr)
+		}
+	}
+
+	if _, err := blocklist.New(writeFile(t, "acme"), &blocklist.Options{
+		Format: "csv",
+	}); err == nil {
+		t.Error("expected error for unsupported format")
+	}
+}
+
+func TestService_reloadOnChange(t *testing.T) {
+	filename := writeFile(t, "acme\n")
+
+	s, err := blocklist.New(filename, &blocklist.Options{
+		ReloadInterval: 10 * time.Millisecond,
+		LogFunc:        func(string, ...interface{}) {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	sum := sha1.Sum([]byte("Acme2023"))
+
+	if count, err := s.IsPasswordCompromised(ctx, sum); err != nil || count != 0 {
+		t.Fatalf("got count %v and error %v, want 0", count, err)
+	}
+
+	if err := os.WriteFile(filename, []byte("acme\nAcme2023\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		count, err := s.IsPasswordCompromised(ctx, sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("blocklist is not reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if l := s.Len(); l != 2 {
+		t.Errorf("got %v passwords, want 2", l)
+	}
+}
+
+func TestService_Reload(t *testing.T) {
+	filename := writeFile(t, "acme\n")
+
+	s, err := blocklist.New(filename, &blocklist.Options{
+		ReloadInterval: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := os.WriteFile(filename, []byte("acme\nAcme2023\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if l := s.Len(); l != 2 {
+		t.Errorf("got %v passwords, want 2", l)
+	}
+
+	// invalid file keeps the current list
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err == nil {
+		t.Error("expected error for missing file")
+	}
+	if l := s.Len(); l != 2 {
+		t.Errorf("got %v passwords, want 2", l)
+	}
+}
+
+func TestService_Close(t *testing.T) {
+	s, err := blocklist.New(writeFile(t, "acme\n"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.IsPasswordCompromised(context.Background(), sha1.Sum([]byte("acme"))); !errors.Is(err, blocklist.ErrClosed) {
+		t.Errorf("got error %v, want %v", err, blocklist.ErrClosed)
+	}
+	if err := s.Reload(); !errors.Is(err, blocklist.ErrClosed) {
+		t.Errorf("got error %v, want %v", err, blocklist.ErrClosed)
+	}
+}
+
+func writeFile(t *testing.T, data string) string {
+	t.Helper()
+
+	filename := filepath.Join(t.TempDir(), "blocklist.txt")
+	if err := os.WriteFile(filename, []byte(data), 0666); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func hexDecodeSHA1Sum(t *testing.T, s string) (sum [20]byte) {
+	t.Helper()
+
+	if _, err := hex.Decode(sum[:], []byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	return sum
+}
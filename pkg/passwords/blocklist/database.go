@@ -0,0 +1,99 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blocklist
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"resenje.org/compromised/pkg/passwords"
+)
+
+// Database is a passwords database that is used as a blocklist, such as a
+// database created by the index-passwords command for large lists.
+type Database interface {
+	passwords.Service
+	Reload() error
+	Close() error
+}
+
+// DatabaseService is a blocklist with passwords from a database that is
+// reloaded when its files change.
+type DatabaseService struct {
+	Database
+
+	watcher   *watcher
+	closeOnce sync.Once
+}
+
+// NewDatabase creates a new instance of DatabaseService with the database
+// that is stored on the path. The database is reloaded when the db.json file
+// of the database directory, or the database file if the path is a file,
+// changes. Only ReloadInterval and LogFunc options are used.
+func NewDatabase(db Database, path string, o *Options) (*DatabaseService, error) {
+	if o == nil {
+		o = new(Options)
+	}
+	interval := o.ReloadInterval
+	if interval == 0 {
+		interval = defaultReloadInterval
+	}
+	logFunc := o.LogFunc
+	if logFunc == nil {
+		logFunc = func(format string, a ...interface{}) {
+			fmt.Printf(format+"\n", a...)
+		}
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	filename := path
+	if stat.IsDir() {
+		filename = filepath.Join(path, "db.json")
+	}
+	info, err := statFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	load := func() (fileInfo, error) {
+		// the file is checked before the database is reloaded so that the
+		// change during the reload is not missed
+		info, err := statFile(filename)
+		if err != nil {
+			return fileInfo{}, err
+		}
+		if err := db.Reload(); err != nil {
+			return fileInfo{}, err
+		}
+		return info, nil
+	}
+	return &DatabaseService{
+		Database: db,
+		watcher: newWatcher(filename, info, interval, load, func() {
+			logFunc("blocklist %s reloaded", path)
+		}, logFunc),
+	}, nil
+}
+
+// Reload reopens the database.
+func (s *DatabaseService) Reload() error {
+	_, err := s.watcher.reload(true)
+	return err
+}
+
+// Close stops checking the database for changes and closes it.
+func (s *DatabaseService) Close() (err error) {
+	s.closeOnce.Do(func() {
+		s.watcher.close()
+		err = s.Database.Close()
+	})
+	return err
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blocklist_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"resenje.org/compromised/pkg/passwords/blocklist"
+)
+
+func TestDatabase_reloadOnChange(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// returns the database path and the file that is changed
+		files func(dir string) (path, filename string)
+	}{
+		{
+			name: "directory",
+			files: func(dir string) (string, string) {
+				return dir, filepath.Join(dir, "db.json")
+			},
+		},
+		{
+			name: "file",
+			files: func(dir string) (string, string) {
+				filename := filepath.Join(dir, "blocklist.db")
+				return filename, filename
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, filename := tc.files(t.TempDir())
+			if err := os.WriteFile(filename, []byte("1"), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			db := new(testDatabase)
+			s, err := blocklist.NewDatabase(db, path, &blocklist.Options{
+				ReloadInterval: 10 * time.Millisecond,
+				LogFunc:        func(string, ...interface{}) {},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			time.Sleep(50 * time.Millisecond)
+			if n := db.reloads.Load(); n != 0 {
+				t.Fatalf("got %v reloads of unchanged database, want 0", n)
+			}
+
+			if err := os.WriteFile(filename, []byte("12"), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for db.reloads.Load() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("database is not reloaded")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			time.Sleep(50 * time.Millisecond)
+			if n := db.reloads.Load(); n != 1 {
+				t.Errorf("got %v reloads, want 1", n)
+			}
+		})
+	}
+}
+
+func TestDatabase_Close(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "db.json"), []byte("{}"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db := new(testDatabase)
+	s, err := blocklist.NewDatabase(db, dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.reloads.Load(); n != 1 {
+		t.Errorf("got %v reloads, want 1", n)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := db.closes.Load(); n != 1 {
+		t.Errorf("got %v closes, want 1", n)
+	}
+}
+
+func TestNewDatabase_missing(t *testing.T) {
+	db := new(testDatabase)
+
+	if _, err := blocklist.NewDatabase(db, filepath.Join(t.TempDir(), "missing"), nil); !os.IsNotExist(err) {
+		t.Errorf("got error %v, want not exist", err)
+	}
+	// directory without the meta information file
+	if _, err := blocklist.NewDatabase(db, t.TempDir(), nil); !os.IsNotExist(err) {
+		t.Errorf("got error %v, want not exist", err)
+	}
+}
+
+// testDatabase counts reloads and closes of the database.
+type testDatabase struct {
+	reloads atomic.Int32
+	closes  atomic.Int32
+}
+
+func (d *testDatabase) IsPasswordCompromised(context.Context, [20]byte) (uint64, error) {
+	return 0, nil
+}
+
+func (d *testDatabase) Reload() error {
+	d.reloads.Add(1)
+	return nil
+}
+
+func (d *testDatabase) Close() error {
+	d.closes.Add(1)
+	return nil
+}
@@ -0,0 +1,131 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package blocklist
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+type fileInfo struct {
+	modTime time.Time
+	size    int64
+}
+
+// statFile returns the file information that is used to detect changes.
+func statFile(filename string) (fileInfo, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return fileInfo{}, err
+	}
+	return fileInfo{modTime: stat.ModTime(), size: stat.Size()}, nil
+}
+
+// watcher loads a blocklist again when its file changes by the modification
+// time and size, until it is closed.
+type watcher struct {
+	filename string
+	// load reads the blocklist and returns the information of the file that
+	// is read
+	load func() (fileInfo, error)
+	// reloaded is called after the blocklist is loaded because the file is
+	// changed
+	reloaded func()
+	logFunc  func(string, ...interface{})
+
+	mu sync.Mutex // serializes loads and protects checked
+	// checked is the file information of the last load, also if it failed,
+	// so that an invalid file is not read again until it changes
+	checked fileInfo
+
+	quit      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// newWatcher starts checking the file for changes in intervals, if the
+// interval is positive. The checked file information is of the blocklist that
+// is already loaded.
+func newWatcher(filename string, checked fileInfo, interval time.Duration, load func() (fileInfo, error), reloaded func(), logFunc func(string, ...interface{})) *watcher {
+	w := &watcher{
+		filename: filename,
+		load:     load,
+		reloaded: reloaded,
+		logFunc:  logFunc,
+		checked:  checked,
+		quit:     make(chan struct{}),
+	}
+	if interval > 0 {
+		w.done = make(chan struct{})
+		go w.watch(interval)
+	}
+	return w
+}
+
+// reload loads the blocklist if it is forced or if the file is changed, and
+// returns true if it is loaded.
+func (w *watcher) reload(force bool) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !force {
+		info, err := statFile(w.filename)
+		if err != nil {
+			return false, err
+		}
+		if info == w.checked {
+			return false, nil
+		}
+		w.checked = info
+	}
+
+	info, err := w.load()
+	if err != nil {
+		return false, err
+	}
+	w.checked = info
+	return true, nil
+}
+
+// watch reloads the blocklist when the file changes until the watcher is
+// closed. Errors are logged and the current blocklist is kept.
+func (w *watcher) watch(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := w.reload(false)
+			if err != nil {
+				if errors.Is(err, ErrClosed) {
+					return
+				}
+				w.logFunc("blocklist %s reload: %v", w.filename, err)
+				continue
+			}
+			if reloaded {
+				w.reloaded()
+			}
+		case <-w.quit:
+			return
+		}
+	}
+}
+
+// close stops checking the file for changes.
+func (w *watcher) close() {
+	w.closeOnce.Do(func() {
+		close(w.quit)
+		if w.done != nil {
+			<-w.done
+		}
+	})
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compact
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"resenje.org/compromised/pkg/filter"
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+// BuildOptions holds optional parameters for building a compact database.
+type BuildOptions struct {
+	// MinHashCount filters out hashes with lower compromised counts.
+	MinHashCount uint64
+	// FingerprintBits is the size of filter fingerprints which determines
+	// the false positive rate and the size of the database. Possible values
+	// are 8, with 0.39% false positive rate and around 1.13 bytes per hash,
+	// and 16, with 0.0015% false positive rate and around 2.25 bytes per
+	// hash. The default is 8.
+	FingerprintBits int
+	// TopCount is the number of hashes with the highest compromised counts
+	// that are stored with their exact counts, as counts are not stored in
+	// filters.
+	TopCount int
+	// LogFunc can be specified as a custom receiver of log messages.
+	LogFunc func(string, ...interface{})
+}
+
+const defaultFingerprintBits = 8
+
+// Build creates a compact database file from the existing database directory
+// or container file. Hashes are read from the database twice, first to count
+// them and to find the most compromised ones, and then to build filters. The
+// file is written with the .tmp suffix and renamed when it is complete. It
+// returns the number of saved hashes.
+func Build(dbDir, filename string, o *BuildOptions) (n uint64, err error) {
+	if o == nil {
+		o = new(BuildOptions)
+	}
+	if o.FingerprintBits == 0 {
+		o.FingerprintBits = defaultFingerprintBits
+	}
+	if o.FingerprintBits != 8 && o.FingerprintBits != 16 {
+		return 0, fmt.Errorf("unsupported fingerprint bits %v", o.FingerprintBits)
+	}
+	if o.TopCount < 0 {
+		return 0, fmt.Errorf("invalid top count %v", o.TopCount)
+	}
+	logFunc := o.LogFunc
+	if logFunc == nil {
+		logFunc = func(format string, a ...interface{}) {
+			fmt.Printf(format+"\n", a...)
+		}
+	}
+
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		return 0, fmt.Errorf("compact database file %s already exists", filename)
+	}
+
+	s, err := file.New(dbDir, &file.Options{DisableFilter: true})
+	if err != nil {
+		return 0, err
+	}
+	h := s.Hash()
+	if err := s.Close(); err != nil {
+		return 0, err
+	}
+	size := hashSize(h)
+	if size == 0 {
+		return 0, fmt.Errorf("unsupported hash %s", h)
+	}
+
+	m := meta{
+		Version:           compactVersion,
+		Hash:              string(h),
+		FingerprintBits:   o.FingerprintBits,
+		FalsePositiveRate: falsePositiveRate(o.FingerprintBits),
+	}
+
+	logFunc("reading database %s", dbDir)
+
+	top := &topHashes{limit: o.TopCount}
+	if err := file.Iterate(dbDir, func(hash []byte, count uint64) error {
+		if count < o.MinHashCount {
+			return nil
+		}
+		if m.Count == 0 || count < m.MinHashCount {
+			m.MinHashCount = count
+		}
+		if count > m.MaxHashCount {
+			m.MaxHashCount = count
+		}
+		m.Count++
+		top.add(hash, count)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	records := top.sorted()
+	m.TopCount = len(records)
+
+	metaData, err := json.Marshal(m)
+	if err != nil {
+		return 0, fmt.Errorf("encode meta information: %w", err)
+	}
+
+	tmpFilename := filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpFilename)
+		}
+	}()
+	w := bufio.NewWriterSize(f, 64*1024)
+
+	header := make([]byte, compactHeaderSize)
+	copy(header, compactMagic)
+	binary.BigEndian.PutUint32(header[len(compactMagic):], compactVersion)
+	binary.BigEndian.PutUint32(header[len(compactMagic)+4:], uint32(len(metaData)))
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	if _, err := w.Write(metaData); err != nil {
+		return 0, err
+	}
+	record := make([]byte, size+8)
+	for _, r := range records {
+		copy(record, r.hash)
+		binary.BigEndian.PutUint64(record[size:], r.count)
+		if _, err := w.Write(record); err != nil {
+			return 0, err
+		}
+	}
+
+	logFunc("building filters of %v hashes", m.Count)
+
+	// hashes are iterated in ascending order, so that keys of every filter
+	// are collected one filter at a time
+	var (
+		bucket      int
+		keys        []uint64
+		count       uint64
+		filtersSize int64
+	)
+	writeFilters := func(next int) error {
+		for ; bucket < next; bucket++ {
+			n, err := writeFilter(w, o.FingerprintBits, keys)
+			if err != nil {
+				return fmt.Errorf("filter %v: %w", bucket, err)
+			}
+			filtersSize += n
+			keys = keys[:0]
+		}
+		return nil
+	}
+	if err := file.Iterate(dbDir, func(hash []byte, c uint64) error {
+		if c < o.MinHashCount {
+			return nil
+		}
+		b, key := bucketKey(hash)
+		if b != bucket {
+			if err := writeFilters(b); err != nil {
+				return err
+			}
+		}
+		keys = append(keys, key)
+		count++
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if err := writeFilters(bucketCount); err != nil {
+		return 0, err
+	}
+	if count != m.Count {
+		return 0, errors.New("database changed while reading")
+	}
+
+	if err := w.Flush(); err != nil {
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return 0, err
+	}
+
+	logFunc("filters size: %v bytes", filtersSize)
+	logFunc("false positive rate: %v", m.FalsePositiveRate)
+	logFunc("exact counts of %v hashes", m.TopCount)
+	logFunc("saved %v hashes", m.Count)
+
+	return m.Count, nil
+}
+
+// writeFilter writes the binary fuse filter of keys with the fingerprint size
+// in bits.
+func writeFilter(w io.Writer, fingerprintBits int, keys []uint64) (int64, error) {
+	switch fingerprintBits {
+	case 8:
+		f, err := filter.NewBinaryFuse[uint8](keys)
+		if err != nil {
+			return 0, err
+		}
+		return f.WriteTo(w)
+	case 16:
+		f, err := filter.NewBinaryFuse[uint16](keys)
+		if err != nil {
+			return 0, err
+		}
+		return f.WriteTo(w)
+	}
+	return 0, fmt.Errorf("unsupported fingerprint bits %v", fingerprintBits)
+}
+
+// topHashes keeps the limited number of hashes with the highest counts in a
+// heap with the lowest count at the root. Hashes with equal counts are kept
+// in the ascending order.
+type topHashes struct {
+	limit   int
+	records []topHash
+}
+
+type topHash struct {
+	hash  []byte
+	count uint64
+}
+
+func (t *topHashes) add(hash []byte, count uint64) {
+	if t.limit == 0 {
+		return
+	}
+	if len(t.records) < t.limit {
+		heap.Push(t, topHash{hash: append([]byte(nil), hash...), count: count})
+		return
+	}
+	// hashes are added in ascending order, so that a hash with the same
+	// count as the root is not kept
+	if count <= t.records[0].count {
+		return
+	}
+	copy(t.records[0].hash, hash)
+	t.records[0].count = count
+	heap.Fix(t, 0)
+}
+
+// sorted returns all kept hashes ordered by hashes.
+func (t *topHashes) sorted() []topHash {
+	sort.Slice(t.records, func(i, j int) bool {
+		return bytes.Compare(t.records[i].hash, t.records[j].hash) < 0
+	})
+	return t.records
+}
+
+// Len implements heap.Interface.
+func (t *topHashes) Len() int { return len(t.records) }
+
+// Less implements heap.Interface.
+func (t *topHashes) Less(i, j int) bool {
+	if t.records[i].count == t.records[j].count {
+		return bytes.Compare(t.records[i].hash, t.records[j].hash) > 0
+	}
+	return t.records[i].count < t.records[j].count
+}
+
+// Swap implements heap.Interface.
+func (t *topHashes) Swap(i, j int) { t.records[i], t.records[j] = t.records[j], t.records[i] }
+
+// Push implements heap.Interface.
+func (t *topHashes) Push(x interface{}) { t.records = append(t.records, x.(topHash)) }
+
+// Pop implements heap.Interface.
+func (t *topHashes) Pop() interface{} {
+	r := t.records[len(t.records)-1]
+	t.records = t.records[:len(t.records)-1]
+	return r
+}
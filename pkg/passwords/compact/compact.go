@@ -0,0 +1,118 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package compact provides a passwords database in a single file that stores
+// only binary fuse filters of all hashes and, optionally, exact counts of the
+// most compromised hashes. It is a fraction of the size of the complete
+// database at the cost of approximate answers: passwords that are not
+// compromised are reported as compromised with the false positive rate of
+// filters, and compromised passwords that are not in the exact counts table
+// are reported with the minimal count of the database.
+//
+// With 8 bit fingerprints, filters take around 1.13 bytes per hash, which is
+// around 650MB for 572 million hashes of pwned passwords version 6 and around
+// 1GB for 900 million hashes of newer releases, with the false positive rate
+// of 0.39%. Sixteen bit fingerprints reduce the false positive rate to 0.0015%
+// and double the size. Smaller databases require excluding less compromised
+// hashes with BuildOptions.MinHashCount, for example around 400MB with min
+// hash count 2 and 100MB with min hash count 5 for version 6 with 8 bit
+// fingerprints.
+package compact
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"math"
+	"os"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+// Compact file layout, with all integers encoded in big endian order:
+//
+//	magic          8 bytes
+//	version        uint32
+//	meta size      uint32
+//	meta           JSON encoded meta information
+//	top hashes     top count * (hash, count uint64), ordered by hashes
+//	filters        256 binary fuse filters of hashes by their first byte
+//
+// Filter keys are the last 8 bytes of hashes, as the first byte selects the
+// filter.
+const (
+	compactVersion    = 1
+	compactMagic      = "CMPRFLTR"
+	compactHeaderSize = len(compactMagic) + 4 + 4
+	maxMetaSize       = 1 << 20
+	bucketCount       = 256
+
+	ntlmSize = 16 // MD4 hash size in bytes
+)
+
+type meta struct {
+	Version int    `json:"version"`
+	Hash    string `json:"hash"`
+	Count   uint64 `json:"count"`
+	// MinHashCount is the lowest count of all hashes and it is returned
+	// for hashes that are found only in filters.
+	MinHashCount uint64 `json:"min_hash_count"`
+	MaxHashCount uint64 `json:"max_hash_count"`
+	// FingerprintBits is the size of filter fingerprints, 8 or 16.
+	FingerprintBits   int     `json:"fingerprint_bits"`
+	FalsePositiveRate float64 `json:"false_positive_rate"`
+	// TopCount is the number of hashes stored with their exact counts.
+	TopCount int `json:"top_count"`
+}
+
+// IsCompactFile returns true if the path is a compact database file, and
+// false for other files and directories.
+func IsCompactFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if stat.IsDir() {
+		return false, nil
+	}
+	magic := make([]byte, len(compactMagic))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	return bytes.Equal(magic, []byte(compactMagic)), nil
+}
+
+// hashSize returns the size of the hash in bytes or 0 if the hash is not
+// supported.
+func hashSize(h file.Hash) int {
+	switch h {
+	case file.HashSHA1:
+		return sha1.Size
+	case file.HashNTLM:
+		return ntlmSize
+	}
+	return 0
+}
+
+// bucketKey returns the filter index and the filter key of the hash.
+func bucketKey(hash []byte) (bucket int, key uint64) {
+	return int(hash[0]), binary.BigEndian.Uint64(hash[len(hash)-8:])
+}
+
+// falsePositiveRate returns the false positive rate of binary fuse filters
+// with the number of fingerprint bits.
+func falsePositiveRate(fingerprintBits int) float64 {
+	return math.Ldexp(1, -fingerprintBits)
+}
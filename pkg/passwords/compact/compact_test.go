@@ -0,0 +1,462 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compact_test
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords/compact"
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+const (
+	sha1Input = "../file/testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+	ntlmInput = "../file/testdata/pwned-passwords-ntlm-ordered-by-hash.txt"
+)
+
+func noLog(string, ...interface{}) {}
+
+func TestBuild(t *testing.T) {
+	for _, tc := range []struct {
+		name         string
+		input        string
+		hash         file.Hash
+		hashCounting file.HashCounting
+		format       file.Format
+		o            compact.BuildOptions
+	}{
+		{
+			name:  "default",
+			input: sha1Input,
+			hash:  file.HashSHA1,
+		},
+		{
+			name:  "16 bit fingerprints",
+			input: sha1Input,
+			hash:  file.HashSHA1,
+			o:     compact.BuildOptions{FingerprintBits: 16},
+		},
+		{
+			name:  "top count",
+			input: sha1Input,
+			hash:  file.HashSHA1,
+			o:     compact.BuildOptions{TopCount: 100},
+		},
+		{
+			name:  "top count all hashes",
+			input: sha1Input,
+			hash:  file.HashSHA1,
+			o:     compact.BuildOptions{TopCount: 10000},
+		},
+		{
+			name:  "min hash count",
+			input: sha1Input,
+			hash:  file.HashSHA1,
+			o:     compact.BuildOptions{MinHashCount: 10, TopCount: 10},
+		},
+		{
+			name:   "container",
+			input:  sha1Input,
+			hash:   file.HashSHA1,
+			format: file.FormatContainer,
+			o:      compact.BuildOptions{TopCount: 10},
+		},
+		{
+			name:         "approximate counts",
+			input:        sha1Input,
+			hash:         file.HashSHA1,
+			hashCounting: file.HashCountingApprox,
+			o:            compact.BuildOptions{TopCount: 10},
+		},
+		{
+			name:  "ntlm",
+			input: ntlmInput,
+			hash:  file.HashNTLM,
+			o:     compact.BuildOptions{FingerprintBits: 16, TopCount: 10},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			dbDir := filepath.Join(dir, "db")
+			if _, err := file.Index(tc.input, dbDir, &file.IndexOptions{
+				Hash:         tc.hash,
+				HashCounting: tc.hashCounting,
+				Format:       tc.format,
+				LogFunc:      noLog,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// expected counts are read from the database, as it may store
+			// approximate counts
+			want := make(map[string]uint64)
+			if err := file.Iterate(dbDir, func(hash []byte, count uint64) error {
+				if count >= tc.o.MinHashCount {
+					want[string(hash)] = count
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			top := topHashes(want, tc.o.TopCount)
+			minCount := uint64(0)
+			for _, c := range want {
+				if minCount == 0 || c < minCount {
+					minCount = c
+				}
+			}
+
+			filename := filepath.Join(dir, "db.compact")
+			o := tc.o
+			o.LogFunc = noLog
+			n, err := compact.Build(dbDir, filename, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != uint64(len(want)) {
+				t.Errorf("got %v hashes, want %v", n, len(want))
+			}
+			if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+				t.Errorf("temporary file not removed: %v", err)
+			}
+
+			isCompact, err := compact.IsCompactFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !isCompact {
+				t.Error("compact database file not detected")
+			}
+			isCompact, err = compact.IsCompactFile(dbDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if isCompact {
+				t.Error("database detected as compact")
+			}
+
+			s, err := compact.New(filename, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if got := s.Hash(); got != tc.hash {
+				t.Errorf("got hash %v, want %v", got, tc.hash)
+			}
+			fingerprintBits := tc.o.FingerprintBits
+			if fingerprintBits == 0 {
+				fingerprintBits = 8
+			}
+			falsePositiveRate := 1 / float64(uint64(1)<<fingerprintBits)
+			if got := s.FalsePositiveRate(); got != falsePositiveRate {
+				t.Errorf("got false positive rate %v, want %v", got, falsePositiveRate)
+			}
+
+			lookup := func(hash []byte) uint64 {
+				t.Helper()
+				var (
+					count uint64
+					err   error
+				)
+				if tc.hash == file.HashNTLM {
+					var sum [16]byte
+					copy(sum[:], hash)
+					count, err = s.IsNTLMPasswordCompromised(context.Background(), sum)
+				} else {
+					var sum [20]byte
+					copy(sum[:], hash)
+					count, err = s.IsPasswordCompromised(context.Background(), sum)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				return count
+			}
+
+			for hash, count := range want {
+				wantCount := minCount
+				if _, ok := top[hash]; ok {
+					wantCount = count
+				}
+				if got := lookup([]byte(hash)); got != wantCount {
+					t.Errorf("hash %X: got count %v, want %v", hash, got, wantCount)
+				}
+			}
+
+			const misses = 10000
+			var falsePositives int
+			for i := 0; i < misses; i++ {
+				sum := sha1.Sum([]byte(fmt.Sprintf("not compromised %v", i)))
+				if lookup(sum[:]) > 0 {
+					falsePositives++
+				}
+			}
+			if max := int(falsePositiveRate*misses*3) + 3; falsePositives > max {
+				t.Errorf("got %v false positives, want at most %v", falsePositives, max)
+			}
+
+			if tc.hash != file.HashSHA1 {
+				return
+			}
+			var sums [][20]byte
+			var wantCounts []uint64
+			for hash := range want {
+				var sum [20]byte
+				copy(sum[:], hash)
+				sums = append(sums, sum)
+				wantCounts = append(wantCounts, lookup(sum[:]))
+			}
+			counts, err := s.ArePasswordsCompromised(context.Background(), sums)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := range counts {
+				if counts[i] != wantCounts[i] {
+					t.Errorf("batch hash %X: got count %v, want %v", sums[i], counts[i], wantCounts[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBuild_invalid(t *testing.T) {
+	dir := t.TempDir()
+	dbDir := filepath.Join(dir, "db")
+	if _, err := file.Index(sha1Input, dbDir, &file.IndexOptions{LogFunc: noLog}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		dbDir    string
+		filename string
+		o        compact.BuildOptions
+	}{
+		{
+			name:     "fingerprint bits",
+			dbDir:    dbDir,
+			filename: filepath.Join(dir, "fingerprint-bits.compact"),
+			o:        compact.BuildOptions{FingerprintBits: 4},
+		},
+		{
+			name:     "top count",
+			dbDir:    dbDir,
+			filename: filepath.Join(dir, "top-count.compact"),
+			o:        compact.BuildOptions{TopCount: -1},
+		},
+		{
+			name:     "existing output",
+			dbDir:    dbDir,
+			filename: dbDir,
+		},
+		{
+			name:     "missing database",
+			dbDir:    filepath.Join(dir, "missing"),
+			filename: filepath.Join(dir, "missing.compact"),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			o := tc.o
+			o.LogFunc = noLog
+			if _, err := compact.Build(tc.dbDir, tc.filename, &o); err == nil {
+				t.Fatal("expected error")
+			}
+			if tc.filename == tc.dbDir {
+				return
+			}
+			if _, err := os.Stat(tc.filename); !os.IsNotExist(err) {
+				t.Errorf("output file created: %v", err)
+			}
+		})
+	}
+}
+
+func TestService_reload(t *testing.T) {
+	dir := t.TempDir()
+
+	build := func(input, name string, hash file.Hash, minHashCount uint64) string {
+		t.Helper()
+		dbDir := filepath.Join(dir, name)
+		if _, err := file.Index(input, dbDir, &file.IndexOptions{
+			Hash:         hash,
+			MinHashCount: minHashCount,
+			LogFunc:      noLog,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(dir, name+".compact")
+		if _, err := compact.Build(dbDir, filename, &compact.BuildOptions{
+			FingerprintBits: 16,
+			LogFunc:         noLog,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+	all := build(sha1Input, "all", file.HashSHA1, 0)
+	high := build(sha1Input, "high", file.HashSHA1, 1000)
+	ntlm := build(ntlmInput, "ntlm", file.HashNTLM, 0)
+
+	filename := filepath.Join(dir, "current.compact")
+	if err := os.Link(all, filename); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := compact.New(filename, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// compromised only once, so that it is not in the database with high
+	// counts
+	sum := hexDecodeSHA1Sum(t, "008D79391C817885A59822F6153136C1CEFC2569")
+	assertCount := func(want uint64) {
+		t.Helper()
+		got, err := s.IsPasswordCompromised(context.Background(), sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("got count %v, want %v", got, want)
+		}
+	}
+	assertCount(1)
+
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(high, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	assertCount(0)
+
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(ntlm, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); !errors.Is(err, file.ErrHashMismatch) {
+		t.Errorf("got error %v, want %v", err, file.ErrHashMismatch)
+	}
+	assertCount(0)
+
+	if _, err := s.IsNTLMPasswordCompromised(context.Background(), [16]byte{}); !errors.Is(err, file.ErrHashMismatch) {
+		t.Errorf("got error %v, want %v", err, file.ErrHashMismatch)
+	}
+
+	if err := os.Remove(filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(all, filename); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.IsPasswordCompromised(context.Background(), sum); !errors.Is(err, file.ErrClosed) {
+		t.Errorf("got error %v, want %v", err, file.ErrClosed)
+	}
+	if err := s.Reload(); !errors.Is(err, file.ErrClosed) {
+		t.Errorf("got error %v, want %v", err, file.ErrClosed)
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	dir := t.TempDir()
+	dbDir := filepath.Join(dir, "db")
+	if _, err := file.Index(sha1Input, dbDir, &file.IndexOptions{LogFunc: noLog}); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "db.compact")
+	if _, err := compact.Build(dbDir, filename, &compact.BuildOptions{
+		TopCount: 10,
+		LogFunc:  noLog,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{
+			name: "empty",
+			data: nil,
+		},
+		{
+			name: "magic",
+			data: append([]byte("NOTCMPCT"), data[8:]...),
+		},
+		{
+			name: "truncated",
+			data: data[:len(data)-1],
+		},
+		{
+			name: "trailing data",
+			data: append(append([]byte(nil), data...), 0),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "db.compact")
+			if err := os.WriteFile(filename, tc.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := compact.New(filename, nil); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+// topHashes returns the limited number of hashes with the highest counts,
+// preferring lower hashes with the same counts.
+func topHashes(counts map[string]uint64, limit int) map[string]struct{} {
+	hashes := make([]string, 0, len(counts))
+	for h := range counts {
+		hashes = append(hashes, h)
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		if counts[hashes[i]] == counts[hashes[j]] {
+			return hashes[i] < hashes[j]
+		}
+		return counts[hashes[i]] > counts[hashes[j]]
+	})
+	if len(hashes) > limit {
+		hashes = hashes[:limit]
+	}
+	top := make(map[string]struct{}, len(hashes))
+	for _, h := range hashes {
+		top[h] = struct{}{}
+	}
+	return top
+}
+
+func hexDecodeSHA1Sum(t *testing.T, s string) (sum [20]byte) {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(sum[:], b)
+	return sum
+}
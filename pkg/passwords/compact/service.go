@@ -0,0 +1,306 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compact
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"resenje.org/compromised/pkg/filter"
+	"resenje.org/compromised/pkg/passwords"
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+var (
+	_ passwords.Service      = (*Service)(nil)
+	_ passwords.BatchService = (*Service)(nil)
+	_ passwords.NTLMService  = (*Service)(nil)
+)
+
+// Service implements passwords service with the compact database which is
+// completely loaded into memory. Lookups do not read files.
+type Service struct {
+	filename string
+	hash     file.Hash
+
+	mu       sync.RWMutex // protects db
+	db       *database
+	reloadMu sync.Mutex // serializes reloads
+
+	metrics metrics
+}
+
+// Options holds optional parameters for opening a compact database.
+type Options struct {
+	// Name identifies the database in the service metrics with the db label
+	// when multiple databases are used in the same process.
+	Name string
+}
+
+// database holds the content of a compact database file.
+type database struct {
+	meta       meta
+	top        []byte // records of hashes with exact counts
+	recordSize int
+	filters    [bucketCount]keyFilter
+}
+
+// keyFilter is implemented by binary fuse filters with all fingerprint sizes.
+type keyFilter interface {
+	Contains(key uint64) bool
+}
+
+// New creates a new instance of Service by reading the compact database file.
+func New(filename string, o *Options) (*Service, error) {
+	if o == nil {
+		o = new(Options)
+	}
+	db, err := readDatabase(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		filename: filename,
+		hash:     file.Hash(db.meta.Hash),
+		db:       db,
+		metrics:  newMetrics(o.Name),
+	}, nil
+}
+
+// Hash returns the password hashing algorithm of the database.
+func (s *Service) Hash() file.Hash {
+	return s.hash
+}
+
+// FalsePositiveRate returns the rate of not compromised passwords that are
+// reported as compromised.
+func (s *Service) FalsePositiveRate() float64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.db == nil {
+		return 0
+	}
+	return s.db.meta.FalsePositiveRate
+}
+
+// IsPasswordCompromised provides information if the password is compromised.
+// The count is exact only for the most compromised passwords that are stored
+// with their counts, and it is the minimal count of the database for others.
+// It returns file.ErrHashMismatch if the database does not contain SHA1
+// hashes.
+func (s *Service) IsPasswordCompromised(_ context.Context, sum [20]byte) (count uint64, err error) {
+	if s.hash != file.HashSHA1 {
+		return 0, file.ErrHashMismatch
+	}
+	return s.lookup(sum[:])
+}
+
+// IsNTLMPasswordCompromised provides information if the password is
+// compromised by its NTLM hash, in the same way as IsPasswordCompromised. It
+// returns file.ErrHashMismatch if the database does not contain NTLM hashes.
+func (s *Service) IsNTLMPasswordCompromised(_ context.Context, sum [16]byte) (count uint64, err error) {
+	if s.hash != file.HashNTLM {
+		return 0, file.ErrHashMismatch
+	}
+	return s.lookup(sum[:])
+}
+
+// ArePasswordsCompromised provides information for multiple passwords if they
+// are compromised. Returned counts are in the same order as provided sums.
+func (s *Service) ArePasswordsCompromised(ctx context.Context, sums [][20]byte) (counts []uint64, err error) {
+	if s.hash != file.HashSHA1 {
+		return nil, file.ErrHashMismatch
+	}
+
+	db, err := s.database()
+	if err != nil {
+		return nil, err
+	}
+	counts = make([]uint64, len(sums))
+	for i, sum := range sums {
+		counts[i] = s.count(db, sum[:])
+	}
+	return counts, nil
+}
+
+func (s *Service) lookup(hash []byte) (count uint64, err error) {
+	db, err := s.database()
+	if err != nil {
+		return 0, err
+	}
+	return s.count(db, hash), nil
+}
+
+// count returns the exact count of the hash from the top hashes or the
+// minimal count of the database if the hash is in the filter.
+func (s *Service) count(db *database, hash []byte) (count uint64) {
+	s.metrics.CheckedCount.Inc()
+	defer func() {
+		if count > 0 {
+			s.metrics.CompromisedCount.Inc()
+		}
+	}()
+
+	if count, ok := db.topCount(hash); ok {
+		return count
+	}
+	bucket, key := bucketKey(hash)
+	if db.filters[bucket].Contains(key) {
+		return db.meta.MinHashCount
+	}
+	return 0
+}
+
+// topCount returns the exact count of the hash if it is in the top hashes.
+func (db *database) topCount(hash []byte) (uint64, bool) {
+	n := db.meta.TopCount
+	i := sort.Search(n, func(i int) bool {
+		return bytes.Compare(db.top[i*db.recordSize:i*db.recordSize+len(hash)], hash) >= 0
+	})
+	if i == n {
+		return 0, false
+	}
+	record := db.top[i*db.recordSize : (i+1)*db.recordSize]
+	if !bytes.Equal(record[:len(hash)], hash) {
+		return 0, false
+	}
+	return binary.BigEndian.Uint64(record[len(hash):]), true
+}
+
+func (s *Service) database() (*database, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.db == nil {
+		return nil, file.ErrClosed
+	}
+	return s.db, nil
+}
+
+// Reload reads the database from the same file again and replaces the
+// current one with it. Lookups that are in progress finish on the previous
+// database. The new database must have the same hashing algorithm as the
+// current one.
+func (s *Service) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	db, err := readDatabase(s.filename)
+	if err != nil {
+		return err
+	}
+	if h := file.Hash(db.meta.Hash); h != s.hash {
+		return fmt.Errorf("%w: %s instead %s", file.ErrHashMismatch, h, s.hash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.db == nil {
+		return file.ErrClosed
+	}
+	s.db = db
+	return nil
+}
+
+// Close releases the database.
+func (s *Service) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.db = nil
+	return nil
+}
+
+// readDatabase reads and validates the complete compact database file.
+func readDatabase(filename string) (*database, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := bufio.NewReaderSize(f, 64*1024)
+
+	header := make([]byte, compactHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
+	}
+	if !bytes.Equal(header[:len(compactMagic)], []byte(compactMagic)) {
+		return nil, errors.New("not a compact database file")
+	}
+	if v := binary.BigEndian.Uint32(header[len(compactMagic):]); v > compactVersion {
+		return nil, fmt.Errorf("unsupported compact database version %v", v)
+	}
+	metaSize := binary.BigEndian.Uint32(header[len(compactMagic)+4:])
+	if metaSize > maxMetaSize {
+		return nil, fmt.Errorf("invalid meta information size %v", metaSize)
+	}
+	metaData := make([]byte, metaSize)
+	if _, err := io.ReadFull(r, metaData); err != nil {
+		return nil, fmt.Errorf("read meta information: %w", err)
+	}
+
+	db := new(database)
+	if err := json.Unmarshal(metaData, &db.meta); err != nil {
+		return nil, fmt.Errorf("decode meta information: %w", err)
+	}
+	size := hashSize(file.Hash(db.meta.Hash))
+	if size == 0 {
+		return nil, fmt.Errorf("unsupported hash %s", db.meta.Hash)
+	}
+	db.recordSize = size + 8
+
+	topSize := int64(db.meta.TopCount) * int64(db.recordSize)
+	if db.meta.TopCount < 0 || uint64(db.meta.TopCount) > db.meta.Count || topSize > stat.Size() {
+		return nil, fmt.Errorf("invalid top count %v", db.meta.TopCount)
+	}
+	db.top = make([]byte, topSize)
+	if _, err := io.ReadFull(r, db.top); err != nil {
+		return nil, fmt.Errorf("read top hashes: %w", err)
+	}
+	for i := 1; i < db.meta.TopCount; i++ {
+		if bytes.Compare(db.top[(i-1)*db.recordSize:(i-1)*db.recordSize+size], db.top[i*db.recordSize:i*db.recordSize+size]) >= 0 {
+			return nil, fmt.Errorf("top hash %v not in order", i)
+		}
+	}
+
+	for i := range db.filters {
+		var err error
+		switch db.meta.FingerprintBits {
+		case 8:
+			db.filters[i], err = filter.ReadBinaryFuse[uint8](r)
+		case 16:
+			db.filters[i], err = filter.ReadBinaryFuse[uint16](r)
+		default:
+			return nil, fmt.Errorf("unsupported fingerprint bits %v", db.meta.FingerprintBits)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("filter %v: %w", i, err)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("unexpected data after filters")
+	}
+	return db, nil
+}
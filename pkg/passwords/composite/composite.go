@@ -0,0 +1,162 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package composite provides a passwords service that merges lookups in
+// multiple named sources, such as a pwned passwords database and an
+// organization blocklist.
+package composite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"resenje.org/compromised/pkg/passwords"
+)
+
+var (
+	_ passwords.Service       = (*Service)(nil)
+	_ passwords.BatchService  = (*Service)(nil)
+	_ passwords.RangeService  = (*Service)(nil)
+	_ passwords.SourceService = (*Service)(nil)
+)
+
+// Source is a named passwords service.
+type Source struct {
+	Name    string
+	Service passwords.Service
+	// Private source is checked by password lookups, but its passwords are
+	// not listed by range lookups, so that they can not be enumerated, like
+	// the ones in an organization blocklist.
+	Private bool
+}
+
+// Service implements passwords service that checks passwords in all sources
+// and returns the highest compromised count among them.
+type Service struct {
+	sources []Source
+}
+
+// New creates a new instance of Service with sources that have unique names.
+func New(sources ...Source) (*Service, error) {
+	if len(sources) == 0 {
+		return nil, errors.New("no sources")
+	}
+	names := make(map[string]struct{}, len(sources))
+	for _, s := range sources {
+		if s.Name == "" {
+			return nil, errors.New("empty source name")
+		}
+		if s.Service == nil {
+			return nil, fmt.Errorf("source %s: nil service", s.Name)
+		}
+		if _, ok := names[s.Name]; ok {
+			return nil, fmt.Errorf("duplicate source %s", s.Name)
+		}
+		names[s.Name] = struct{}{}
+	}
+	return &Service{
+		sources: append([]Source(nil), sources...),
+	}, nil
+}
+
+// IsPasswordCompromised returns the highest compromised count of the password
+// in all sources.
+func (s *Service) IsPasswordCompromised(ctx context.Context, sum [20]byte) (count uint64, err error) {
+	count, _, err = s.PasswordSources(ctx, sum)
+	return count, err
+}
+
+// PasswordSources returns the highest compromised count of the password and
+// names of sources that contain it, in the order of sources.
+func (s *Service) PasswordSources(ctx context.Context, sum [20]byte) (count uint64, sources []string, err error) {
+	for _, source := range s.sources {
+		c, err := source.Service.IsPasswordCompromised(ctx, sum)
+		if err != nil {
+			return 0, nil, fmt.Errorf("source %s: %w", source.Name, err)
+		}
+		if c == 0 {
+			continue
+		}
+		if c > count {
+			count = c
+		}
+		sources = append(sources, source.Name)
+	}
+	return count, sources, nil
+}
+
+// ArePasswordsCompromised returns the highest compromised counts of passwords
+// in all sources in the same order as provided sums.
+func (s *Service) ArePasswordsCompromised(ctx context.Context, sums [][20]byte) (counts []uint64, err error) {
+	counts, _, err = s.ArePasswordsInSources(ctx, sums)
+	return counts, err
+}
+
+// ArePasswordsInSources returns the highest compromised counts of passwords
+// and names of sources that contain them in the same order as provided sums.
+// Sources that support batch checks are checked with a single call.
+func (s *Service) ArePasswordsInSources(ctx context.Context, sums [][20]byte) (counts []uint64, sources [][]string, err error) {
+	counts = make([]uint64, len(sums))
+	sources = make([][]string, len(sums))
+	for _, source := range s.sources {
+		c, err := passwords.ArePasswordsCompromised(ctx, source.Service, sums)
+		if err != nil {
+			return nil, nil, fmt.Errorf("source %s: %w", source.Name, err)
+		}
+		if len(c) != len(sums) {
+			return nil, nil, fmt.Errorf("source %s: got %v counts for %v passwords", source.Name, len(c), len(sums))
+		}
+		for i := range sums {
+			if c[i] == 0 {
+				continue
+			}
+			if c[i] > counts[i] {
+				counts[i] = c[i]
+			}
+			sources[i] = append(sources[i], source.Name)
+		}
+	}
+	return counts, sources, nil
+}
+
+// PasswordsByPrefix returns passwords from all sources that are not private
+// and support range lookups which SHA1 sums start with the 20 bit prefix,
+// ordered by their sums and with the highest count of passwords that are in
+// multiple sources.
+func (s *Service) PasswordsByPrefix(ctx context.Context, prefix uint32) ([]passwords.Password, error) {
+	var result []passwords.Password
+	for _, source := range s.sources {
+		if source.Private {
+			continue
+		}
+		rangeService, ok := source.Service.(passwords.RangeService)
+		if !ok {
+			continue
+		}
+		list, err := rangeService.PasswordsByPrefix(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("source %s: %w", source.Name, err)
+		}
+		result = append(result, list...)
+	}
+
+	sort.SliceStable(result, func(i, j int) bool {
+		return bytes.Compare(result[i].SHA1Sum[:], result[j].SHA1Sum[:]) < 0
+	})
+	unique := result[:0]
+	for _, p := range result {
+		if last := len(unique) - 1; last >= 0 && unique[last].SHA1Sum == p.SHA1Sum {
+			if p.Count > unique[last].Count {
+				unique[last].Count = p.Count
+			}
+			continue
+		}
+		unique = append(unique, p)
+	}
+	return unique, nil
+}
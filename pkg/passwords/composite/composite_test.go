@@ -0,0 +1,238 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package composite_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords"
+	"resenje.org/compromised/pkg/passwords/composite"
+	mockpasswords "resenje.org/compromised/pkg/passwords/mock"
+)
+
+func TestService(t *testing.T) {
+	s := newService(t)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		sum         [20]byte
+		wantCount   uint64
+		wantSources []string
+	}{
+		{sum: [20]byte{1}, wantCount: 10, wantSources: []string{"pwned"}},
+		{sum: [20]byte{2}, wantCount: 10, wantSources: []string{"pwned", "blocklist"}},
+		{sum: [20]byte{3}, wantCount: 100, wantSources: []string{"blocklist"}},
+		{sum: [20]byte{4}},
+	} {
+		count, sources, err := s.PasswordSources(ctx, tc.sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tc.wantCount {
+			t.Errorf("%x: got count %v, want %v", tc.sum, count, tc.wantCount)
+		}
+		if !reflect.DeepEqual(sources, tc.wantSources) {
+			t.Errorf("%x: got sources %v, want %v", tc.sum, sources, tc.wantSources)
+		}
+
+		count, err = s.IsPasswordCompromised(ctx, tc.sum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tc.wantCount {
+			t.Errorf("%x: got count %v, want %v", tc.sum, count, tc.wantCount)
+		}
+	}
+
+	counts, sources, err := s.ArePasswordsInSources(ctx, [][20]byte{{4}, {3}, {2}, {1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{0, 100, 10, 10}; !reflect.DeepEqual(counts, want) {
+		t.Errorf("got counts %v, want %v", counts, want)
+	}
+	if want := [][]string{nil, {"blocklist"}, {"pwned", "blocklist"}, {"pwned"}}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("got sources %v, want %v", sources, want)
+	}
+}
+
+func TestService_PasswordsByPrefix(t *testing.T) {
+	s := newService(t)
+
+	got, err := s.PasswordsByPrefix(context.Background(), 0x00200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []passwords.Password{
+		{SHA1Sum: [20]byte{0, 0x20, 0x01}, Count: 5},
+		{SHA1Sum: [20]byte{0, 0x20, 0x02}, Count: 100},
+		{SHA1Sum: [20]byte{0, 0x20, 0x03}, Count: 100},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got passwords %v, want %v", got, want)
+	}
+}
+
+func TestService_PasswordsByPrefix_private(t *testing.T) {
+	rangeService := func(list ...passwords.Password) passwords.Service {
+		return mockpasswords.New(func(_ context.Context, sum [20]byte) (uint64, error) {
+			for _, p := range list {
+				if p.SHA1Sum == sum {
+					return p.Count, nil
+				}
+			}
+			return 0, nil
+		}, mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+			return list, nil
+		}))
+	}
+
+	s, err := composite.New(
+		composite.Source{
+			Name:    "pwned",
+			Service: rangeService(passwords.Password{SHA1Sum: [20]byte{0, 0x20, 0x01}, Count: 5}),
+		},
+		composite.Source{
+			Name:    "blocklist",
+			Service: rangeService(passwords.Password{SHA1Sum: [20]byte{0, 0x20, 0x02}, Count: 100}),
+			Private: true,
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.PasswordsByPrefix(context.Background(), 0x00200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []passwords.Password{
+		{SHA1Sum: [20]byte{0, 0x20, 0x01}, Count: 5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got passwords %v, want %v", got, want)
+	}
+
+	// private source is still checked by password lookups
+	count, sources, err := s.PasswordSources(context.Background(), [20]byte{0, 0x20, 0x02})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 100 {
+		t.Errorf("got count %v, want 100", count)
+	}
+	if want := []string{"blocklist"}; !reflect.DeepEqual(sources, want) {
+		t.Errorf("got sources %v, want %v", sources, want)
+	}
+}
+
+func TestService_error(t *testing.T) {
+	testErr := errors.New("test error")
+	s, err := composite.New(composite.Source{
+		Name: "pwned",
+		Service: mockpasswords.New(func(_ context.Context, _ [20]byte) (uint64, error) {
+			return 0, testErr
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.IsPasswordCompromised(context.Background(), [20]byte{1})
+	if !errors.Is(err, testErr) {
+		t.Errorf("got error %v, want %v", err, testErr)
+	}
+	if want := "source pwned: test error"; err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	service := mockpasswords.New(nil)
+	for _, tc := range []struct {
+		sources []composite.Source
+		wantErr string
+	}{
+		{
+			wantErr: "no sources",
+		},
+		{
+			sources: []composite.Source{{Service: service}},
+			wantErr: "empty source name",
+		},
+		{
+			sources: []composite.Source{{Name: "pwned"}},
+			wantErr: "source pwned: nil service",
+		},
+		{
+			sources: []composite.Source{{Name: "pwned", Service: service}, {Name: "pwned", Service: service}},
+			wantErr: "duplicate source pwned",
+		},
+	} {
+		_, err := composite.New(tc.sources...)
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("got error %v, want %q", err, tc.wantErr)
+		}
+	}
+}
+
+// newService returns a composite service with pwned source that supports
+// batch and range lookups and blocklist source that supports only range
+// lookups.
+func newService(t *testing.T) *composite.Service {
+	t.Helper()
+
+	pwned := map[[20]byte]uint64{
+		{1}:             10,
+		{2}:             10,
+		{0, 0x20, 0x01}: 5,
+		{0, 0x20, 0x02}: 7,
+	}
+	blocklist := map[[20]byte]uint64{
+		{2}:             1,
+		{3}:             100,
+		{0, 0x20, 0x02}: 100,
+		{0, 0x20, 0x03}: 100,
+	}
+
+	s, err := composite.New(
+		composite.Source{
+			Name: "pwned",
+			Service: mockpasswords.New(func(_ context.Context, sum [20]byte) (uint64, error) {
+				return pwned[sum], nil
+			}, mockpasswords.WithArePasswordsCompromisedFunc(func(_ context.Context, sums [][20]byte) ([]uint64, error) {
+				counts := make([]uint64, len(sums))
+				for i, sum := range sums {
+					counts[i] = pwned[sum]
+				}
+				return counts, nil
+			}), mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+				return []passwords.Password{
+					{SHA1Sum: [20]byte{0, 0x20, 0x01}, Count: 5},
+					{SHA1Sum: [20]byte{0, 0x20, 0x02}, Count: 7},
+				}, nil
+			})),
+		},
+		composite.Source{
+			Name: "blocklist",
+			Service: mockpasswords.New(func(_ context.Context, sum [20]byte) (uint64, error) {
+				return blocklist[sum], nil
+			}, mockpasswords.WithPasswordsByPrefixFunc(func(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+				return []passwords.Password{
+					{SHA1Sum: [20]byte{0, 0x20, 0x02}, Count: 100},
+					{SHA1Sum: [20]byte{0, 0x20, 0x03}, Count: 100},
+				}, nil
+			})),
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
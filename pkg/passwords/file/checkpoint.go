@@ -0,0 +1,101 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const checkpointFilename = "checkpoint.json"
+
+// checkpoint is the progress of writing a database that is saved in the
+// temporary directory after every complete shard.
+type checkpoint struct {
+	Hash         string   `json:"hash"`
+	MinHashCount uint64   `json:"min_hash_count"`
+	ShardCount   int      `json:"shard_count"`
+	CountDecoder string   `json:"count_decoder"`
+	CountClasses []uint64 `json:"count_classes,omitempty"`
+	// Shards is the number of complete shards.
+	Shards int `json:"shards"`
+	// IndexSize is the size of the index file with entries of all complete
+	// shards and the start of the next one.
+	IndexSize int64 `json:"index_size"`
+	// Count is the number of hashes in complete shards.
+	Count uint64 `json:"count"`
+	// LastHash is the hex encoded last hash in complete shards.
+	LastHash string `json:"last_hash"`
+}
+
+// temporaryDir returns the directory where the database is written before it
+// is complete and renamed to the database directory.
+func temporaryDir(dir string) string {
+	return filepath.Clean(dir) + ".tmp"
+}
+
+// readCheckpoint reads the checkpoint from the directory. It returns nil if
+// the checkpoint is not saved.
+func readCheckpoint(dir string) (*checkpoint, error) {
+	b, err := os.ReadFile(filepath.Join(dir, checkpointFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("read checkpoint: %w", err)
+	}
+	var c checkpoint
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, fmt.Errorf("decode checkpoint: %w", err)
+	}
+	if !isShardCountValid(c.ShardCount) || c.Shards < 1 || c.Shards >= c.ShardCount {
+		return nil, errors.New("invalid checkpoint")
+	}
+	return &c, nil
+}
+
+// writeCheckpoint replaces the checkpoint in the directory.
+func writeCheckpoint(dir string, c checkpoint) error {
+	b, err := json.MarshalIndent(c, "", "    ")
+	if err != nil {
+		return fmt.Errorf("encode checkpoint: %w", err)
+	}
+	filename := filepath.Join(dir, checkpointFilename)
+	if err := os.WriteFile(filename+".tmp", b, 0666); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		return fmt.Errorf("write checkpoint: %w", err)
+	}
+	return nil
+}
+
+// matches returns an error if the checkpoint is saved for a database with
+// different options.
+func (c *checkpoint) matches(m meta) error {
+	if c.Hash != m.Hash || c.MinHashCount != m.MinHashCount || c.ShardCount != m.ShardCount || c.CountDecoder != m.CountDecoder {
+		return fmt.Errorf("checkpoint is saved with different options: hash %s, min hash count %v, shard count %v, count decoder %s", c.Hash, c.MinHashCount, c.ShardCount, c.CountDecoder)
+	}
+	if !equalCountClasses(c.CountClasses, m.CountClasses) {
+		return fmt.Errorf("checkpoint is saved with different count classes %v", c.CountClasses)
+	}
+	return nil
+}
+
+func equalCountClasses(a, b []uint64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
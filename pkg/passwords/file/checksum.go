@@ -0,0 +1,98 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ErrChecksumMismatch is returned when the content of a database file does
+// not match the checksum stored in the db.json file.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// checksum returns the hex encoded SHA-256 checksum of the complete file
+// content.
+func checksum(f io.ReaderAt) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, 1<<62)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// fileChecksums returns checksums of all database files in the directory.
+func fileChecksums(dir string, m meta) (map[string]string, error) {
+	filenames := m.dataFilenames()
+	checksums := make(map[string]string, len(filenames))
+	for _, filename := range filenames {
+		sum, err := func() (string, error) {
+			f, err := os.Open(filepath.Join(dir, filename))
+			if err != nil {
+				return "", err
+			}
+			defer f.Close()
+			return checksum(f)
+		}()
+		if err != nil {
+			return nil, fmt.Errorf("checksum %s: %w", filename, err)
+		}
+		checksums[filename] = sum
+	}
+	return checksums, nil
+}
+
+// file returns the open index, hashes or filter file by its filename.
+func (db *database) file(filename string) dataFile {
+	switch filename {
+	case indexFilename:
+		return db.index
+	case filterFilename:
+		return db.filterFile
+	}
+	for i, f := range db.shards {
+		if getShardFilename(i, db.shardCount) == filename {
+			return f
+		}
+	}
+	return nil
+}
+
+// verifyChecksum returns ErrChecksumMismatch if the content of the open
+// database file does not match its checksum from the meta information.
+func (db *database) verifyChecksum(filename string) error {
+	want, ok := db.meta.Checksums[filename]
+	if !ok {
+		return fmt.Errorf("%s: checksum not stored in db.json", filename)
+	}
+	got, err := checksum(db.file(filename))
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	if got != want {
+		return fmt.Errorf("%s: %w", filename, ErrChecksumMismatch)
+	}
+	return nil
+}
+
+// verifyChecksums validates all database files with checksums from the meta
+// information.
+func (db *database) verifyChecksums() error {
+	if len(db.meta.Checksums) == 0 {
+		return errors.New("checksums not stored in db.json")
+	}
+	for _, filename := range db.meta.dataFilenames() {
+		if err := db.verifyChecksum(filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
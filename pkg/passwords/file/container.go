@@ -0,0 +1,372 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Format enumerates database storage formats.
+type Format string
+
+var (
+	// FormatDirectory stores the database in a directory with the db.json
+	// meta information file, the index file and hashes files.
+	FormatDirectory Format = "directory"
+	// FormatContainer stores the database in a single file with the meta
+	// information, the index and all hashes in its sections.
+	FormatContainer Format = "container"
+)
+
+func (f Format) isValid() bool {
+	return f == FormatDirectory || f == FormatContainer
+}
+
+// Container file layout, with all integers encoded in big endian order:
+//
+//	magic            8 bytes
+//	version          uint32
+//	sections count   uint32
+//	sections table   sections count * (kind uint16, shard uint16, offset uint64, size uint64)
+//	sections data    every section at the offset aligned to containerAlignment
+//
+// The meta information section is the JSON encoded db.json content. Index,
+// hashes and filter sections have the same content as files of a database
+// directory.
+const (
+	containerVersion     = 2
+	containerMagic       = "CMPRMSDB"
+	containerHeaderSize  = len(containerMagic) + 4 + 4
+	containerSectionSize = 2 + 2 + 8 + 8
+	containerAlignment   = 4096
+	maxContainerSections = maxShardCount + 2
+
+	// containerFilename is the name of the container file in the temporary
+	// database directory before it is renamed to the database filename.
+	containerFilename = "db.container"
+)
+
+// Container section kinds.
+const (
+	sectionMeta   uint16 = 1
+	sectionIndex  uint16 = 2
+	sectionHashes uint16 = 3
+	sectionFilter uint16 = 4
+)
+
+// containerSection describes the location of a section in the container
+// file.
+type containerSection struct {
+	kind   uint16
+	shard  uint16
+	offset int64
+	size   int64
+}
+
+// isContainer returns true if the database path is a single container file
+// instead of a directory.
+func isContainer(path string) (bool, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	return !stat.IsDir(), nil
+}
+
+// databaseFormat returns the storage format of the database on the path.
+func databaseFormat(path string) (Format, error) {
+	container, err := isContainer(path)
+	if err != nil {
+		return "", err
+	}
+	if container {
+		return FormatContainer, nil
+	}
+	return FormatDirectory, nil
+}
+
+// readContainer reads and validates the header and the meta information of
+// the container file. It returns all sections from the header.
+func readContainer(f dataFile) (m meta, sections []containerSection, err error) {
+	size, err := dataFileSize(f)
+	if err != nil {
+		return m, nil, err
+	}
+	header, err := readAt(f, 0, int64(containerHeaderSize))
+	if err != nil {
+		return m, nil, fmt.Errorf("read container header: %w", err)
+	}
+	if !bytes.Equal(header[:len(containerMagic)], []byte(containerMagic)) {
+		return m, nil, errors.New("not a database container file")
+	}
+	if v := binary.BigEndian.Uint32(header[len(containerMagic):]); v > containerVersion {
+		return m, nil, fmt.Errorf("unsupported container version %v", v)
+	}
+	count := binary.BigEndian.Uint32(header[len(containerMagic)+4:])
+	if count > maxContainerSections {
+		return m, nil, fmt.Errorf("invalid container sections count %v", count)
+	}
+
+	table, err := readAt(f, int64(containerHeaderSize), int64(count)*int64(containerSectionSize))
+	if err != nil {
+		return m, nil, fmt.Errorf("read container sections: %w", err)
+	}
+	metaSection := -1
+	for i := 0; i < int(count); i++ {
+		b := table[i*containerSectionSize:]
+		s := containerSection{
+			kind:   binary.BigEndian.Uint16(b),
+			shard:  binary.BigEndian.Uint16(b[2:]),
+			offset: int64(binary.BigEndian.Uint64(b[4:])),
+			size:   int64(binary.BigEndian.Uint64(b[12:])),
+		}
+		if s.offset < 0 || s.size < 0 || s.offset > size || s.size > size-s.offset {
+			return m, nil, fmt.Errorf("container section %v out of file bounds", i)
+		}
+		sections = append(sections, s)
+		if s.kind == sectionMeta {
+			metaSection = i
+		}
+	}
+	if metaSection < 0 {
+		return m, nil, errors.New("container meta information not found")
+	}
+
+	b, err := readAt(f, sections[metaSection].offset, sections[metaSection].size)
+	if err != nil {
+		return m, nil, fmt.Errorf("read container meta information: %w", err)
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, nil, fmt.Errorf("decode container meta information: %w", err)
+	}
+	if m.Version > version {
+		return m, nil, errors.New("unsupported data version")
+	}
+	return m, sections, nil
+}
+
+// readContainerMeta reads the meta information from the container file.
+func readContainerMeta(filename string) (meta, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return meta{}, err
+	}
+	defer f.Close()
+
+	m, _, err := readContainer(f)
+	return m, err
+}
+
+// openContainer opens the container file with the openFile function and
+// provides its index and hashes sections as database files.
+func openContainer(filename string, openFile func(filename string) (dataFile, error)) (db *database, err error) {
+	f, err := openFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+
+	m, sections, err := readContainer(f)
+	if err != nil {
+		return nil, err
+	}
+	db, err = newDatabase(m)
+	if err != nil {
+		return nil, err
+	}
+	db.format = FormatContainer
+	db.containerFile = f
+
+	db.shards = make(map[int]dataFile, m.ShardCount)
+	for _, s := range sections {
+		switch s.kind {
+		case sectionIndex:
+			if db.index != nil {
+				return nil, errors.New("duplicate container index section")
+			}
+			db.index = &section{file: f, offset: s.offset, size: s.size}
+		case sectionHashes:
+			shard := int(s.shard)
+			if shard >= m.ShardCount {
+				return nil, fmt.Errorf("invalid container hashes section %v", shard)
+			}
+			if _, ok := db.shards[shard]; ok {
+				return nil, fmt.Errorf("duplicate container hashes section %v", shard)
+			}
+			db.shards[shard] = &section{file: f, offset: s.offset, size: s.size}
+		case sectionFilter:
+			db.filterFile = &section{file: f, offset: s.offset, size: s.size}
+		}
+	}
+	if db.index == nil {
+		return nil, errors.New("container index section not found")
+	}
+	for i := 0; i < m.ShardCount; i++ {
+		if _, ok := db.shards[i]; !ok {
+			return nil, fmt.Errorf("container hashes section %v not found", i)
+		}
+	}
+	if m.FilterFalsePositiveRate > 0 && db.filterFile == nil {
+		return nil, errors.New("container filter section not found")
+	}
+	return db, nil
+}
+
+// writeContainer writes the meta information and the index and hashes files
+// from the database directory into a single container file.
+func writeContainer(filename, dir string, m meta) (err error) {
+	metaData, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("encode meta information: %w", err)
+	}
+
+	sections := []containerSection{{kind: sectionMeta, size: int64(len(metaData))}}
+	filenames := []string{""}
+	for i, name := range m.dataFilenames() {
+		size, err := fileSize(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		s := containerSection{kind: sectionHashes, shard: uint16(i - 1), size: size}
+		switch name {
+		case indexFilename:
+			s = containerSection{kind: sectionIndex, size: size}
+		case filterFilename:
+			s = containerSection{kind: sectionFilter, size: size}
+		}
+		sections = append(sections, s)
+		filenames = append(filenames, name)
+	}
+	offset := int64(containerHeaderSize + len(sections)*containerSectionSize)
+	for i := range sections {
+		offset = alignContainerOffset(offset)
+		sections[i].offset = offset
+		offset += sections[i].size
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+		}
+	}()
+	w := bufio.NewWriterSize(f, 64*1024)
+
+	header := make([]byte, containerHeaderSize, containerHeaderSize+len(sections)*containerSectionSize)
+	copy(header, containerMagic)
+	binary.BigEndian.PutUint32(header[len(containerMagic):], containerVersion)
+	binary.BigEndian.PutUint32(header[len(containerMagic)+4:], uint32(len(sections)))
+	for _, s := range sections {
+		var b [containerSectionSize]byte
+		binary.BigEndian.PutUint16(b[0:], s.kind)
+		binary.BigEndian.PutUint16(b[2:], s.shard)
+		binary.BigEndian.PutUint64(b[4:], uint64(s.offset))
+		binary.BigEndian.PutUint64(b[12:], uint64(s.size))
+		header = append(header, b[:]...)
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	position := int64(len(header))
+	for i, s := range sections {
+		if _, err := w.Write(make([]byte, s.offset-position)); err != nil {
+			return err
+		}
+		if s.kind == sectionMeta {
+			if _, err := w.Write(metaData); err != nil {
+				return err
+			}
+		} else if err := copyFile(w, filepath.Join(dir, filenames[i]), s.size); err != nil {
+			return fmt.Errorf("%s: %w", filenames[i], err)
+		}
+		position = s.offset + s.size
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return syncClose(f)
+}
+
+// alignContainerOffset returns the first offset of a section that is not
+// lower than the provided one.
+func alignContainerOffset(offset int64) int64 {
+	return (offset + containerAlignment - 1) / containerAlignment * containerAlignment
+}
+
+// copyFile writes the complete content of the file, which must have the
+// provided size, to the writer.
+func copyFile(w io.Writer, filename string, size int64) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("copied %v bytes instead %v", n, size)
+	}
+	return nil
+}
+
+func fileSize(filename string) (int64, error) {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return 0, err
+	}
+	return stat.Size(), nil
+}
+
+// section provides positional reads of a part of the container file. Closing
+// the section does not close the container file.
+type section struct {
+	file   dataFile
+	offset int64
+	size   int64
+}
+
+// ReadAt implements io.ReaderAt interface.
+func (s *section) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= s.size {
+		return 0, io.EOF
+	}
+	if available := s.size - off; int64(len(p)) > available {
+		n, err = s.file.ReadAt(p[:available], s.offset+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return s.file.ReadAt(p, s.offset+off)
+}
+
+// Close does not close the container file which is closed by the database.
+func (s *section) Close() error {
+	return nil
+}
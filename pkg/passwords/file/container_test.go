@@ -0,0 +1,167 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestContainer(t *testing.T) {
+	const inputFilename = "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+	dir := t.TempDir()
+	noLog := func(string, ...interface{}) {}
+
+	dbDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+		ShardCount: 4,
+	})
+
+	containerFilename, count := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+		ShardCount: 4,
+		Format:     file.FormatContainer,
+	})
+
+	stat, err := os.Stat(containerFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stat.IsDir() {
+		t.Fatal("container is a directory")
+	}
+	if _, err := os.Stat(file.TemporaryDir(containerFilename)); !os.IsNotExist(err) {
+		t.Errorf("temporary directory not removed: %v", err)
+	}
+
+	if err := file.Verify(containerFilename, &file.VerifyOptions{LogFunc: noLog}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mode := range []file.Mode{file.ModeFile, file.ModeMmap} {
+		if mode == file.ModeMmap && runtime.GOOS == "windows" {
+			continue
+		}
+		s, err := file.New(containerFilename, &file.Options{
+			Mode:            mode,
+			VerifyChecksums: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stats, err := s.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Format != file.FormatContainer {
+			t.Errorf("got format %s, want %s", stats.Format, file.FormatContainer)
+		}
+		if stats.Version != 1 {
+			t.Errorf("got version %v, want 1", stats.Version)
+		}
+		if stats.Count != count {
+			t.Errorf("got count %v, want %v", stats.Count, count)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var want, got bytes.Buffer
+	if _, err := file.Export(dbDir, &want, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Export(containerFilename, &got, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Error("container hashes are not the same as directory hashes")
+	}
+
+	// converting the container back to the directory format creates the
+	// same database files
+	convertedDir := filepath.Join(dir, "converted")
+	if _, err := file.Reindex(containerFilename, convertedDir, &file.ReindexOptions{
+		Format:  file.FormatDirectory,
+		LogFunc: noLog,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	assertSameDataFiles(t, convertedDir, dbDir)
+
+	// merging keeps the container format
+	mergedFilename := filepath.Join(dir, "merged.container")
+	if _, err := file.Merge(containerFilename, inputFilename, mergedFilename, &file.MergeOptions{
+		LogFunc: noLog,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if stat, err := os.Stat(mergedFilename); err != nil {
+		t.Fatal(err)
+	} else if stat.IsDir() {
+		t.Error("merged container is a directory")
+	}
+}
+
+func TestContainer_invalid(t *testing.T) {
+	dir := t.TempDir()
+
+	containerFilename, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", &file.IndexOptions{
+		Format: file.FormatContainer,
+	})
+	data, err := os.ReadFile(containerFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		data    []byte
+		wantErr string
+	}{
+		{
+			name:    "empty",
+			data:    nil,
+			wantErr: "read container header: short read at 0: 0 instead 16",
+		},
+		{
+			name:    "magic",
+			data:    append([]byte("NOTADB00"), data[8:]...),
+			wantErr: "not a database container file",
+		},
+		{
+			name:    "version",
+			data:    append(append(append([]byte(nil), data[:8]...), 0, 0, 0, 3), data[12:]...),
+			wantErr: "unsupported container version 3",
+		},
+		{
+			name:    "truncated",
+			data:    data[:len(data)-1],
+			wantErr: "out of file bounds",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(dir, tc.name)
+			if err := os.WriteFile(filename, tc.data, 0666); err != nil {
+				t.Fatal(err)
+			}
+			for _, mode := range []file.Mode{file.ModeFile, file.ModeMmap} {
+				if mode == file.ModeMmap && runtime.GOOS == "windows" {
+					continue
+				}
+				_, err := file.New(filename, &file.Options{Mode: mode})
+				if err == nil || !strings.HasSuffix(err.Error(), tc.wantErr) {
+					t.Errorf("%s: got error %v, want %q", mode, err, tc.wantErr)
+				}
+			}
+		})
+	}
+}
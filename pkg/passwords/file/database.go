@@ -0,0 +1,395 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"resenje.org/compromised/pkg/approxcount"
+	"resenje.org/compromised/pkg/filter"
+)
+
+// database holds open files of a single database directory or a container
+// file.
+type database struct {
+	meta              meta
+	format            Format
+	index             dataFile
+	shards            map[int]dataFile
+	shardCount        int
+	hash              Hash
+	hashRemainderSize int64
+	countDecoder      func([]byte) uint64
+	// countEncodedSize is the size of encoded counts, or the minimal size
+	// of variable length counts.
+	countEncodedSize int64
+	// varintCounts is true if counts are encoded as variable length
+	// integers, when index positions are offsets in bytes instead of record
+	// numbers.
+	varintCounts bool
+	// containerFile is the open container file that index and hashes
+	// sections are read from, if the database is stored in a single file.
+	containerFile dataFile
+	// filterFile is the open filter file, if the database has it, and the
+	// filter is the filter from it, if it is loaded.
+	filterFile dataFile
+	filter     *filter.Bloom
+
+	// refs counts lookups that are in progress, so that the database is
+	// closed only after all of them are done.
+	refs sync.WaitGroup
+}
+
+// openDatabase reads the database meta information from the directory and
+// opens all database files with the openFile function. If the path is a
+// container file, it is opened with the openFile function instead.
+func openDatabase(path string, openFile func(filename string) (dataFile, error)) (*database, error) {
+	container, err := isContainer(path)
+	if err != nil {
+		return nil, err
+	}
+	if container {
+		return openContainer(path, openFile)
+	}
+
+	m, err := readDirectoryMeta(path)
+	if err != nil {
+		return nil, err
+	}
+	return openDirectory(path, m, openFile)
+}
+
+// openDirectory opens all database files in the directory with the provided
+// meta information.
+func openDirectory(dir string, m meta, openFile func(filename string) (dataFile, error)) (*database, error) {
+	db, err := newDatabase(m)
+	if err != nil {
+		return nil, err
+	}
+	db.format = FormatDirectory
+
+	index, err := openFile(filepath.Join(dir, indexFilename))
+	if err != nil {
+		return nil, err
+	}
+	shards := make(map[int]dataFile, m.ShardCount)
+	for i := 0; i < m.ShardCount; i++ {
+		f, err := openFile(filepath.Join(
+			dir,
+			getShardFilename(i, m.ShardCount),
+		))
+		if err != nil {
+			for _, f := range shards {
+				f.Close()
+			}
+			index.Close()
+			return nil, fmt.Errorf("open hashes file %v: %w", i, err)
+		}
+		shards[i] = f
+	}
+	db.index = index
+	db.shards = shards
+	if m.FilterFalsePositiveRate > 0 {
+		f, err := openFile(filepath.Join(dir, filterFilename))
+		if err != nil {
+			db.close()
+			return nil, fmt.Errorf("open filter file: %w", err)
+		}
+		db.filterFile = f
+	}
+	return db, nil
+}
+
+// newDatabase validates the meta information and returns the database
+// without open files.
+func newDatabase(m meta) (*database, error) {
+	hash := Hash(m.Hash)
+	if hash.size() == 0 {
+		return nil, errors.New("unsupported hashing algorithm")
+	}
+	if !isShardCountValid(m.ShardCount) {
+		return nil, errors.New("invalid shard count")
+	}
+
+	var countDecoder func([]byte) uint64
+	var countEncodedSize int64
+	var varintCounts bool
+	switch m.CountDecoder {
+	case "big32":
+		countDecoder = func(b []byte) uint64 {
+			return uint64(binary.BigEndian.Uint32(b))
+		}
+		countEncodedSize = 4
+	case "approx8":
+		e, err := approxcount.NewEncoder(uint64(m.MaxHashCount))
+		if err != nil {
+			return nil, err
+		}
+		countDecoder = func(b []byte) uint64 {
+			return e.Decode(b[0])
+		}
+		countEncodedSize = 1
+	case "approx16":
+		e, err := approxcount.NewEncoder16(uint64(m.MaxHashCount))
+		if err != nil {
+			return nil, err
+		}
+		countDecoder = func(b []byte) uint64 {
+			return e.Decode(binary.BigEndian.Uint16(b))
+		}
+		countEncodedSize = 2
+	case "uvarint":
+		countDecoder = func(b []byte) uint64 {
+			v, _ := binary.Uvarint(b)
+			return v
+		}
+		countEncodedSize = 1
+		varintCounts = true
+	case "classes":
+		if err := validateCountClasses(m.CountClasses); err != nil {
+			return nil, err
+		}
+		classes := m.CountClasses
+		countDecoder = func(b []byte) uint64 {
+			if int(b[0]) >= len(classes) {
+				return classes[len(classes)-1]
+			}
+			return classes[b[0]]
+		}
+		countEncodedSize = 1
+	case "none":
+		countDecoder = func(b []byte) uint64 {
+			return 1
+		}
+		countEncodedSize = 0
+	default:
+		return nil, errors.New("invalid count decoder")
+	}
+
+	return &database{
+		meta:              m,
+		shardCount:        m.ShardCount,
+		hash:              hash,
+		hashRemainderSize: int64(hash.size() - partitionSize),
+		countDecoder:      countDecoder,
+		countEncodedSize:  countEncodedSize,
+		varintCounts:      varintCounts,
+	}, nil
+}
+
+// readMeta reads and validates the meta information from the database
+// directory or the container file.
+func readMeta(path string) (meta, error) {
+	container, err := isContainer(path)
+	if err != nil {
+		return meta{}, err
+	}
+	if container {
+		return readContainerMeta(path)
+	}
+	return readDirectoryMeta(path)
+}
+
+// readDirectoryMeta reads and validates the meta information file from the
+// database directory.
+func readDirectoryMeta(dir string) (m meta, err error) {
+	b, err := os.ReadFile(filepath.Join(dir, "db.json"))
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, err
+	}
+	if m.Version > version {
+		return m, errors.New("unsupported data version")
+	}
+	return m, nil
+}
+
+// loadFilter reads the filter from the filter file into memory, if the
+// database has it.
+func (db *database) loadFilter() error {
+	if db.filterFile == nil {
+		return nil
+	}
+	f, err := filter.ReadBloom(io.NewSectionReader(db.filterFile, 0, 1<<62))
+	if err != nil {
+		return fmt.Errorf("load filter: %w", err)
+	}
+	db.filter = f
+	return nil
+}
+
+// recordSize returns the size of a single hash record in shard files, or the
+// minimal size of records with variable length counts.
+func (db *database) recordSize() int64 {
+	return db.hashRemainderSize + db.countEncodedSize
+}
+
+// positionSize returns the number of bytes in shard files for a single index
+// position, which is the record size, or a single byte for records with
+// variable length counts.
+func (db *database) positionSize() int64 {
+	if db.varintCounts {
+		return 1
+	}
+	return db.recordSize()
+}
+
+// parseRecord returns the hash remainder and the decoded count of the first
+// record in b and the size of the record. The size is 0 if b does not start
+// with a complete valid record.
+func (db *database) parseRecord(b []byte) (remainder []byte, count uint64, size int) {
+	remainderSize := int(db.hashRemainderSize)
+	if db.varintCounts {
+		if len(b) <= remainderSize {
+			return nil, 0, 0
+		}
+		count, n := binary.Uvarint(b[remainderSize:])
+		if n <= 0 {
+			return nil, 0, 0
+		}
+		return b[:remainderSize], count, remainderSize + n
+	}
+	recordSize := int(db.recordSize())
+	if len(b) < recordSize {
+		return nil, 0, 0
+	}
+	return b[:remainderSize], db.countDecoder(b[remainderSize:recordSize]), recordSize
+}
+
+// readRecord reads the next record from the hashes file, copies its hash
+// remainder into the provided slice and returns its decoded count and the
+// number of index positions that it takes.
+func (db *database) readRecord(r *bufio.Reader, remainder []byte) (count uint64, positions uint32, err error) {
+	maxSize := int(db.recordSize())
+	if db.varintCounts {
+		maxSize = int(db.hashRemainderSize) + binary.MaxVarintLen64
+	}
+	b, err := r.Peek(maxSize)
+	if len(b) == 0 {
+		return 0, 0, err
+	}
+	rem, count, size := db.parseRecord(b)
+	if size == 0 {
+		if err == io.EOF {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		return 0, 0, errors.New("invalid record")
+	}
+	copy(remainder, rem)
+	if _, err := r.Discard(size); err != nil {
+		return 0, 0, err
+	}
+	if db.varintCounts {
+		return count, uint32(size), nil
+	}
+	return count, 1, nil
+}
+
+// The index file has a big endian uint32 entry for every partition with the
+// position in the hashes file of its shard after the last record of the
+// partition, and a zero entry before entries of every shard, so that the
+// position of the first record of a partition is the entry before its own.
+// Positions are record numbers, or offsets in bytes for variable length
+// counts.
+//
+// Databases indexed by earlier versions have the zero entry of a shard just
+// before the entry of its first partition with hashes, so partitions without
+// hashes before it have the end of the previous shard as the start value.
+// That is why a partition has records only if its end is after its start.
+
+// partitionRange returns the start and the end position of records of the
+// partition from the index entries buffer, where i is the number of the
+// partition entry that holds its start. It returns false if the partition has
+// no records.
+func partitionRange(index []byte, i int) (start, end uint32, ok bool) {
+	start = binary.BigEndian.Uint32(index[i*indexLocationEncodedSize:])
+	end = binary.BigEndian.Uint32(index[(i+1)*indexLocationEncodedSize:])
+	return start, end, end > start
+}
+
+// partitionRecords returns all hash records from the partition that the hash
+// belongs to.
+func (db *database) partitionRecords(hash []byte) ([]byte, error) {
+	shard := getShard(int(hash[0]), db.shardCount)
+
+	partition := uint24(hash[:partitionSize])
+
+	indexLocation := (int64(partition) + int64(shard)) * indexLocationEncodedSize // add the shard count as it starts with a zero value step
+
+	buf, err := readAt(db.index, indexLocation, indexReadSize)
+	if err != nil {
+		return nil, &lookupError{stage: indexErrorStage(err), err: fmt.Errorf("index: %w", err)}
+	}
+
+	start, end, ok := partitionRange(buf, 0)
+	if !ok {
+		return nil, nil
+	}
+
+	hashRemainderStep := db.positionSize()
+	hashRemaindersStart := int64(start) * hashRemainderStep
+	hashRemaindersEnd := int64(end) * hashRemainderStep
+
+	records, err := readAt(db.shards[shard], hashRemaindersStart, hashRemaindersEnd-hashRemaindersStart)
+	if err != nil {
+		return nil, &lookupError{stage: lookupStageShardRead, err: fmt.Errorf("hashes %v: %w", shard, err)}
+	}
+	return records, nil
+}
+
+// lookupError is returned by partitionRecords with the stage of the lookup
+// that failed.
+type lookupError struct {
+	stage string
+	err   error
+}
+
+func (e *lookupError) Error() string { return e.err.Error() }
+func (e *lookupError) Unwrap() error { return e.err }
+
+// indexErrorStage returns the lookup stage of the error of reading the index.
+// A short read is a location beyond the end of the index, which is the
+// positional equivalent of a failed seek.
+func indexErrorStage(err error) string {
+	if errors.Is(err, errShortRead) {
+		return lookupStageIndexSeek
+	}
+	return lookupStageIndexRead
+}
+
+// close closes all open files.
+func (db *database) close() error {
+	for v, f := range db.shards {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("close hashes file %v: %w", v, err)
+		}
+	}
+	if err := db.index.Close(); err != nil {
+		return err
+	}
+	if db.filterFile != nil {
+		if err := db.filterFile.Close(); err != nil {
+			return fmt.Errorf("close filter file: %w", err)
+		}
+	}
+	if db.containerFile != nil {
+		return db.containerFile.Close()
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ExportOptions holds optional parameters for exporting a database.
+type ExportOptions struct {
+	// MinHashCount filters out hashes with lower compromised counts.
+	MinHashCount uint64
+	// StartPrefix is the hexadecimal prefix of the first exported hash.
+	// Hashes with lower prefixes of the same length are not exported.
+	StartPrefix string
+	// EndPrefix is the hexadecimal prefix of the last exported hash. Hashes
+	// with higher prefixes of the same length are not exported.
+	EndPrefix string
+}
+
+// Export writes hashes from the database to the writer as HASH:COUNT lines
+// ordered by hashes, in the same format as the input of Index. Hash prefixes
+// are reconstructed from the index and counts are decoded with the database
+// count decoder, so that approximate counts are written as approximated
+// values and all counts are 1 if the database does not store them. It
+// returns the number of written hashes.
+func Export(dbDir string, w io.Writer, o *ExportOptions) (uint64, error) {
+	if o == nil {
+		o = new(ExportOptions)
+	}
+
+	m, err := readMeta(dbDir)
+	if err != nil {
+		return 0, err
+	}
+	hashHexSize := Hash(m.Hash).size() * 2
+	if hashHexSize == 0 {
+		return 0, fmt.Errorf("unsupported hash %s", m.Hash)
+	}
+
+	startPrefix := strings.ToUpper(o.StartPrefix)
+	endPrefix := strings.ToUpper(o.EndPrefix)
+	for _, p := range []string{startPrefix, endPrefix} {
+		if len(p) > hashHexSize {
+			return 0, fmt.Errorf("prefix %s longer than %s hash", p, m.Hash)
+		}
+		if _, err := hex.DecodeString(p + strings.Repeat("0", len(p)%2)); err != nil {
+			return 0, fmt.Errorf("invalid prefix %s: %w", p, err)
+		}
+	}
+	firstPartition, err := prefixPartition(startPrefix, '0')
+	if err != nil {
+		return 0, err
+	}
+	lastPartition := maxUint24
+	if endPrefix != "" {
+		lastPartition, err = prefixPartition(endPrefix, 'F')
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	bw := bufio.NewWriterSize(w, 64*1024)
+	line := make([]byte, 0, hashHexSize+22)
+	var count uint64
+	if err := iterateRange(dbDir, firstPartition, lastPartition, func(hash []byte, c uint64) error {
+		if c < o.MinHashCount {
+			return nil
+		}
+		line = line[:0]
+		for _, b := range hash {
+			line = append(line, upperHexDigits[b>>4], upperHexDigits[b&0x0f])
+		}
+		if startPrefix != "" && string(line[:len(startPrefix)]) < startPrefix {
+			return nil
+		}
+		if endPrefix != "" && string(line[:len(endPrefix)]) > endPrefix {
+			return nil
+		}
+		line = append(line, ':')
+		line = strconv.AppendUint(line, c, 10)
+		line = append(line, '\n')
+		if _, err := bw.Write(line); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// upperHexDigits are used to encode hashes in the same way as in pwned
+// passwords files.
+const upperHexDigits = "0123456789ABCDEF"
+
+// prefixPartition returns the partition of hashes with the hexadecimal prefix
+// which is padded with the provided digit to the partition size.
+func prefixPartition(prefix string, pad byte) (int, error) {
+	const partitionHexSize = partitionSize * 2
+	if len(prefix) > partitionHexSize {
+		prefix = prefix[:partitionHexSize]
+	}
+	prefix += strings.Repeat(string(pad), partitionHexSize-len(prefix))
+	p, err := strconv.ParseUint(prefix, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid prefix %s: %w", prefix, err)
+	}
+	return int(p), nil
+}
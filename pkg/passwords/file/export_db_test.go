@@ -0,0 +1,153 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestExport(t *testing.T) {
+	for _, tc := range []struct {
+		inputFilename string
+		hash          file.Hash
+	}{
+		{
+			inputFilename: "testdata/pwned-passwords-sha1-ordered-by-hash.txt",
+			hash:          file.HashSHA1,
+		},
+		{
+			inputFilename: "testdata/pwned-passwords-ntlm-ordered-by-hash.txt",
+			hash:          file.HashNTLM,
+		},
+	} {
+		t.Run(string(tc.hash), func(t *testing.T) {
+			data, err := os.ReadFile(tc.inputFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+			dbDir, _ := indexTestDatabase(t, tc.inputFilename, &file.IndexOptions{
+				Hash: tc.hash,
+			})
+
+			for _, o := range []file.ExportOptions{
+				{},
+				{MinHashCount: 10},
+				{StartPrefix: "1", EndPrefix: "3a"},
+				{StartPrefix: "01BD1723", EndPrefix: "01BD17"},
+				{StartPrefix: "5", MinHashCount: 3},
+				{EndPrefix: "0"},
+				{StartPrefix: "FFFFFFF"},
+			} {
+				t.Run(fmt.Sprintf("%+v", o), func(t *testing.T) {
+					var want []string
+					for _, line := range lines {
+						count, err := strconv.ParseUint(line[strings.IndexByte(line, ':')+1:], 10, 64)
+						if err != nil {
+							t.Fatal(err)
+						}
+						if count < o.MinHashCount {
+							continue
+						}
+						if p := strings.ToUpper(o.StartPrefix); line[:len(p)] < p {
+							continue
+						}
+						if p := strings.ToUpper(o.EndPrefix); line[:len(p)] > p {
+							continue
+						}
+						want = append(want, line+"\n")
+					}
+
+					var buf bytes.Buffer
+					n, err := file.Export(dbDir, &buf, &o)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if n != uint64(len(want)) {
+						t.Errorf("got %v exported hashes, want %v", n, len(want))
+					}
+					if got, want := buf.String(), strings.Join(want, ""); got != want {
+						t.Errorf("got exported data\n%s\nwant\n%s", got, want)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestExport_reshard(t *testing.T) {
+	const inputFilename = "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+	noLog := func(string, ...interface{}) {}
+
+	hashCountings := []file.HashCounting{file.HashCountingExact, file.HashCountingVarint}
+	if !testing.Short() {
+		hashCountings = append(hashCountings, file.HashCountingClasses, file.HashCountingNone)
+	}
+	for _, hashCounting := range hashCountings {
+		t.Run(string(hashCounting), func(t *testing.T) {
+			dir := t.TempDir()
+
+			dbDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+				ShardCount:   32,
+				HashCounting: hashCounting,
+			})
+
+			exportFilename := filepath.Join(dir, "export.txt")
+			f, err := os.Create(exportFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := file.Export(dbDir, f, nil); err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			wantDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+				ShardCount:   4,
+				HashCounting: hashCounting,
+			})
+
+			gotDir := filepath.Join(dir, "got")
+			if _, err := file.Index(exportFilename, gotDir, &file.IndexOptions{
+				ShardCount:   4,
+				HashCounting: hashCounting,
+				LogFunc:      noLog,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			assertSameDataFiles(t, gotDir, wantDir)
+		})
+	}
+}
+
+func TestExport_invalidPrefix(t *testing.T) {
+	dbDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-ntlm-ordered-by-hash.txt", &file.IndexOptions{
+		Hash: file.HashNTLM,
+	})
+
+	for _, o := range []file.ExportOptions{
+		{StartPrefix: "12G"},
+		{EndPrefix: "0000000x"},
+		{StartPrefix: strings.Repeat("0", 33)},
+	} {
+		if _, err := file.Export(dbDir, new(bytes.Buffer), &o); err == nil {
+			t.Errorf("expected error for %+v", o)
+		}
+	}
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+type SearchFunc = searchFunc
+
+var (
+	LinearSearch        = linearSearch
+	BinarySearch        = binarySearch
+	InterpolationSearch = interpolationSearch
+	TemporaryDir        = temporaryDir
+)
+
+func SetSearchFunc(s *Service, f SearchFunc) {
+	s.search = f
+}
+
+func SetIndexBlockSize(size int) (reset func()) {
+	prev := indexBlockSize
+	indexBlockSize = size
+	return func() { indexBlockSize = prev }
+}
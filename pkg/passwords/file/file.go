@@ -9,21 +9,49 @@ import (
 	"crypto/sha1"
 	"fmt"
 	"strconv"
+	"time"
 )
 
 const (
 	version           = 1
-	supportedHash     = "sha1"
 	defaultShardCount = 32
 	maxShardCount     = 256
 
+	indexFilename  = "index.db"
+	filterFilename = "filter.db"
+
 	partitionSize            = 3 // uint24 size in bytes
 	indexLocationEncodedSize = 4 // uint32 size in bytes
 	indexReadSize            = indexLocationEncodedSize * 2
-	hashRemainderSize        = sha1.Size - partitionSize
 	maxUint24                = 1<<24 - 1
+
+	ntlmSize = 16 // MD4 hash size in bytes
+
+	rangePrefixBits      = 20 // five hexadecimal digits
+	rangePartitionsCount = 1 << (partitionSize*8 - rangePrefixBits)
 )
 
+// Hash enumerates supported password hashing algorithms.
+type Hash string
+
+var (
+	// HashSHA1 is SHA1 hash of a password.
+	HashSHA1 Hash = "sha1"
+	// HashNTLM is NTLM hash of a password, MD4 hash of its UTF-16LE encoding.
+	HashNTLM Hash = "ntlm"
+)
+
+// size returns the size of the hash in bytes or 0 if the hash is not supported.
+func (h Hash) size() int {
+	switch h {
+	case HashSHA1:
+		return sha1.Size
+	case HashNTLM:
+		return ntlmSize
+	}
+	return 0
+}
+
 var validShardCounts = []int{1, 2, 4, 8, 16, 32, 64, 128, 256}
 
 type meta struct {
@@ -34,8 +62,45 @@ type meta struct {
 	MaxHashCount uint64 `json:"max_hash_count"`
 	ShardCount   int    `json:"shard_count"`
 	CountDecoder string `json:"count_decoder"`
+	// CountClasses are lower bounds of count classes of the classes count
+	// decoder.
+	CountClasses []uint64 `json:"count_classes,omitempty"`
+	// Lineage lists all operations that produced the database, from the
+	// initial indexing to the latest merge.
+	Lineage []Lineage `json:"lineage,omitempty"`
+	// Checksums are hex encoded SHA-256 checksums of the index, hashes and
+	// filter files by their filenames.
+	Checksums map[string]string `json:"checksums,omitempty"`
+	// FilterFalsePositiveRate is the target false positive rate of the Bloom
+	// filter of all hashes in the filter.db file. The filter is not stored
+	// if it is 0.
+	FilterFalsePositiveRate float64 `json:"filter_false_positive_rate,omitempty"`
 }
 
+// Lineage describes an operation that produced a database.
+type Lineage struct {
+	// Operation is index for the initial indexing, merge for updates or
+	// reindex for changes of database options.
+	Operation string    `json:"operation"`
+	Time      time.Time `json:"time"`
+	// Input is the filename of the input file.
+	Input string `json:"input"`
+	// Base is the directory of the merged database.
+	Base string `json:"base,omitempty"`
+	// Count is the number of hashes after the operation.
+	Count   uint64 `json:"count"`
+	Added   uint64 `json:"added,omitempty"`
+	Updated uint64 `json:"updated,omitempty"`
+	Removed uint64 `json:"removed,omitempty"`
+}
+
+// Lineage operations.
+const (
+	lineageIndex   = "index"
+	lineageMerge   = "merge"
+	lineageReindex = "reindex"
+)
+
 func isShardCountValid(v int) bool {
 	for _, c := range validShardCounts {
 		if v == c {
@@ -50,6 +115,19 @@ func getShard(b, shardCount int) int {
 	return b / d
 }
 
+// dataFilenames returns filenames of the index file, all hashes files and the
+// filter file, if the database has it.
+func (m meta) dataFilenames() []string {
+	filenames := []string{indexFilename}
+	for i := 0; i < m.ShardCount; i++ {
+		filenames = append(filenames, getShardFilename(i, m.ShardCount))
+	}
+	if m.FilterFalsePositiveRate > 0 {
+		filenames = append(filenames, filterFilename)
+	}
+	return filenames
+}
+
 func getShardFilename(shard, shardCount int) string {
 	if shardCount == 1 {
 		return "hashes.db"
@@ -0,0 +1,173 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestService_filter(t *testing.T) {
+	dir := t.TempDir()
+	noLog := func(string, ...interface{}) {}
+
+	dbDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", &file.IndexOptions{
+		FilterFalsePositiveRate: 0.01,
+	})
+
+	if _, err := os.Stat(filepath.Join(dbDir, "filter.db")); err != nil {
+		t.Fatal(err)
+	}
+	if err := file.Verify(dbDir, &file.VerifyOptions{LogFunc: noLog}); err != nil {
+		t.Fatal(err)
+	}
+
+	const misses = 1000
+	hit := hexDecodeSHA1Sum(t, "01BD172389F8C32824FEA8B2EF228853D225291B")
+
+	for _, disableFilter := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disable filter %v", disableFilter), func(t *testing.T) {
+			s, err := file.New(dbDir, &file.Options{
+				DisableFilter: disableFilter,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			isPasswordCompromised(t, s, "01BD172389F8C32824FEA8B2EF228853D225291B", 15, 0)
+			for i := 0; i < misses; i++ {
+				count, err := s.IsPasswordCompromised(context.Background(), sha1.Sum([]byte(fmt.Sprintf("not compromised %v", i))))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count != 0 {
+					t.Fatalf("got count %v for not compromised password %v", count, i)
+				}
+			}
+			counts, err := s.ArePasswordsCompromised(context.Background(), [][20]byte{hit, {}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if counts[0] != 15 || counts[1] != 0 {
+				t.Errorf("got batch counts %v, want [15 0]", counts)
+			}
+
+			hits := counterValue(t, s, "compromised_passwords_filter_hit_count")
+			filterMisses := counterValue(t, s, "compromised_passwords_filter_miss_count")
+			falsePositives := counterValue(t, s, "compromised_passwords_filter_false_positive_count")
+
+			if disableFilter {
+				if hits != 0 || filterMisses != 0 || falsePositives != 0 {
+					t.Errorf("got filter metrics %v, %v, %v with disabled filter", hits, filterMisses, falsePositives)
+				}
+				return
+			}
+			// two hits of the compromised password and the zero hash
+			if hits+filterMisses != misses+3 {
+				t.Errorf("got %v filter hits and %v misses for %v lookups", hits, filterMisses, misses+3)
+			}
+			if filterMisses < 2 {
+				t.Errorf("got %v filter misses for compromised passwords", filterMisses)
+			}
+			if falsePositives != filterMisses-2 {
+				t.Errorf("got %v false positives for %v filter misses", falsePositives, filterMisses)
+			}
+			if falsePositives > misses/20 {
+				t.Errorf("got %v false positives for %v not compromised passwords", falsePositives, misses)
+			}
+		})
+	}
+
+	t.Run("stats", func(t *testing.T) {
+		s, err := file.New(dbDir, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+
+		stats, err := s.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.FilterFalsePositiveRate != 0.01 {
+			t.Errorf("got filter false positive rate %v, want 0.01", stats.FilterFalsePositiveRate)
+		}
+		stat, err := os.Stat(filepath.Join(dbDir, "filter.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.FilterSize != stat.Size() {
+			t.Errorf("got filter size %v, want %v", stats.FilterSize, stat.Size())
+		}
+	})
+
+	t.Run("reindex", func(t *testing.T) {
+		outputDir := filepath.Join(dir, "reindexed")
+		if _, err := file.Reindex(dbDir, outputDir, &file.ReindexOptions{
+			ShardCount: 2,
+			LogFunc:    noLog,
+		}); err != nil {
+			t.Fatal(err)
+		}
+		// the filter depends only on hashes, not on the shard count
+		got, err := os.ReadFile(filepath.Join(outputDir, "filter.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := os.ReadFile(filepath.Join(dbDir, "filter.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Error("reindexed filter differs")
+		}
+	})
+}
+
+func TestIndex_invalidFilterFalsePositiveRate(t *testing.T) {
+	for _, rate := range []float64{-0.1, 1, 2} {
+		_, err := file.Index("testdata/pwned-passwords-sha1-ordered-by-hash.txt", filepath.Join(t.TempDir(), "db"), &file.IndexOptions{
+			FilterFalsePositiveRate: rate,
+			LogFunc:                 func(string, ...interface{}) {},
+		})
+		if want := fmt.Sprintf("invalid filter false positive rate %v", rate); err == nil || err.Error() != want {
+			t.Errorf("got error %v, want %q", err, want)
+		}
+	}
+}
+
+// counterValue returns the value of the service counter by its name.
+func counterValue(t *testing.T, s *file.Service, name string) float64 {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	for _, c := range s.Metrics() {
+		if err := registry.Register(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() == name {
+			return f.GetMetric()[0].GetCounter().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not found", name)
+	return 0
+}
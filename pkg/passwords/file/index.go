@@ -6,19 +6,12 @@
 package file
 
 import (
-	"bufio"
-	"encoding/binary"
-	"encoding/hex"
-	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
-	"strconv"
+	"sort"
 	"time"
-
-	"resenje.org/compromised/pkg/approxcount"
 )
 
 // IndexOptions holds oprional parameter for indexing pwned passwords data.
@@ -31,6 +24,35 @@ type IndexOptions struct {
 	// HashCounting specifies if hashes compromised count should be exact,
 	// approximate or none in order to have more compact database.
 	HashCounting HashCounting
+	// CountClasses are lower bounds of count classes for the
+	// HashCountingClasses hash counting, in ascending order and starting
+	// with 1. The default is DefaultCountClasses.
+	CountClasses []uint64
+	// Hash specifies the hashing algorithm of hashes in the input file. The
+	// default is HashSHA1.
+	Hash Hash
+	// Format specifies if the database is stored in a directory or in a
+	// single container file. The default is FormatDirectory.
+	Format Format
+	// FilterFalsePositiveRate is the target false positive rate of the Bloom
+	// filter of all hashes which is stored with the database, so that the
+	// service can find out that a password is not compromised without
+	// reading database files. The filter requires around 1.44*log2(1/rate)
+	// bits per hash, in memory when it is created and when the database is
+	// opened. The filter is not created if the rate is 0.
+	FilterFalsePositiveRate float64
+	// Concurrency is the number of goroutines that parse input lines. Input
+	// reading and database writing are always sequential, and the created
+	// database is the same regardless of this option. Values lower than 2
+	// index the input with a single goroutine.
+	Concurrency int
+	// Resume continues indexing that was interrupted, from the last
+	// checkpoint saved in the temporary directory next to the output
+	// directory. The input must be the same as in the interrupted indexing
+	// and it is read again from the beginning, but hashes that are already
+	// indexed are not written again. If there is no temporary directory,
+	// indexing starts from the beginning.
+	Resume bool
 	// LogFunc can be specified as a custom receiver of log messages.
 	LogFunc func(string, ...interface{})
 }
@@ -43,14 +65,89 @@ var (
 	HashCountingExact HashCounting = "exact"
 	// HashCountingApprox stores counts with approximation of around 5%.
 	HashCountingApprox HashCounting = "approx"
+	// HashCountingApprox16 stores counts in two bytes with approximation of
+	// around 0.01%, where counts up to a few thousands are exact.
+	HashCountingApprox16 HashCounting = "approx16"
+	// HashCountingVarint stores exact counts as variable length integers,
+	// in one byte for counts lower than 128 and in more bytes for higher
+	// counts. Index positions are offsets in bytes instead of hash numbers
+	// and every hashes file must be smaller than 4GB.
+	HashCountingVarint HashCounting = "varint"
+	// HashCountingClasses stores only the class of counts in one byte, and
+	// the lower bound of the class is returned as the count. Classes are
+	// specified by the CountClasses option.
+	HashCountingClasses HashCounting = "classes"
 	// HashCountingNone does not store counts.
 	HashCountingNone HashCounting = "none"
 )
 
+// DefaultCountClasses are lower bounds of count classes of the
+// HashCountingClasses hash counting, in the 1-2-5 sequence.
+var DefaultCountClasses = []uint64{
+	1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000, 20000, 50000,
+	100000, 200000, 500000, 1000000, 2000000, 5000000, 10000000,
+}
+
+// maxCountClasses is the number of classes that can be encoded in one byte.
+const maxCountClasses = 256
+
+// validateCountClasses returns an error if count classes can not be encoded.
+func validateCountClasses(classes []uint64) error {
+	if len(classes) == 0 || len(classes) > maxCountClasses {
+		return fmt.Errorf("invalid number of count classes %v", len(classes))
+	}
+	if classes[0] != 1 {
+		return fmt.Errorf("first count class %v instead 1", classes[0])
+	}
+	for i := 1; i < len(classes); i++ {
+		if classes[i] <= classes[i-1] {
+			return fmt.Errorf("count class %v not higher than %v", classes[i], classes[i-1])
+		}
+	}
+	return nil
+}
+
+// hashCountingClasses returns validated count classes for the hash counting,
+// which are the default ones if they are not provided, or nil if the hash
+// counting does not use classes.
+func hashCountingClasses(c HashCounting, classes []uint64) ([]uint64, error) {
+	if c != HashCountingClasses {
+		if len(classes) > 0 {
+			return nil, fmt.Errorf("count classes are not supported by %s hash counting", c)
+		}
+		return nil, nil
+	}
+	if len(classes) == 0 {
+		classes = DefaultCountClasses
+	}
+	if err := validateCountClasses(classes); err != nil {
+		return nil, err
+	}
+	return append([]uint64(nil), classes...), nil
+}
+
+// countClass returns the index of the class that the count belongs to.
+func countClass(classes []uint64, count uint64) int {
+	i := sort.Search(len(classes), func(i int) bool {
+		return classes[i] > count
+	}) - 1
+	if i < 0 {
+		return 0
+	}
+	return i
+}
+
 // Index creates an indexed database of pwned passwords by reading hashes and
 // their counts from a textual file where hashes are ordered by their values
-// provided by https://haveibeenpwned.com/Passwords. It returns the number of
-// saved hashes.
+// provided by https://haveibeenpwned.com/Passwords. Both SHA1 and NTLM files are
+// supported, where the hashing algorithm must be specified in the options. The
+// input file is read only once and it can be compressed with gzip, zstd or xz,
+// or read from the standard input if StdinFilename is used as the input
+// filename. Database files are written in a temporary directory, where the
+// progress is saved after every shard, so that indexing can be resumed if it
+// is interrupted, and the directory is renamed to the output directory when
+// the database is complete, or packed into a single container file with the
+// FormatContainer format. It returns the number of saved hashes.
 func Index(inputFilename, outputDir string, o *IndexOptions) (uint64, error) {
 	if o == nil {
 		o = new(IndexOptions)
@@ -67,6 +164,21 @@ func Index(inputFilename, outputDir string, o *IndexOptions) (uint64, error) {
 	if o.HashCounting == "" {
 		o.HashCounting = HashCountingExact
 	}
+	if o.Hash == "" {
+		o.Hash = HashSHA1
+	}
+	if o.Hash.size() == 0 {
+		return 0, fmt.Errorf("unsupported hash %s", o.Hash)
+	}
+	if o.Format == "" {
+		o.Format = FormatDirectory
+	}
+	if !o.Format.isValid() {
+		return 0, fmt.Errorf("unsupported format %s", o.Format)
+	}
+	if o.FilterFalsePositiveRate < 0 || o.FilterFalsePositiveRate >= 1 {
+		return 0, fmt.Errorf("invalid filter false positive rate %v", o.FilterFalsePositiveRate)
+	}
 	if o.LogFunc == nil {
 		o.LogFunc = func(format string, a ...interface{}) {
 			fmt.Printf(format+"\n", a...)
@@ -74,274 +186,117 @@ func Index(inputFilename, outputDir string, o *IndexOptions) (uint64, error) {
 	}
 	logFunc := o.LogFunc
 
-	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
-		return 0, fmt.Errorf("database directory %s already exists", outputDir)
-	}
-
-	inputFile, err := os.Open(inputFilename)
+	countDecoder, err := countDecoderName(o.HashCounting)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return 0, fmt.Errorf("input file %s does not exist", inputFilename)
-		}
-		return 0, fmt.Errorf("open input file: %w", err)
-	}
-	defer inputFile.Close()
-
-	logFunc("analyzing input file %s", inputFilename)
-
-	progressTicker := time.NewTicker(10 * time.Second)
-	defer progressTicker.Stop()
-
-	start := time.Now()
-
-	stat, err := inputFile.Stat()
-	if err != nil {
-		return 0, fmt.Errorf("input file stat: %w", err)
-	}
-
-	inputFileSize := stat.Size()
-
-	var i uint64
-	var fileCursor uint64
-	var maxHashCount uint64
-	scanner := bufio.NewScanner(inputFile)
-	var prevLine string
-	for scanner.Scan() {
-		s := scanner.Text()
-
-		fileCursor += uint64(len(s)) + 1
-
-		if s[:40] < prevLine {
-			return 0, errors.New("input file is not sorted by hashes")
-		}
-
-		c, err := strconv.ParseUint(s[41:], 10, 64)
-		if err != nil {
-			return 0, fmt.Errorf("convert count to integer: line %v: %v", i, err)
-		}
-
-		if c < o.MinHashCount {
-			continue
-		}
-
-		i++
-
-		if c > maxHashCount {
-			maxHashCount = c
-		}
-
-		select {
-		case <-progressTicker.C:
-			p := float64(fileCursor) / float64(inputFileSize) * 100
-			d := time.Since(start)
-			logFunc("line: %v\tprogress: %.2f%%\teta: %v", i, p, time.Duration(float64(d)*100/p)-d)
-		default:
-		}
-	}
-
-	count := i
-
-	var countDecoder string
-	switch o.HashCounting {
-	case HashCountingExact:
-		countDecoder = "big32"
-	case HashCountingApprox:
-		countDecoder = "approx8"
-	case HashCountingNone:
-		countDecoder = "none"
-	default:
-		return 0, fmt.Errorf("unsupported hash counter %s", o.HashCounting)
+		return 0, err
 	}
-
-	dbSize, err := getDBSize(count, o.ShardCount, supportedHash, o.HashCounting)
+	countClasses, err := hashCountingClasses(o.HashCounting, o.CountClasses)
 	if err != nil {
-		return 0, fmt.Errorf("get db size: %w", err)
+		return 0, err
 	}
 
-	logFunc("total hashes: %v", count)
-	logFunc("estimated db size: %v", formatBytes(dbSize))
-	logFunc("max hash count: %v", maxHashCount)
-
-	if err := os.MkdirAll(outputDir, 0777); err != nil {
-		return 0, fmt.Errorf("create output dir %s: %w", outputDir, err)
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		return 0, fmt.Errorf("database directory %s already exists", outputDir)
 	}
 
-	metaFile, err := os.Create(filepath.Join(outputDir, "db.json"))
+	in, err := openInput(inputFilename)
 	if err != nil {
-		return 0, fmt.Errorf("create db.json file: %w", err)
+		return 0, err
 	}
-	defer metaFile.Close()
+	defer in.Close()
 
-	b, err := json.MarshalIndent(meta{
-		Version:      version,
-		Hash:         supportedHash,
-		Count:        count,
-		MaxHashCount: maxHashCount,
+	w, err := newWriter(outputDir, meta{
+		Hash:         string(o.Hash),
 		MinHashCount: o.MinHashCount,
 		ShardCount:   o.ShardCount,
 		CountDecoder: countDecoder,
-	}, "", "    ")
+		CountClasses: countClasses,
+
+		FilterFalsePositiveRate: o.FilterFalsePositiveRate,
+	}, &writerOptions{
+		checkpoint: true,
+		resume:     o.Resume,
+		container:  o.Format == FormatContainer,
+	})
 	if err != nil {
-		return 0, fmt.Errorf("encode db.json: %w", err)
-	}
-
-	if err := os.WriteFile(filepath.Join(outputDir, "db.json"), b, 0666); err != nil {
-		return 0, fmt.Errorf("write db.json: %w", err)
-	}
-
-	hashFileWriters := make(map[int]*bufio.Writer, o.ShardCount)
-	for i := 0; i < o.ShardCount; i++ {
-		f, err := os.Create(filepath.Join(
-			outputDir,
-			getShardFilename(i, o.ShardCount),
-		))
-		if err != nil {
-			return 0, fmt.Errorf("create hashes file %v: %w", i, err)
-		}
-		defer f.Close()
-
-		w := bufio.NewWriterSize(f, 64*1024)
-		hashFileWriters[i] = w
-		defer w.Flush()
+		return 0, err
 	}
+	defer w.close()
 
+	logFunc("indexing input file %s", inputFilename)
 	logFunc("saving to: %v", outputDir)
-
-	start = time.Now()
-
-	if _, err := inputFile.Seek(0, io.SeekStart); err != nil {
-		return 0, fmt.Errorf("seek to the beginning of input file: %w", err)
-	}
-
-	var hashCountEncoder func(uint64) []byte
-	switch o.HashCounting {
-	case HashCountingExact:
-		b := make([]byte, 4)
-		hashCountEncoder = func(v uint64) []byte {
-			binary.BigEndian.PutUint32(b, uint32(v))
-			return b
-		}
-	case HashCountingApprox:
-		e, err := approxcount.NewEncoder(uint64(maxHashCount))
-		if err != nil {
-			return 0, fmt.Errorf("new approxcount %v: %w", maxHashCount, err)
-		}
-		hashCountEncoder = func(v uint64) []byte {
-			return []byte{e.Encode(v)}
-		}
-	case HashCountingNone:
-		hashCountEncoder = func(v uint64) []byte {
-			return nil
-		}
-	default:
-		return 0, fmt.Errorf("unsupported hash counter %s", o.HashCounting)
-	}
-
-	indexFile, err := os.Create(filepath.Join(outputDir, "index.db"))
-	if err != nil {
-		return 0, fmt.Errorf("create index file: %w", err)
-	}
-	defer indexFile.Close()
-
-	indexFileWriter := bufio.NewWriterSize(indexFile, 64*1024)
-	defer indexFileWriter.Flush()
-
-	i = 0
-	fileCursor = 0
-	var hashFileIndex uint32
-	var partition, previousPartition uint64
-	var previousShard int
-	scanner = bufio.NewScanner(inputFile)
-	if _, err := indexFileWriter.Write(make([]byte, 4)); err != nil {
-		return 0, fmt.Errorf("write index zero entry: %w", err)
+	if w.resume != nil {
+		logFunc("resuming with %v of %v shards indexed", w.resume.Shards, o.ShardCount)
 	}
-	buf := make([]byte, 4)
-	for scanner.Scan() {
-		s := scanner.Text()
 
-		fileCursor += uint64(len(s)) + 1
-
-		count, err := strconv.ParseUint(s[41:], 10, 64)
-		if err != nil {
-			return 0, fmt.Errorf("convert count to integer: line %v: %w", i, err)
-		}
+	progressTicker := time.NewTicker(10 * time.Second)
+	defer progressTicker.Stop()
 
-		prefix, err := hex.DecodeString(s[:6])
-		if err != nil {
-			return 0, fmt.Errorf("decode prefix: line %v: %w", i, err)
-		}
+	start := time.Now()
 
-		partition = uint24(prefix)
-		if partition != previousPartition {
-			if partition < previousPartition {
-				return 0, fmt.Errorf("partition %v not after partition %v", partition, previousPartition)
-			}
-			for i := previousPartition; i < partition; i++ {
-				binary.BigEndian.PutUint32(buf, hashFileIndex)
-				if _, err := indexFileWriter.Write(buf); err != nil {
-					return 0, fmt.Errorf("write index cursor: line %v: %w", i, err)
-				}
+	logProgress := func(line uint64) {
+		select {
+		case <-progressTicker.C:
+			if p, ok := in.progress(); ok {
+				d := time.Since(start)
+				logFunc("line: %v\tprogress: %.2f%%\teta: %v", line, p, time.Duration(float64(d)*100/p)-d)
+			} else {
+				logFunc("line: %v", line)
 			}
-			previousPartition = partition
+		default:
 		}
+	}
 
-		shard := getShard(int(prefix[0]), o.ShardCount)
-		if shard != previousShard {
-			hashFileIndex = 0
-			previousShard = shard
-			if _, err := indexFileWriter.Write(make([]byte, 4)); err != nil {
-				return 0, fmt.Errorf("write index zero entry: %w", err)
-			}
+	if o.Concurrency > 1 {
+		if err := indexConcurrently(in, w, o.Hash, o.MinHashCount, o.Concurrency, logProgress); err != nil {
+			return 0, err
 		}
-
-		if count >= o.MinHashCount {
-			hash, err := hex.DecodeString(s[6:40])
-			if err != nil {
-				return 0, fmt.Errorf("decode hash: line %v: %w", i, err)
-			}
-
-			if _, err := hashFileWriters[shard].Write(hash); err != nil {
-				return 0, fmt.Errorf("write hash: line %v: %w", i, err)
-			}
-			if _, err := hashFileWriters[shard].Write(hashCountEncoder(uint64(count))); err != nil {
-				return 0, fmt.Errorf("write hash count: line %v: %w", i, err)
+	} else {
+		s := newHashScanner(in, o.Hash)
+		for s.scan() {
+			if s.count >= o.MinHashCount {
+				if err := w.add(s.hash, s.count); err != nil {
+					return 0, fmt.Errorf("line %v: %w", s.line, err)
+				}
 			}
-
-			i++
-			hashFileIndex++
+			logProgress(s.line)
 		}
-
-		select {
-		case <-progressTicker.C:
-			p := float64(fileCursor) / float64(inputFileSize) * 100
-			d := time.Since(start)
-			logFunc("line: %v\tprogress: %.2f%%\teta: %v", i, p, time.Duration(float64(d)*100/p)-d)
-		default:
+		if err := s.Err(); err != nil {
+			return 0, err
 		}
 	}
 
-	if err := scanner.Err(); err != nil {
-		return 0, fmt.Errorf("read input file: %w", err)
+	w.meta.Lineage = []Lineage{{
+		Operation: lineageIndex,
+		Time:      time.Now().UTC(),
+		Input:     filepath.Base(inputFilename),
+		Count:     w.meta.Count,
+	}}
+
+	m, err := w.finish()
+	if err != nil {
+		return 0, err
 	}
 
-	binary.BigEndian.PutUint32(buf, uint32(hashFileIndex))
-	for i := partition; i <= maxUint24; i++ {
-		if _, err := indexFileWriter.Write(buf); err != nil {
-			return 0, fmt.Errorf("write index end %v: %w", i, err)
-		}
+	dbSize, err := getDBSize(m.Count, o.ShardCount, o.Hash, o.HashCounting)
+	if err != nil {
+		return 0, fmt.Errorf("get db size: %w", err)
 	}
 
-	logFunc("saved %v hashes", i)
+	logFunc("db size: %v", formatBytes(dbSize))
+	logFunc("max hash count: %v", m.MaxHashCount)
+	logFunc("saved %v hashes", m.Count)
 
-	return i, nil
+	return m.Count, nil
 }
 
-func getDBSize(count uint64, shardCount int, hash string, hashCounting HashCounting) (uint64, error) {
+func getDBSize(count uint64, shardCount int, hash Hash, hashCounting HashCounting) (uint64, error) {
 	indexMaxSeek := (maxUint24 + shardCount) * indexLocationEncodedSize
 
 	indexFileSize := indexMaxSeek + indexReadSize
 
-	if hash != supportedHash {
+	hashSize := hash.size()
+	if hashSize == 0 {
 		return 0, errors.New("unsupported hashing algorithm")
 	}
 
@@ -351,13 +306,20 @@ func getDBSize(count uint64, shardCount int, hash string, hashCounting HashCount
 		countEncodedSize = 4
 	case HashCountingApprox:
 		countEncodedSize = 1
+	case HashCountingApprox16:
+		countEncodedSize = 2
+	case HashCountingVarint:
+		// the minimal size, as higher counts are encoded in more bytes
+		countEncodedSize = 1
+	case HashCountingClasses:
+		countEncodedSize = 1
 	case HashCountingNone:
 		countEncodedSize = 0
 	default:
 		return 0, fmt.Errorf("unsupported hash counter %s", hashCounting)
 	}
 
-	hashesFileSize := (hashRemainderSize + countEncodedSize) * count
+	hashesFileSize := (uint64(hashSize-partitionSize) + countEncodedSize) * count
 
 	return uint64(indexFileSize) + hashesFileSize, nil
 }
@@ -0,0 +1,200 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// indexBlockSize is the approximate size of input blocks that are parsed
+// concurrently.
+var indexBlockSize = 1 << 20
+
+// indexBlock is a part of the input with complete lines and the result of
+// their parsing.
+type indexBlock struct {
+	data      []byte
+	firstLine uint64
+	lines     uint64
+
+	hashes []byte   // concatenated hashes with counts not lower than minimal
+	counts []uint64 // counts of hashes
+	line   []uint64 // input line numbers of hashes
+	first  []byte   // the first hash in the block
+	last   []byte   // the last hash in the block
+	err    error
+	done   chan struct{}
+}
+
+// indexConcurrently adds hashes from the input to the writer by parsing input
+// lines in blocks with the concurrency number of goroutines. The reading and
+// writing are done sequentially, while blocks are passed to the writer in the
+// same order as they are in the input, so that the database files are the same
+// as the ones created by sequential indexing. Function progress is called with
+// the last processed input line number after every block.
+func indexConcurrently(r io.Reader, w *writer, h Hash, minHashCount uint64, concurrency int, progress func(line uint64)) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	// quit is closed before waiting for goroutines to stop
+	quit := make(chan struct{})
+	defer close(quit)
+
+	jobs := make(chan *indexBlock, concurrency)
+	ordered := make(chan *indexBlock, concurrency*2)
+
+	// parsers
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range jobs {
+				b.parse(h, minHashCount)
+				close(b.done)
+			}
+		}()
+	}
+
+	// reader
+	readErr := make(chan error, 1)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(ordered)
+		defer close(jobs)
+		readErr <- readIndexBlocks(r, func(b *indexBlock) bool {
+			select {
+			case ordered <- b:
+			case <-quit:
+				return false
+			}
+			select {
+			case jobs <- b:
+			case <-quit:
+				return false
+			}
+			return true
+		})
+	}()
+
+	// writer
+	hashSize := h.size()
+	var last []byte
+	for b := range ordered {
+		<-b.done
+		if b.err != nil {
+			return b.err
+		}
+		// validate the order of all lines, not only the ones with hashes
+		// that are written
+		if last != nil && bytes.Compare(b.first, last) <= 0 {
+			return fmt.Errorf("input is not sorted by hashes: line %v", b.firstLine)
+		}
+		last = b.last
+		for i, count := range b.counts {
+			if err := w.add(b.hashes[i*hashSize:(i+1)*hashSize], count); err != nil {
+				if errors.Is(err, errHashOrder) {
+					return fmt.Errorf("input is not sorted by hashes: line %v", b.line[i])
+				}
+				return fmt.Errorf("line %v: %w", b.line[i], err)
+			}
+		}
+		progress(b.firstLine + b.lines - 1)
+	}
+	return <-readErr
+}
+
+// readIndexBlocks reads the input in blocks of complete lines and calls the
+// send function for each of them until it returns false.
+func readIndexBlocks(r io.Reader, send func(b *indexBlock) bool) error {
+	br := bufio.NewReaderSize(r, 64*1024)
+	line := uint64(1)
+	for {
+		data := make([]byte, indexBlockSize)
+		// io.ReadFull is not used as it would not distinguish the end of the
+		// input from io.ErrUnexpectedEOF returned by truncated compressed
+		// inputs
+		var n int
+		var err error
+		for n < len(data) && err == nil {
+			var m int
+			m, err = br.Read(data[n:])
+			n += m
+		}
+		data = data[:n]
+		if err == nil {
+			// complete the last line
+			var rest []byte
+			rest, err = br.ReadBytes('\n')
+			data = append(data, rest...)
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("read input: %w", err)
+		}
+		if len(data) == 0 {
+			return nil
+		}
+
+		lines := uint64(bytes.Count(data, []byte{'\n'}))
+		if data[len(data)-1] != '\n' {
+			lines++
+		}
+		if !send(&indexBlock{
+			data:      data,
+			firstLine: line,
+			lines:     lines,
+			done:      make(chan struct{}),
+		}) {
+			return nil
+		}
+		line += lines
+	}
+}
+
+// parse decodes all lines from the block data and validates their order
+// within the block.
+func (b *indexBlock) parse(h Hash, minHashCount uint64) {
+	hashSize := h.size()
+	hash := make([]byte, hashSize)
+	prevHash := make([]byte, hashSize)
+	data := b.data
+	for i := uint64(0); len(data) > 0; i++ {
+		lineData := data
+		if n := bytes.IndexByte(data, '\n'); n >= 0 {
+			lineData, data = data[:n], data[n+1:]
+		} else {
+			data = nil
+		}
+		line := b.firstLine + i
+
+		count, err := parseHashLine(lineData, h, hash)
+		if err != nil {
+			b.err = fmt.Errorf("line %v: %w", line, err)
+			return
+		}
+		if i == 0 {
+			b.first = append([]byte(nil), hash...)
+		} else if bytes.Compare(hash, prevHash) <= 0 {
+			b.err = fmt.Errorf("input is not sorted by hashes: line %v", line)
+			return
+		}
+		copy(prevHash, hash)
+
+		if count < minHashCount {
+			continue
+		}
+		b.hashes = append(b.hashes, hash...)
+		b.counts = append(b.counts, count)
+		b.line = append(b.line, line)
+	}
+	b.last = prevHash
+	b.data = nil
+}
@@ -0,0 +1,534 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestIndex_compressed(t *testing.T) {
+	const inputFilename = "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashCountings := []file.HashCounting{file.HashCountingExact}
+	if !testing.Short() {
+		hashCountings = append(hashCountings, file.HashCountingApprox)
+	}
+	for _, hashCounting := range hashCountings {
+		t.Run(string(hashCounting), func(t *testing.T) {
+			dir := t.TempDir()
+
+			wantDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+				HashCounting: hashCounting,
+			})
+
+			for _, tc := range []struct {
+				name     string
+				compress func(w io.Writer) (io.WriteCloser, error)
+			}{
+				{
+					name: "gzip",
+					compress: func(w io.Writer) (io.WriteCloser, error) {
+						return gzip.NewWriter(w), nil
+					},
+				},
+				{
+					name: "zstd",
+					compress: func(w io.Writer) (io.WriteCloser, error) {
+						return zstd.NewWriter(w)
+					},
+				},
+				{
+					name: "xz",
+					compress: func(w io.Writer) (io.WriteCloser, error) {
+						return xz.NewWriter(w)
+					},
+				},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					var buf bytes.Buffer
+					w, err := tc.compress(&buf)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if _, err := w.Write(data); err != nil {
+						t.Fatal(err)
+					}
+					if err := w.Close(); err != nil {
+						t.Fatal(err)
+					}
+
+					compressedFilename := filepath.Join(dir, "input."+tc.name)
+					if err := os.WriteFile(compressedFilename, buf.Bytes(), 0666); err != nil {
+						t.Fatal(err)
+					}
+
+					dbDir := filepath.Join(dir, tc.name)
+					if _, err := file.Index(compressedFilename, dbDir, &file.IndexOptions{
+						HashCounting: hashCounting,
+						LogFunc:      func(string, ...interface{}) {},
+					}); err != nil {
+						t.Fatal(err)
+					}
+
+					assertSameDataFiles(t, dbDir, wantDir)
+				})
+			}
+
+			t.Run("stdin", func(t *testing.T) {
+				f, err := os.Open(inputFilename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer f.Close()
+
+				stdin := os.Stdin
+				os.Stdin = f
+				defer func() { os.Stdin = stdin }()
+
+				dbDir := filepath.Join(dir, "stdin")
+				if _, err := file.Index(file.StdinFilename, dbDir, &file.IndexOptions{
+					HashCounting: hashCounting,
+					LogFunc:      func(string, ...interface{}) {},
+				}); err != nil {
+					t.Fatal(err)
+				}
+
+				assertSameDataFiles(t, dbDir, wantDir)
+			})
+		})
+	}
+}
+
+func TestIndex_sevenZip(t *testing.T) {
+	dir := t.TempDir()
+
+	inputFilename := filepath.Join(dir, "input.7z")
+	if err := os.WriteFile(inputFilename, []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c, 0, 4}, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := file.Index(inputFilename, filepath.Join(dir, "db"), &file.IndexOptions{
+		LogFunc: func(string, ...interface{}) {},
+	})
+	if err == nil || !strings.Contains(err.Error(), "7z x -so") {
+		t.Fatalf("got error %v, want 7z error", err)
+	}
+}
+
+func TestIndex_truncatedCompressedInput(t *testing.T) {
+	dir := t.TempDir()
+
+	data, err := os.ReadFile("testdata/pwned-passwords-sha1-ordered-by-hash.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := gzipData(t, data)
+
+	inputFilename := filepath.Join(dir, "input.txt.gz")
+	if err := os.WriteFile(inputFilename, compressed[:len(compressed)/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		t.Run(fmt.Sprintf("concurrency %v", concurrency), func(t *testing.T) {
+			defer file.SetIndexBlockSize(1000)()
+
+			_, err := file.Index(inputFilename, filepath.Join(t.TempDir(), "db"), &file.IndexOptions{
+				Concurrency: concurrency,
+				LogFunc:     func(string, ...interface{}) {},
+			})
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+		})
+	}
+}
+
+func TestIndex_unsortedInputCleanup(t *testing.T) {
+	dir := t.TempDir()
+
+	inputFilename := filepath.Join(dir, "input.txt")
+	if err := os.WriteFile(inputFilename, []byte("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:1\n0000000000000000000000000000000000000000:1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	dbDir := filepath.Join(dir, "db")
+	if _, err := file.Index(inputFilename, dbDir, &file.IndexOptions{
+		LogFunc: func(string, ...interface{}) {},
+	}); err == nil {
+		t.Fatal("expected error")
+	}
+
+	if _, err := os.Stat(dbDir); !os.IsNotExist(err) {
+		t.Errorf("database directory not removed: %v", err)
+	}
+}
+
+func TestIndex_resume(t *testing.T) {
+	// blocks smaller than the truncated input for concurrent indexing
+	defer file.SetIndexBlockSize(4096)()
+
+	dir := t.TempDir()
+
+	inputFilename := filepath.Join(dir, "input.txt")
+	writeDenseInput(t, inputFilename, 4096, 8)
+
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := gzipData(t, data)
+
+	compressedInputFilename := filepath.Join(dir, "input.txt.gz")
+	if err := os.WriteFile(compressedInputFilename, compressed, 0666); err != nil {
+		t.Fatal(err)
+	}
+	// truncated input interrupts indexing after some shards are indexed
+	truncatedInputFilename := filepath.Join(dir, "truncated.txt.gz")
+	if err := os.WriteFile(truncatedInputFilename, compressed[:len(compressed)/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	noLog := func(string, ...interface{}) {}
+
+	for _, tc := range []struct {
+		name    string
+		options file.IndexOptions
+	}{
+		{
+			name: "exact",
+		},
+		{
+			name: "approx concurrent",
+			options: file.IndexOptions{
+				HashCounting: file.HashCountingApprox,
+				Concurrency:  4,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			wantDir := filepath.Join(dir, "want")
+			wantOptions := tc.options
+			wantOptions.LogFunc = noLog
+			wantCount, err := file.Index(inputFilename, wantDir, &wantOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			gotDir := filepath.Join(dir, "got")
+			tmpDir := file.TemporaryDir(gotDir)
+
+			options := tc.options
+			options.LogFunc = noLog
+			if _, err := file.Index(truncatedInputFilename, gotDir, &options); !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+			}
+			if _, err := os.Stat(gotDir); !os.IsNotExist(err) {
+				t.Fatalf("database directory exists: %v", err)
+			}
+			if _, err := os.Stat(filepath.Join(tmpDir, "checkpoint.json")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(tmpDir, "db.json")); !os.IsNotExist(err) {
+				t.Fatalf("db.json in temporary directory: %v", err)
+			}
+
+			_, err = file.Index(inputFilename, gotDir, &options)
+			want := fmt.Sprintf("temporary database directory %s already exists", tmpDir)
+			if err == nil || err.Error() != want {
+				t.Fatalf("got error %v, want %q", err, want)
+			}
+
+			options.Resume = true
+			gotCount, err := file.Index(compressedInputFilename, gotDir, &options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotCount != wantCount {
+				t.Errorf("got count %v, want %v", gotCount, wantCount)
+			}
+			if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+				t.Errorf("temporary directory exists: %v", err)
+			}
+
+			assertSameDataFiles(t, gotDir, wantDir)
+		})
+	}
+}
+
+func TestIndex_resumeInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	inputFilename := filepath.Join(dir, "input.txt")
+	writeDenseInput(t, inputFilename, 4096, 8)
+
+	data, err := os.ReadFile(inputFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed := gzipData(t, data)
+
+	truncatedInputFilename := filepath.Join(dir, "truncated.txt.gz")
+	if err := os.WriteFile(truncatedInputFilename, compressed[:len(compressed)/2], 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	noLog := func(string, ...interface{}) {}
+
+	dbDir := filepath.Join(dir, "db")
+	if _, err := file.Index(truncatedInputFilename, dbDir, &file.IndexOptions{
+		LogFunc: noLog,
+	}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got error %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		inputFilename string
+		options       file.IndexOptions
+		wantErr       string
+	}{
+		{
+			name:          "different input",
+			inputFilename: "testdata/pwned-passwords-sha1-ordered-by-hash.txt",
+			wantErr:       "input does not match the checkpoint",
+		},
+		{
+			name:          "different options",
+			inputFilename: inputFilename,
+			options:       file.IndexOptions{ShardCount: 64},
+			wantErr:       "checkpoint is saved with different options: hash sha1, min hash count 1, shard count 32, count decoder big32",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			options := tc.options
+			options.Resume = true
+			options.LogFunc = noLog
+			_, err := file.Index(tc.inputFilename, dbDir, &options)
+			if err == nil || !strings.HasSuffix(err.Error(), tc.wantErr) {
+				t.Errorf("got error %v, want %q", err, tc.wantErr)
+			}
+			if _, err := os.Stat(filepath.Join(file.TemporaryDir(dbDir), "checkpoint.json")); err != nil {
+				t.Errorf("checkpoint: %v", err)
+			}
+		})
+	}
+}
+
+func TestIndex_concurrency(t *testing.T) {
+	dir := t.TempDir()
+
+	denseInputFilename := filepath.Join(dir, "dense.txt")
+	writeDenseInput(t, denseInputFilename, 4096, 8)
+
+	noLog := func(string, ...interface{}) {}
+
+	type testCase struct {
+		name          string
+		inputFilename string
+		options       file.IndexOptions
+		blockSize     int
+		concurrency   int
+	}
+	testCases := []testCase{
+		{
+			name:          "default",
+			inputFilename: "testdata/pwned-passwords-sha1-ordered-by-hash.txt",
+			blockSize:     1 << 20,
+			concurrency:   2,
+		},
+		{
+			name:          "small blocks",
+			inputFilename: "testdata/pwned-passwords-sha1-ordered-by-hash.txt",
+			blockSize:     100,
+			concurrency:   8,
+		},
+		{
+			name:          "dense",
+			inputFilename: denseInputFilename,
+			blockSize:     4096,
+			concurrency:   8,
+		},
+		{
+			name:          "dense varint",
+			inputFilename: denseInputFilename,
+			options:       file.IndexOptions{ShardCount: 16, HashCounting: file.HashCountingVarint},
+			blockSize:     1000,
+			concurrency:   4,
+		},
+		{
+			name:          "min hash count",
+			inputFilename: "testdata/pwned-passwords-sha1-ordered-by-hash.txt",
+			options:       file.IndexOptions{MinHashCount: 10, HashCounting: file.HashCountingNone},
+			blockSize:     300,
+			concurrency:   4,
+		},
+	}
+	if !testing.Short() {
+		testCases = append(testCases, []testCase{
+			{
+				name:          "dense single shard",
+				inputFilename: denseInputFilename,
+				options:       file.IndexOptions{ShardCount: 1},
+				blockSize:     4096,
+				concurrency:   2,
+			},
+			{
+				name:          "dense max shards approx",
+				inputFilename: denseInputFilename,
+				options:       file.IndexOptions{ShardCount: 256, HashCounting: file.HashCountingApprox},
+				blockSize:     1000,
+				concurrency:   4,
+			},
+		}...)
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			wantDir, _ := indexTestDatabase(t, tc.inputFilename, &tc.options)
+
+			defer file.SetIndexBlockSize(tc.blockSize)()
+
+			gotDir := filepath.Join(t.TempDir(), "concurrent")
+			concurrentOptions := tc.options
+			concurrentOptions.Concurrency = tc.concurrency
+			concurrentOptions.LogFunc = noLog
+			if _, err := file.Index(tc.inputFilename, gotDir, &concurrentOptions); err != nil {
+				t.Fatal(err)
+			}
+
+			assertSameDataFiles(t, gotDir, wantDir)
+		})
+	}
+}
+
+func TestIndex_concurrencyUnsortedInput(t *testing.T) {
+	defer file.SetIndexBlockSize(100)()
+
+	data, err := os.ReadFile("testdata/pwned-passwords-sha1-ordered-by-hash.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	for _, i := range []int{1, 2, 3, 500, len(lines) - 1} {
+		t.Run(fmt.Sprintf("line %v", i+1), func(t *testing.T) {
+			dir := t.TempDir()
+
+			unsorted := append([]string(nil), lines...)
+			unsorted[i-1], unsorted[i] = unsorted[i], unsorted[i-1]
+
+			inputFilename := filepath.Join(dir, "input.txt")
+			if err := os.WriteFile(inputFilename, []byte(strings.Join(unsorted, "\n")), 0666); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := file.Index(inputFilename, filepath.Join(dir, "db"), &file.IndexOptions{
+				MinHashCount: 10,
+				Concurrency:  4,
+				LogFunc:      func(string, ...interface{}) {},
+			})
+			want := fmt.Sprintf("input is not sorted by hashes: line %v", i+1)
+			if err == nil || err.Error() != want {
+				t.Errorf("got error %v, want %q", err, want)
+			}
+		})
+	}
+}
+
+// assertSameDataFiles checks that index and hashes files in both database
+// directories are the same.
+func assertSameDataFiles(t *testing.T, gotDir, wantDir string) {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(wantDir, "*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("no database files")
+	}
+	for _, f := range files {
+		want, err := os.ReadFile(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(gotDir, filepath.Base(f)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("file %s differs", filepath.Base(f))
+		}
+	}
+}
+
+func gzipData(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestIndex_invalidCountClasses(t *testing.T) {
+	for _, tc := range []struct {
+		options file.IndexOptions
+		wantErr string
+	}{
+		{
+			options: file.IndexOptions{HashCounting: file.HashCountingExact, CountClasses: []uint64{1, 10}},
+			wantErr: "count classes are not supported by exact hash counting",
+		},
+		{
+			options: file.IndexOptions{HashCounting: file.HashCountingClasses, CountClasses: []uint64{0, 10}},
+			wantErr: "first count class 0 instead 1",
+		},
+		{
+			options: file.IndexOptions{HashCounting: file.HashCountingClasses, CountClasses: []uint64{1, 10, 10}},
+			wantErr: "count class 10 not higher than 10",
+		},
+		{
+			options: file.IndexOptions{HashCounting: file.HashCountingClasses, CountClasses: make([]uint64, 257)},
+			wantErr: "invalid number of count classes 257",
+		},
+	} {
+		dbDir := filepath.Join(t.TempDir(), "db")
+		tc.options.LogFunc = func(string, ...interface{}) {}
+		_, err := file.Index("testdata/pwned-passwords-sha1-ordered-by-hash.txt", dbDir, &tc.options)
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("got error %v, want %q", err, tc.wantErr)
+		}
+		if _, err := os.Stat(dbDir); !os.IsNotExist(err) {
+			t.Errorf("database directory created: %v", err)
+		}
+	}
+}
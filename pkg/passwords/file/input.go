@@ -0,0 +1,151 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// StdinFilename is the input filename that reads the input from the standard
+// input.
+const StdinFilename = "-"
+
+// input reads hash lines from a file or the standard input, decompressing
+// gzip, zstd and xz streams.
+type input struct {
+	io.Reader
+
+	// size is the size of the input file, or 0 if it is not known
+	size int64
+	// read is the number of bytes read from the input file, which are
+	// compressed bytes for compressed inputs
+	read *int64
+
+	closeFuncs []func() error
+}
+
+var (
+	gzipMagic     = []byte{0x1f, 0x8b}
+	zstdMagic     = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	xzMagic       = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	sevenZipMagic = []byte{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}
+)
+
+// openInput opens the file, or the standard input if the filename is
+// StdinFilename, and detects its compression by the content.
+func openInput(filename string) (_ *input, err error) {
+	in := &input{
+		read: new(int64),
+	}
+	defer func() {
+		if err != nil {
+			in.Close()
+		}
+	}()
+
+	var f *os.File
+	if filename == StdinFilename {
+		f = os.Stdin
+	} else {
+		f, err = os.Open(filename)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, fmt.Errorf("input file %s does not exist", filename)
+			}
+			return nil, fmt.Errorf("open input file: %w", err)
+		}
+		in.closeFuncs = append(in.closeFuncs, f.Close)
+
+		stat, err := f.Stat()
+		if err != nil {
+			return nil, fmt.Errorf("input file stat: %w", err)
+		}
+		if stat.Mode().IsRegular() {
+			in.size = stat.Size()
+		}
+	}
+
+	r := bufio.NewReaderSize(&countingReader{r: f, n: in.read}, 64*1024)
+	magic, err := r.Peek(len(xzMagic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("read input: %w", err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		in.closeFuncs = append(in.closeFuncs, gr.Close)
+		in.Reader = gr
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		in.closeFuncs = append(in.closeFuncs, func() error {
+			zr.Close()
+			return nil
+		})
+		in.Reader = zr
+	case bytes.HasPrefix(magic, xzMagic):
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("xz: %w", err)
+		}
+		in.Reader = xr
+	case bytes.HasPrefix(magic, sevenZipMagic):
+		return nil, errors.New("7z archives are not supported, extract the file to the standard output with 7z x -so")
+	default:
+		in.Reader = r
+	}
+
+	return in, nil
+}
+
+// progress returns the percentage of the input file that is read, or false if
+// the input size is not known.
+func (in *input) progress() (float64, bool) {
+	if in.size <= 0 {
+		return 0, false
+	}
+	return float64(atomic.LoadInt64(in.read)) / float64(in.size) * 100, true
+}
+
+// Close closes decompressors and the input file.
+func (in *input) Close() error {
+	var err error
+	for i := len(in.closeFuncs) - 1; i >= 0; i-- {
+		if e := in.closeFuncs[i](); e != nil && err == nil {
+			err = e
+		}
+	}
+	in.closeFuncs = nil
+	return err
+}
+
+// countingReader counts the number of bytes read from the underlying reader.
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(r.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Iterate calls the function for every hash in the database directory or the
+// container file in ascending order, with its count decoded by the database
+// count decoder. The hash slice is reused between calls and must not be
+// retained. Iteration stops with the first error returned by the function.
+func Iterate(path string, f func(hash []byte, count uint64) error) error {
+	return iterate(path, f)
+}
+
+// iterate calls the function for every hash in the database in ascending
+// order, by reading the index and all shard files sequentially. The hash
+// slice is reused between calls and must not be retained.
+func iterate(dir string, f func(hash []byte, count uint64) error) error {
+	return iterateRange(dir, 0, maxUint24, f)
+}
+
+// iterateRange calls the function for every hash in the database from the
+// first to the last partition, inclusive, in ascending order. Hashes files
+// are read only from the first hash in the range.
+func iterateRange(dir string, first, last int, f func(hash []byte, count uint64) error) error {
+	db, err := openDatabase(dir, func(filename string) (dataFile, error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	return db.iterateRange(first, last, f)
+}
+
+// iterateRange calls the function for every hash in the open database from
+// the first to the last partition, inclusive, in ascending order.
+func (db *database) iterateRange(first, last int, f func(hash []byte, count uint64) error) error {
+	partitionsPerShard := (maxUint24 + 1) / db.shardCount
+	positionSize := db.positionSize()
+	hashSize := db.hash.size()
+
+	hash := make([]byte, hashSize)
+	for shard := 0; shard < db.shardCount; shard++ {
+		firstPartition := shard * partitionsPerShard
+		lastPartition := firstPartition + partitionsPerShard - 1
+		if lastPartition < first || firstPartition > last {
+			continue
+		}
+
+		// index entries of all shard partitions, with the shard start entry
+		index, err := readAt(db.index, int64(firstPartition+shard)*indexLocationEncodedSize, int64(partitionsPerShard+1)*indexLocationEncodedSize)
+		if err != nil {
+			return fmt.Errorf("index: %w", err)
+		}
+
+		// all records of the shard are read if it is completely in the range
+		complete := firstPartition >= first && lastPartition <= last
+
+		var r *bufio.Reader
+		if complete {
+			r = bufio.NewReaderSize(io.NewSectionReader(db.shards[shard], 0, 1<<62), 64*1024)
+		}
+		var position uint32
+		for i := 0; i < partitionsPerShard; i++ {
+			start, end, ok := partitionRange(index, i)
+			if !ok {
+				continue
+			}
+			if start != position {
+				return fmt.Errorf("hashes %v: partition %v starts at %v instead %v", shard, firstPartition+i, start, position)
+			}
+			partition := firstPartition + i
+			if partition < first || partition > last {
+				position = end
+				continue
+			}
+			if r == nil {
+				r = bufio.NewReaderSize(io.NewSectionReader(db.shards[shard], int64(start)*positionSize, 1<<62), 64*1024)
+			}
+			hash[0], hash[1], hash[2] = byte(partition>>16), byte(partition>>8), byte(partition)
+			for position < end {
+				count, positions, err := db.readRecord(r, hash[partitionSize:])
+				if err != nil {
+					return fmt.Errorf("hashes %v: read record %v: %w", shard, position, err)
+				}
+				position += positions
+				if err := f(hash, count); err != nil {
+					return err
+				}
+			}
+			if position != end {
+				return fmt.Errorf("hashes %v: partition %v ends at %v instead %v", shard, partition, position, end)
+			}
+		}
+		if !complete {
+			continue
+		}
+		if _, err := r.ReadByte(); err == nil {
+			return fmt.Errorf("hashes %v: unindexed data after record %v", shard, position)
+		} else if err != io.EOF {
+			return fmt.Errorf("hashes %v: %w", shard, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+// testDatabases holds databases that are indexed once and shared between
+// tests, as indexing is the most expensive part of tests, especially with the
+// race detector.
+var testDatabases struct {
+	dir string
+
+	mu  sync.Mutex
+	dbs map[string]testDatabase
+}
+
+type testDatabase struct {
+	dir   string
+	count uint64
+}
+
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "compromised-file-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	testDatabases.dir = dir
+
+	code := m.Run()
+
+	if err := os.RemoveAll(dir); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	os.Exit(code)
+}
+
+// indexTestDatabase returns the path and the number of indexed hashes of the
+// database that is indexed from the input file with index options. The
+// database is indexed only on the first call with the same arguments and it
+// must not be modified by tests.
+func indexTestDatabase(t testing.TB, inputFilename string, o *file.IndexOptions) (dbDir string, count uint64) {
+	t.Helper()
+
+	var options file.IndexOptions
+	if o != nil {
+		options = *o
+	}
+	options.LogFunc = nil
+	options.Concurrency = 0
+	// defaults that are also set explicitly by tests
+	if options.Hash == "" {
+		options.Hash = file.HashSHA1
+	}
+	if options.HashCounting == "" {
+		options.HashCounting = file.HashCountingExact
+	}
+	key := fmt.Sprintf("%s %#v", inputFilename, options)
+
+	testDatabases.mu.Lock()
+	defer testDatabases.mu.Unlock()
+
+	if db, ok := testDatabases.dbs[key]; ok {
+		return db.dir, db.count
+	}
+
+	dbDir = filepath.Join(testDatabases.dir, fmt.Sprintf("db%v", len(testDatabases.dbs)))
+	if options.Format == file.FormatContainer {
+		dbDir += ".container"
+	}
+	options.LogFunc = func(string, ...interface{}) {}
+	count, err := file.Index(inputFilename, dbDir, &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if testDatabases.dbs == nil {
+		testDatabases.dbs = make(map[string]testDatabase)
+	}
+	testDatabases.dbs[key] = testDatabase{
+		dir:   dbDir,
+		count: count,
+	}
+	return dbDir, count
+}
@@ -0,0 +1,199 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MergeOptions holds optional parameters for merging hashes into a database.
+type MergeOptions struct {
+	// LogFunc can be specified as a custom receiver of log messages.
+	LogFunc func(string, ...interface{})
+}
+
+// Merge creates a new database in outputDir with all hashes from the existing
+// database in dbDir and hashes from the input file that has the same format
+// and ordering as the file for the Index function. Counts from the input file
+// replace counts of the same hashes in the database and hashes which counts
+// are lower than the minimal hash count of the database, such as 0, are
+// removed. The new database has the same options and format as the existing
+// one and the merge is recorded in its lineage. Only the existing database
+// and the input file are read, without the original input of the existing
+// database. The input file can be compressed in the same way as for the Index
+// function, but it can not be the standard input as it is read twice.
+// Approximate counts are encoded relative to the maximal hash count, so
+// counts in the input file can not be higher than the maximal hash count of
+// a database with approximate counts, as all its counts would change with
+// every merge. It returns the number of saved hashes.
+func Merge(dbDir, inputFilename, outputDir string, o *MergeOptions) (uint64, error) {
+	if o == nil {
+		o = new(MergeOptions)
+	}
+	logFunc := o.LogFunc
+	if logFunc == nil {
+		logFunc = func(format string, a ...interface{}) {
+			fmt.Printf(format+"\n", a...)
+		}
+	}
+
+	m, err := readMeta(dbDir)
+	if err != nil {
+		return 0, fmt.Errorf("read database meta: %w", err)
+	}
+	hash := Hash(m.Hash)
+	if hash.size() == 0 {
+		return 0, fmt.Errorf("unsupported hash %s", m.Hash)
+	}
+
+	format, err := databaseFormat(dbDir)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		return 0, fmt.Errorf("database directory %s already exists", outputDir)
+	}
+
+	// the input is read twice
+	if inputFilename == StdinFilename {
+		return 0, errors.New("merging from the standard input is not supported")
+	}
+
+	logFunc("analyzing input file %s", inputFilename)
+
+	// validate the input before writing anything and find the maximal hash
+	// count for approximate counts encoding
+	maxHashCount := m.MaxHashCount
+	var inputCount uint64
+	if err := scanHashesFile(inputFilename, hash, func(s *hashScanner) error {
+		for s.scan() {
+			inputCount++
+			if s.count > maxHashCount {
+				maxHashCount = s.count
+			}
+		}
+		return s.Err()
+	}); err != nil {
+		return 0, err
+	}
+
+	logFunc("input hashes: %v", inputCount)
+
+	if (m.CountDecoder == "approx8" || m.CountDecoder == "approx16") && maxHashCount > m.MaxHashCount {
+		return 0, fmt.Errorf("input hash count %v higher than max hash count %v of the database with approximate counts", maxHashCount, m.MaxHashCount)
+	}
+
+	base, err := filepath.Abs(dbDir)
+	if err != nil {
+		return 0, err
+	}
+
+	w, err := newWriter(outputDir, meta{
+		Hash:         m.Hash,
+		MinHashCount: m.MinHashCount,
+		MaxHashCount: maxHashCount,
+		ShardCount:   m.ShardCount,
+		CountDecoder: m.CountDecoder,
+		CountClasses: m.CountClasses,
+		Lineage:      append([]Lineage(nil), m.Lineage...),
+
+		FilterFalsePositiveRate: m.FilterFalsePositiveRate,
+	}, &writerOptions{
+		container: format == FormatContainer,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer w.close()
+
+	logFunc("saving to: %v", outputDir)
+
+	var added, updated, removed uint64
+	if err := scanHashesFile(inputFilename, hash, func(s *hashScanner) error {
+		hasInput := s.scan()
+
+		// addInput saves the current hash from the input file if its count
+		// is not too low and advances the input
+		addInput := func(existing bool) error {
+			if s.count >= m.MinHashCount {
+				if err := w.add(s.hash, s.count); err != nil {
+					return err
+				}
+				if existing {
+					updated++
+				} else {
+					added++
+				}
+			} else if existing {
+				removed++
+			}
+			hasInput = s.scan()
+			return nil
+		}
+
+		if err := iterate(dbDir, func(hash []byte, count uint64) error {
+			for hasInput && bytes.Compare(s.hash, hash) < 0 {
+				if err := addInput(false); err != nil {
+					return err
+				}
+			}
+			if hasInput && bytes.Equal(s.hash, hash) {
+				return addInput(true)
+			}
+			return w.add(hash, count)
+		}); err != nil {
+			return err
+		}
+
+		for hasInput {
+			if err := addInput(false); err != nil {
+				return err
+			}
+		}
+		return s.Err()
+	}); err != nil {
+		return 0, err
+	}
+
+	w.meta.Lineage = append(w.meta.Lineage, Lineage{
+		Operation: lineageMerge,
+		Time:      time.Now().UTC(),
+		Input:     filepath.Base(inputFilename),
+		Base:      base,
+		Count:     w.meta.Count,
+		Added:     added,
+		Updated:   updated,
+		Removed:   removed,
+	})
+
+	meta, err := w.finish()
+	if err != nil {
+		return 0, err
+	}
+
+	logFunc("added %v, updated %v and removed %v hashes", added, updated, removed)
+	logFunc("saved %v hashes", meta.Count)
+
+	return meta.Count, nil
+}
+
+// scanHashesFile opens the file, which may be compressed, and calls the
+// function with a hashScanner that reads from it.
+func scanHashesFile(filename string, h Hash, f func(s *hashScanner) error) error {
+	in, err := openInput(filename)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	return f(newHashScanner(in, h))
+}
@@ -0,0 +1,230 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+
+	b, err := os.ReadFile("testdata/pwned-passwords-sha1-ordered-by-hash.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+
+	// base database is missing every third hash, the update adds them,
+	// changes counts of every fifth hash and removes every seventh hash
+	var base, update, want []string
+	var wantAdded, wantUpdated, wantRemoved int
+	for i, line := range lines {
+		hash, _, _ := strings.Cut(line, ":")
+		switch {
+		case i%3 == 0:
+			update = append(update, line)
+			want = append(want, line)
+			wantAdded++
+		case i%7 == 0:
+			base = append(base, line)
+			update = append(update, hash+":0")
+			wantRemoved++
+		case i%5 == 0:
+			base = append(base, line)
+			update = append(update, fmt.Sprintf("%s:%v", hash, 1000000+i))
+			want = append(want, fmt.Sprintf("%s:%v", hash, 1000000+i))
+			wantUpdated++
+		default:
+			base = append(base, line)
+			want = append(want, line)
+		}
+	}
+
+	writeLines := func(name string, lines []string) string {
+		t.Helper()
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0666); err != nil {
+			t.Fatal(err)
+		}
+		return filename
+	}
+
+	noLog := func(string, ...interface{}) {}
+
+	shardCounts := []int{1, 256}
+	if !testing.Short() {
+		shardCounts = append(shardCounts, 32)
+	}
+	for _, shardCount := range shardCounts {
+		t.Run(fmt.Sprintf("shard count %v", shardCount), func(t *testing.T) {
+			dir := t.TempDir()
+
+			if _, err := file.Index(writeLines("base.txt", base), filepath.Join(dir, "base"), &file.IndexOptions{
+				ShardCount: shardCount,
+				LogFunc:    noLog,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			count, err := file.Merge(filepath.Join(dir, "base"), writeLines("update.txt", update), filepath.Join(dir, "merged"), &file.MergeOptions{
+				LogFunc: noLog,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != uint64(len(want)) {
+				t.Errorf("got count %v, want %v", count, len(want))
+			}
+
+			if _, err := file.Index(writeLines("want.txt", want), filepath.Join(dir, "want"), &file.IndexOptions{
+				ShardCount: shardCount,
+				LogFunc:    noLog,
+			}); err != nil {
+				t.Fatal(err)
+			}
+
+			// all data files must be the same as if the database is indexed
+			// from the complete input
+			assertSameDataFiles(t, filepath.Join(dir, "merged"), filepath.Join(dir, "want"))
+
+			metaData, err := os.ReadFile(filepath.Join(dir, "merged", "db.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var meta struct {
+				Count   int
+				Lineage []struct {
+					Operation string
+					Input     string
+					Base      string
+					Count     int
+					Added     int
+					Updated   int
+					Removed   int
+				}
+			}
+			if err := json.Unmarshal(metaData, &meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta.Count != len(want) {
+				t.Errorf("got meta count %v, want %v", meta.Count, len(want))
+			}
+			if len(meta.Lineage) != 2 {
+				t.Fatalf("got lineage %+v, want two entries", meta.Lineage)
+			}
+			if l := meta.Lineage[0]; l.Operation != "index" || l.Input != "base.txt" || l.Count != len(base) {
+				t.Errorf("got index lineage %+v", l)
+			}
+			l := meta.Lineage[1]
+			if l.Operation != "merge" || l.Input != "update.txt" || filepath.Base(l.Base) != "base" || l.Count != len(want) {
+				t.Errorf("got merge lineage %+v", l)
+			}
+			if l.Added != wantAdded || l.Updated != wantUpdated || l.Removed != wantRemoved {
+				t.Errorf("got added %v, updated %v, removed %v, want %v, %v, %v", l.Added, l.Updated, l.Removed, wantAdded, wantUpdated, wantRemoved)
+			}
+		})
+	}
+}
+
+func TestMerge_unsortedInput(t *testing.T) {
+	dir := t.TempDir()
+
+	baseDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", nil)
+
+	updateFilename := filepath.Join(dir, "update.txt")
+	if err := os.WriteFile(updateFilename, []byte("FFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFFF:1\n0000000000000000000000000000000000000000:1\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := file.Merge(baseDir, updateFilename, filepath.Join(dir, "merged"), &file.MergeOptions{
+		LogFunc: func(string, ...interface{}) {},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "merged")); !os.IsNotExist(err) {
+		t.Errorf("merged database directory created: %v", err)
+	}
+}
+
+func TestMerge_lossyCounts(t *testing.T) {
+	const inputFilename = "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+	noLog := func(string, ...interface{}) {}
+
+	export := func(t *testing.T, dbDir string) []string {
+		t.Helper()
+		var buf bytes.Buffer
+		if _, err := file.Export(dbDir, &buf, nil); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(strings.TrimSpace(buf.String()), "\n")
+	}
+
+	for _, hashCounting := range []file.HashCounting{file.HashCountingApprox, file.HashCountingApprox16, file.HashCountingClasses} {
+		t.Run(string(hashCounting), func(t *testing.T) {
+			dir := t.TempDir()
+
+			baseDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+				HashCounting: hashCounting,
+			})
+			want := export(t, baseDir)
+
+			// counts of existing hashes do not change with repeated merges
+			dbDir := baseDir
+			for i, hash := range []string{
+				"0000000000000000000000000000000000000001",
+				"0000000000000000000000000000000000000002",
+			} {
+				updateFilename := filepath.Join(dir, fmt.Sprintf("update%v.txt", i))
+				if err := os.WriteFile(updateFilename, []byte(hash+":1\n"), 0666); err != nil {
+					t.Fatal(err)
+				}
+				mergedDir := filepath.Join(dir, fmt.Sprintf("merged%v", i))
+				if _, err := file.Merge(dbDir, updateFilename, mergedDir, &file.MergeOptions{
+					LogFunc: noLog,
+				}); err != nil {
+					t.Fatal(err)
+				}
+				dbDir = mergedDir
+				want = append([]string{strings.ToUpper(hash) + ":1"}, want...)
+				sort.Strings(want)
+			}
+			if got := export(t, dbDir); !reflect.DeepEqual(got, want) {
+				t.Error("counts changed after merges")
+			}
+
+			updateFilename := filepath.Join(dir, "update-max.txt")
+			if err := os.WriteFile(updateFilename, []byte("0000000000000000000000000000000000000003:1099511627776\n"), 0666); err != nil {
+				t.Fatal(err)
+			}
+			_, err := file.Merge(baseDir, updateFilename, filepath.Join(dir, "merged-max"), &file.MergeOptions{
+				LogFunc: noLog,
+			})
+			if hashCounting == file.HashCountingClasses {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), "input hash count 1099511627776 higher than max hash count") {
+				t.Errorf("got error %v, want max hash count error", err)
+			}
+		})
+	}
+}
@@ -6,6 +6,8 @@
 package file
 
 import (
+	"strconv"
+
 	"github.com/prometheus/client_golang/prometheus"
 	m "resenje.org/compromised/pkg/metrics"
 )
@@ -14,29 +16,126 @@ type metrics struct {
 	// all metrics fields must be exported
 	// to be able to return them by Metrics()
 	// using reflection
-	CheckedCount     prometheus.Counter
-	CompromisedCount prometheus.Counter
+	CheckedCount             prometheus.Counter
+	CompromisedCount         prometheus.Counter
+	FilterHitCount           prometheus.Counter
+	FilterMissCount          prometheus.Counter
+	FilterFalsePositiveCount prometheus.Counter
+	LookupDuration           *prometheus.HistogramVec
+	LookupReadBytes          prometheus.Histogram
+	LookupErrorCount         *prometheus.CounterVec
+	ReturnedCount            prometheus.Histogram
+	DatabaseInfo             *prometheus.GaugeVec
 }
 
-func newMetrics() metrics {
+// Lookup stages that are used as the stage label of the lookup errors metric.
+const (
+	lookupStageIndexSeek = "index_seek"
+	lookupStageIndexRead = "index_read"
+	lookupStageShardRead = "shard_read"
+)
+
+func newMetrics(name string) metrics {
 	subsystem := "passwords"
 
+	var labels prometheus.Labels
+	if name != "" {
+		labels = prometheus.Labels{"db": name}
+	}
+
 	return metrics{
 		CheckedCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: m.Namespace,
-			Subsystem: subsystem,
-			Name:      "checked_count",
-			Help:      "Number of checked passwords.",
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "checked_count",
+			Help:        "Number of checked passwords.",
+			ConstLabels: labels,
 		}),
 		CompromisedCount: prometheus.NewCounter(prometheus.CounterOpts{
-			Namespace: m.Namespace,
-			Subsystem: subsystem,
-			Name:      "compromised_count",
-			Help:      "Number of detected compromised passwords.",
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "compromised_count",
+			Help:        "Number of detected compromised passwords.",
+			ConstLabels: labels,
+		}),
+		FilterHitCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "filter_hit_count",
+			Help:        "Number of lookups answered by the filter without reading database files.",
+			ConstLabels: labels,
 		}),
+		FilterMissCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "filter_miss_count",
+			Help:        "Number of lookups that the filter could not answer.",
+			ConstLabels: labels,
+		}),
+		FilterFalsePositiveCount: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "filter_false_positive_count",
+			Help:        "Number of lookups that the filter could not answer for not compromised passwords.",
+			ConstLabels: labels,
+		}),
+		LookupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "lookup_duration_seconds",
+			Help:        "Histogram of password hash lookup durations by database shards.",
+			Buckets:     []float64{0.00001, 0.000025, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.1},
+			ConstLabels: labels,
+		}, []string{"shard"}),
+		LookupReadBytes: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "lookup_read_bytes",
+			Help:        "Histogram of bytes read from database files by password hash lookups.",
+			Buckets:     prometheus.ExponentialBuckets(8, 4, 8),
+			ConstLabels: labels,
+		}),
+		LookupErrorCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "lookup_error_count",
+			Help:        "Number of failed password hash lookups by stages of the lookup: index_seek, index_read and shard_read.",
+			ConstLabels: labels,
+		}, []string{"stage"}),
+		ReturnedCount: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "returned_count",
+			Help:        "Histogram of returned counts of compromised passwords.",
+			Buckets:     prometheus.ExponentialBuckets(1, 10, 8),
+			ConstLabels: labels,
+		}),
+		DatabaseInfo: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "database_info",
+			Help:        "Meta information of the loaded database, with the constant value 1.",
+			ConstLabels: labels,
+		}, []string{"version", "format", "hash", "count_decoder", "count", "min_hash_count", "max_hash_count", "shard_count"}),
 	}
 }
 
+// setDatabaseInfo replaces the database info metric with meta information of
+// the database.
+func (m metrics) setDatabaseInfo(db *database) {
+	m.DatabaseInfo.Reset()
+	m.DatabaseInfo.WithLabelValues(
+		strconv.Itoa(db.meta.Version),
+		string(db.format),
+		string(db.hash),
+		db.meta.CountDecoder,
+		strconv.FormatUint(db.meta.Count, 10),
+		strconv.FormatUint(db.meta.MinHashCount, 10),
+		strconv.FormatUint(db.meta.MaxHashCount, 10),
+		strconv.Itoa(db.shardCount),
+	).Set(1)
+}
+
 // Metrics provides prometheus metrics from this Service.
 func (s *Service) Metrics() (cs []prometheus.Collector) {
 	return m.PrometheusCollectorsFromFields(s.metrics)
@@ -0,0 +1,160 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestService_metrics(t *testing.T) {
+	srcDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", &file.IndexOptions{
+		ShardCount: 4,
+	})
+
+	// database files are truncated
+	dbDir := filepath.Join(t.TempDir(), "db")
+	copyDir(t, srcDir, dbDir)
+
+	s, err := file.New(dbDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+
+	hits := [][20]byte{
+		hexDecodeSHA1Sum(t, "002DCFC06E1B1B25F220203617B526794D10612A"), // 7
+		hexDecodeSHA1Sum(t, "008D79391C817885A59822F6153136C1CEFC2569"), // 1
+	}
+	misses := [][20]byte{
+		hexDecodeSHA1Sum(t, "0000000000000000000000000000000000000000"),
+		hexDecodeSHA1Sum(t, "ffffffffffffffffffffffffffffffffffffffff"),
+	}
+	for _, sum := range append(hits, misses...) {
+		if _, err := s.IsPasswordCompromised(ctx, sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.ArePasswordsCompromised(ctx, hits); err != nil {
+		t.Fatal(err)
+	}
+
+	families := gatherMetrics(t, s)
+
+	if v := families["compromised_passwords_checked_count"].GetMetric()[0].GetCounter().GetValue(); v != 6 {
+		t.Errorf("got checked count %v, want 6", v)
+	}
+	if v := families["compromised_passwords_compromised_count"].GetMetric()[0].GetCounter().GetValue(); v != 4 {
+		t.Errorf("got compromised count %v, want 4", v)
+	}
+
+	returned := families["compromised_passwords_returned_count"].GetMetric()[0].GetHistogram()
+	if returned.GetSampleCount() != 4 || returned.GetSampleSum() != 16 {
+		t.Errorf("got returned counts %v with sum %v, want 4 with sum 16", returned.GetSampleCount(), returned.GetSampleSum())
+	}
+
+	readBytes := families["compromised_passwords_lookup_read_bytes"].GetMetric()[0].GetHistogram()
+	if readBytes.GetSampleCount() != 6 || readBytes.GetSampleSum() == 0 {
+		t.Errorf("got read bytes %v with sum %v, want 6 with non zero sum", readBytes.GetSampleCount(), readBytes.GetSampleSum())
+	}
+
+	shards := make(map[string]uint64)
+	for _, m := range families["compromised_passwords_lookup_duration_seconds"].GetMetric() {
+		shards[labelValue(m.GetLabel(), "shard")] = m.GetHistogram().GetSampleCount()
+	}
+	if len(shards) != 2 || shards["0"] != 5 || shards["3"] != 1 {
+		t.Errorf("got lookup durations by shards %v, want 5 in shard 0 and 1 in shard 3", shards)
+	}
+
+	info := families["compromised_passwords_database_info"].GetMetric()
+	if len(info) != 1 {
+		t.Fatalf("got %v database info metrics, want 1", len(info))
+	}
+	for name, want := range map[string]string{
+		"version":       "1",
+		"format":        "directory",
+		"hash":          "sha1",
+		"count_decoder": "big32",
+		"count":         "2862",
+		"shard_count":   "4",
+	} {
+		if v := labelValue(info[0].GetLabel(), name); v != want {
+			t.Errorf("got database info label %s %q, want %q", name, v, want)
+		}
+	}
+
+	if _, ok := families["compromised_passwords_lookup_error_count"]; ok {
+		t.Error("lookup errors counted without errors")
+	}
+
+	// truncated files fail lookups in different stages
+	shardFilenames, err := filepath.Glob(filepath.Join(dbDir, "hashes-*.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range shardFilenames {
+		if err := os.Truncate(filename, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.IsPasswordCompromised(ctx, hits[0]); err == nil {
+		t.Error("expected error for truncated hashes file")
+	}
+	if err := os.Truncate(filepath.Join(dbDir, "index.db"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.IsPasswordCompromised(ctx, hits[0]); err == nil {
+		t.Error("expected error for truncated index file")
+	}
+
+	stages := make(map[string]float64)
+	for _, m := range gatherMetrics(t, s)["compromised_passwords_lookup_error_count"].GetMetric() {
+		stages[labelValue(m.GetLabel(), "stage")] = m.GetCounter().GetValue()
+	}
+	if len(stages) != 2 || stages["shard_read"] != 1 || stages["index_seek"] != 1 {
+		t.Errorf("got lookup errors by stages %v, want one shard_read and one index_seek", stages)
+	}
+}
+
+// gatherMetrics returns metric families of the service by their names.
+func gatherMetrics(t *testing.T, s *file.Service) map[string]*dto.MetricFamily {
+	t.Helper()
+
+	registry := prometheus.NewRegistry()
+	for _, c := range s.Metrics() {
+		if err := registry.Register(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := make(map[string]*dto.MetricFamily)
+	for _, f := range families {
+		m[f.GetName()] = f
+	}
+	return m
+}
+
+// labelValue returns the value of the label by its name.
+func labelValue(labels []*dto.LabelPair, name string) string {
+	for _, l := range labels {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// mmapFile provides positional reads from a memory mapped file content without
+// making system calls.
+type mmapFile struct {
+	data []byte
+}
+
+func openMmapFile(filename string) (*mmapFile, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := stat.Size()
+	if size == 0 {
+		// empty files can not be mapped
+		return new(mmapFile), nil
+	}
+	if int64(int(size)) != size {
+		return nil, fmt.Errorf("file %s too large to be memory mapped", filename)
+	}
+
+	data, err := mmap(f, int(size))
+	if err != nil {
+		return nil, fmt.Errorf("mmap %s: %w", filename, err)
+	}
+
+	return &mmapFile{
+		data: data,
+	}, nil
+}
+
+// ReadAt implements io.ReaderAt interface.
+func (m *mmapFile) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= int64(len(m.data)) {
+		return 0, io.EOF
+	}
+	n = copy(p, m.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// slice returns a part of the mapped file content without copying it.
+func (m *mmapFile) slice(offset, size int64) ([]byte, error) {
+	if offset < 0 || size < 0 {
+		return nil, errors.New("negative offset or size")
+	}
+	if offset+size > int64(len(m.data)) {
+		available := int64(len(m.data)) - offset
+		if available < 0 {
+			available = 0
+		}
+		return nil, fmt.Errorf("%w at %v: %v instead %v", errShortRead, offset, available, size)
+	}
+	return m.data[offset : offset+size : offset+size], nil
+}
+
+// Close unmaps the file content.
+func (m *mmapFile) Close() error {
+	if m.data == nil {
+		return nil
+	}
+	data := m.data
+	m.data = nil
+	return munmap(data)
+}
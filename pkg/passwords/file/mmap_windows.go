@@ -0,0 +1,22 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build windows
+// +build windows
+
+package file
+
+import (
+	"errors"
+	"os"
+)
+
+func mmap(_ *os.File, _ int) ([]byte, error) {
+	return nil, errors.New("memory mapped files are not supported on Windows")
+}
+
+func munmap(_ []byte) error {
+	return nil
+}
@@ -0,0 +1,251 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ReindexOptions holds optional parameters for reindexing a database. Options
+// with zero values keep the values of the existing database.
+type ReindexOptions struct {
+	// MinHashCount filters out hashes with lower compromised counts. It can
+	// not be lower than the minimal hash count of the existing database.
+	// Hashes are filtered by counts as they are stored in the existing
+	// database, so for HashCountingApprox and HashCountingApprox16 databases
+	// hashes with counts close to MinHashCount are kept or removed by their
+	// approximated counts. It must be one of the count classes for
+	// HashCountingClasses databases and it can not be higher than the
+	// minimal hash count of HashCountingNone databases, as their counts are
+	// not stored.
+	MinHashCount uint64
+	// ShardCount specifies the number of files into which hashes should be
+	// stored.
+	ShardCount int
+	// HashCounting specifies if hashes compromised count should be exact,
+	// approximate or none. Counts can not be more precise than in the
+	// existing database.
+	HashCounting HashCounting
+	// CountClasses are lower bounds of count classes for the
+	// HashCountingClasses hash counting. If the existing database has count
+	// classes, all of them must be its classes, as counts within classes are
+	// not known. Empty value keeps classes of the existing database, if it
+	// has them, or uses DefaultCountClasses.
+	CountClasses []uint64
+	// FilterFalsePositiveRate is the target false positive rate of the Bloom
+	// filter of all hashes, in the same way as for the Index function.
+	FilterFalsePositiveRate float64
+	// Format specifies if the new database is stored in a directory or in a
+	// single container file.
+	Format Format
+	// Resume continues reindexing that was interrupted, in the same way as
+	// for the Index function.
+	Resume bool
+	// LogFunc can be specified as a custom receiver of log messages.
+	LogFunc func(string, ...interface{})
+}
+
+// Reindex creates a new database in outputDir with hashes from the existing
+// database in dbDir, but with different options. The number of shards can be
+// changed, hashes can be filtered with a higher minimal hash count, counts
+// can be stored less precisely and the database can be converted between the
+// directory and the container file formats. Only the existing database is
+// read, without its original input. It returns the number of saved hashes.
+func Reindex(dbDir, outputDir string, o *ReindexOptions) (uint64, error) {
+	if o == nil {
+		o = new(ReindexOptions)
+	}
+	logFunc := o.LogFunc
+	if logFunc == nil {
+		logFunc = func(format string, a ...interface{}) {
+			fmt.Printf(format+"\n", a...)
+		}
+	}
+
+	m, err := readMeta(dbDir)
+	if err != nil {
+		return 0, fmt.Errorf("read database meta: %w", err)
+	}
+	if Hash(m.Hash).size() == 0 {
+		return 0, fmt.Errorf("unsupported hash %s", m.Hash)
+	}
+	hashCounting, err := hashCountingName(m.CountDecoder)
+	if err != nil {
+		return 0, err
+	}
+
+	minHashCount := o.MinHashCount
+	if minHashCount == 0 {
+		minHashCount = m.MinHashCount
+	}
+	if minHashCount < m.MinHashCount {
+		return 0, fmt.Errorf("min hash count %v lower than %v of the database", minHashCount, m.MinHashCount)
+	}
+	if minHashCount > m.MinHashCount {
+		switch hashCounting {
+		case HashCountingNone:
+			return 0, fmt.Errorf("min hash count %v higher than %v of the database without hash counts", minHashCount, m.MinHashCount)
+		case HashCountingClasses:
+			if len(m.CountClasses) == 0 || m.CountClasses[countClass(m.CountClasses, minHashCount)] != minHashCount {
+				return 0, fmt.Errorf("min hash count %v is not a count class of the database", minHashCount)
+			}
+		}
+	}
+	shardCount := o.ShardCount
+	if shardCount == 0 {
+		shardCount = m.ShardCount
+	}
+	if !isShardCountValid(shardCount) {
+		return 0, errors.New("invalid shard count")
+	}
+	if o.HashCounting != "" {
+		if hashCountingPrecision(o.HashCounting) > hashCountingPrecision(hashCounting) {
+			return 0, fmt.Errorf("%s hash counting is more precise than %s hash counting of the database", o.HashCounting, hashCounting)
+		}
+		hashCounting = o.HashCounting
+	}
+	countDecoder, err := countDecoderName(hashCounting)
+	if err != nil {
+		return 0, err
+	}
+	countClasses := o.CountClasses
+	if len(countClasses) == 0 && hashCounting == HashCountingClasses {
+		countClasses = m.CountClasses
+	}
+	countClasses, err = hashCountingClasses(hashCounting, countClasses)
+	if err != nil {
+		return 0, err
+	}
+	if len(countClasses) > 0 && len(m.CountClasses) > 0 {
+		for _, c := range countClasses {
+			if m.CountClasses[countClass(m.CountClasses, c)] != c {
+				return 0, fmt.Errorf("count class %v is not a count class of the database", c)
+			}
+		}
+	}
+	format := o.Format
+	if format == "" {
+		format, err = databaseFormat(dbDir)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if !format.isValid() {
+		return 0, fmt.Errorf("unsupported format %s", format)
+	}
+	filterFalsePositiveRate := o.FilterFalsePositiveRate
+	if filterFalsePositiveRate == 0 {
+		filterFalsePositiveRate = m.FilterFalsePositiveRate
+	}
+	if filterFalsePositiveRate < 0 || filterFalsePositiveRate >= 1 {
+		return 0, fmt.Errorf("invalid filter false positive rate %v", filterFalsePositiveRate)
+	}
+
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		return 0, fmt.Errorf("database directory %s already exists", outputDir)
+	}
+
+	base, err := filepath.Abs(dbDir)
+	if err != nil {
+		return 0, err
+	}
+
+	w, err := newWriter(outputDir, meta{
+		Hash:         m.Hash,
+		MinHashCount: minHashCount,
+		ShardCount:   shardCount,
+		CountDecoder: countDecoder,
+		CountClasses: countClasses,
+		Lineage:      append([]Lineage(nil), m.Lineage...),
+
+		FilterFalsePositiveRate: filterFalsePositiveRate,
+	}, &writerOptions{
+		checkpoint: true,
+		resume:     o.Resume,
+		container:  format == FormatContainer,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer w.close()
+
+	logFunc("reindexing database %s", dbDir)
+	logFunc("saving to: %v", outputDir)
+	if w.resume != nil {
+		logFunc("resuming with %v of %v shards indexed", w.resume.Shards, shardCount)
+	}
+
+	var removed uint64
+	if err := iterate(dbDir, func(hash []byte, count uint64) error {
+		// all hashes already have counts of at least the min hash count of
+		// the database, which may be higher than their stored counts
+		if minHashCount > m.MinHashCount && count < minHashCount {
+			removed++
+			return nil
+		}
+		return w.add(hash, count)
+	}); err != nil {
+		return 0, err
+	}
+
+	w.meta.Lineage = append(w.meta.Lineage, Lineage{
+		Operation: lineageReindex,
+		Time:      time.Now().UTC(),
+		Base:      base,
+		Count:     w.meta.Count,
+		Removed:   removed,
+	})
+
+	meta, err := w.finish()
+	if err != nil {
+		return 0, err
+	}
+
+	logFunc("removed %v hashes", removed)
+	logFunc("saved %v hashes", meta.Count)
+
+	return meta.Count, nil
+}
+
+// hashCountingName returns the hash counting type of the count decoder stored
+// in the meta information.
+func hashCountingName(countDecoder string) (HashCounting, error) {
+	switch countDecoder {
+	case "big32":
+		return HashCountingExact, nil
+	case "approx8":
+		return HashCountingApprox, nil
+	case "approx16":
+		return HashCountingApprox16, nil
+	case "uvarint":
+		return HashCountingVarint, nil
+	case "classes":
+		return HashCountingClasses, nil
+	case "none":
+		return HashCountingNone, nil
+	}
+	return "", fmt.Errorf("unsupported count decoder %s", countDecoder)
+}
+
+// hashCountingPrecision orders hash counting types by the precision of
+// stored counts.
+func hashCountingPrecision(c HashCounting) int {
+	switch c {
+	case HashCountingExact, HashCountingVarint:
+		return 4
+	case HashCountingApprox16:
+		return 3
+	case HashCountingApprox:
+		return 2
+	case HashCountingClasses:
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestReindex(t *testing.T) {
+	const inputFilename = "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+	noLog := func(string, ...interface{}) {}
+
+	dbDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+		MinHashCount: 2,
+	})
+
+	type testCase struct {
+		reindexOptions file.ReindexOptions
+		// options for indexing the same database from the input file
+		indexOptions file.IndexOptions
+	}
+	testCases := []testCase{
+		{
+			reindexOptions: file.ReindexOptions{},
+			indexOptions:   file.IndexOptions{MinHashCount: 2},
+		},
+		{
+			reindexOptions: file.ReindexOptions{ShardCount: 4},
+			indexOptions:   file.IndexOptions{MinHashCount: 2, ShardCount: 4},
+		},
+		{
+			reindexOptions: file.ReindexOptions{MinHashCount: 10},
+			indexOptions:   file.IndexOptions{MinHashCount: 10},
+		},
+		{
+			reindexOptions: file.ReindexOptions{HashCounting: file.HashCountingApprox},
+			indexOptions:   file.IndexOptions{MinHashCount: 2, HashCounting: file.HashCountingApprox},
+		},
+		{
+			reindexOptions: file.ReindexOptions{ShardCount: 8, HashCounting: file.HashCountingVarint},
+			indexOptions:   file.IndexOptions{MinHashCount: 2, ShardCount: 8, HashCounting: file.HashCountingVarint},
+		},
+		{
+			reindexOptions: file.ReindexOptions{HashCounting: file.HashCountingClasses},
+			indexOptions:   file.IndexOptions{MinHashCount: 2, HashCounting: file.HashCountingClasses},
+		},
+		{
+			reindexOptions: file.ReindexOptions{MinHashCount: 5, ShardCount: 1, HashCounting: file.HashCountingNone},
+			indexOptions:   file.IndexOptions{MinHashCount: 5, ShardCount: 1, HashCounting: file.HashCountingNone},
+		},
+	}
+	if !testing.Short() {
+		testCases = append(testCases, []testCase{
+			{
+				reindexOptions: file.ReindexOptions{HashCounting: file.HashCountingApprox16},
+				indexOptions:   file.IndexOptions{MinHashCount: 2, HashCounting: file.HashCountingApprox16},
+			},
+			{
+				reindexOptions: file.ReindexOptions{HashCounting: file.HashCountingClasses, CountClasses: []uint64{1, 10, 100}},
+				indexOptions:   file.IndexOptions{MinHashCount: 2, HashCounting: file.HashCountingClasses, CountClasses: []uint64{1, 10, 100}},
+			},
+		}...)
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%+v", tc.reindexOptions), func(t *testing.T) {
+			wantDir, wantCount := indexTestDatabase(t, inputFilename, &tc.indexOptions)
+
+			gotDir := filepath.Join(t.TempDir(), "got")
+			tc.reindexOptions.LogFunc = noLog
+			gotCount, err := file.Reindex(dbDir, gotDir, &tc.reindexOptions)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if gotCount != wantCount {
+				t.Errorf("got count %v, want %v", gotCount, wantCount)
+			}
+
+			assertSameDataFiles(t, gotDir, wantDir)
+
+			b, err := os.ReadFile(filepath.Join(gotDir, "db.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var meta struct {
+				MinHashCount uint64 `json:"min_hash_count"`
+				Lineage      []file.Lineage
+			}
+			if err := json.Unmarshal(b, &meta); err != nil {
+				t.Fatal(err)
+			}
+			if meta.MinHashCount != tc.indexOptions.MinHashCount {
+				t.Errorf("got min hash count %v, want %v", meta.MinHashCount, tc.indexOptions.MinHashCount)
+			}
+			if len(meta.Lineage) != 2 {
+				t.Fatalf("got lineage %+v, want two entries", meta.Lineage)
+			}
+			base, err := filepath.Abs(dbDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if l := meta.Lineage[1]; l.Operation != "reindex" || l.Base != base || l.Count != gotCount {
+				t.Errorf("got reindex lineage %+v", l)
+			}
+		})
+	}
+}
+
+func TestReindex_invalidOptions(t *testing.T) {
+	dir := t.TempDir()
+	noLog := func(string, ...interface{}) {}
+
+	dbDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", &file.IndexOptions{
+		MinHashCount: 2,
+		HashCounting: file.HashCountingApprox,
+	})
+
+	for _, tc := range []struct {
+		options file.ReindexOptions
+		wantErr string
+	}{
+		{
+			options: file.ReindexOptions{HashCounting: file.HashCountingExact},
+			wantErr: "exact hash counting is more precise than approx hash counting of the database",
+		},
+		{
+			options: file.ReindexOptions{MinHashCount: 1},
+			wantErr: "min hash count 1 lower than 2 of the database",
+		},
+		{
+			options: file.ReindexOptions{ShardCount: 3},
+			wantErr: "invalid shard count",
+		},
+	} {
+		tc.options.LogFunc = noLog
+		outputDir := filepath.Join(dir, "output")
+		_, err := file.Reindex(dbDir, outputDir, &tc.options)
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("got error %v, want %q", err, tc.wantErr)
+		}
+		if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+			t.Errorf("output directory created: %v", err)
+		}
+	}
+}
+
+func TestReindex_countClasses(t *testing.T) {
+	const inputFilename = "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+	noLog := func(string, ...interface{}) {}
+
+	dbDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+		HashCounting: file.HashCountingClasses,
+		CountClasses: []uint64{1, 5, 10, 50, 100},
+	})
+
+	t.Run("subset", func(t *testing.T) {
+		for _, tc := range []struct {
+			reindexOptions file.ReindexOptions
+			indexOptions   file.IndexOptions
+		}{
+			{
+				reindexOptions: file.ReindexOptions{},
+				indexOptions:   file.IndexOptions{HashCounting: file.HashCountingClasses, CountClasses: []uint64{1, 5, 10, 50, 100}},
+			},
+			{
+				reindexOptions: file.ReindexOptions{CountClasses: []uint64{1, 10, 100}},
+				indexOptions:   file.IndexOptions{HashCounting: file.HashCountingClasses, CountClasses: []uint64{1, 10, 100}},
+			},
+			{
+				reindexOptions: file.ReindexOptions{MinHashCount: 5, HashCounting: file.HashCountingNone},
+				indexOptions:   file.IndexOptions{MinHashCount: 5, HashCounting: file.HashCountingNone},
+			},
+			{
+				reindexOptions: file.ReindexOptions{MinHashCount: 10},
+				indexOptions:   file.IndexOptions{MinHashCount: 10, HashCounting: file.HashCountingClasses, CountClasses: []uint64{1, 5, 10, 50, 100}},
+			},
+		} {
+			wantDir, _ := indexTestDatabase(t, inputFilename, &tc.indexOptions)
+
+			gotDir := filepath.Join(t.TempDir(), "got")
+			tc.reindexOptions.LogFunc = noLog
+			if _, err := file.Reindex(dbDir, gotDir, &tc.reindexOptions); err != nil {
+				t.Fatal(err)
+			}
+
+			assertSameDataFiles(t, gotDir, wantDir)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		for _, tc := range []struct {
+			options file.ReindexOptions
+			wantErr string
+		}{
+			{
+				options: file.ReindexOptions{CountClasses: []uint64{1, 20}},
+				wantErr: "count class 20 is not a count class of the database",
+			},
+			{
+				options: file.ReindexOptions{CountClasses: []uint64{2, 10}},
+				wantErr: "first count class 2 instead 1",
+			},
+			{
+				options: file.ReindexOptions{HashCounting: file.HashCountingApprox16},
+				wantErr: "approx16 hash counting is more precise than classes hash counting of the database",
+			},
+			{
+				options: file.ReindexOptions{HashCounting: file.HashCountingNone, CountClasses: []uint64{1, 10}},
+				wantErr: "count classes are not supported by none hash counting",
+			},
+			{
+				options: file.ReindexOptions{MinHashCount: 20},
+				wantErr: "min hash count 20 is not a count class of the database",
+			},
+		} {
+			tc.options.LogFunc = noLog
+			outputDir := filepath.Join(t.TempDir(), "output")
+			_, err := file.Reindex(dbDir, outputDir, &tc.options)
+			if err == nil || err.Error() != tc.wantErr {
+				t.Errorf("got error %v, want %q", err, tc.wantErr)
+			}
+		}
+	})
+}
+
+func TestReindex_minHashCountNone(t *testing.T) {
+	noLog := func(string, ...interface{}) {}
+
+	dbDir, wantCount := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", &file.IndexOptions{
+		MinHashCount: 2,
+		HashCounting: file.HashCountingNone,
+	})
+
+	outputDir := filepath.Join(t.TempDir(), "output")
+	_, err := file.Reindex(dbDir, outputDir, &file.ReindexOptions{
+		MinHashCount: 10,
+		LogFunc:      noLog,
+	})
+	if want := "min hash count 10 higher than 2 of the database without hash counts"; err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+	if _, err := os.Stat(outputDir); !os.IsNotExist(err) {
+		t.Errorf("output directory created: %v", err)
+	}
+
+	count, err := file.Reindex(dbDir, outputDir, &file.ReindexOptions{
+		MinHashCount: 2,
+		LogFunc:      noLog,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != wantCount {
+		t.Errorf("got count %v, want %v", count, wantCount)
+	}
+}
+
+func TestReindex_minHashCountApprox(t *testing.T) {
+	noLog := func(string, ...interface{}) {}
+
+	dbDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", &file.IndexOptions{
+		MinHashCount: 2,
+		HashCounting: file.HashCountingApprox,
+	})
+
+	// hashes are filtered by their approximated counts, as they are exported
+	var want bytes.Buffer
+	wantCount, err := file.Export(dbDir, &want, &file.ExportOptions{
+		MinHashCount: 10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputDir := filepath.Join(t.TempDir(), "output")
+	count, err := file.Reindex(dbDir, outputDir, &file.ReindexOptions{
+		MinHashCount: 10,
+		LogFunc:      noLog,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != wantCount {
+		t.Errorf("got count %v, want %v", count, wantCount)
+	}
+
+	var got bytes.Buffer
+	if _, err := file.Export(outputDir, &got, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got.String() != want.String() {
+		t.Error("reindexed hashes are not the same as exported with min hash count")
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// hashScanner reads hashes and their counts from textual HASH:COUNT lines,
+// validating that the hashes are in ascending order.
+type hashScanner struct {
+	scanner  *bufio.Scanner
+	hashName Hash
+	hash     []byte
+	prevHash []byte
+	count    uint64
+	line     uint64
+	invalid  error
+}
+
+func newHashScanner(r io.Reader, h Hash) *hashScanner {
+	return &hashScanner{
+		scanner:  bufio.NewScanner(r),
+		hashName: h,
+		hash:     make([]byte, h.size()),
+	}
+}
+
+// scan reads the next line and returns false when there are no more lines or
+// when the line is not valid, which is returned by the Err method.
+func (s *hashScanner) scan() bool {
+	if s.invalid != nil || !s.scanner.Scan() {
+		return false
+	}
+	s.line++
+
+	s.prevHash = append(s.prevHash[:0], s.hash...)
+	count, err := parseHashLine(s.scanner.Bytes(), s.hashName, s.hash)
+	if err != nil {
+		// the last line is incomplete if reading failed, which is returned
+		// by the Err method
+		if s.scanner.Err() != nil {
+			return false
+		}
+		s.invalid = fmt.Errorf("line %v: %w", s.line, err)
+		return false
+	}
+	if s.line > 1 && bytes.Compare(s.hash, s.prevHash) <= 0 {
+		s.invalid = fmt.Errorf("input is not sorted by hashes: line %v", s.line)
+		return false
+	}
+	s.count = count
+
+	return true
+}
+
+// Err returns the first invalid line or reading error.
+func (s *hashScanner) Err() error {
+	if s.invalid != nil {
+		return s.invalid
+	}
+	if err := s.scanner.Err(); err != nil {
+		return fmt.Errorf("read input: %w", err)
+	}
+	return nil
+}
+
+// parseHashLine decodes the hash from a HASH:COUNT line into the provided hash
+// slice and returns the count.
+func parseHashLine(line []byte, h Hash, hash []byte) (count uint64, err error) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	hashHexSize := len(hash) * 2
+	if len(line) < hashHexSize+2 || line[hashHexSize] != ':' {
+		return 0, fmt.Errorf("invalid %s hash line", h)
+	}
+	if _, err := hex.Decode(hash, line[:hashHexSize]); err != nil {
+		return 0, fmt.Errorf("decode hash: %w", err)
+	}
+	count, err = strconv.ParseUint(string(line[hashHexSize+1:]), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("convert count to integer: %w", err)
+	}
+	return count, nil
+}
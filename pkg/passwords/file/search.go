@@ -0,0 +1,89 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// searchFunc returns the index of the record that starts with the hash
+// remainder or -1 if there is no such record. Records are stored sequentially
+// in the records slice, each of them recordSize bytes long, ordered by their
+// hash remainders.
+type searchFunc func(records []byte, recordSize int, remainder []byte) int
+
+// linearSearch compares the hash remainder with every record until the match is
+// found.
+func linearSearch(records []byte, recordSize int, remainder []byte) int {
+	for i, offset := 0, 0; offset+recordSize <= len(records); i, offset = i+1, offset+recordSize {
+		if bytes.Equal(remainder, records[offset:offset+len(remainder)]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// binarySearch finds the hash remainder in logarithmic time.
+func binarySearch(records []byte, recordSize int, remainder []byte) int {
+	n := len(records) / recordSize
+	i := sort.Search(n, func(i int) bool {
+		offset := i * recordSize
+		return bytes.Compare(records[offset:offset+len(remainder)], remainder) >= 0
+	})
+	if i < n && bytes.Equal(remainder, records[i*recordSize:i*recordSize+len(remainder)]) {
+		return i
+	}
+	return -1
+}
+
+// interpolationSearch relies on the uniform distribution of hashes to estimate
+// the position of the hash remainder from the values of its first 8 bytes. On
+// average, it makes fewer comparisons than the binary search.
+func interpolationSearch(records []byte, recordSize int, remainder []byte) int {
+	n := len(records) / recordSize
+	if n == 0 {
+		return -1
+	}
+
+	key := binary.BigEndian.Uint64(remainder)
+	keyAt := func(i int) uint64 {
+		return binary.BigEndian.Uint64(records[i*recordSize:])
+	}
+
+	low, high := 0, n-1
+	for low <= high {
+		lowKey, highKey := keyAt(low), keyAt(high)
+		if key < lowKey || key > highKey {
+			return -1
+		}
+		if lowKey == highKey {
+			// all keys in the range are equal, interpolation is not possible
+			if i := binarySearch(records[low*recordSize:(high+1)*recordSize], recordSize, remainder); i >= 0 {
+				return low + i
+			}
+			return -1
+		}
+
+		// (key-lowKey) * (high-low) / (highKey-lowKey) without overflow,
+		// the quotient is never larger than high-low
+		hi, lo := bits.Mul64(key-lowKey, uint64(high-low))
+		q, _ := bits.Div64(hi, lo, highKey-lowKey)
+		i := low + int(q)
+
+		switch c := bytes.Compare(records[i*recordSize:i*recordSize+len(remainder)], remainder); {
+		case c == 0:
+			return i
+		case c < 0:
+			low = i + 1
+		default:
+			high = i - 1
+		}
+	}
+	return -1
+}
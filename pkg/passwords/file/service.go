@@ -6,179 +6,496 @@
 package file
 
 import (
-	"bufio"
 	"bytes"
 	"context"
-	"encoding/binary"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
 
-	"resenje.org/compromised/pkg/approxcount"
 	"resenje.org/compromised/pkg/passwords"
 )
 
-var _ passwords.Service = (*Service)(nil)
+var (
+	_ passwords.Service      = (*Service)(nil)
+	_ passwords.RangeService = (*Service)(nil)
+	_ passwords.BatchService = (*Service)(nil)
+	_ passwords.NTLMService  = (*Service)(nil)
+)
+
+var (
+	// ErrHashMismatch is returned when a database is queried with a hash of a
+	// different algorithm than the one it is indexed with.
+	ErrHashMismatch = errors.New("hash not supported by the database")
+	// ErrClosed is returned when a closed Service is used.
+	ErrClosed = errors.New("database closed")
+
+	// errShortRead is returned by readAt when the data is not available at
+	// the offset, which is beyond the end of the file.
+	errShortRead = errors.New("short read")
+)
 
 // Service implements passwords service by reading the passwords hash data
 // directly from files stored on the filesystem.
 type Service struct {
-	index            *os.File
-	shards           map[int]*os.File
-	shardCount       int
-	countDecoder     func([]byte) uint64
-	countEncodedSize int64
-	metrics          metrics
+	dir             string
+	openFile        func(filename string) (dataFile, error)
+	hash            Hash
+	verifyChecksums bool
+	disableFilter   bool
+
+	mu       sync.RWMutex // protects db
+	db       *database
+	reloadMu sync.Mutex // serializes reloads
+
+	search  searchFunc
+	metrics metrics
+}
+
+// dataFile provides positional reads of a database file.
+type dataFile interface {
+	io.ReaderAt
+	io.Closer
+}
+
+// Options holds optional parameters for opening a database.
+type Options struct {
+	// Mode specifies how the database files are accessed. The default is
+	// ModeFile.
+	Mode Mode
+	// Name identifies the database in the service metrics with the db label
+	// when multiple databases are used in the same process.
+	Name string
+	// VerifyChecksums validates all database files with checksums stored in
+	// the db.json file when the database is opened or reloaded. It reads
+	// complete files, which may take a long time for large databases.
+	VerifyChecksums bool
+	// DisableFilter does not load the Bloom filter of the database into
+	// memory, if the database has it, and all lookups read database files.
+	DisableFilter bool
 }
 
+// Mode enumerates database files access modes.
+type Mode string
+
+var (
+	// ModeFile reads database files with a system call on every lookup.
+	ModeFile Mode = "file"
+	// ModeMmap maps database files into memory and performs lookups without
+	// system calls. It requires enough virtual memory to map the complete
+	// database and it performs best when the database is in the page cache.
+	ModeMmap Mode = "mmap"
+)
+
 // New creates a new instance of Service by opening database files in a provided
-// directory location on the filesystem.
-func New(dir string) (*Service, error) {
-	b, err := os.ReadFile(filepath.Join(dir, "db.json"))
-	if err != nil {
-		return nil, err
-	}
-	var m meta
-	if err := json.Unmarshal(b, &m); err != nil {
-		return nil, err
-	}
-	if m.Version > version {
-		return nil, errors.New("unsupported data version")
+// directory location on the filesystem, or a single container file if the
+// location is a file.
+func New(dir string, o *Options) (*Service, error) {
+	if o == nil {
+		o = new(Options)
 	}
-	if m.Hash != supportedHash {
-		return nil, errors.New("unsupported hashing algorithm")
-	}
-	if !isShardCountValid(m.ShardCount) {
-		return nil, errors.New("invalid shard count")
+	if o.Mode == "" {
+		o.Mode = ModeFile
 	}
 
-	var countDecoder func([]byte) uint64
-	var countEncodedSize int64
-	switch m.CountDecoder {
-	case "big32":
-		countDecoder = func(b []byte) uint64 {
-			return uint64(binary.BigEndian.Uint32(b))
-		}
-		countEncodedSize = 4
-	case "approx8":
-		e, err := approxcount.NewEncoder(uint64(m.MaxHashCount))
-		if err != nil {
-			return nil, err
-		}
-		countDecoder = func(b []byte) uint64 {
-			return e.Decode(b[0])
+	var openFile func(filename string) (dataFile, error)
+	switch o.Mode {
+	case ModeFile:
+		openFile = func(filename string) (dataFile, error) {
+			f, err := os.Open(filename)
+			if err != nil {
+				return nil, err
+			}
+			return f, nil
 		}
-		countEncodedSize = 1
-	case "none":
-		countDecoder = func(b []byte) uint64 {
-			return 1
+	case ModeMmap:
+		openFile = func(filename string) (dataFile, error) {
+			f, err := openMmapFile(filename)
+			if err != nil {
+				return nil, err
+			}
+			return f, nil
 		}
-		countEncodedSize = 0
 	default:
-		return nil, errors.New("invalid count decoder")
+		return nil, fmt.Errorf("unsupported mode %s", o.Mode)
 	}
 
-	index, err := os.Open(filepath.Join(dir, "index.db"))
+	db, err := openDatabase(dir, openFile)
 	if err != nil {
 		return nil, err
 	}
-	shards := make(map[int]*os.File, m.ShardCount)
-	for i := 0; i < m.ShardCount; i++ {
-		shards[i], err = os.Open(filepath.Join(
-			dir,
-			getShardFilename(i, m.ShardCount),
-		))
-		if err != nil {
-			return nil, fmt.Errorf("open hashes file %v: %w", i, err)
+	if o.VerifyChecksums {
+		if err := db.verifyChecksums(); err != nil {
+			db.close()
+			return nil, err
+		}
+	}
+	if !o.DisableFilter {
+		if err := db.loadFilter(); err != nil {
+			db.close()
+			return nil, err
 		}
 	}
-	return &Service{
-		index:            index,
-		shards:           shards,
-		shardCount:       m.ShardCount,
-		countDecoder:     countDecoder,
-		countEncodedSize: countEncodedSize,
-		metrics:          newMetrics(),
-	}, nil
+	s := &Service{
+		dir:             dir,
+		openFile:        openFile,
+		hash:            db.hash,
+		verifyChecksums: o.VerifyChecksums,
+		disableFilter:   o.DisableFilter,
+		db:              db,
+		search:          binarySearch,
+		metrics:         newMetrics(o.Name),
+	}
+	s.metrics.setDatabaseInfo(db)
+	return s, nil
 }
 
-const maxReaderBufferSize = 4096
+// Hash returns the password hashing algorithm of the database.
+func (s *Service) Hash() Hash {
+	return s.hash
+}
 
 // IsPasswordCompromised provides information if the password is compromised by
-// reading the index and hashes files.
+// reading the index and hashes files. It is safe to call it concurrently as all
+// reads are positional and use buffers that are not shared between calls. It
+// returns ErrHashMismatch if the database does not contain SHA1 hashes.
 func (s *Service) IsPasswordCompromised(_ context.Context, sum [20]byte) (count uint64, err error) {
-	shard := getShard(int(sum[0]), s.shardCount)
+	if s.hash != HashSHA1 {
+		return 0, ErrHashMismatch
+	}
+	return s.lookup(sum[:])
+}
 
-	partition := uint24(sum[:partitionSize])
+// IsNTLMPasswordCompromised provides information if the password is
+// compromised by its NTLM hash. It returns ErrHashMismatch if the database does
+// not contain NTLM hashes.
+func (s *Service) IsNTLMPasswordCompromised(_ context.Context, sum [16]byte) (count uint64, err error) {
+	if s.hash != HashNTLM {
+		return 0, ErrHashMismatch
+	}
+	return s.lookup(sum[:])
+}
 
-	indexLocation := (int64(partition) + int64(shard)) * indexLocationEncodedSize // add the shard count as it starts with a zero value step
-	indexCursor, err := s.index.Seek(indexLocation, io.SeekStart)
+func (s *Service) lookup(hash []byte) (count uint64, err error) {
+	db, err := s.acquire()
 	if err != nil {
-		return 0, fmt.Errorf("index seek to %v: %w", indexLocation, err)
+		return 0, err
 	}
-	if indexLocation != indexCursor {
-		return 0, fmt.Errorf("index out of range: %v instead %v", indexCursor, indexLocation)
+	defer db.refs.Done()
+
+	start := time.Now()
+	s.metrics.CheckedCount.Inc()
+
+	var bytesRead int
+	if s.filterContains(db, hash) {
+		var records []byte
+		records, bytesRead, err = s.partitionRecords(db, hash)
+		if err != nil {
+			return 0, err
+		}
+		count = s.find(db, records, hash)
+		if count == 0 && db.filter != nil {
+			s.metrics.FilterFalsePositiveCount.Inc()
+		}
 	}
 
-	buf := make([]byte, indexReadSize)
-	n, err := s.index.Read(buf)
+	s.observeLookup(db, hash, start, bytesRead, count)
+	return count, nil
+}
+
+// partitionRecords returns records of the partition of the hash and the
+// number of bytes read from database files, counting errors by the lookup
+// stage that failed.
+func (s *Service) partitionRecords(db *database, hash []byte) (records []byte, bytesRead int, err error) {
+	records, err = db.partitionRecords(hash)
 	if err != nil {
-		return 0, fmt.Errorf("index read %v at %v: %w", len(buf), indexCursor, err)
-	}
-	if n != len(buf) {
-		return 0, fmt.Errorf("index short read at %v: %v instead %v", indexCursor, n, len(buf))
+		var e *lookupError
+		if errors.As(err, &e) {
+			s.metrics.LookupErrorCount.WithLabelValues(e.stage).Inc()
+		}
+		return nil, 0, err
 	}
+	return records, indexReadSize + len(records), nil
+}
 
-	hashRemainderStep := hashRemainderSize + s.countEncodedSize
+// observeLookup updates metrics of a completed lookup of the hash.
+func (s *Service) observeLookup(db *database, hash []byte, start time.Time, bytesRead int, count uint64) {
+	shard := getShard(int(hash[0]), db.shardCount)
+	s.metrics.LookupDuration.WithLabelValues(strconv.Itoa(shard)).Observe(time.Since(start).Seconds())
+	s.metrics.LookupReadBytes.Observe(float64(bytesRead))
+	if count > 0 {
+		s.metrics.CompromisedCount.Inc()
+		s.metrics.ReturnedCount.Observe(float64(count))
+	}
+}
 
-	hashRemaindersStart := int64(binary.BigEndian.Uint32(buf[:indexLocationEncodedSize])) * hashRemainderStep
-	hashRemaindersEnd := int64(binary.BigEndian.Uint32(buf[indexLocationEncodedSize:indexLocationEncodedSize*2])) * hashRemainderStep
+// filterContains returns false if the database filter is loaded and the hash
+// is definitely not in the database.
+func (s *Service) filterContains(db *database, hash []byte) bool {
+	if db.filter == nil {
+		return true
+	}
+	if !db.filter.Contains(hash) {
+		s.metrics.FilterHitCount.Inc()
+		return false
+	}
+	s.metrics.FilterMissCount.Inc()
+	return true
+}
 
-	hashFile := s.shards[shard]
+// ArePasswordsCompromised provides information for multiple passwords if they
+// are compromised. Sums are grouped by partitions, so that the index and hashes
+// of every partition are read only once. Returned counts are in the same order
+// as provided sums.
+func (s *Service) ArePasswordsCompromised(ctx context.Context, sums [][20]byte) (counts []uint64, err error) {
+	if s.hash != HashSHA1 {
+		return nil, ErrHashMismatch
+	}
 
-	hashRemaindersCursor, err := hashFile.Seek(hashRemaindersStart, io.SeekStart)
+	db, err := s.acquire()
 	if err != nil {
-		return 0, fmt.Errorf("hashes %v seek to %v: %w", shard, hashRemaindersStart, err)
+		return nil, err
+	}
+	defer db.refs.Done()
+
+	order := make([]int, len(sums))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(sums[order[i]][:], sums[order[j]][:]) < 0
+	})
+
+	counts = make([]uint64, len(sums))
+	var records []byte
+	var recordsPartition []byte
+	for _, o := range order {
+		sum := sums[o]
+
+		// every sum is a lookup, but only the first one in a partition reads
+		// database files
+		start := time.Now()
+		s.metrics.CheckedCount.Inc()
+
+		var bytesRead int
+		if s.filterContains(db, sum[:]) {
+			if recordsPartition == nil || !bytes.Equal(sum[:partitionSize], recordsPartition) {
+				if err := ctx.Err(); err != nil {
+					return nil, err
+				}
+				records, bytesRead, err = s.partitionRecords(db, sum[:])
+				if err != nil {
+					return nil, err
+				}
+				recordsPartition = sums[o][:partitionSize]
+			}
+			counts[o] = s.find(db, records, sum[:])
+			if counts[o] == 0 && db.filter != nil {
+				s.metrics.FilterFalsePositiveCount.Inc()
+			}
+		}
+
+		s.observeLookup(db, sum[:], start, bytesRead, counts[o])
+	}
+	return counts, nil
+}
+
+// find returns the count of the hash from partition records or 0 if the hash is
+// not found.
+func (s *Service) find(db *database, records []byte, hash []byte) (count uint64) {
+	if db.varintCounts {
+		return findVariable(db, records, hash[partitionSize:])
+	}
+
+	hashRemainderStep := int(db.recordSize())
+
+	i := s.search(records, hashRemainderStep, hash[partitionSize:])
+	if i < 0 {
+		return 0
+	}
+
+	record := records[i*hashRemainderStep : (i+1)*hashRemainderStep]
+	return db.countDecoder(record[db.hashRemainderSize:])
+}
+
+// findVariable returns the count of the hash remainder from partition records
+// with variable length counts, which can be searched only sequentially, or 0
+// if the hash is not found.
+func findVariable(db *database, records []byte, remainder []byte) (count uint64) {
+	for len(records) > 0 {
+		r, count, size := db.parseRecord(records)
+		if size == 0 {
+			return 0
+		}
+		switch bytes.Compare(r, remainder) {
+		case 0:
+			return count
+		case 1:
+			return 0
+		}
+		records = records[size:]
 	}
-	if hashRemaindersStart != hashRemaindersCursor {
-		return 0, fmt.Errorf("hashes out of range: %v instead %v", hashRemaindersCursor, hashRemaindersStart)
+	return 0
+}
+
+// PasswordsByPrefix returns all compromised passwords which SHA1 sums start
+// with the 20 bit prefix by reading all partitions that share the prefix.
+func (s *Service) PasswordsByPrefix(_ context.Context, prefix uint32) ([]passwords.Password, error) {
+	if s.hash != HashSHA1 {
+		return nil, ErrHashMismatch
+	}
+	if prefix >= 1<<rangePrefixBits {
+		return nil, fmt.Errorf("prefix %x out of range", prefix)
 	}
 
-	readerBufferSize := hashRemaindersEnd - hashRemaindersStart
-	if readerBufferSize > maxReaderBufferSize || readerBufferSize < hashRemainderStep {
-		readerBufferSize = maxReaderBufferSize
+	db, err := s.acquire()
+	if err != nil {
+		return nil, err
 	}
+	defer db.refs.Done()
+
+	firstPartition := prefix * rangePartitionsCount
+	shard := getShard(int(prefix>>(rangePrefixBits-8)), db.shardCount)
 
-	buf = make([]byte, hashRemainderStep)
-	passwordHashRemainder := sum[partitionSize:]
-	hashRemaindersCursor = hashRemaindersStart
-	hashFileReader := bufio.NewReaderSize(hashFile, int(readerBufferSize))
-	for hashRemaindersCursor < hashRemaindersEnd {
-		n, err := hashFileReader.Read(buf)
+	var result []passwords.Password
+	hash := make([]byte, partitionSize)
+	for i := uint32(0); i < rangePartitionsCount; i++ {
+		partition := firstPartition + i
+		hash[0], hash[1], hash[2] = byte(partition>>16), byte(partition>>8), byte(partition)
+		records, _, err := s.partitionRecords(db, hash)
 		if err != nil {
-			return 0, fmt.Errorf("hashes %v read %v at %v: %w", shard, len(buf), hashRemaindersCursor, err)
+			return nil, err
 		}
-		if n != len(buf) {
-			return 0, fmt.Errorf("hashes short read at cursor %v: %v instead %v", hashRemaindersCursor, n, len(buf))
+		for offset := 0; offset < len(records); {
+			remainder, count, size := db.parseRecord(records[offset:])
+			if size == 0 {
+				s.metrics.LookupErrorCount.WithLabelValues(lookupStageShardRead).Inc()
+				return nil, fmt.Errorf("hashes %v: invalid record in partition %06x", shard, partition)
+			}
+			offset += size
+
+			var p passwords.Password
+			p.SHA1Sum[0], p.SHA1Sum[1], p.SHA1Sum[2] = byte(partition>>16), byte(partition>>8), byte(partition)
+			copy(p.SHA1Sum[partitionSize:], remainder)
+			p.Count = count
+
+			result = append(result, p)
 		}
-		if bytes.Equal(passwordHashRemainder, buf[:hashRemainderSize]) {
-			return s.countDecoder(buf[hashRemainderSize:]), nil
+	}
+
+	return result, nil
+}
+
+// readAt returns size bytes from the data file at the offset. Memory mapped
+// files return a slice of their content, without copying the data, also for
+// sections of a memory mapped container file.
+func readAt(f dataFile, offset, size int64) ([]byte, error) {
+	if s, ok := f.(*section); ok {
+		if offset < 0 || size < 0 {
+			return nil, errors.New("negative offset or size")
+		}
+		if offset+size > s.size {
+			available := s.size - offset
+			if available < 0 {
+				available = 0
+			}
+			return nil, fmt.Errorf("%w at %v: %v instead %v", errShortRead, offset, available, size)
+		}
+		f, offset = s.file, s.offset+offset
+	}
+	if m, ok := f.(*mmapFile); ok {
+		return m.slice(offset, size)
+	}
+	buf := make([]byte, size)
+	n, err := f.ReadAt(buf, offset)
+	if n != len(buf) {
+		if err == nil || errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%w at %v: %v instead %v", errShortRead, offset, n, len(buf))
 		}
-		hashRemaindersCursor += int64(n)
+		return nil, fmt.Errorf("read %v at %v: %w", len(buf), offset, err)
 	}
+	return buf, nil
+}
+
+// acquire returns the current database and marks it as used until the
+// returned database refs are marked as done.
+func (s *Service) acquire() (*database, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 
-	return 0, nil
+	if s.db == nil {
+		return nil, ErrClosed
+	}
+	s.db.refs.Add(1)
+	return s.db, nil
 }
 
-// Close closes all open files.
-func (s *Service) Close() error {
-	for v, f := range s.shards {
-		if err := f.Close(); err != nil {
-			return fmt.Errorf("close hashes file %v: %w", v, err)
+// Reload opens the database from the same directory again and replaces the
+// current one with it. Lookups that are in progress finish on the previous
+// database which is closed when they are done, while the new lookups use the
+// new one. This allows to replace database files, or the target of a
+// symbolic link to the database directory, without stopping the service. The
+// new database must have the same hashing algorithm as the current one and,
+// with the VerifyChecksums option, valid checksums.
+func (s *Service) Reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	db, err := openDatabase(s.dir, s.openFile)
+	if err != nil {
+		return err
+	}
+	if db.hash != s.hash {
+		db.close()
+		return fmt.Errorf("%w: %s instead %s", ErrHashMismatch, db.hash, s.hash)
+	}
+	if s.verifyChecksums {
+		if err := db.verifyChecksums(); err != nil {
+			db.close()
+			return err
+		}
+	}
+	if !s.disableFilter {
+		if err := db.loadFilter(); err != nil {
+			db.close()
+			return err
 		}
 	}
-	return s.index.Close()
+
+	s.mu.Lock()
+	old := s.db
+	if old == nil {
+		s.mu.Unlock()
+		db.close()
+		return ErrClosed
+	}
+	s.db = db
+	s.mu.Unlock()
+
+	s.metrics.setDatabaseInfo(db)
+
+	old.refs.Wait()
+	return old.close()
+}
+
+// Close waits for all lookups in progress to finish and closes all open
+// files.
+func (s *Service) Close() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	s.mu.Lock()
+	db := s.db
+	s.db = nil
+	s.mu.Unlock()
+
+	if db == nil {
+		return nil
+	}
+	db.refs.Wait()
+	return db.close()
 }
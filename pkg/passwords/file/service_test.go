@@ -7,64 +7,702 @@ package file_test
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"resenje.org/compromised/pkg/passwords"
 	"resenje.org/compromised/pkg/passwords/file"
 )
 
 func TestService(t *testing.T) {
-	t.Run("default index options", newServiceTest(nil))
+	t.Run("default index options", newServiceTest(nil, nil))
 
 	t.Run("min hash count", newServiceTest(&file.IndexOptions{
 		MinHashCount: 10,
-	}))
+	}, nil))
 
 	for _, shardCount := range []int{1, 2, 4, 8, 16, 32, 64, 128, 256} {
 		t.Run(fmt.Sprintf("shard count %v", shardCount), newServiceTest(&file.IndexOptions{
 			ShardCount: shardCount,
-		}))
+		}, nil))
 	}
 
 	t.Run("approximate hash count", newServiceTest(&file.IndexOptions{
 		HashCounting: file.HashCountingApprox,
-	}))
+	}, nil))
+
+	t.Run("approximate 16 bit hash count", newServiceTest(&file.IndexOptions{
+		HashCounting: file.HashCountingApprox16,
+	}, nil))
+
+	t.Run("varint hash count", newServiceTest(&file.IndexOptions{
+		HashCounting: file.HashCountingVarint,
+	}, nil))
+
+	t.Run("varint hash count shard count 16", newServiceTest(&file.IndexOptions{
+		HashCounting: file.HashCountingVarint,
+		ShardCount:   16,
+	}, nil))
+
+	t.Run("default count classes", newServiceTest(&file.IndexOptions{
+		HashCounting: file.HashCountingClasses,
+	}, nil))
+
+	t.Run("custom count classes", newServiceTest(&file.IndexOptions{
+		HashCounting: file.HashCountingClasses,
+		CountClasses: []uint64{1, 3, 10, 100, 1000},
+	}, nil))
 
 	t.Run("no hash count", newServiceTest(&file.IndexOptions{
 		HashCounting: file.HashCountingNone,
-	}))
+	}, nil))
 
 	t.Run("all custom index options", newServiceTest(&file.IndexOptions{
 		MinHashCount: 5,
 		HashCounting: file.HashCountingApprox,
 		ShardCount:   8,
+	}, nil))
+
+	t.Run("mmap", newServiceTest(nil, &file.Options{
+		Mode: file.ModeMmap,
+	}))
+
+	t.Run("mmap all custom index options", newServiceTest(&file.IndexOptions{
+		MinHashCount: 5,
+		HashCounting: file.HashCountingApprox,
+		ShardCount:   8,
+	}, &file.Options{
+		Mode: file.ModeMmap,
+	}))
+
+	t.Run("container", newServiceTest(&file.IndexOptions{
+		Format: file.FormatContainer,
+	}, nil))
+
+	t.Run("filter", newServiceTest(&file.IndexOptions{
+		FilterFalsePositiveRate: 0.01,
+	}, nil))
+
+	t.Run("mmap container filter", newServiceTest(&file.IndexOptions{
+		ShardCount:              4,
+		Format:                  file.FormatContainer,
+		FilterFalsePositiveRate: 0.001,
+	}, &file.Options{
+		Mode: file.ModeMmap,
+	}))
+
+	t.Run("mmap container varint hash count", newServiceTest(&file.IndexOptions{
+		MinHashCount: 5,
+		HashCounting: file.HashCountingVarint,
+		ShardCount:   8,
+		Format:       file.FormatContainer,
+	}, &file.Options{
+		Mode: file.ModeMmap,
+	}))
+
+	t.Run("mmap container all custom index options", newServiceTest(&file.IndexOptions{
+		MinHashCount: 5,
+		HashCounting: file.HashCountingApprox,
+		ShardCount:   8,
+		Format:       file.FormatContainer,
+	}, &file.Options{
+		Mode: file.ModeMmap,
 	}))
 }
 
-func newServiceTest(o *file.IndexOptions) func(t *testing.T) {
-	return func(t *testing.T) {
-		if o == nil {
-			o = new(file.IndexOptions)
+func TestService_invalidMode(t *testing.T) {
+	dbDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", nil)
+
+	_, err := file.New(dbDir, &file.Options{
+		Mode: "unknown",
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestService_metricsName(t *testing.T) {
+	dbDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", nil)
+
+	registry := prometheus.NewRegistry()
+	for _, name := range []string{"full", "top"} {
+		s, err := file.New(dbDir, &file.Options{
+			Name: name,
+		})
+		if err != nil {
+			t.Fatal(err)
 		}
+		defer s.Close()
 
-		dir := t.TempDir()
+		if _, err := s.IsPasswordCompromised(context.Background(), [20]byte{}); err != nil {
+			t.Fatal(err)
+		}
 
-		inputFilename := "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
-		dbDir := filepath.Join(dir, "db")
+		for _, c := range s.Metrics() {
+			if err := registry.Register(c); err != nil {
+				t.Fatalf("register %s metrics: %v", name, err)
+			}
+		}
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		var names []string
+		for _, m := range f.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "db" {
+					names = append(names, l.GetValue())
+				}
+			}
+		}
+		if !reflect.DeepEqual(names, []string{"full", "top"}) {
+			t.Errorf("%s: got db labels %v, want [full top]", f.GetName(), names)
+		}
+	}
+}
+
+func TestService_reload(t *testing.T) {
+	dir := t.TempDir()
+	inputFilename := "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+	allDir, _ := indexTestDatabase(t, inputFilename, nil)
+	topDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+		MinHashCount: 10,
+	})
+	current := filepath.Join(dir, "current")
+	if err := os.Symlink(allDir, current); err != nil {
+		if runtime.GOOS == "windows" {
+			t.Skipf("symbolic links not available: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	s, err := file.New(current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	lowCountHash := "002DCFC06E1B1B25F220203617B526794D10612A"
+	highCountHash := "01BD172389F8C32824FEA8B2EF228853D225291B"
+	highCountSum := hexDecodeSHA1Sum(t, highCountHash)
+
+	isPasswordCompromised(t, s, lowCountHash, 7, 0)
+	isPasswordCompromised(t, s, highCountHash, 15, 0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				count, err := s.IsPasswordCompromised(ctx, highCountSum)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if count != 15 {
+					t.Errorf("got count %v, want 15", count)
+					return
+				}
+			}
+		}()
+	}
+
+	if err := os.Remove(current); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(topDir, current); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	wg.Wait()
+
+	isPasswordCompromised(t, s, lowCountHash, 0, 0)
+	isPasswordCompromised(t, s, highCountHash, 15, 0)
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.IsPasswordCompromised(context.Background(), highCountSum); !errors.Is(err, file.ErrClosed) {
+		t.Errorf("got error %v, want %v", err, file.ErrClosed)
+	}
+	if err := s.Reload(); !errors.Is(err, file.ErrClosed) {
+		t.Errorf("got reload error %v, want %v", err, file.ErrClosed)
+	}
+}
+
+func TestService_reloadHashMismatch(t *testing.T) {
+	sha1Dir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", nil)
+	ntlmDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-ntlm-ordered-by-hash.txt", &file.IndexOptions{
+		Hash: file.HashNTLM,
+	})
+	current := filepath.Join(t.TempDir(), "current")
+	if err := os.Symlink(sha1Dir, current); err != nil {
+		if runtime.GOOS == "windows" {
+			t.Skipf("symbolic links not available: %v", err)
+		}
+		t.Fatal(err)
+	}
+
+	s, err := file.New(current, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := os.Remove(current); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(ntlmDir, current); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reload(); !errors.Is(err, file.ErrHashMismatch) {
+		t.Fatalf("got error %v, want %v", err, file.ErrHashMismatch)
+	}
+
+	isPasswordCompromised(t, s, "01BD172389F8C32824FEA8B2EF228853D225291B", 15, 0)
+}
+
+func TestService_verifyChecksums(t *testing.T) {
+	srcDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", nil)
+
+	// the database is modified
+	dbDir := filepath.Join(t.TempDir(), "db")
+	copyDir(t, srcDir, dbDir)
+
+	s, err := file.New(dbDir, &file.Options{
+		VerifyChecksums: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	writeFileAt(t, filepath.Join(dbDir, "hashes-0.db"), []byte{0xff}, 0)
+
+	if err := s.Reload(); !errors.Is(err, file.ErrChecksumMismatch) {
+		t.Errorf("got reload error %v, want %v", err, file.ErrChecksumMismatch)
+	}
+	if _, err := file.New(dbDir, &file.Options{
+		VerifyChecksums: true,
+	}); !errors.Is(err, file.ErrChecksumMismatch) {
+		t.Errorf("got error %v, want %v", err, file.ErrChecksumMismatch)
+	}
+
+	updateMeta(t, dbDir, func(m map[string]interface{}) {
+		delete(m, "checksums")
+	})
+	if _, err := file.New(dbDir, &file.Options{
+		VerifyChecksums: true,
+	}); err == nil || err.Error() != "checksums not stored in db.json" {
+		t.Errorf("got error %v, want checksums not stored error", err)
+	}
+}
+
+func TestService_ntlm(t *testing.T) {
+	inputFilename := "testdata/pwned-passwords-ntlm-ordered-by-hash.txt"
+
+	for _, tc := range []struct {
+		name string
+		o    *file.IndexOptions
+	}{
+		{
+			name: "default index options",
+			o:    &file.IndexOptions{},
+		},
+		{
+			name: "all custom index options",
+			o: &file.IndexOptions{
+				MinHashCount: 5,
+				HashCounting: file.HashCountingApprox,
+				ShardCount:   8,
+			},
+		},
+		{
+			name: "varint hash count",
+			o: &file.IndexOptions{
+				HashCounting: file.HashCountingVarint,
+				ShardCount:   4,
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.o.Hash = file.HashNTLM
+
+			dbDir, _ := indexTestDatabase(t, inputFilename, tc.o)
+
+			s, err := file.New(dbDir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			if h := s.Hash(); h != file.HashNTLM {
+				t.Errorf("got hash %s, want %s", h, file.HashNTLM)
+			}
+
+			inputFile, err := os.Open(inputFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer inputFile.Close()
+
+			scanner := bufio.NewScanner(inputFile)
+			for scanner.Scan() {
+				line := scanner.Text()
+
+				want, err := strconv.ParseUint(line[33:], 10, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want, tolerance := wantHashCount(tc.o, want)
+				if want < tc.o.MinHashCount {
+					want = 0
+				}
+
+				sum := hexDecodeNTLMSum(t, line[:32])
+				got, err := s.IsNTLMPasswordCompromised(context.Background(), sum)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got < want-tolerance || got > want+tolerance {
+					t.Errorf("hash %s: got count %v, want %v with tolerance %v", line[:32], got, want, tolerance)
+				}
+
+				sum[15] ^= 0xff
+				got, err = s.IsNTLMPasswordCompromised(context.Background(), sum)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got != 0 {
+					t.Errorf("hash %x: got count %v, want 0", sum, got)
+				}
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := s.IsPasswordCompromised(context.Background(), [20]byte{}); !errors.Is(err, file.ErrHashMismatch) {
+				t.Errorf("got error %v, want %v", err, file.ErrHashMismatch)
+			}
+			if _, err := s.ArePasswordsCompromised(context.Background(), [][20]byte{{}}); !errors.Is(err, file.ErrHashMismatch) {
+				t.Errorf("got error %v, want %v", err, file.ErrHashMismatch)
+			}
+			if _, err := s.PasswordsByPrefix(context.Background(), 0); !errors.Is(err, file.ErrHashMismatch) {
+				t.Errorf("got error %v, want %v", err, file.ErrHashMismatch)
+			}
+		})
+	}
+}
+
+func TestService_sha1NTLMMismatch(t *testing.T) {
+	dbDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", nil)
+
+	s, err := file.New(dbDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if h := s.Hash(); h != file.HashSHA1 {
+		t.Errorf("got hash %s, want %s", h, file.HashSHA1)
+	}
+
+	if _, err := s.IsNTLMPasswordCompromised(context.Background(), [16]byte{}); !errors.Is(err, file.ErrHashMismatch) {
+		t.Errorf("got error %v, want %v", err, file.ErrHashMismatch)
+	}
+}
+
+func TestIndex_invalidLine(t *testing.T) {
+	// sha1 hashes are not valid ntlm hashes
+	_, err := file.Index("testdata/pwned-passwords-sha1-ordered-by-hash.txt", filepath.Join(t.TempDir(), "db"), &file.IndexOptions{
+		Hash:    file.HashNTLM,
+		LogFunc: func(string, ...interface{}) {},
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestService_concurrent(t *testing.T) {
+	for _, mode := range []file.Mode{file.ModeFile, file.ModeMmap} {
+		t.Run(string(mode), func(t *testing.T) {
+			skipUnsupportedMode(t, mode)
 
-		count, err := file.Index(inputFilename, dbDir, o)
+			testServiceConcurrent(t, &file.Options{
+				Mode: mode,
+			})
+		})
+	}
+}
+
+func testServiceConcurrent(t *testing.T, so *file.Options) {
+	inputFilename := "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+	dbDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+		ShardCount: 4,
+	})
+
+	s, err := file.New(dbDir, so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var hashes []hashCount
+	inputFile, err := os.Open(inputFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inputFile.Close()
+
+	scanner := bufio.NewScanner(inputFile)
+	for scanner.Scan() {
+		line := scanner.Text()
+		count, err := strconv.ParseUint(line[41:], 10, 64)
 		if err != nil {
 			t.Fatal(err)
 		}
+		hashes = append(hashes, hashCount{
+			sum:   hexDecodeSHA1Sum(t, line[:40]),
+			count: count,
+		})
+		// a hash from the same partition that is not in the database
+		miss := hexDecodeSHA1Sum(t, line[:40])
+		miss[19] ^= 0xff
+		hashes = append(hashes, hashCount{
+			sum: miss,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	const goroutines = 32
+
+	var wg sync.WaitGroup
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+
+			// every goroutine starts from a different hash to have
+			// overlapping reads on the same files at different offsets
+			offset := g * len(hashes) / goroutines
+			for i := range hashes {
+				h := hashes[(offset+i)%len(hashes)]
+				got, err := s.IsPasswordCompromised(context.Background(), h.sum)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if got != h.count {
+					t.Errorf("hash %x: got count %v, want %v", h.sum, got, h.count)
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+}
+
+func TestService_search(t *testing.T) {
+	dir := t.TempDir()
+
+	inputFilename := filepath.Join(dir, "input.txt")
+	hashes := writeDenseInput(t, inputFilename, 64, 200)
+
+	dbDir := filepath.Join(dir, "db")
+	if _, err := file.Index(inputFilename, dbDir, &file.IndexOptions{
+		LogFunc: func(string, ...interface{}) {},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		search file.SearchFunc
+	}{
+		{name: "linear", search: file.LinearSearch},
+		{name: "binary", search: file.BinarySearch},
+		{name: "interpolation", search: file.InterpolationSearch},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := file.New(dbDir, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			file.SetSearchFunc(s, tc.search)
+
+			for i, h := range hashes {
+				isPasswordCompromised(t, s, hex.EncodeToString(h.sum[:]), h.count, 0)
+
+				// hashes between the existing ones in the same partition
+				miss := h.sum
+				miss[19]++
+				if i+1 < len(hashes) && hashes[i+1].sum == miss {
+					continue
+				}
+				isPasswordCompromised(t, s, hex.EncodeToString(miss[:]), 0, 0)
+			}
+		})
+	}
+}
+
+type hashCount struct {
+	sum   [20]byte
+	count uint64
+}
+
+// writeDenseInput writes a sorted input file with a number of partitions that
+// hold many more hashes than the pwned passwords dataset in order to make the
+// search within a partition significant. Some hashes share the first 8 bytes of
+// their remainders.
+func writeDenseInput(t testing.TB, filename string, partitions, hashesPerPartition int) (hashes []hashCount) {
+	t.Helper()
+
+	r := rand.New(rand.NewSource(1))
+
+	seen := make(map[[20]byte]struct{})
+	for p := 0; p < partitions; p++ {
+		partition := uint32(p) * (1 << 24 / uint32(partitions))
+		for i := 0; i < hashesPerPartition; i++ {
+			var sum [20]byte
+			if i%10 == 9 {
+				sum = hashes[len(hashes)-1].sum
+				r.Read(sum[11:])
+			} else {
+				r.Read(sum[:])
+			}
+			sum[0], sum[1], sum[2] = byte(partition>>16), byte(partition>>8), byte(partition)
+			if _, ok := seen[sum]; ok {
+				continue
+			}
+			seen[sum] = struct{}{}
+			hashes = append(hashes, hashCount{
+				sum:   sum,
+				count: uint64(r.Intn(1000000) + 1),
+			})
+		}
+	}
+
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i].sum[:], hashes[j].sum[:]) < 0
+	})
+
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	for _, h := range hashes {
+		fmt.Fprintf(w, "%X:%d\n", h.sum, h.count)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	return hashes
+}
+
+func BenchmarkService(b *testing.B) {
+	for _, hashesPerPartition := range []int{34, 1024} {
+		b.Run(fmt.Sprintf("hashes per partition %v", hashesPerPartition), func(b *testing.B) {
+			dir := b.TempDir()
+
+			inputFilename := filepath.Join(dir, "input.txt")
+			hashes := writeDenseInput(b, inputFilename, 256, hashesPerPartition)
+
+			for _, shardCount := range []int{1, 32, 256} {
+				for _, hashCounting := range []file.HashCounting{file.HashCountingExact, file.HashCountingApprox, file.HashCountingVarint, file.HashCountingNone} {
+					dbDir := filepath.Join(dir, fmt.Sprintf("db-%v-%s", shardCount, hashCounting))
+					if _, err := file.Index(inputFilename, dbDir, &file.IndexOptions{
+						ShardCount:   shardCount,
+						HashCounting: hashCounting,
+						LogFunc:      func(string, ...interface{}) {},
+					}); err != nil {
+						b.Fatal(err)
+					}
+
+					for _, search := range []struct {
+						name string
+						f    file.SearchFunc
+					}{
+						{name: "linear", f: file.LinearSearch},
+						{name: "binary", f: file.BinarySearch},
+						{name: "interpolation", f: file.InterpolationSearch},
+					} {
+						b.Run(fmt.Sprintf("shard count %v hash counting %s %s search", shardCount, hashCounting, search.name), func(b *testing.B) {
+							skipUnsupportedMode(b, file.ModeMmap)
+
+							s, err := file.New(dbDir, &file.Options{
+								Mode: file.ModeMmap,
+							})
+							if err != nil {
+								b.Fatal(err)
+							}
+							defer s.Close()
+
+							file.SetSearchFunc(s, search.f)
+
+							ctx := context.Background()
+
+							b.ResetTimer()
+							for i := 0; i < b.N; i++ {
+								if _, err := s.IsPasswordCompromised(ctx, hashes[i%len(hashes)].sum); err != nil {
+									b.Fatal(err)
+								}
+							}
+						})
+					}
+				}
+			}
+		})
+	}
+}
+
+func newServiceTest(o *file.IndexOptions, so *file.Options) func(t *testing.T) {
+	return func(t *testing.T) {
+		if o == nil {
+			o = new(file.IndexOptions)
+		}
+		if so != nil {
+			skipUnsupportedMode(t, so.Mode)
+		}
+
+		inputFilename := "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+		dbDir, count := indexTestDatabase(t, inputFilename, o)
 
-		s, err := file.New(dbDir)
+		s, err := file.New(dbDir, so)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -89,17 +727,11 @@ func newServiceTest(o *file.IndexOptions) func(t *testing.T) {
 					t.Fatal(err)
 				}
 
-				if o.HashCounting == file.HashCountingNone {
-					want = 1
-				}
-
 				var tolerance uint64
-				if o.HashCounting == file.HashCountingApprox {
-					tolerance = uint64(math.Round(float64(want) / 25))
-				}
-
 				if want < o.MinHashCount {
 					want = 0
+				} else {
+					want, tolerance = wantHashCount(o, want)
 				}
 
 				isPasswordCompromised(t, s, hash, want, tolerance)
@@ -119,6 +751,115 @@ func newServiceTest(o *file.IndexOptions) func(t *testing.T) {
 			}
 		})
 
+		t.Run("batch", func(t *testing.T) {
+			inputFile, err := os.Open(inputFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer inputFile.Close()
+
+			var sums [][20]byte
+			scanner := bufio.NewScanner(inputFile)
+			for scanner.Scan() {
+				sum := hexDecodeSHA1Sum(t, scanner.Text()[:40])
+				sums = append(sums, sum)
+				sum[19] ^= 0xff
+				sums = append(sums, sum)
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+			// duplicates
+			sums = append(sums, sums[:100]...)
+
+			rand.New(rand.NewSource(1)).Shuffle(len(sums), func(i, j int) {
+				sums[i], sums[j] = sums[j], sums[i]
+			})
+
+			counts, err := s.ArePasswordsCompromised(context.Background(), sums)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(counts) != len(sums) {
+				t.Fatalf("got %v counts, want %v", len(counts), len(sums))
+			}
+			for i, sum := range sums {
+				want, err := s.IsPasswordCompromised(context.Background(), sum)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if counts[i] != want {
+					t.Errorf("hash %x: got count %v, want %v", sum, counts[i], want)
+				}
+			}
+		})
+
+		t.Run("range", func(t *testing.T) {
+			inputFile, err := os.Open(inputFilename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer inputFile.Close()
+
+			want := make(map[uint32][]string)
+			scanner := bufio.NewScanner(inputFile)
+			for scanner.Scan() {
+				line := scanner.Text()
+
+				count, err := strconv.ParseUint(line[41:], 10, 64)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if count < o.MinHashCount {
+					continue
+				}
+
+				prefix, err := strconv.ParseUint(line[:5], 16, 32)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want[uint32(prefix)] = append(want[uint32(prefix)], line)
+			}
+			if err := scanner.Err(); err != nil {
+				t.Fatal(err)
+			}
+
+			// prefixes without passwords
+			for _, prefix := range []uint32{0x00000, 0x78901, 0xfffff} {
+				if _, ok := want[prefix]; !ok {
+					want[prefix] = nil
+				}
+			}
+
+			for prefix, lines := range want {
+				got, err := s.PasswordsByPrefix(context.Background(), prefix)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(lines) {
+					t.Fatalf("prefix %05x: got %v passwords, want %v", prefix, len(got), len(lines))
+				}
+				for i, line := range lines {
+					if hash := strings.ToUpper(hex.EncodeToString(got[i].SHA1Sum[:])); hash != line[:40] {
+						t.Errorf("prefix %05x: got hash %s, want %s", prefix, hash, line[:40])
+					}
+
+					want, err := strconv.ParseUint(line[41:], 10, 64)
+					if err != nil {
+						t.Fatal(err)
+					}
+					want, tolerance := wantHashCount(o, want)
+					if got[i].Count < want-tolerance || got[i].Count > want+tolerance {
+						t.Errorf("hash %s: got count %v, want %v with tolerance %v", line[:40], got[i].Count, want, tolerance)
+					}
+				}
+			}
+
+			if _, err := s.PasswordsByPrefix(context.Background(), 0x100000); err == nil {
+				t.Error("expected error for prefix out of range")
+			}
+		})
+
 		t.Run("miss edges", func(t *testing.T) {
 			inputFile, err := os.Open(inputFilename)
 			if err != nil {
@@ -149,6 +890,13 @@ func newServiceTest(o *file.IndexOptions) func(t *testing.T) {
 				if h := partition + prevRemainder; h != prevLine[:40] {
 					isPasswordCompromised(t, s, h, 0, 0)
 				}
+				if p, err := strconv.ParseUint(partition, 16, 32); err == nil && p > 0 {
+					// the partition just before the one with hashes, possibly
+					// at the start of a shard
+					if h := fmt.Sprintf("%06X", p-1) + remainder; h != prevLine[:40] {
+						isPasswordCompromised(t, s, h, 0, 0)
+					}
+				}
 
 				prevLine = line
 			}
@@ -159,6 +907,33 @@ func newServiceTest(o *file.IndexOptions) func(t *testing.T) {
 	}
 }
 
+// wantHashCount returns the count that is expected to be stored in the
+// database for the count from the input file, with the tolerance of the
+// approximation.
+func wantHashCount(o *file.IndexOptions, count uint64) (want, tolerance uint64) {
+	switch o.HashCounting {
+	case file.HashCountingNone:
+		return 1, 0
+	case file.HashCountingApprox:
+		return count, uint64(math.Round(float64(count) / 25))
+	case file.HashCountingApprox16:
+		return count, uint64(math.Round(float64(count) / 1000))
+	case file.HashCountingClasses:
+		classes := o.CountClasses
+		if len(classes) == 0 {
+			classes = file.DefaultCountClasses
+		}
+		for _, c := range classes {
+			if c > count {
+				break
+			}
+			want = c
+		}
+		return want, 0
+	}
+	return count, 0
+}
+
 func isPasswordCompromised(t *testing.T, s passwords.Service, hash string, want, tolerance uint64) {
 	t.Helper()
 
@@ -188,3 +963,26 @@ func hexDecodeSHA1Sum(t *testing.T, s string) (sum [20]byte) {
 	copy(sum[:], b)
 	return sum
 }
+
+func hexDecodeNTLMSum(t *testing.T, s string) (sum [16]byte) {
+	t.Helper()
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copy(sum[:], b)
+	return sum
+}
+
+// skipUnsupportedMode skips the test if the service mode is not supported on
+// the current operating system, as memory mapped files are not supported on
+// Windows.
+func skipUnsupportedMode(t testing.TB, mode file.Mode) {
+	t.Helper()
+
+	if mode == file.ModeMmap && runtime.GOOS == "windows" {
+		t.Skipf("%s mode is not supported on %s", mode, runtime.GOOS)
+	}
+}
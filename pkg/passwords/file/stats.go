@@ -0,0 +1,219 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Stats describes the content of a database.
+type Stats struct {
+	Version      int       `json:"version"`
+	Format       Format    `json:"format"`
+	Hash         Hash      `json:"hash"`
+	Count        uint64    `json:"count"`
+	MinHashCount uint64    `json:"min_hash_count"`
+	MaxHashCount uint64    `json:"max_hash_count"`
+	ShardCount   int       `json:"shard_count"`
+	CountDecoder string    `json:"count_decoder"`
+	CountClasses []uint64  `json:"count_classes,omitempty"`
+	Lineage      []Lineage `json:"lineage,omitempty"`
+
+	// Size is the total size of the index, hashes and filter files in bytes.
+	Size      int64        `json:"size"`
+	IndexSize int64        `json:"index_size"`
+	Shards    []ShardStats `json:"shards"`
+	// FilterSize is the size of the filter file and FilterFalsePositiveRate
+	// is its target false positive rate, if the database has the filter.
+	FilterSize              int64   `json:"filter_size,omitempty"`
+	FilterFalsePositiveRate float64 `json:"filter_false_positive_rate,omitempty"`
+
+	Partitions PartitionStats `json:"partitions"`
+	// Counts is the histogram of hashes by their decoded counts in buckets
+	// of decimal orders of magnitude.
+	Counts []CountBucket `json:"counts"`
+}
+
+// ShardStats describes a single hashes file.
+type ShardStats struct {
+	Filename string `json:"filename"`
+	Size     int64  `json:"size"`
+	// Count is the number of indexed hashes in the file.
+	Count uint64 `json:"count"`
+}
+
+// PartitionStats describes the distribution of hashes by partitions of
+// hashes with the same 24-bit prefix.
+type PartitionStats struct {
+	// Count is the number of all partitions.
+	Count uint64 `json:"count"`
+	// Empty is the number of partitions without hashes.
+	Empty uint64  `json:"empty"`
+	Min   uint64  `json:"min"`
+	Avg   float64 `json:"avg"`
+	Max   uint64  `json:"max"`
+}
+
+// CountBucket is the number of hashes with counts in the inclusive range from
+// Min to Max.
+type CountBucket struct {
+	Min    uint64 `json:"min"`
+	Max    uint64 `json:"max"`
+	Hashes uint64 `json:"hashes"`
+}
+
+// Stats returns meta information, file sizes and the distribution of hashes
+// in the database. It reads all database files, which may take a long time
+// for large databases.
+func (s *Service) Stats() (*Stats, error) {
+	db, err := s.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer db.refs.Done()
+
+	return db.stats()
+}
+
+func (db *database) stats() (*Stats, error) {
+	st := &Stats{
+		Version:      db.meta.Version,
+		Format:       db.format,
+		Hash:         db.hash,
+		Count:        db.meta.Count,
+		MinHashCount: db.meta.MinHashCount,
+		MaxHashCount: db.meta.MaxHashCount,
+		ShardCount:   db.shardCount,
+		CountDecoder: db.meta.CountDecoder,
+		CountClasses: db.meta.CountClasses,
+		Lineage:      db.meta.Lineage,
+
+		FilterFalsePositiveRate: db.meta.FilterFalsePositiveRate,
+
+		Partitions: PartitionStats{
+			Count: maxUint24 + 1,
+			Min:   ^uint64(0),
+		},
+	}
+
+	indexSize, err := dataFileSize(db.index)
+	if err != nil {
+		return nil, fmt.Errorf("index: %w", err)
+	}
+	st.IndexSize = indexSize
+	st.Size = indexSize
+
+	if db.filterFile != nil {
+		filterSize, err := dataFileSize(db.filterFile)
+		if err != nil {
+			return nil, fmt.Errorf("filter: %w", err)
+		}
+		st.FilterSize = filterSize
+		st.Size += filterSize
+	}
+
+	var counts [20]uint64 // by the number of decimal digits minus one
+	partitionsPerShard := (maxUint24 + 1) / db.shardCount
+	remainder := make([]byte, db.hashRemainderSize)
+	for shard := 0; shard < db.shardCount; shard++ {
+		firstPartition := shard * partitionsPerShard
+
+		index, err := readAt(db.index, int64(firstPartition+shard)*indexLocationEncodedSize, int64(partitionsPerShard+1)*indexLocationEncodedSize)
+		if err != nil {
+			return nil, fmt.Errorf("index: %w", err)
+		}
+
+		size, err := dataFileSize(db.shards[shard])
+		if err != nil {
+			return nil, fmt.Errorf("hashes %v: %w", shard, err)
+		}
+
+		// records are counted while they are read, as index positions are
+		// not record numbers for variable length counts
+		r := bufio.NewReaderSize(io.NewSectionReader(db.shards[shard], 0, size), 64*1024)
+		var shardCount uint64
+		var position uint32
+		for i := 0; i < partitionsPerShard; i++ {
+			_, end, ok := partitionRange(index, i)
+			var n uint64
+			for ok && position < end {
+				count, positions, err := db.readRecord(r, remainder)
+				if err != nil {
+					return nil, fmt.Errorf("hashes %v: read record %v: %w", shard, shardCount+n, err)
+				}
+				position += positions
+				n++
+				var digits int
+				for c := count; c >= 10; c /= 10 {
+					digits++
+				}
+				counts[digits]++
+			}
+			if n == 0 {
+				st.Partitions.Empty++
+			}
+			if n < st.Partitions.Min {
+				st.Partitions.Min = n
+			}
+			if n > st.Partitions.Max {
+				st.Partitions.Max = n
+			}
+			shardCount += n
+		}
+
+		st.Shards = append(st.Shards, ShardStats{
+			Filename: getShardFilename(shard, db.shardCount),
+			Size:     size,
+			Count:    shardCount,
+		})
+		st.Size += size
+	}
+
+	var total uint64
+	for _, s := range st.Shards {
+		total += s.Count
+	}
+	st.Partitions.Avg = float64(total) / float64(st.Partitions.Count)
+
+	min := uint64(1)
+	for i, n := range counts {
+		max := min*10 - 1
+		if i == len(counts)-1 {
+			max = ^uint64(0)
+		}
+		if n > 0 {
+			st.Counts = append(st.Counts, CountBucket{
+				Min:    min,
+				Max:    max,
+				Hashes: n,
+			})
+		}
+		min *= 10
+	}
+
+	return st, nil
+}
+
+// dataFileSize returns the size of the open database file.
+func dataFileSize(f dataFile) (int64, error) {
+	switch f := f.(type) {
+	case *os.File:
+		stat, err := f.Stat()
+		if err != nil {
+			return 0, err
+		}
+		return stat.Size(), nil
+	case *mmapFile:
+		return int64(len(f.data)), nil
+	case *section:
+		return f.size, nil
+	}
+	return 0, errors.New("unsupported file type")
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestService_Stats(t *testing.T) {
+	const inputFilename = "testdata/pwned-passwords-sha1-ordered-by-hash.txt"
+
+	// expected distributions from the input file
+	var count, maxHashCount uint64
+	buckets := make(map[uint64]uint64) // number of hashes by the bucket min
+	partitions := make(map[string]uint64)
+	f, err := os.Open(inputFilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		c, err := strconv.ParseUint(line[41:], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count++
+		if c > maxHashCount {
+			maxHashCount = c
+		}
+		partitions[line[:6]]++
+		min := uint64(1)
+		for c >= min*10 {
+			min *= 10
+		}
+		buckets[min]++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	var wantCounts []file.CountBucket
+	for min := uint64(1); min <= maxHashCount; min *= 10 {
+		if n := buckets[min]; n > 0 {
+			wantCounts = append(wantCounts, file.CountBucket{Min: min, Max: min*10 - 1, Hashes: n})
+		}
+	}
+	var maxPartition uint64
+	for _, n := range partitions {
+		if n > maxPartition {
+			maxPartition = n
+		}
+	}
+
+	dbDir, _ := indexTestDatabase(t, inputFilename, &file.IndexOptions{
+		ShardCount: 4,
+	})
+
+	s, err := file.New(dbDir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	stats, err := s.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Version != 1 || stats.Hash != file.HashSHA1 || stats.Count != count || stats.MinHashCount != 1 || stats.MaxHashCount != maxHashCount || stats.ShardCount != 4 || stats.CountDecoder != "big32" {
+		t.Errorf("got stats meta %+v", stats)
+	}
+	if len(stats.Lineage) != 1 || stats.Lineage[0].Operation != "index" || stats.Lineage[0].Count != count {
+		t.Errorf("got lineage %+v", stats.Lineage)
+	}
+
+	const indexSize = (1<<24 + 4) * 4
+	if stats.IndexSize != indexSize {
+		t.Errorf("got index size %v, want %v", stats.IndexSize, indexSize)
+	}
+	size := int64(indexSize)
+	var shardsCount uint64
+	for i, shard := range stats.Shards {
+		if want := "hashes-" + strconv.Itoa(i) + ".db"; shard.Filename != want {
+			t.Errorf("got shard filename %s, want %s", shard.Filename, want)
+		}
+		stat, err := os.Stat(filepath.Join(dbDir, shard.Filename))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shard.Size != stat.Size() {
+			t.Errorf("got shard %s size %v, want %v", shard.Filename, shard.Size, stat.Size())
+		}
+		if want := uint64(shard.Size / 21); shard.Count != want {
+			t.Errorf("got shard %s count %v, want %v", shard.Filename, shard.Count, want)
+		}
+		size += shard.Size
+		shardsCount += shard.Count
+	}
+	if len(stats.Shards) != 4 {
+		t.Errorf("got %v shards, want 4", len(stats.Shards))
+	}
+	if shardsCount != count {
+		t.Errorf("got shards count %v, want %v", shardsCount, count)
+	}
+	if stats.Size != size {
+		t.Errorf("got size %v, want %v", stats.Size, size)
+	}
+
+	wantPartitions := file.PartitionStats{
+		Count: 1 << 24,
+		Empty: 1<<24 - uint64(len(partitions)),
+		Min:   0,
+		Avg:   float64(count) / (1 << 24),
+		Max:   maxPartition,
+	}
+	if stats.Partitions != wantPartitions {
+		t.Errorf("got partitions %+v, want %+v", stats.Partitions, wantPartitions)
+	}
+
+	if !reflect.DeepEqual(stats.Counts, wantCounts) {
+		t.Errorf("got counts %+v, want %+v", stats.Counts, wantCounts)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stats(); err != file.ErrClosed {
+		t.Errorf("got error %v, want %v", err, file.ErrClosed)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// VerifyOptions holds optional parameters for database verification.
+type VerifyOptions struct {
+	// LogFunc can be specified as a custom receiver of log messages.
+	LogFunc func(string, ...interface{})
+}
+
+// VerifyError is returned by Verify with all problems found in the database.
+type VerifyError struct {
+	Problems []string
+}
+
+func (e *VerifyError) Error() string {
+	return "invalid database: " + strings.Join(e.Problems, "; ")
+}
+
+// Verify checks the integrity of the database in the directory, or in the
+// container file, by reading all of its files. It validates that the index
+// file has the expected size, that index offsets are monotonic in every shard,
+// that every hashes file size matches the number of its indexed hashes, that
+// hashes are sorted within partitions and that files match checksums from the
+// db.json file, if they are stored. All found problems are returned with
+// VerifyError.
+func Verify(dir string, o *VerifyOptions) error {
+	if o == nil {
+		o = new(VerifyOptions)
+	}
+	if o.LogFunc == nil {
+		o.LogFunc = func(format string, a ...interface{}) {
+			fmt.Printf(format+"\n", a...)
+		}
+	}
+	logFunc := o.LogFunc
+
+	db, err := openDatabase(dir, func(filename string) (dataFile, error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+	if err != nil {
+		return &VerifyError{Problems: []string{err.Error()}}
+	}
+	defer db.close()
+
+	var problems []string
+	problemf := func(format string, a ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, a...))
+	}
+
+	logFunc("verifying database %s", dir)
+
+	indexSize := int64(maxUint24+1+db.shardCount) * indexLocationEncodedSize
+	if size, err := dataFileSize(db.index); err != nil {
+		problemf("%s: %v", indexFilename, err)
+	} else if size != indexSize {
+		problemf("%s: size %v instead %v", indexFilename, size, indexSize)
+	} else {
+		var count uint64
+		for shard := 0; shard < db.shardCount; shard++ {
+			filename := getShardFilename(shard, db.shardCount)
+			logFunc("verifying %s", filename)
+			n, err := verifyShard(db, shard)
+			if err != nil {
+				problemf("%s: %v", filename, err)
+				continue
+			}
+			count += n
+		}
+		if len(problems) == 0 && count != db.meta.Count {
+			problemf("%v hashes instead %v from db.json", count, db.meta.Count)
+		}
+	}
+
+	if len(db.meta.Checksums) == 0 {
+		logFunc("checksums not stored in db.json")
+	} else {
+		for _, filename := range db.meta.dataFilenames() {
+			logFunc("verifying %s checksum", filename)
+			if err := db.verifyChecksum(filename); err != nil {
+				problemf("%v", err)
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return &VerifyError{Problems: problems}
+	}
+	return nil
+}
+
+// verifyShard validates index entries of the shard, the size of its hashes
+// file and the order of hashes. It returns the number of hashes in the shard.
+func verifyShard(db *database, shard int) (uint64, error) {
+	partitionsPerShard := (maxUint24 + 1) / db.shardCount
+	firstPartition := shard * partitionsPerShard
+	positionSize := db.positionSize()
+
+	index, err := readAt(db.index, int64(firstPartition+shard)*indexLocationEncodedSize, int64(partitionsPerShard+1)*indexLocationEncodedSize)
+	if err != nil {
+		return 0, fmt.Errorf("index: %w", err)
+	}
+
+	// partitions are read in order and their offsets must be contiguous
+	var position uint32
+	for i := 0; i < partitionsPerShard; i++ {
+		start, end, ok := partitionRange(index, i)
+		if position == 0 && !ok {
+			continue
+		}
+		if start != position || end < start {
+			return 0, fmt.Errorf("index offsets of partition %06x are %v and %v after offset %v", firstPartition+i, start, end, position)
+		}
+		position = end
+	}
+
+	size, err := dataFileSize(db.shards[shard])
+	if err != nil {
+		return 0, err
+	}
+	if want := int64(position) * positionSize; size != want {
+		if db.varintCounts {
+			return 0, fmt.Errorf("size %v instead %v", size, want)
+		}
+		return 0, fmt.Errorf("size %v instead %v for %v hashes", size, want, position)
+	}
+
+	r := bufio.NewReaderSize(io.NewSectionReader(db.shards[shard], 0, size), 64*1024)
+	remainder := make([]byte, db.hashRemainderSize)
+	prev := make([]byte, db.hashRemainderSize)
+	var count uint64
+	position = 0
+	for i := 0; i < partitionsPerShard; i++ {
+		start, end, ok := partitionRange(index, i)
+		if !ok {
+			continue
+		}
+		for position < end {
+			_, positions, err := db.readRecord(r, remainder)
+			if err != nil {
+				return 0, fmt.Errorf("read record %v: %w", position, err)
+			}
+			if position > start && bytes.Compare(remainder, prev) <= 0 {
+				return 0, fmt.Errorf("hash %06x%x is not sorted in partition %06x", firstPartition+i, remainder, firstPartition+i)
+			}
+			copy(prev, remainder)
+			position += positions
+			count++
+		}
+		if position != end {
+			return 0, fmt.Errorf("partition %06x ends at %v instead %v", firstPartition+i, position, end)
+		}
+	}
+	return count, nil
+}
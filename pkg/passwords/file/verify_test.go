@@ -0,0 +1,218 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file_test
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"resenje.org/compromised/pkg/passwords/file"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+
+	inputFilename := filepath.Join(dir, "input.txt")
+	writeDenseInput(t, inputFilename, 4096, 8)
+
+	dbDir := filepath.Join(dir, "db")
+	if _, err := file.Index(inputFilename, dbDir, &file.IndexOptions{
+		LogFunc: func(string, ...interface{}) {},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		// corrupt modifies database files in the directory
+		corrupt      func(t *testing.T, dir string)
+		wantProblems []string
+	}{
+		{
+			name:    "valid",
+			corrupt: func(t *testing.T, dir string) {},
+		},
+		{
+			name: "without checksums",
+			corrupt: func(t *testing.T, dir string) {
+				updateMeta(t, dir, func(m map[string]interface{}) {
+					delete(m, "checksums")
+				})
+			},
+		},
+		{
+			name: "truncated index",
+			corrupt: func(t *testing.T, dir string) {
+				truncateFile(t, filepath.Join(dir, "index.db"), 1000)
+			},
+			wantProblems: []string{
+				"index.db: size 67107992 instead 67108992",
+				"index.db: checksum mismatch",
+			},
+		},
+		{
+			name: "truncated hashes file",
+			corrupt: func(t *testing.T, dir string) {
+				truncateFile(t, filepath.Join(dir, "hashes-3.db"), 10)
+			},
+			wantProblems: []string{
+				"hashes-3.db: size 21494 instead 21504 for 1024 hashes",
+				"hashes-3.db: checksum mismatch",
+			},
+		},
+		{
+			name: "index offsets",
+			corrupt: func(t *testing.T, dir string) {
+				// the end of the third partition with hashes in the first
+				// shard
+				writeFileAt(t, filepath.Join(dir, "index.db"), []byte{0, 0, 0, 1}, 8193*4)
+			},
+			wantProblems: []string{
+				"hashes-0.db: index offsets of partition 002000 are 16 and 1 after offset 16",
+				"index.db: checksum mismatch",
+			},
+		},
+		{
+			name: "unsorted hashes",
+			corrupt: func(t *testing.T, dir string) {
+				filename := filepath.Join(dir, "hashes-1.db")
+				data, err := os.ReadFile(filename)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// swap the first two records
+				const recordSize = 21
+				first := append([]byte(nil), data[:recordSize]...)
+				copy(data, data[recordSize:2*recordSize])
+				copy(data[recordSize:], first)
+				writeFileAt(t, filename, data[:2*recordSize], 0)
+			},
+			wantProblems: []string{
+				"hashes-1.db: hash 080000128b21a82fad6a8052a49744ed6945bd93 is not sorted in partition 080000",
+				"hashes-1.db: checksum mismatch",
+			},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "db")
+			copyDir(t, dbDir, dir)
+			tc.corrupt(t, dir)
+
+			err := file.Verify(dir, &file.VerifyOptions{
+				LogFunc: func(string, ...interface{}) {},
+			})
+			if tc.wantProblems == nil {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			var verifyErr *file.VerifyError
+			if !errors.As(err, &verifyErr) {
+				t.Fatalf("got error %v, want verify error", err)
+			}
+			if got, want := strings.Join(verifyErr.Problems, "\n"), strings.Join(tc.wantProblems, "\n"); got != want {
+				t.Errorf("got problems\n%s\nwant\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestVerify_missingFile(t *testing.T) {
+	srcDir, _ := indexTestDatabase(t, "testdata/pwned-passwords-sha1-ordered-by-hash.txt", nil)
+
+	dbDir := filepath.Join(t.TempDir(), "db")
+	copyDir(t, srcDir, dbDir)
+	if err := os.Remove(filepath.Join(dbDir, "hashes-5.db")); err != nil {
+		t.Fatal(err)
+	}
+
+	err := file.Verify(dbDir, &file.VerifyOptions{
+		LogFunc: func(string, ...interface{}) {},
+	})
+	var verifyErr *file.VerifyError
+	if !errors.As(err, &verifyErr) {
+		t.Fatalf("got error %v, want verify error", err)
+	}
+	if len(verifyErr.Problems) != 1 || !strings.HasPrefix(verifyErr.Problems[0], "open hashes file 5: ") {
+		t.Errorf("got problems %q", verifyErr.Problems)
+	}
+}
+
+// copyDir copies all files from the src directory into a new dst directory.
+func copyDir(t *testing.T, src, dst string) {
+	t.Helper()
+
+	entries, err := os.ReadDir(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(src, e.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dst, e.Name()), data, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func truncateFile(t *testing.T, filename string, n int64) {
+	t.Helper()
+
+	stat, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filename, stat.Size()-n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFileAt(t *testing.T, filename string, data []byte, offset int64) {
+	t.Helper()
+
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteAt(data, offset); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// updateMeta modifies the db.json file in the database directory.
+func updateMeta(t *testing.T, dir string, f func(m map[string]interface{})) {
+	t.Helper()
+
+	filename := filepath.Join(dir, "db.json")
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	f(m)
+	data, err = json.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filename, data, 0666); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,677 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package file
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+
+	"resenje.org/compromised/pkg/approxcount"
+	"resenje.org/compromised/pkg/filter"
+)
+
+// errHashOrder is returned by the writer when hashes are not added in
+// ascending order.
+var errHashOrder = errors.New("hashes not in ascending order")
+
+// writer creates database files from hashes that are added in ascending
+// order. Files are written in a temporary directory which is renamed to the
+// database directory when the writer finishes, or packed into a container
+// file.
+type writer struct {
+	dir          string // temporary directory
+	outputDir    string
+	meta         meta
+	hashSize     int
+	countEncoder func(uint64) []byte
+	// approxDeferred is true when approximate counts are encoded at the end
+	// as the maximal hash count is not known in advance
+	approxDeferred bool
+	finished       bool
+	checkpoint     bool
+	container      bool
+	// varintCounts is true when index positions are offsets in bytes of
+	// records with variable length counts
+	varintCounts bool
+	// checkpointed is true if the checkpoint is saved in the temporary
+	// directory, when it is not removed on close
+	checkpointed bool
+	// resume is the checkpoint from which writing is resumed until hashes
+	// from complete shards are added again
+	resume *checkpoint
+
+	indexFile     *os.File
+	index         *bufio.Writer
+	shardFiles    []*os.File
+	shards        []*bufio.Writer
+	buf           []byte
+	repeatedBuf   []byte // index entries with the same value
+	nextPartition uint64 // next partition which end is not written to the index
+	shardIndex    uint32 // index position in the current shard
+	prevHash      []byte
+}
+
+// writerOptions holds optional parameters for the writer.
+type writerOptions struct {
+	// checkpoint saves the progress after every complete shard, when the
+	// temporary directory is not removed if the writer does not finish.
+	checkpoint bool
+	// resume continues writing from the checkpoint in the temporary
+	// directory, if it is saved. Hashes from complete shards must be added
+	// again, but they are only validated against the checkpoint.
+	resume bool
+	// container writes the database in a single file with the
+	// FormatContainer format instead of a directory.
+	container bool
+}
+
+// newWriter creates all database files in the temporary directory of the
+// database directory which must not exist. Meta information must have the
+// hash, shard count and count decoder set. If the maximal hash count is not
+// set for approximate counts, exact counts are written and converted when the
+// writer finishes, when the maximal count is known.
+func newWriter(dir string, m meta, o *writerOptions) (w *writer, err error) {
+	if o == nil {
+		o = new(writerOptions)
+	}
+	hashSize := Hash(m.Hash).size()
+	if hashSize == 0 {
+		return nil, fmt.Errorf("unsupported hash %s", m.Hash)
+	}
+	if !isShardCountValid(m.ShardCount) {
+		return nil, errors.New("invalid shard count")
+	}
+	approxDeferred := (m.CountDecoder == "approx8" || m.CountDecoder == "approx16") && m.MaxHashCount == 0
+	em := m
+	if approxDeferred {
+		em.CountDecoder = "big32"
+	}
+	countEncoder, err := newCountEncoder(em)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("database directory %s already exists", dir)
+	}
+
+	tmpDir := temporaryDir(dir)
+	var resume *checkpoint
+	if _, err := os.Stat(tmpDir); !os.IsNotExist(err) {
+		if !o.resume {
+			return nil, fmt.Errorf("temporary database directory %s already exists", tmpDir)
+		}
+		resume, err = readCheckpoint(tmpDir)
+		if err != nil {
+			return nil, err
+		}
+		if resume == nil {
+			// interrupted before the first checkpoint
+			if err := os.RemoveAll(tmpDir); err != nil {
+				return nil, fmt.Errorf("remove temporary database directory: %w", err)
+			}
+		} else if err := resume.matches(m); err != nil {
+			return nil, err
+		}
+	}
+	if resume == nil {
+		if err := os.MkdirAll(tmpDir, 0777); err != nil {
+			return nil, fmt.Errorf("create output dir %s: %w", tmpDir, err)
+		}
+	}
+
+	w = &writer{
+		dir:            tmpDir,
+		outputDir:      dir,
+		meta:           m,
+		hashSize:       hashSize,
+		countEncoder:   countEncoder,
+		approxDeferred: approxDeferred,
+		varintCounts:   m.CountDecoder == "uvarint",
+		checkpoint:     o.checkpoint || o.resume,
+		container:      o.container,
+		checkpointed:   resume != nil,
+		resume:         resume,
+		buf:            make([]byte, indexLocationEncodedSize),
+	}
+	defer func() {
+		if err != nil {
+			w.close()
+		}
+	}()
+
+	var indexSize int64
+	if resume != nil {
+		indexSize = resume.IndexSize
+	}
+	w.indexFile, err = openWriterFile(filepath.Join(tmpDir, indexFilename), indexSize)
+	if err != nil {
+		return nil, fmt.Errorf("create index file: %w", err)
+	}
+	w.index = bufio.NewWriterSize(w.indexFile, 64*1024)
+
+	for i := 0; i < m.ShardCount; i++ {
+		var size int64
+		if resume != nil && i < resume.Shards {
+			// complete shards are not written again
+			size = -1
+		}
+		f, err := openWriterFile(filepath.Join(tmpDir, getShardFilename(i, m.ShardCount)), size)
+		if err != nil {
+			return nil, fmt.Errorf("create hashes file %v: %w", i, err)
+		}
+		w.shardFiles = append(w.shardFiles, f)
+		w.shards = append(w.shards, bufio.NewWriterSize(f, 64*1024))
+	}
+
+	if resume != nil {
+		w.nextPartition = uint64(resume.Shards * ((maxUint24 + 1) / m.ShardCount))
+		return w, nil
+	}
+
+	// the first shard start
+	if err := w.writeIndex(0); err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// openWriterFile opens or creates the file for writing at the end of its
+// content which is truncated to the size, if the size is not negative.
+func openWriterFile(filename string, size int64) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if size >= 0 {
+		if err := f.Truncate(size); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(0, io.SeekEnd); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// add writes the hash and its count to the database. Hashes must be added in
+// ascending order.
+func (w *writer) add(hash []byte, count uint64) error {
+	if len(hash) != w.hashSize {
+		return fmt.Errorf("invalid hash size %v", len(hash))
+	}
+	if w.prevHash != nil && bytes.Compare(hash, w.prevHash) <= 0 {
+		return fmt.Errorf("%w: %x after %x", errHashOrder, hash, w.prevHash)
+	}
+
+	if w.resume != nil {
+		if getShard(int(hash[0]), w.meta.ShardCount) < w.resume.Shards {
+			// the hash is written before the checkpoint
+			w.prevHash = append(w.prevHash[:0], hash...)
+			w.meta.Count++
+			if count > w.meta.MaxHashCount {
+				w.meta.MaxHashCount = count
+			}
+			return nil
+		}
+		if err := w.verifyResume(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.writePartitionsEnds(uint24(hash)); err != nil {
+		return err
+	}
+	w.prevHash = append(w.prevHash[:0], hash...)
+
+	shardNumber := getShard(int(hash[0]), w.meta.ShardCount)
+	shard := w.shards[shardNumber]
+	encodedCount := w.countEncoder(count)
+	positions := uint32(1)
+	if w.varintCounts {
+		positions = uint32(w.hashSize - partitionSize + len(encodedCount))
+		if w.shardIndex > math.MaxUint32-positions {
+			return fmt.Errorf("hashes file %v larger than 4GB, more shards are required", shardNumber)
+		}
+	}
+	if _, err := shard.Write(hash[partitionSize:]); err != nil {
+		return fmt.Errorf("write hash: %w", err)
+	}
+	if _, err := shard.Write(encodedCount); err != nil {
+		return fmt.Errorf("write hash count: %w", err)
+	}
+	w.shardIndex += positions
+	w.meta.Count++
+	if count > w.meta.MaxHashCount {
+		w.meta.MaxHashCount = count
+	}
+	return nil
+}
+
+// writePartitionsEnds writes index entries for all partitions before the
+// provided one, including the start entries of all shards that begin in that
+// range.
+func (w *writer) writePartitionsEnds(partition uint64) error {
+	partitionsPerShard := uint64(maxUint24+1) / uint64(w.meta.ShardCount)
+	for w.nextPartition < partition {
+		// all partitions until the end of the shard have the same end
+		n := partition - w.nextPartition
+		if shardEnd := partitionsPerShard - w.nextPartition%partitionsPerShard; shardEnd < n {
+			n = shardEnd
+		}
+		if err := w.writeIndexRepeated(w.shardIndex, n); err != nil {
+			return err
+		}
+		w.nextPartition += n
+		if next := w.nextPartition; next <= maxUint24 && next%partitionsPerShard == 0 {
+			w.shardIndex = 0
+			if err := w.writeIndex(0); err != nil {
+				return err
+			}
+			if err := w.saveCheckpoint(int(next / partitionsPerShard)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// saveCheckpoint flushes and syncs the index and the last complete shard file
+// and saves the checkpoint with the number of complete shards.
+func (w *writer) saveCheckpoint(shards int) error {
+	if !w.checkpoint {
+		return nil
+	}
+	if err := w.index.Flush(); err != nil {
+		return fmt.Errorf("flush index: %w", err)
+	}
+	if err := w.indexFile.Sync(); err != nil {
+		return fmt.Errorf("sync index: %w", err)
+	}
+	indexSize, err := w.indexFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("index size: %w", err)
+	}
+	shard := shards - 1
+	if err := w.shards[shard].Flush(); err != nil {
+		return fmt.Errorf("flush hashes file %v: %w", shard, err)
+	}
+	if err := w.shardFiles[shard].Sync(); err != nil {
+		return fmt.Errorf("sync hashes file %v: %w", shard, err)
+	}
+	if err := writeCheckpoint(w.dir, checkpoint{
+		Hash:         w.meta.Hash,
+		MinHashCount: w.meta.MinHashCount,
+		ShardCount:   w.meta.ShardCount,
+		CountDecoder: w.meta.CountDecoder,
+		CountClasses: w.meta.CountClasses,
+		Shards:       shards,
+		IndexSize:    indexSize,
+		Count:        w.meta.Count,
+		LastHash:     hex.EncodeToString(w.prevHash),
+	}); err != nil {
+		return err
+	}
+	w.checkpointed = true
+	return nil
+}
+
+// verifyResume checks that the hashes added again from complete shards are
+// the same as the ones written before the checkpoint was saved and continues
+// writing.
+func (w *writer) verifyResume() error {
+	if w.meta.Count != w.resume.Count || hex.EncodeToString(w.prevHash) != w.resume.LastHash {
+		return errors.New("input does not match the checkpoint")
+	}
+	w.resume = nil
+	return nil
+}
+
+func (w *writer) writeIndex(v uint32) error {
+	binary.BigEndian.PutUint32(w.buf, v)
+	if _, err := w.index.Write(w.buf); err != nil {
+		return fmt.Errorf("write index: %w", err)
+	}
+	return nil
+}
+
+// writeIndexRepeated writes the same index entry n times, in larger writes
+// for long ranges of partitions without hashes.
+func (w *writer) writeIndexRepeated(v uint32, n uint64) error {
+	if n == 1 {
+		return w.writeIndex(v)
+	}
+	if w.repeatedBuf == nil {
+		w.repeatedBuf = make([]byte, 1024*indexLocationEncodedSize)
+	}
+	entries := uint64(len(w.repeatedBuf) / indexLocationEncodedSize)
+	if n < entries {
+		entries = n
+	}
+	b := w.repeatedBuf[:entries*indexLocationEncodedSize]
+	for i := 0; i < len(b); i += indexLocationEncodedSize {
+		binary.BigEndian.PutUint32(b[i:], v)
+	}
+	for n > 0 {
+		if n < entries {
+			b = b[:n*indexLocationEncodedSize]
+		}
+		if _, err := w.index.Write(b); err != nil {
+			return fmt.Errorf("write index: %w", err)
+		}
+		n -= uint64(len(b) / indexLocationEncodedSize)
+	}
+	return nil
+}
+
+// finish completes the index, flushes and closes all database files and
+// writes the meta information file at the end, when all other files are
+// complete. The temporary directory is then renamed to the database
+// directory, or all files are packed into the container file that is renamed
+// to the database filename. It returns the written meta information.
+func (w *writer) finish() (meta, error) {
+	defer w.close()
+
+	if w.resume != nil {
+		if err := w.verifyResume(); err != nil {
+			return meta{}, err
+		}
+	}
+
+	if err := w.writePartitionsEnds(maxUint24 + 1); err != nil {
+		return meta{}, err
+	}
+
+	if err := w.index.Flush(); err != nil {
+		return meta{}, fmt.Errorf("flush index: %w", err)
+	}
+	for i, s := range w.shards {
+		if err := s.Flush(); err != nil {
+			return meta{}, fmt.Errorf("flush hashes file %v: %w", i, err)
+		}
+	}
+	for i, f := range w.shardFiles {
+		if err := syncClose(f); err != nil {
+			return meta{}, fmt.Errorf("close hashes file %v: %w", i, err)
+		}
+	}
+	w.shardFiles = nil
+	if err := syncClose(w.indexFile); err != nil {
+		return meta{}, fmt.Errorf("close index file: %w", err)
+	}
+	w.indexFile = nil
+
+	// hashes files are not the same as at the checkpoint after approximate
+	// counts are encoded
+	if w.checkpointed {
+		if err := os.Remove(filepath.Join(w.dir, checkpointFilename)); err != nil {
+			return meta{}, fmt.Errorf("remove checkpoint: %w", err)
+		}
+		w.checkpointed = false
+	}
+
+	if w.approxDeferred {
+		if err := w.encodeApproxCounts(); err != nil {
+			return meta{}, err
+		}
+	}
+
+	if w.meta.FilterFalsePositiveRate > 0 {
+		if err := w.writeFilter(); err != nil {
+			return meta{}, fmt.Errorf("write filter: %w", err)
+		}
+	}
+
+	checksums, err := fileChecksums(w.dir, w.meta)
+	if err != nil {
+		return meta{}, err
+	}
+	w.meta.Checksums = checksums
+	w.meta.Version = version
+
+	if w.container {
+		return w.finishContainer()
+	}
+
+	b, err := json.MarshalIndent(w.meta, "", "    ")
+	if err != nil {
+		return meta{}, fmt.Errorf("encode db.json: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(w.dir, "db.json"), b, 0666); err != nil {
+		return meta{}, fmt.Errorf("write db.json: %w", err)
+	}
+
+	if err := os.Rename(w.dir, w.outputDir); err != nil {
+		return meta{}, fmt.Errorf("rename temporary database directory: %w", err)
+	}
+
+	w.finished = true
+
+	return w.meta, nil
+}
+
+// finishContainer writes all database files from the temporary directory into
+// the container file which replaces the temporary directory.
+func (w *writer) finishContainer() (meta, error) {
+	filename := filepath.Join(w.dir, containerFilename)
+	if err := writeContainer(filename, w.dir, w.meta); err != nil {
+		return meta{}, fmt.Errorf("write container file: %w", err)
+	}
+
+	if err := os.Rename(filename, w.outputDir); err != nil {
+		return meta{}, fmt.Errorf("rename container file: %w", err)
+	}
+
+	w.finished = true
+
+	if err := os.RemoveAll(w.dir); err != nil {
+		return meta{}, fmt.Errorf("remove temporary database directory: %w", err)
+	}
+
+	return w.meta, nil
+}
+
+// writeFilter creates the Bloom filter of all hashes in the temporary
+// directory and writes it to the filter file.
+func (w *writer) writeFilter() error {
+	b, err := filter.NewBloom(w.meta.Count, w.meta.FilterFalsePositiveRate)
+	if err != nil {
+		return err
+	}
+
+	// the filter file is not written yet
+	m := w.meta
+	m.FilterFalsePositiveRate = 0
+	db, err := openDirectory(w.dir, m, func(filename string) (dataFile, error) {
+		f, err := os.Open(filename)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	})
+	if err != nil {
+		return err
+	}
+	defer db.close()
+
+	if err := db.iterateRange(0, maxUint24, func(hash []byte, _ uint64) error {
+		b.Add(hash)
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	f, err := os.Create(filepath.Join(w.dir, filterFilename))
+	if err != nil {
+		return err
+	}
+	if _, err := b.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return syncClose(f)
+}
+
+// encodeApproxCounts rewrites all hashes files by replacing exact counts with
+// approximate counts. Index does not change as it contains hash positions.
+func (w *writer) encodeApproxCounts() error {
+	countEncoder, err := newCountEncoder(w.meta)
+	if err != nil {
+		return err
+	}
+	remainderSize := w.hashSize - partitionSize
+	record := make([]byte, remainderSize+4)
+	for i := 0; i < w.meta.ShardCount; i++ {
+		filename := filepath.Join(w.dir, getShardFilename(i, w.meta.ShardCount))
+		if err := func() error {
+			src, err := os.Open(filename)
+			if err != nil {
+				return err
+			}
+			defer src.Close()
+
+			dst, err := os.Create(filename + ".tmp")
+			if err != nil {
+				return err
+			}
+			defer dst.Close()
+
+			r := bufio.NewReaderSize(src, 64*1024)
+			bw := bufio.NewWriterSize(dst, 64*1024)
+			for {
+				if _, err := io.ReadFull(r, record); err != nil {
+					if errors.Is(err, io.EOF) {
+						break
+					}
+					return err
+				}
+				if _, err := bw.Write(record[:remainderSize]); err != nil {
+					return err
+				}
+				if _, err := bw.Write(countEncoder(uint64(binary.BigEndian.Uint32(record[remainderSize:])))); err != nil {
+					return err
+				}
+			}
+			if err := bw.Flush(); err != nil {
+				return err
+			}
+			return syncClose(dst)
+		}(); err != nil {
+			return fmt.Errorf("encode approximate counts in hashes file %v: %w", i, err)
+		}
+		if err := os.Rename(filename+".tmp", filename); err != nil {
+			return fmt.Errorf("encode approximate counts in hashes file %v: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// close closes all open files without flushing buffered data and removes the
+// temporary directory if the writer is not finished successfully and the
+// checkpoint is not saved.
+func (w *writer) close() {
+	for _, f := range w.shardFiles {
+		f.Close()
+	}
+	w.shardFiles = nil
+	if w.indexFile != nil {
+		w.indexFile.Close()
+		w.indexFile = nil
+	}
+	if !w.finished && !w.checkpointed {
+		os.RemoveAll(w.dir)
+	}
+}
+
+// syncClose commits the file content to the storage and closes the file.
+func syncClose(f *os.File) error {
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// countDecoderName returns the name of the count decoder stored in the meta
+// information for the hash counting type.
+func countDecoderName(c HashCounting) (string, error) {
+	switch c {
+	case HashCountingExact:
+		return "big32", nil
+	case HashCountingApprox:
+		return "approx8", nil
+	case HashCountingApprox16:
+		return "approx16", nil
+	case HashCountingVarint:
+		return "uvarint", nil
+	case HashCountingClasses:
+		return "classes", nil
+	case HashCountingNone:
+		return "none", nil
+	}
+	return "", fmt.Errorf("unsupported hash counter %s", c)
+}
+
+// newCountEncoder returns a function that encodes hash counts in the way that
+// the count decoder from the meta information can decode them.
+func newCountEncoder(m meta) (func(uint64) []byte, error) {
+	switch m.CountDecoder {
+	case "big32":
+		b := make([]byte, 4)
+		return func(v uint64) []byte {
+			binary.BigEndian.PutUint32(b, uint32(v))
+			return b
+		}, nil
+	case "approx8":
+		e, err := approxcount.NewEncoder(m.MaxHashCount)
+		if err != nil {
+			return nil, fmt.Errorf("new approxcount %v: %w", m.MaxHashCount, err)
+		}
+		return func(v uint64) []byte {
+			return []byte{e.Encode(v)}
+		}, nil
+	case "approx16":
+		e, err := approxcount.NewEncoder16(m.MaxHashCount)
+		if err != nil {
+			return nil, fmt.Errorf("new approxcount %v: %w", m.MaxHashCount, err)
+		}
+		b := make([]byte, 2)
+		return func(v uint64) []byte {
+			binary.BigEndian.PutUint16(b, e.Encode(v))
+			return b
+		}, nil
+	case "uvarint":
+		b := make([]byte, binary.MaxVarintLen64)
+		return func(v uint64) []byte {
+			return b[:binary.PutUvarint(b, v)]
+		}, nil
+	case "classes":
+		if err := validateCountClasses(m.CountClasses); err != nil {
+			return nil, err
+		}
+		classes := m.CountClasses
+		return func(v uint64) []byte {
+			return []byte{byte(countClass(classes, v))}
+		}, nil
+	case "none":
+		return func(v uint64) []byte {
+			return nil
+		}, nil
+	}
+	return nil, fmt.Errorf("unsupported count decoder %s", m.CountDecoder)
+}
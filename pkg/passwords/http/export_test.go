@@ -6,3 +6,5 @@
 package http
 
 type IsPasswordCompromisedResponse = isPasswordCompromisedResponse
+
+type ArePasswordsCompromisedResponse = arePasswordsCompromisedResponse
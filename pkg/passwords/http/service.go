@@ -6,6 +6,7 @@
 package http
 
 import (
+	"bytes"
 	"context"
 	"encoding/hex"
 	"encoding/json"
@@ -16,9 +17,13 @@ import (
 	"strings"
 
 	"resenje.org/compromised/pkg/passwords"
+	"resenje.org/compromised/pkg/policy"
 )
 
-var _ passwords.Service = (*Service)(nil)
+var (
+	_ passwords.Service      = (*Service)(nil)
+	_ passwords.BatchService = (*Service)(nil)
+)
 
 // Service implements passwords Service by communicating to the running
 // 'compromised' API using HTTP client.
@@ -47,7 +52,7 @@ type isPasswordCompromisedResponse struct {
 // by making an HTTP request to the running 'compromised' API.
 func (s *Service) IsPasswordCompromised(ctx context.Context, sha1Sum [20]byte) (count uint64, err error) {
 	var r isPasswordCompromisedResponse
-	if err := s.request(ctx, http.MethodGet, "v1/passwords/"+hex.EncodeToString(sha1Sum[:]), &r); err != nil {
+	if err := s.request(ctx, http.MethodGet, "v1/passwords/"+hex.EncodeToString(sha1Sum[:]), nil, &r); err != nil {
 		return 0, err
 	}
 
@@ -57,14 +62,65 @@ func (s *Service) IsPasswordCompromised(ctx context.Context, sha1Sum [20]byte) (
 	return 0, nil
 }
 
-func (s *Service) request(ctx context.Context, method, path string, v interface{}) error {
-	req, err := http.NewRequest(method, path, nil)
+// PasswordVerdict returns the verdict of the password policy that is
+// configured on the running 'compromised' API for the password with the
+// provided SHA1 sum.
+func (s *Service) PasswordVerdict(ctx context.Context, sha1Sum [20]byte) (v policy.Verdict, err error) {
+	if err := s.request(ctx, http.MethodGet, "v1/passwords/"+hex.EncodeToString(sha1Sum[:])+"/verdict", nil, &v); err != nil {
+		return policy.Verdict{}, err
+	}
+	return v, nil
+}
+
+type arePasswordsCompromisedResponse struct {
+	Hash        string `json:"hash"`
+	Compromised bool   `json:"compromised"`
+	Count       uint64 `json:"count"`
+}
+
+// ArePasswordsCompromised provides the information for multiple passwords if
+// they are compromised by making a single HTTP request to the running
+// 'compromised' API. The number of sums must not exceed the batch limit that
+// is configured on the API.
+func (s *Service) ArePasswordsCompromised(ctx context.Context, sha1Sums [][20]byte) (counts []uint64, err error) {
+	hashes := make([]string, len(sha1Sums))
+	for i, sum := range sha1Sums {
+		hashes[i] = hex.EncodeToString(sum[:])
+	}
+	body, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	var r []arePasswordsCompromisedResponse
+	if err := s.request(ctx, http.MethodPost, "v1/passwords", bytes.NewReader(body), &r); err != nil {
+		return nil, err
+	}
+
+	if len(r) != len(sha1Sums) {
+		return nil, fmt.Errorf("got %v results, expected %v", len(r), len(sha1Sums))
+	}
+
+	counts = make([]uint64, len(r))
+	for i, p := range r {
+		if p.Compromised {
+			counts[i] = p.Count
+		}
+	}
+	return counts, nil
+}
+
+func (s *Service) request(ctx context.Context, method, path string, body io.Reader, v interface{}) error {
+	req, err := http.NewRequest(method, path, body)
 	if err != nil {
 		return err
 	}
 	req = req.WithContext(ctx)
 
 	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 
 	r, err := s.httpClient.Do(req)
 	if err != nil {
@@ -11,9 +11,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"testing"
 
 	httppasswords "resenje.org/compromised/pkg/passwords/http"
+	"resenje.org/compromised/pkg/policy"
 )
 
 func TestIsPasswordCompromised_compromised(t *testing.T) {
@@ -76,6 +78,87 @@ func TestIsPasswordCompromised_notCompromised(t *testing.T) {
 	}
 }
 
+func TestPasswordVerdict(t *testing.T) {
+	client, mux := newClient(t)
+
+	hash := "3d5896ffe806a482490b99f690650995b63c3513"
+	want := policy.Verdict{
+		Outcome:   "warn",
+		Reason:    "password is compromised 101 times, at least 10",
+		Threshold: 10,
+		Version:   "1",
+	}
+
+	mux.HandleFunc("/v1/passwords/"+hash+"/verdict", func(w http.ResponseWriter, r *http.Request) {
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		_, _ = w.Write(b)
+	})
+
+	got, err := client.PasswordVerdict(context.Background(), hexDecodeSHA1Sum(t, hash))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Errorf("got verdict %+v, want %+v", got, want)
+	}
+}
+
+func TestArePasswordsCompromised(t *testing.T) {
+	client, mux := newClient(t)
+
+	hashes := []string{
+		"3d5896ffe806a482490b99f690650995b63c3513",
+		"3d5896ffe806a482490b99f690650995b63c3514",
+	}
+	want := []uint64{101, 0}
+
+	mux.HandleFunc("/v1/passwords", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		var got []string
+		if err := json.NewDecoder(r.Body).Decode(&got); err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !reflect.DeepEqual(got, hashes) {
+			t.Errorf("got hashes %v, want %v", got, hashes)
+		}
+		b, err := json.Marshal([]httppasswords.ArePasswordsCompromisedResponse{
+			{Hash: hashes[0], Compromised: true, Count: want[0]},
+			{Hash: hashes[1]},
+		})
+		if err != nil {
+			t.Error(err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		_, _ = w.Write(b)
+	})
+
+	got, err := client.ArePasswordsCompromised(context.Background(), [][20]byte{
+		hexDecodeSHA1Sum(t, hashes[0]),
+		hexDecodeSHA1Sum(t, hashes[1]),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got counts %v, want %v", got, want)
+	}
+}
+
 const jsonContentType = "application/json; charset=utf-8"
 
 func newClient(t testing.TB) (client *httppasswords.Service, mux *http.ServeMux) {
@@ -11,7 +11,12 @@ import (
 	"resenje.org/compromised/pkg/passwords"
 )
 
-var _ passwords.Service = (*Service)(nil)
+var (
+	_ passwords.Service      = (*Service)(nil)
+	_ passwords.RangeService = (rangeFunc)(nil)
+	_ passwords.BatchService = (batchFunc)(nil)
+	_ passwords.NTLMService  = (ntlmFunc)(nil)
+)
 
 // Service implements passwords service with injectable functionality mainly
 // meant unit testing services that depend on passwords service.
@@ -19,12 +24,99 @@ type Service struct {
 	isPasswordCompromisedFunc func(ctx context.Context, sha1Sum [20]byte) (uint64, error)
 }
 
+// options holds functions of optional passwords service interfaces.
+type options struct {
+	passwordsByPrefixFunc         rangeFunc
+	arePasswordsCompromisedFunc   batchFunc
+	isNTLMPasswordCompromisedFunc ntlmFunc
+}
+
+// Option sets optional injectable functions to the Service.
+type Option func(*options)
+
+// WithPasswordsByPrefixFunc sets the function that is called by the
+// PasswordsByPrefix method, so that the service implements
+// passwords.RangeService.
+func WithPasswordsByPrefixFunc(f func(ctx context.Context, prefix uint32) ([]passwords.Password, error)) Option {
+	return func(o *options) {
+		o.passwordsByPrefixFunc = f
+	}
+}
+
+// WithArePasswordsCompromisedFunc sets the function that is called by the
+// ArePasswordsCompromised method, so that the service implements
+// passwords.BatchService.
+func WithArePasswordsCompromisedFunc(f func(ctx context.Context, sha1Sums [][20]byte) ([]uint64, error)) Option {
+	return func(o *options) {
+		o.arePasswordsCompromisedFunc = f
+	}
+}
+
+// WithIsNTLMPasswordCompromisedFunc sets the function that is called by the
+// IsNTLMPasswordCompromised method, so that the service implements
+// passwords.NTLMService.
+func WithIsNTLMPasswordCompromisedFunc(f func(ctx context.Context, ntlmSum [16]byte) (uint64, error)) Option {
+	return func(o *options) {
+		o.isNTLMPasswordCompromisedFunc = f
+	}
+}
+
 // New creates a new instance of Service by injecting the passed function as the
-// service method.
-func New(isPasswordCompromisedFunc func(ctx context.Context, sha1Sum [20]byte) (uint64, error)) *Service {
-	return &Service{
+// service method. The returned service implements optional passwords service
+// interfaces only for functions that are set with options.
+func New(isPasswordCompromisedFunc func(ctx context.Context, sha1Sum [20]byte) (uint64, error), opts ...Option) passwords.Service {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := &Service{
 		isPasswordCompromisedFunc: isPasswordCompromisedFunc,
 	}
+
+	r, b, n := o.passwordsByPrefixFunc, o.arePasswordsCompromisedFunc, o.isNTLMPasswordCompromisedFunc
+	switch {
+	case r != nil && b != nil && n != nil:
+		return struct {
+			*Service
+			rangeFunc
+			batchFunc
+			ntlmFunc
+		}{s, r, b, n}
+	case r != nil && b != nil:
+		return struct {
+			*Service
+			rangeFunc
+			batchFunc
+		}{s, r, b}
+	case r != nil && n != nil:
+		return struct {
+			*Service
+			rangeFunc
+			ntlmFunc
+		}{s, r, n}
+	case b != nil && n != nil:
+		return struct {
+			*Service
+			batchFunc
+			ntlmFunc
+		}{s, b, n}
+	case r != nil:
+		return struct {
+			*Service
+			rangeFunc
+		}{s, r}
+	case b != nil:
+		return struct {
+			*Service
+			batchFunc
+		}{s, b}
+	case n != nil:
+		return struct {
+			*Service
+			ntlmFunc
+		}{s, n}
+	}
+	return s
 }
 
 // IsPasswordCompromised calls the function what is passed to the New
@@ -32,3 +124,27 @@ func New(isPasswordCompromisedFunc func(ctx context.Context, sha1Sum [20]byte) (
 func (s *Service) IsPasswordCompromised(ctx context.Context, sha1Sum [20]byte) (uint64, error) {
 	return s.isPasswordCompromisedFunc(ctx, sha1Sum)
 }
+
+// rangeFunc implements passwords.RangeService with the function set by the
+// WithPasswordsByPrefixFunc option.
+type rangeFunc func(ctx context.Context, prefix uint32) ([]passwords.Password, error)
+
+func (f rangeFunc) PasswordsByPrefix(ctx context.Context, prefix uint32) ([]passwords.Password, error) {
+	return f(ctx, prefix)
+}
+
+// batchFunc implements passwords.BatchService with the function set by the
+// WithArePasswordsCompromisedFunc option.
+type batchFunc func(ctx context.Context, sha1Sums [][20]byte) ([]uint64, error)
+
+func (f batchFunc) ArePasswordsCompromised(ctx context.Context, sha1Sums [][20]byte) ([]uint64, error) {
+	return f(ctx, sha1Sums)
+}
+
+// ntlmFunc implements passwords.NTLMService with the function set by the
+// WithIsNTLMPasswordCompromisedFunc option.
+type ntlmFunc func(ctx context.Context, ntlmSum [16]byte) (uint64, error)
+
+func (f ntlmFunc) IsNTLMPasswordCompromised(ctx context.Context, ntlmSum [16]byte) (uint64, error) {
+	return f(ctx, ntlmSum)
+}
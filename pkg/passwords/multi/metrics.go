@@ -0,0 +1,55 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multi
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	m "resenje.org/compromised/pkg/metrics"
+)
+
+type metrics struct {
+	// all metrics fields must be exported
+	// to be able to return them by Metrics()
+	// using reflection
+	RequestCount    *prometheus.CounterVec
+	RequestDuration *prometheus.HistogramVec
+}
+
+// Results of backend requests that are used as the result label of the
+// backend requests metric.
+const (
+	resultSuccess = "success"
+	resultError   = "error"
+	resultTimeout = "timeout"
+	resultSkipped = "skipped"
+)
+
+func newMetrics(name string) metrics {
+	subsystem := "passwords"
+
+	var labels prometheus.Labels
+	if name != "" {
+		labels = prometheus.Labels{"db": name}
+	}
+
+	return metrics{
+		RequestCount: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "backend_request_count",
+			Help:        "Number of requests to backends by their results.",
+			ConstLabels: labels,
+		}, []string{"backend", "result"}),
+		RequestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   m.Namespace,
+			Subsystem:   subsystem,
+			Name:        "backend_request_duration_seconds",
+			Help:        "Histogram of durations of requests to backends.",
+			Buckets:     []float64{0.00001, 0.0001, 0.001, 0.01, 0.1, 0.25, 0.5, 1, 2.5, 5},
+			ConstLabels: labels,
+		}, []string{"backend"}),
+	}
+}
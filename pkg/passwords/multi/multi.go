@@ -0,0 +1,293 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package multi provides a passwords service that checks passwords in
+// multiple backends, such as a local database, a remote compromised service
+// and a blocklist, with a selectable strategy of combining their results.
+package multi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	m "resenje.org/compromised/pkg/metrics"
+	"resenje.org/compromised/pkg/passwords"
+)
+
+var (
+	_ passwords.Service      = (*Service)(nil)
+	_ passwords.BatchService = (*Service)(nil)
+)
+
+var (
+	// ErrUnavailable is returned when no backend provides the result.
+	ErrUnavailable = errors.New("no backend available")
+	// ErrNoQuorum is returned when fewer backends than the quorum provide
+	// results.
+	ErrNoQuorum = errors.New("no quorum")
+)
+
+// Strategy enumerates ways of combining results of backends.
+type Strategy string
+
+var (
+	// StrategyFallback checks backends one by one in the provided order and
+	// returns the result of the first one that succeeds.
+	StrategyFallback Strategy = "fallback"
+	// StrategyMax checks all backends concurrently and returns the highest
+	// count from backends that succeed.
+	StrategyMax Strategy = "max"
+	// StrategyQuorum checks all backends concurrently and returns the highest
+	// count that at least the quorum of backends report, so that a password
+	// is compromised only if enough backends agree.
+	StrategyQuorum Strategy = "quorum"
+)
+
+// Backend is a named passwords service.
+type Backend struct {
+	Name    string
+	Service passwords.Service
+	// Timeout limits the duration of every request to the backend in
+	// addition to the deadline of the request context. No limit is applied
+	// if it is 0.
+	Timeout time.Duration
+	// Check is optionally called before every request to the backend, which
+	// is skipped if it returns an error, for example if its database is
+	// stale.
+	Check func(ctx context.Context) error
+}
+
+// Options holds optional parameters for the Service.
+type Options struct {
+	// Strategy of combining results of backends. The default is
+	// StrategyFallback.
+	Strategy Strategy
+	// Quorum is the number of backends that must succeed and agree on the
+	// count with StrategyQuorum. The default is the majority of backends.
+	Quorum int
+	// Name is used as the db label of metrics.
+	Name string
+}
+
+// Service implements passwords service that checks passwords in multiple
+// backends.
+type Service struct {
+	backends []Backend
+	strategy Strategy
+	quorum   int
+	metrics  metrics
+}
+
+// New creates a new instance of Service with backends that have unique names.
+func New(backends []Backend, o *Options) (*Service, error) {
+	if o == nil {
+		o = new(Options)
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("no backends")
+	}
+	names := make(map[string]struct{}, len(backends))
+	for _, b := range backends {
+		if b.Name == "" {
+			return nil, errors.New("empty backend name")
+		}
+		if b.Service == nil {
+			return nil, fmt.Errorf("backend %s: nil service", b.Name)
+		}
+		if _, ok := names[b.Name]; ok {
+			return nil, fmt.Errorf("duplicate backend %s", b.Name)
+		}
+		names[b.Name] = struct{}{}
+	}
+
+	strategy := o.Strategy
+	if strategy == "" {
+		strategy = StrategyFallback
+	}
+	var quorum int
+	switch strategy {
+	case StrategyFallback, StrategyMax:
+	case StrategyQuorum:
+		quorum = o.Quorum
+		if quorum == 0 {
+			quorum = len(backends)/2 + 1
+		}
+		if quorum < 1 || quorum > len(backends) {
+			return nil, fmt.Errorf("quorum %v out of range for %v backends", quorum, len(backends))
+		}
+	default:
+		return nil, fmt.Errorf("unsupported strategy %s", strategy)
+	}
+
+	return &Service{
+		backends: append([]Backend(nil), backends...),
+		strategy: strategy,
+		quorum:   quorum,
+		metrics:  newMetrics(o.Name),
+	}, nil
+}
+
+// IsPasswordCompromised returns the compromised count of the password from
+// backends by the strategy of the Service.
+func (s *Service) IsPasswordCompromised(ctx context.Context, sum [20]byte) (count uint64, err error) {
+	counts, err := s.lookup(ctx, 1, func(ctx context.Context, service passwords.Service) ([]uint64, error) {
+		count, err := service.IsPasswordCompromised(ctx, sum)
+		if err != nil {
+			return nil, err
+		}
+		return []uint64{count}, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return counts[0], nil
+}
+
+// ArePasswordsCompromised returns compromised counts of passwords from
+// backends by the strategy of the Service, in the same order as provided
+// sums. Backends that support batch checks are checked with a single call.
+func (s *Service) ArePasswordsCompromised(ctx context.Context, sums [][20]byte) (counts []uint64, err error) {
+	return s.lookup(ctx, len(sums), func(ctx context.Context, service passwords.Service) ([]uint64, error) {
+		return passwords.ArePasswordsCompromised(ctx, service, sums)
+	})
+}
+
+// Metrics returns prometheus collectors of per backend metrics.
+func (s *Service) Metrics() []prometheus.Collector {
+	return m.PrometheusCollectorsFromFields(s.metrics)
+}
+
+// lookupFunc returns n counts from a single backend service.
+type lookupFunc func(ctx context.Context, service passwords.Service) ([]uint64, error)
+
+// lookup returns n counts from backends combined by the strategy.
+func (s *Service) lookup(ctx context.Context, n int, f lookupFunc) ([]uint64, error) {
+	if s.strategy == StrategyFallback {
+		var errs []error
+		for _, b := range s.backends {
+			counts, err := s.call(ctx, b, n, f)
+			if err == nil {
+				return counts, nil
+			}
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, backendsError(ErrUnavailable, errs)
+	}
+
+	results := make([][]uint64, len(s.backends))
+	errs := make([]error, len(s.backends))
+	var wg sync.WaitGroup
+	for i, b := range s.backends {
+		wg.Add(1)
+		go func(i int, b Backend) {
+			defer wg.Done()
+			results[i], errs[i] = s.call(ctx, b, n, f)
+		}(i, b)
+	}
+	wg.Wait()
+
+	var succeeded [][]uint64
+	var failed []error
+	for i, err := range errs {
+		if err != nil {
+			failed = append(failed, err)
+			continue
+		}
+		succeeded = append(succeeded, results[i])
+	}
+
+	if s.strategy == StrategyQuorum {
+		if len(succeeded) < s.quorum {
+			return nil, backendsError(ErrNoQuorum, failed)
+		}
+		return quorumCounts(succeeded, n, s.quorum), nil
+	}
+
+	if len(succeeded) == 0 {
+		return nil, backendsError(ErrUnavailable, failed)
+	}
+	counts := make([]uint64, n)
+	for _, c := range succeeded {
+		for i := range counts {
+			if c[i] > counts[i] {
+				counts[i] = c[i]
+			}
+		}
+	}
+	return counts, nil
+}
+
+// call returns n counts from the backend, limiting its duration by the backend
+// timeout and recording its metrics.
+func (s *Service) call(ctx context.Context, b Backend, n int, f lookupFunc) (counts []uint64, err error) {
+	if b.Check != nil {
+		if err := b.Check(ctx); err != nil {
+			s.metrics.RequestCount.WithLabelValues(b.Name, resultSkipped).Inc()
+			return nil, fmt.Errorf("backend %s: %w", b.Name, err)
+		}
+	}
+
+	if b.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, b.Timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	counts, err = f(ctx, b.Service)
+	s.metrics.RequestDuration.WithLabelValues(b.Name).Observe(time.Since(start).Seconds())
+	if err == nil && len(counts) != n {
+		err = fmt.Errorf("got %v counts for %v passwords", len(counts), n)
+	}
+	if err != nil {
+		result := resultError
+		if errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			result = resultTimeout
+		}
+		s.metrics.RequestCount.WithLabelValues(b.Name, result).Inc()
+		return nil, fmt.Errorf("backend %s: %w", b.Name, err)
+	}
+	s.metrics.RequestCount.WithLabelValues(b.Name, resultSuccess).Inc()
+	return counts, nil
+}
+
+// quorumCounts returns for every password the highest count that is reported
+// by at least quorum backends.
+func quorumCounts(results [][]uint64, n, quorum int) []uint64 {
+	counts := make([]uint64, n)
+	c := make([]uint64, len(results))
+	for i := range counts {
+		for j, r := range results {
+			c[j] = r[i]
+		}
+		sort.Slice(c, func(i, j int) bool {
+			return c[i] > c[j]
+		})
+		counts[i] = c[quorum-1]
+	}
+	return counts
+}
+
+// backendsError returns the error that wraps err with messages of errors from
+// backends.
+func backendsError(err error, errs []error) error {
+	if len(errs) == 0 {
+		return err
+	}
+	messages := make([]string, 0, len(errs))
+	for _, e := range errs {
+		messages = append(messages, e.Error())
+	}
+	return fmt.Errorf("%w: %s", err, strings.Join(messages, "; "))
+}
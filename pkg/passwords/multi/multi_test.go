@@ -0,0 +1,350 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package multi_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"resenje.org/compromised/pkg/passwords"
+	mockpasswords "resenje.org/compromised/pkg/passwords/mock"
+	"resenje.org/compromised/pkg/passwords/multi"
+)
+
+var errTest = errors.New("test error")
+
+// countService returns a service that reports the count for every password.
+func countService(count uint64) passwords.Service {
+	return mockpasswords.New(func(_ context.Context, _ [20]byte) (uint64, error) {
+		return count, nil
+	})
+}
+
+// errorService returns a service that fails every lookup.
+func errorService() passwords.Service {
+	return mockpasswords.New(func(_ context.Context, _ [20]byte) (uint64, error) {
+		return 0, errTest
+	}, mockpasswords.WithArePasswordsCompromisedFunc(func(_ context.Context, _ [][20]byte) ([]uint64, error) {
+		return nil, errTest
+	}))
+}
+
+// blockingService returns a service that blocks until the context is done.
+func blockingService() passwords.Service {
+	return mockpasswords.New(func(ctx context.Context, _ [20]byte) (uint64, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	})
+}
+
+func TestService(t *testing.T) {
+	stale := func(context.Context) error { return errors.New("stale database") }
+
+	for _, tc := range []struct {
+		name     string
+		backends []multi.Backend
+		options  *multi.Options
+		want     uint64
+		wantErr  error
+	}{
+		{
+			name: "fallback first",
+			backends: []multi.Backend{
+				{Name: "local", Service: countService(5)},
+				{Name: "remote", Service: countService(10)},
+			},
+			want: 5,
+		},
+		{
+			name: "fallback on error",
+			backends: []multi.Backend{
+				{Name: "local", Service: errorService()},
+				{Name: "remote", Service: countService(10)},
+			},
+			want: 10,
+		},
+		{
+			name: "fallback on check",
+			backends: []multi.Backend{
+				{Name: "local", Service: countService(5), Check: stale},
+				{Name: "remote", Service: countService(10)},
+			},
+			want: 10,
+		},
+		{
+			name: "fallback on timeout",
+			backends: []multi.Backend{
+				{Name: "local", Service: blockingService(), Timeout: 10 * time.Millisecond},
+				{Name: "remote", Service: countService(10)},
+			},
+			want: 10,
+		},
+		{
+			name: "fallback unavailable",
+			backends: []multi.Backend{
+				{Name: "local", Service: errorService()},
+				{Name: "remote", Service: countService(10), Check: stale},
+			},
+			wantErr: multi.ErrUnavailable,
+		},
+		{
+			name: "max",
+			backends: []multi.Backend{
+				{Name: "local", Service: countService(5)},
+				{Name: "remote", Service: countService(10)},
+				{Name: "blocklist", Service: countService(0)},
+			},
+			options: &multi.Options{Strategy: multi.StrategyMax},
+			want:    10,
+		},
+		{
+			name: "max with failed backends",
+			backends: []multi.Backend{
+				{Name: "local", Service: countService(5)},
+				{Name: "remote", Service: blockingService(), Timeout: 10 * time.Millisecond},
+				{Name: "blocklist", Service: errorService()},
+			},
+			options: &multi.Options{Strategy: multi.StrategyMax},
+			want:    5,
+		},
+		{
+			name: "max unavailable",
+			backends: []multi.Backend{
+				{Name: "local", Service: errorService()},
+				{Name: "remote", Service: errorService()},
+			},
+			options: &multi.Options{Strategy: multi.StrategyMax},
+			wantErr: multi.ErrUnavailable,
+		},
+		{
+			name: "quorum majority",
+			backends: []multi.Backend{
+				{Name: "a", Service: countService(5)},
+				{Name: "b", Service: countService(10)},
+				{Name: "c", Service: countService(0)},
+			},
+			options: &multi.Options{Strategy: multi.StrategyQuorum},
+			want:    5,
+		},
+		{
+			name: "quorum not compromised",
+			backends: []multi.Backend{
+				{Name: "a", Service: countService(0)},
+				{Name: "b", Service: countService(10)},
+				{Name: "c", Service: countService(0)},
+			},
+			options: &multi.Options{Strategy: multi.StrategyQuorum},
+			want:    0,
+		},
+		{
+			name: "quorum of one",
+			backends: []multi.Backend{
+				{Name: "a", Service: countService(5)},
+				{Name: "b", Service: countService(10)},
+				{Name: "c", Service: errorService()},
+			},
+			options: &multi.Options{Strategy: multi.StrategyQuorum, Quorum: 1},
+			want:    10,
+		},
+		{
+			name: "no quorum",
+			backends: []multi.Backend{
+				{Name: "a", Service: countService(5)},
+				{Name: "b", Service: errorService()},
+				{Name: "c", Service: countService(10), Check: stale},
+			},
+			options: &multi.Options{Strategy: multi.StrategyQuorum},
+			wantErr: multi.ErrNoQuorum,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := multi.New(tc.backends, tc.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			count, err := s.IsPasswordCompromised(context.Background(), [20]byte{1})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tc.wantErr)
+			}
+			if count != tc.want {
+				t.Errorf("got count %v, want %v", count, tc.want)
+			}
+
+			counts, err := s.ArePasswordsCompromised(context.Background(), [][20]byte{{1}, {2}})
+			if !errors.Is(err, tc.wantErr) {
+				t.Fatalf("got batch error %v, want %v", err, tc.wantErr)
+			}
+			if tc.wantErr != nil {
+				return
+			}
+			if want := []uint64{tc.want, tc.want}; !reflect.DeepEqual(counts, want) {
+				t.Errorf("got counts %v, want %v", counts, want)
+			}
+		})
+	}
+}
+
+func TestService_error(t *testing.T) {
+	s, err := multi.New([]multi.Backend{
+		{Name: "local", Service: errorService()},
+		{Name: "remote", Service: countService(10), Check: func(context.Context) error {
+			return errors.New("stale database")
+		}},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.IsPasswordCompromised(context.Background(), [20]byte{1})
+	want := "no backend available: backend local: test error; backend remote: stale database"
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %q", err, want)
+	}
+}
+
+func TestService_contextDeadline(t *testing.T) {
+	s, err := multi.New([]multi.Backend{
+		{Name: "local", Service: blockingService()},
+		{Name: "remote", Service: blockingService()},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	_, err = s.IsPasswordCompromised(ctx, [20]byte{1})
+	if !errors.Is(err, multi.ErrUnavailable) || !strings.Contains(err.Error(), "backend local") {
+		t.Fatalf("got error %v, want unavailable local backend", err)
+	}
+	if strings.Contains(err.Error(), "backend remote") {
+		t.Errorf("got error %v, want remote backend not requested after deadline", err)
+	}
+}
+
+func TestService_metrics(t *testing.T) {
+	s, err := multi.New([]multi.Backend{
+		{Name: "local", Service: blockingService(), Timeout: 10 * time.Millisecond},
+		{Name: "remote", Service: errorService()},
+		{Name: "blocklist", Service: countService(1)},
+		{Name: "stale", Service: countService(1), Check: func(context.Context) error {
+			return errors.New("stale database")
+		}},
+	}, &multi.Options{
+		Strategy: multi.StrategyMax,
+		Name:     "test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.IsPasswordCompromised(context.Background(), [20]byte{1}); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	for _, c := range s.Metrics() {
+		if err := registry.Register(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results := make(map[string]string)
+	durations := make(map[string]uint64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			labels := labelValues(m.GetLabel())
+			if labels["db"] != "test" {
+				t.Errorf("got db label %q, want test", labels["db"])
+			}
+			switch f.GetName() {
+			case "compromised_passwords_backend_request_count":
+				results[labels["backend"]] = labels["result"]
+			case "compromised_passwords_backend_request_duration_seconds":
+				durations[labels["backend"]] = m.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+
+	wantResults := map[string]string{
+		"local":     "timeout",
+		"remote":    "error",
+		"blocklist": "success",
+		"stale":     "skipped",
+	}
+	if !reflect.DeepEqual(results, wantResults) {
+		t.Errorf("got results %v, want %v", results, wantResults)
+	}
+	wantDurations := map[string]uint64{
+		"local":     1,
+		"remote":    1,
+		"blocklist": 1,
+	}
+	if !reflect.DeepEqual(durations, wantDurations) {
+		t.Errorf("got durations %v, want %v", durations, wantDurations)
+	}
+}
+
+func TestNew_invalid(t *testing.T) {
+	service := countService(0)
+	for _, tc := range []struct {
+		backends []multi.Backend
+		options  *multi.Options
+		wantErr  string
+	}{
+		{
+			wantErr: "no backends",
+		},
+		{
+			backends: []multi.Backend{{Service: service}},
+			wantErr:  "empty backend name",
+		},
+		{
+			backends: []multi.Backend{{Name: "local"}},
+			wantErr:  "backend local: nil service",
+		},
+		{
+			backends: []multi.Backend{{Name: "local", Service: service}, {Name: "local", Service: service}},
+			wantErr:  "duplicate backend local",
+		},
+		{
+			backends: []multi.Backend{{Name: "local", Service: service}},
+			options:  &multi.Options{Strategy: "random"},
+			wantErr:  "unsupported strategy random",
+		},
+		{
+			backends: []multi.Backend{{Name: "local", Service: service}},
+			options:  &multi.Options{Strategy: multi.StrategyQuorum, Quorum: 2},
+			wantErr:  "quorum 2 out of range for 1 backends",
+		},
+	} {
+		_, err := multi.New(tc.backends, tc.options)
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("got error %v, want %q", err, tc.wantErr)
+		}
+	}
+}
+
+func labelValues(labels []*dto.LabelPair) map[string]string {
+	m := make(map[string]string, len(labels))
+	for _, l := range labels {
+		m[l.GetName()] = l.GetValue()
+	}
+	return m
+}
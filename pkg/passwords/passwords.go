@@ -11,3 +11,63 @@ import "context"
 type Service interface {
 	IsPasswordCompromised(ctx context.Context, sha1Sum [20]byte) (count uint64, err error)
 }
+
+// RangeService is an optional extension of Service that lists compromised
+// passwords which hashes share a common prefix. It allows checking passwords
+// without revealing their complete hashes, as the k-anonymity model suggests.
+type RangeService interface {
+	// PasswordsByPrefix returns all compromised passwords which SHA1 sums
+	// start with the 20 bit prefix, ordered by their sums.
+	PasswordsByPrefix(ctx context.Context, prefix uint32) ([]Password, error)
+}
+
+// BatchService is an optional extension of Service that checks multiple
+// passwords at once.
+type BatchService interface {
+	// ArePasswordsCompromised returns compromised counts for every SHA1 sum in
+	// the same order as sums are provided.
+	ArePasswordsCompromised(ctx context.Context, sha1Sums [][20]byte) (counts []uint64, err error)
+}
+
+// SourceService is an optional extension of Service that combines multiple
+// sources of compromised passwords and reports which of them contain the
+// password.
+type SourceService interface {
+	// PasswordSources returns the compromised count of the password and names
+	// of all sources that contain it.
+	PasswordSources(ctx context.Context, sha1Sum [20]byte) (count uint64, sources []string, err error)
+	// ArePasswordsInSources returns compromised counts and names of sources
+	// for every SHA1 sum in the same order as sums are provided.
+	ArePasswordsInSources(ctx context.Context, sha1Sums [][20]byte) (counts []uint64, sources [][]string, err error)
+}
+
+// NTLMService is an optional extension of Service that checks passwords by
+// their NTLM hashes.
+type NTLMService interface {
+	IsNTLMPasswordCompromised(ctx context.Context, ntlmSum [16]byte) (count uint64, err error)
+}
+
+// Password holds the SHA1 sum of a compromised password and the number of
+// times it has been compromised.
+type Password struct {
+	SHA1Sum [20]byte
+	Count   uint64
+}
+
+// ArePasswordsCompromised returns compromised counts for every SHA1 sum in the
+// same order as sums are provided, with a single call if the service
+// implements BatchService, or by checking passwords one by one if it does not.
+func ArePasswordsCompromised(ctx context.Context, s Service, sha1Sums [][20]byte) (counts []uint64, err error) {
+	if batchService, ok := s.(BatchService); ok {
+		return batchService.ArePasswordsCompromised(ctx, sha1Sums)
+	}
+	counts = make([]uint64, len(sha1Sums))
+	for i, sum := range sha1Sums {
+		count, err := s.IsPasswordCompromised(ctx, sum)
+		if err != nil {
+			return nil, err
+		}
+		counts[i] = count
+	}
+	return counts, nil
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package policy maps compromised counts of passwords to named outcomes, so
+// that all clients apply the same rule for accepting passwords, instead of
+// their own count thresholds.
+package policy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Outcomes of the default policy.
+const (
+	OutcomeAllow  = "allow"
+	OutcomeWarn   = "warn"
+	OutcomeReject = "reject"
+)
+
+// Rule assigns the outcome to passwords that are compromised at least
+// MinCount times.
+type Rule struct {
+	Outcome  string `json:"outcome" yaml:"outcome"`
+	MinCount uint64 `json:"min-count" yaml:"min-count"`
+	// Source limits the rule to passwords that are found in the named source,
+	// such as an organization blocklist. Rules with sources take precedence
+	// over rules without them.
+	Source string `json:"source,omitempty" yaml:"source,omitempty"`
+	// Reason is returned in verdicts of this rule instead of the generated
+	// one.
+	Reason string `json:"reason,omitempty" yaml:"reason,omitempty"`
+}
+
+// DefaultRules reject passwords that are very frequently compromised and
+// warn about those that are compromised multiple times, as NIST SP 800-63B
+// requires that passwords from previous breaches are not accepted, but
+// leaves the rate limits to the service.
+var DefaultRules = []Rule{
+	{Outcome: OutcomeReject, MinCount: 1000},
+	{Outcome: OutcomeWarn, MinCount: 10},
+}
+
+// Options holds optional parameters for the Policy.
+type Options struct {
+	// Version identifies thresholds of the policy in verdicts. If it is not
+	// set, it is derived from rules, so that it changes when rules change.
+	Version string
+	// Rules are the policy rules in any order, with unique min counts for
+	// every source. The default is DefaultRules.
+	Rules []Rule
+	// DefaultOutcome is the outcome of passwords that do not match any rule.
+	// The default is OutcomeAllow.
+	DefaultOutcome string
+}
+
+// Policy maps compromised counts of passwords to outcomes by rules with the
+// highest min count that is not greater than the password count.
+type Policy struct {
+	version        string
+	rules          []Rule // ordered by sources and descending min counts
+	defaultOutcome string
+}
+
+// Verdict is the outcome of the policy for a single password.
+type Verdict struct {
+	Outcome string `json:"outcome"`
+	Reason  string `json:"reason"`
+	// Threshold is the min count of the matched rule, or 0 if the password
+	// does not match any rule.
+	Threshold uint64 `json:"threshold,omitempty"`
+	// Source is the source of the matched rule, if it has one.
+	Source  string `json:"source,omitempty"`
+	Version string `json:"version"`
+}
+
+// New creates a new Policy from options.
+func New(o *Options) (*Policy, error) {
+	if o == nil {
+		o = new(Options)
+	}
+	rules := o.Rules
+	if len(rules) == 0 {
+		rules = DefaultRules
+	}
+	defaultOutcome := o.DefaultOutcome
+	if defaultOutcome == "" {
+		defaultOutcome = OutcomeAllow
+	}
+
+	rules = append([]Rule(nil), rules...)
+	sort.Slice(rules, func(i, j int) bool {
+		if (rules[i].Source == "") != (rules[j].Source == "") {
+			return rules[i].Source != ""
+		}
+		if rules[i].Source != rules[j].Source {
+			return rules[i].Source < rules[j].Source
+		}
+		return rules[i].MinCount > rules[j].MinCount
+	})
+	for i, r := range rules {
+		if r.Outcome == "" {
+			return nil, fmt.Errorf("empty outcome of rule with min count %v", r.MinCount)
+		}
+		if r.MinCount == 0 {
+			return nil, fmt.Errorf("rule %s: min count must be greater than 0", r.Outcome)
+		}
+		if i > 0 && r.MinCount == rules[i-1].MinCount && r.Source == rules[i-1].Source {
+			return nil, fmt.Errorf("rules %s and %s have the same min count %v", rules[i-1].Outcome, r.Outcome, r.MinCount)
+		}
+	}
+	if rules[len(rules)-1].Source != "" {
+		return nil, errors.New("at least one rule must not have a source")
+	}
+
+	version := o.Version
+	if version == "" {
+		version = rulesVersion(rules, defaultOutcome)
+	}
+
+	return &Policy{
+		version:        version,
+		rules:          rules,
+		defaultOutcome: defaultOutcome,
+	}, nil
+}
+
+// Version returns the version of policy thresholds.
+func (p *Policy) Version() string {
+	return p.version
+}
+
+// Verdict returns the outcome of the policy for the password with the
+// compromised count that is found in the optionally provided sources.
+func (p *Policy) Verdict(count uint64, sources ...string) Verdict {
+	for _, r := range p.rules {
+		if count < r.MinCount {
+			continue
+		}
+		if r.Source != "" && !contains(sources, r.Source) {
+			continue
+		}
+		reason := r.Reason
+		if reason == "" {
+			if r.Source != "" {
+				reason = fmt.Sprintf("password is found in %s", r.Source)
+			} else {
+				reason = fmt.Sprintf("password is compromised %v times, at least %v", count, r.MinCount)
+			}
+		}
+		return Verdict{
+			Outcome:   r.Outcome,
+			Reason:    reason,
+			Threshold: r.MinCount,
+			Source:    r.Source,
+			Version:   p.version,
+		}
+	}
+
+	reason := "password is not compromised"
+	if count > 0 {
+		reason = fmt.Sprintf("password is compromised %v times, less than %v", count, p.rules[len(p.rules)-1].MinCount)
+	}
+	return Verdict{
+		Outcome: p.defaultOutcome,
+		Reason:  reason,
+		Version: p.version,
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rulesVersion returns a short hash of ordered rules and the default outcome.
+func rulesVersion(rules []Rule, defaultOutcome string) string {
+	h := sha256.New()
+	for _, r := range rules {
+		if r.Source != "" {
+			fmt.Fprintf(h, "%q %v %q %q\n", r.Outcome, r.MinCount, r.Reason, r.Source)
+			continue
+		}
+		fmt.Fprintf(h, "%q %v %q\n", r.Outcome, r.MinCount, r.Reason)
+	}
+	fmt.Fprintf(h, "%q\n", defaultOutcome)
+	return hex.EncodeToString(h.Sum(nil)[:4])
+}
+
+// ParseRules parses rules from comma separated outcome=min-count pairs, for
+// example "reject=1000,warn=10", without reasons. The outcome can be followed
+// by @ and the source of the rule, as in "reject@blocklist=1".
+func ParseRules(s string) (rules []Rule, err error) {
+	for _, pair := range strings.Split(s, ",") {
+		outcome, minCount, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rule %q", pair)
+		}
+		c, err := strconv.ParseUint(strings.TrimSpace(minCount), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid min count of rule %q", pair)
+		}
+		outcome, source, _ := strings.Cut(outcome, "@")
+		rules = append(rules, Rule{
+			Outcome:  strings.TrimSpace(outcome),
+			MinCount: c,
+			Source:   strings.TrimSpace(source),
+		})
+	}
+	return rules, nil
+}
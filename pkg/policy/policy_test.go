@@ -0,0 +1,231 @@
+// Copyright (c) 2020, Compromised AUTHORS.
+// All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package policy_test
+
+import (
+	"reflect"
+	"testing"
+
+	"resenje.org/compromised/pkg/policy"
+)
+
+func TestPolicy_default(t *testing.T) {
+	p, err := policy.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := p.Version()
+	if version == "" {
+		t.Fatal("empty version")
+	}
+
+	for _, tc := range []struct {
+		count uint64
+		want  policy.Verdict
+	}{
+		{
+			count: 0,
+			want:  policy.Verdict{Outcome: "allow", Reason: "password is not compromised", Version: version},
+		},
+		{
+			count: 9,
+			want:  policy.Verdict{Outcome: "allow", Reason: "password is compromised 9 times, less than 10", Version: version},
+		},
+		{
+			count: 10,
+			want:  policy.Verdict{Outcome: "warn", Reason: "password is compromised 10 times, at least 10", Threshold: 10, Version: version},
+		},
+		{
+			count: 999,
+			want:  policy.Verdict{Outcome: "warn", Reason: "password is compromised 999 times, at least 10", Threshold: 10, Version: version},
+		},
+		{
+			count: 1000,
+			want:  policy.Verdict{Outcome: "reject", Reason: "password is compromised 1000 times, at least 1000", Threshold: 1000, Version: version},
+		},
+		{
+			count: 2996082,
+			want:  policy.Verdict{Outcome: "reject", Reason: "password is compromised 2996082 times, at least 1000", Threshold: 1000, Version: version},
+		},
+	} {
+		if got := p.Verdict(tc.count); got != tc.want {
+			t.Errorf("count %v: got verdict %+v, want %+v", tc.count, got, tc.want)
+		}
+	}
+}
+
+func TestPolicy_custom(t *testing.T) {
+	p, err := policy.New(&policy.Options{
+		Version: "2023-01",
+		Rules: []policy.Rule{
+			{Outcome: "warn", MinCount: 1},
+			{Outcome: "block", MinCount: 100, Reason: "common password"},
+		},
+		DefaultOutcome: "accept",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		count uint64
+		want  policy.Verdict
+	}{
+		{
+			count: 0,
+			want:  policy.Verdict{Outcome: "accept", Reason: "password is not compromised", Version: "2023-01"},
+		},
+		{
+			count: 1,
+			want:  policy.Verdict{Outcome: "warn", Reason: "password is compromised 1 times, at least 1", Threshold: 1, Version: "2023-01"},
+		},
+		{
+			count: 100,
+			want:  policy.Verdict{Outcome: "block", Reason: "common password", Threshold: 100, Version: "2023-01"},
+		},
+	} {
+		if got := p.Verdict(tc.count); got != tc.want {
+			t.Errorf("count %v: got verdict %+v, want %+v", tc.count, got, tc.want)
+		}
+	}
+}
+
+func TestPolicy_sources(t *testing.T) {
+	p, err := policy.New(&policy.Options{
+		Version: "2023-02",
+		Rules: append([]policy.Rule{
+			{Outcome: "reject", MinCount: 1, Source: "blocklist"},
+			{Outcome: "warn", MinCount: 1, Source: "internal", Reason: "internal password"},
+		}, policy.DefaultRules...),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		count   uint64
+		sources []string
+		want    policy.Verdict
+	}{
+		{
+			count: 5,
+			want:  policy.Verdict{Outcome: "allow", Reason: "password is compromised 5 times, less than 10", Version: "2023-02"},
+		},
+		{
+			count:   5,
+			sources: []string{"pwned"},
+			want:    policy.Verdict{Outcome: "allow", Reason: "password is compromised 5 times, less than 10", Version: "2023-02"},
+		},
+		{
+			count:   5,
+			sources: []string{"pwned", "blocklist"},
+			want:    policy.Verdict{Outcome: "reject", Reason: "password is found in blocklist", Threshold: 1, Source: "blocklist", Version: "2023-02"},
+		},
+		{
+			count:   1,
+			sources: []string{"internal"},
+			want:    policy.Verdict{Outcome: "warn", Reason: "internal password", Threshold: 1, Source: "internal", Version: "2023-02"},
+		},
+		{
+			count:   1000,
+			sources: []string{"internal"},
+			want:    policy.Verdict{Outcome: "warn", Reason: "internal password", Threshold: 1, Source: "internal", Version: "2023-02"},
+		},
+		{
+			count:   1000,
+			sources: []string{"pwned"},
+			want:    policy.Verdict{Outcome: "reject", Reason: "password is compromised 1000 times, at least 1000", Threshold: 1000, Version: "2023-02"},
+		},
+	} {
+		if got := p.Verdict(tc.count, tc.sources...); got != tc.want {
+			t.Errorf("count %v in %v: got verdict %+v, want %+v", tc.count, tc.sources, got, tc.want)
+		}
+	}
+}
+
+func TestPolicy_version(t *testing.T) {
+	version := func(o *policy.Options) string {
+		t.Helper()
+
+		p, err := policy.New(o)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Version()
+	}
+
+	defaultVersion := version(nil)
+	if v := version(&policy.Options{Rules: []policy.Rule{
+		{Outcome: "warn", MinCount: 10},
+		{Outcome: "reject", MinCount: 1000},
+	}}); v != defaultVersion {
+		t.Errorf("got version %s for default rules in different order, want %s", v, defaultVersion)
+	}
+	if v := version(&policy.Options{Rules: []policy.Rule{
+		{Outcome: "reject", MinCount: 100},
+		{Outcome: "warn", MinCount: 10},
+	}}); v == defaultVersion {
+		t.Errorf("got default version %s for different rules", v)
+	}
+	if v := version(&policy.Options{Rules: append([]policy.Rule{
+		{Outcome: "reject", MinCount: 1, Source: "blocklist"},
+	}, policy.DefaultRules...)}); v == defaultVersion {
+		t.Errorf("got default version %s for rules with source", v)
+	}
+	if v := version(&policy.Options{DefaultOutcome: "accept"}); v == defaultVersion {
+		t.Errorf("got default version %s for different default outcome", v)
+	}
+}
+
+func TestPolicy_invalid(t *testing.T) {
+	for _, tc := range []struct {
+		rules   []policy.Rule
+		wantErr string
+	}{
+		{
+			rules:   []policy.Rule{{MinCount: 10}},
+			wantErr: "empty outcome of rule with min count 10",
+		},
+		{
+			rules:   []policy.Rule{{Outcome: "warn"}},
+			wantErr: "rule warn: min count must be greater than 0",
+		},
+		{
+			rules:   []policy.Rule{{Outcome: "reject", MinCount: 10}, {Outcome: "warn", MinCount: 10}},
+			wantErr: "rules reject and warn have the same min count 10",
+		},
+		{
+			rules:   []policy.Rule{{Outcome: "reject", MinCount: 1, Source: "blocklist"}},
+			wantErr: "at least one rule must not have a source",
+		},
+	} {
+		_, err := policy.New(&policy.Options{Rules: tc.rules})
+		if err == nil || err.Error() != tc.wantErr {
+			t.Errorf("got error %v, want %q", err, tc.wantErr)
+		}
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	got, err := policy.ParseRules("reject@blocklist=1,reject=1000, warn = 10")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []policy.Rule{
+		{Outcome: "reject", MinCount: 1, Source: "blocklist"},
+		{Outcome: "reject", MinCount: 1000},
+		{Outcome: "warn", MinCount: 10},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got rules %+v, want %+v", got, want)
+	}
+
+	for _, s := range []string{"", "reject", "reject=many"} {
+		if _, err := policy.ParseRules(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}